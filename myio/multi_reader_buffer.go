@@ -8,14 +8,26 @@ import (
 	"sync"
 )
 
+// 关键帧缓存的最大字节数，超过后丢弃缓存直到下一个关键帧
+const maxReplaySize = 16 * 1024 * 1024
+
 // MultiReaderPipe 单个写，多个读的管道
 //
 // 内部不带缓冲区，一次数据的写入需要等所有的数据消费者全部取走数据.
+//
+// 通过WriteHeader和WriteKeyFrame写入的数据会被缓存，
+// 新加入的消费者会先读到头部数据和最近一个关键帧开始的数据.
 type MultiReaderPipe struct {
 	consumerList     *list.List
 	consumerListLock *sync.RWMutex
 	ctx              context.Context
 	cancelFn         context.CancelFunc
+
+	// 只有写的go程会修改，修改时持有consumerListLock的读锁，
+	// 加入消费者时持有写锁，所以两者不会同时发生
+	header     []byte
+	replay     [][]byte
+	replaySize int
 }
 
 // consumer 数据消费者，实现io.ReadCloser接口
@@ -42,6 +54,38 @@ func NewMultiReaderPipe() *MultiReaderPipe {
 // 实现io.Writer接口，往缓冲区写入数据。
 // 该写的操作只有管道被关闭的时候，会返回error
 func (p *MultiReaderPipe) Write(data []byte) (int, error) {
+	return p.write(data, func(copyedData []byte) {
+		if p.replay == nil {
+			return
+		}
+		p.replaySize += len(copyedData)
+		if p.replaySize > maxReplaySize {
+			p.replay = nil
+			p.replaySize = 0
+			return
+		}
+		p.replay = append(p.replay, copyedData)
+	})
+}
+
+// WriteHeader 写入解码所需的头部数据，新的头部会替换旧的头部，并清空关键帧缓存
+func (p *MultiReaderPipe) WriteHeader(data []byte) (int, error) {
+	return p.write(data, func(copyedData []byte) {
+		p.header = copyedData
+		p.replay = nil
+		p.replaySize = 0
+	})
+}
+
+// WriteKeyFrame 写入以关键帧开始的数据，之前缓存的关键帧数据会被丢弃
+func (p *MultiReaderPipe) WriteKeyFrame(data []byte) (int, error) {
+	return p.write(data, func(copyedData []byte) {
+		p.replay = [][]byte{copyedData}
+		p.replaySize = len(copyedData)
+	})
+}
+
+func (p *MultiReaderPipe) write(data []byte, cache func([]byte)) (int, error) {
 	select {
 	case <-p.ctx.Done():
 		return 0, ErrWriteClosedIO
@@ -53,6 +97,7 @@ func (p *MultiReaderPipe) Write(data []byte) (int, error) {
 
 	copyedData := make([]byte, len(data))
 	copy(copyedData, data)
+	cache(copyedData)
 	for e := p.consumerList.Front(); e != nil; e = e.Next() {
 		c := e.Value.(*consumer)
 		reader := bytes.NewReader(copyedData)
@@ -77,6 +122,16 @@ func (p *MultiReaderPipe) PipeReader() *consumer {
 	p.consumerListLock.Lock()
 	defer p.consumerListLock.Unlock()
 
+	// 新的消费者先读取缓存的头部和关键帧数据
+	if len(p.header) > 0 || len(p.replay) > 0 {
+		buf := make([]byte, 0, len(p.header)+p.replaySize)
+		buf = append(buf, p.header...)
+		for _, data := range p.replay {
+			buf = append(buf, data...)
+		}
+		c.currentReader = bytes.NewReader(buf)
+	}
+
 	c.elem = p.consumerList.PushBack(c)
 	return c
 }
@@ -3,7 +3,9 @@ package plex
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"plex-tuner/plex/tv"
 	"strings"
 )
 
@@ -14,6 +16,28 @@ type Config struct {
 	FFMpeg     string `json:"ffmpeg"`
 	Channel    string `json:"channel"`
 	Log        string `json:"log"`
+	// TranscodeProfiles 命名的转码配置，频道通过options中的transcode引用
+	TranscodeProfiles map[string]tv.TranscodeProfile `json:"transcode_profiles"`
+	// Commands 命名的外部命令，pipe和exec-resolve类型的频道通过options中的command引用
+	Commands map[string]tv.Command `json:"commands"`
+	// Slate 直播间未开播时默认的待机画面
+	Slate tv.SlateConfig `json:"slate"`
+	// ErrorSlate 为true时频道无法播放不再返回错误，而是播放显示错误信息的待机画面
+	ErrorSlate bool `json:"error_slate"`
+	// Bilibili b站相关的配置
+	Bilibili BilibiliConfig `json:"bilibili"`
+	// RTMP rtmp推流服务的配置
+	RTMP RTMPConfig `json:"rtmp"`
+}
+
+type RTMPConfig struct {
+	// Listen 推流服务的监听地址，为空时不启动推流服务
+	Listen string `json:"listen"`
+}
+
+type BilibiliConfig struct {
+	// SESSDATA 登录后cookie中的SESSDATA，配置后可以获取登录用户才能观看的画质
+	SESSDATA string `json:"sessdata"`
 }
 
 func loadConfig(name string) (*Config, error) {
@@ -46,5 +70,17 @@ func checkConfig(c *Config) error {
 	c.FFMpeg = strings.TrimSpace(c.FFMpeg)
 	c.Channel = strings.TrimSpace(c.Channel)
 	c.Log = strings.TrimSpace(c.Log)
+	c.Bilibili.SESSDATA = strings.TrimSpace(c.Bilibili.SESSDATA)
+	c.RTMP.Listen = strings.TrimSpace(c.RTMP.Listen)
+	for name, profile := range c.TranscodeProfiles {
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("transcode profile %s: %w", name, err)
+		}
+	}
+	for name, command := range c.Commands {
+		if err := command.Validate(); err != nil {
+			return fmt.Errorf("command %s: %w", name, err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,206 @@
+package plex
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"plex-tuner/plex/tv"
+	"sync"
+	"time"
+)
+
+const (
+	// 节目单包含的时间范围
+	epgPast   = 2 * time.Hour
+	epgFuture = 48 * time.Hour
+
+	xmltvTimeFormat = "20060102150405 -0700"
+
+	// 外部节目单的缓存时间
+	externalGuideTTL = time.Hour
+	// 外部节目单读取失败后，在这段时间内不再重新读取
+	externalGuideRetry = 5 * time.Minute
+)
+
+type xmltv struct {
+	XMLName       xml.Name         `xml:"tv"`
+	GeneratorName string           `xml:"generator-info-name,attr"`
+	Channels      []xmltvChannel   `xml:"channel"`
+	Programmes    []xmltvProgramme `xml:"programme"`
+}
+
+type xmltvChannel struct {
+	Id          string     `xml:"id,attr"`
+	DisplayName string     `xml:"display-name"`
+	Icon        *xmltvIcon `xml:"icon,omitempty"`
+}
+
+type xmltvIcon struct {
+	Src string `xml:"src,attr"`
+}
+
+type xmltvProgramme struct {
+	Start       string `xml:"start,attr"`
+	Stop        string `xml:"stop,attr"`
+	Channel     string `xml:"channel,attr"`
+	Title       string `xml:"title"`
+	Description string `xml:"desc,omitempty"`
+}
+
+// epg 以XMLTV格式输出节目单，频道id与lineup中的GuideNumber相同，只有提供节目单的源类型才有节目
+func (p *Plex) epg(w ResponseWriter, r Request) {
+	if p.config.Channel == "" {
+		internalServerError(w, "channel not configured")
+		return
+	}
+	channels, err := p.loadChannels(r.Context())
+	if err != nil {
+		internalServerError(w, err.Error())
+		return
+	}
+
+	now := time.Now()
+	from, to := now.Add(-epgPast), now.Add(epgFuture)
+	guide := xmltv{GeneratorName: "plex-tuner"}
+	for _, channel := range channels {
+		item := xmltvChannel{Id: channel.Id, DisplayName: channel.Name}
+		if channel.Icon != "" {
+			item.Icon = &xmltvIcon{Src: channel.Icon}
+		}
+		guide.Channels = append(guide.Channels, item)
+		if channel.err != nil || channel.redirect() {
+			continue
+		}
+
+		if channel.EpgId != "" && channel.EpgURL != "" {
+			external, err := loadExternalGuide(r.Context(), channel.EpgURL)
+			if err != nil {
+				p.logger.Printf("[channel %s] %s", channel.Id, channel.redact(err.Error()))
+			}
+			for _, programme := range external[channel.EpgId] {
+				if programmeInRange(programme, from, to) {
+					programme.Channel = channel.Id
+					guide.Programmes = append(guide.Programmes, programme)
+				}
+			}
+		}
+
+		programmes, err := tv.Guide(p.env, channel.source(), from, to)
+		if err != nil {
+			p.logger.Printf("[channel %s] %s", channel.Id, channel.redact(err.Error()))
+			continue
+		}
+		for _, programme := range programmes {
+			guide.Programmes = append(guide.Programmes, xmltvProgramme{
+				Start:       programme.Start.Format(xmltvTimeFormat),
+				Stop:        programme.Stop.Format(xmltvTimeFormat),
+				Channel:     channel.Id,
+				Title:       programme.Title,
+				Description: programme.Description,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(guide)
+}
+
+type externalGuide struct {
+	programmes map[string][]xmltvProgramme
+	loadedAt   time.Time
+	failedAt   time.Time
+}
+
+var (
+	externalGuidesLock = new(sync.Mutex)
+	// externalGuides 按地址缓存的外部节目单
+	externalGuides = make(map[string]*externalGuide)
+)
+
+// loadExternalGuide 读取外部的XMLTV节目单，返回按频道id分组的节目，读取失败时沿用上次的结果。
+// 失败后externalGuideRetry内不再重新读取，避免每个频道都请求一次不可用的地址
+func loadExternalGuide(ctx context.Context, rawUrl string) (map[string][]xmltvProgramme, error) {
+	externalGuidesLock.Lock()
+	cache, ok := externalGuides[rawUrl]
+	externalGuidesLock.Unlock()
+	if ok && (time.Since(cache.loadedAt) < externalGuideTTL || time.Since(cache.failedAt) < externalGuideRetry) {
+		return cache.programmes, nil
+	}
+
+	programmes, err := fetchExternalGuide(ctx, rawUrl)
+	externalGuidesLock.Lock()
+	defer externalGuidesLock.Unlock()
+	if err != nil {
+		failed := &externalGuide{failedAt: time.Now()}
+		if ok {
+			failed.programmes, failed.loadedAt = cache.programmes, cache.loadedAt
+		}
+		externalGuides[rawUrl] = failed
+		return failed.programmes, err
+	}
+	externalGuides[rawUrl] = &externalGuide{programmes: programmes, loadedAt: time.Now()}
+	return programmes, nil
+}
+
+func fetchExternalGuide(ctx context.Context, rawUrl string) (map[string][]xmltvProgramme, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", rawUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		return nil, stripErrorQuery(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("epg: unexpected status %d", resp.StatusCode)
+	}
+
+	// 面板的节目单可能很大，逐个读取节目，不保留其余内容
+	decoder := xml.NewDecoder(resp.Body)
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	programmes := make(map[string][]xmltvProgramme)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return programmes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "programme" {
+			continue
+		}
+		var programme xmltvProgramme
+		if err = decoder.DecodeElement(&programme, &start); err != nil {
+			return nil, err
+		}
+		programmes[programme.Channel] = append(programmes[programme.Channel], programme)
+	}
+}
+
+// programmeInRange 节目与from到to的时间范围有重叠，时间没有时区时按UTC处理
+func programmeInRange(programme xmltvProgramme, from time.Time, to time.Time) bool {
+	start, err := parseXmltvTime(programme.Start)
+	if err != nil {
+		return false
+	}
+	stop, err := parseXmltvTime(programme.Stop)
+	if err != nil {
+		return false
+	}
+	return stop.After(from) && start.Before(to)
+}
+
+func parseXmltvTime(s string) (time.Time, error) {
+	if t, err := time.Parse(xmltvTimeFormat, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("20060102150405", s)
+}
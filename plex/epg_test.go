@@ -0,0 +1,87 @@
+package plex
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEpgExternalGuide(t *testing.T) {
+	now := time.Now().UTC()
+	format := func(t time.Time) string { return t.Format(xmltvTimeFormat) }
+	guide := fmt.Sprintf(`<?xml version="1.0" encoding="ISO-8859-1"?>
+<tv>
+  <channel id="news.us"><display-name>News</display-name></channel>
+  <programme start="%s" stop="%s" channel="news.us"><title lang="en">Morning News</title><desc>Headlines</desc></programme>
+  <programme start="%s" stop="%s" channel="news.us"><title>Last Week</title></programme>
+  <programme start="%s" stop="%s" channel="sports.us"><title>Match</title></programme>
+</tv>`,
+		format(now.Add(-10*time.Minute)), format(now.Add(50*time.Minute)),
+		format(now.Add(-7*24*time.Hour)), format(now.Add(-7*24*time.Hour+time.Hour)),
+		format(now), format(now.Add(time.Hour)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(guide))
+	}))
+	defer srv.Close()
+
+	p := newTestPlex(t, fmt.Sprintf(`[{"id":"1","name":"News","url":"http://127.0.0.1/news.m3u8","type":"hls","epg_id":"news.us","epg_url":%q}]`, srv.URL+"/xmltv.php"))
+
+	w := httptest.NewRecorder()
+	p.epg(w, httptest.NewRequest("GET", "/epg.xml", nil))
+	result := xmltv{}
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Programmes) != 1 {
+		t.Fatalf("programmes = %+v", result.Programmes)
+	}
+	programme := result.Programmes[0]
+	if programme.Channel != "1" || programme.Title != "Morning News" || programme.Description != "Headlines" {
+		t.Errorf("programme = %+v", programme)
+	}
+}
+
+func TestEpgExternalGuideFailure(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	// 同一个节目单地址的多个频道，失败后不再为每个频道重新请求
+	epgUrl := srv.URL + "/xmltv.php"
+	p := newTestPlex(t, fmt.Sprintf(`[
+  {"id":"1","name":"News","url":"http://127.0.0.1/news.m3u8","type":"hls","epg_id":"news.us","epg_url":%q},
+  {"id":"2","name":"Sports","url":"http://127.0.0.1/sports.m3u8","type":"hls","epg_id":"sports.us","epg_url":%q}
+]`, epgUrl, epgUrl))
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		p.epg(w, httptest.NewRequest("GET", "/epg.xml", nil))
+		result := xmltv{}
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Channels) != 2 || len(result.Programmes) != 0 {
+			t.Fatalf("guide = %+v", result)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("requests = %d, want 1", requests)
+	}
+
+	// 超过重试间隔后重新读取
+	externalGuidesLock.Lock()
+	externalGuides[epgUrl].failedAt = time.Now().Add(-externalGuideRetry)
+	externalGuidesLock.Unlock()
+	if _, err := loadExternalGuide(context.Background(), epgUrl); err == nil {
+		t.Error("loadExternalGuide() succeeded")
+	}
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2", requests)
+	}
+}
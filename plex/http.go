@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"path"
+	"plex-tuner/plex/tv"
 
 	"github.com/gorilla/websocket"
 )
@@ -28,6 +29,8 @@ func (p *Plex) newHttpHandler() http.Handler {
 	mux.HandleFunc("/lineup_status.json", p.lineupStatus)
 	mux.HandleFunc("/lineup.json", p.lineup)
 	mux.HandleFunc("/stream/", p.stream)
+	mux.HandleFunc("/status.json", p.status)
+	mux.HandleFunc("/epg.xml", p.epg)
 	mux.HandleFunc("/", p.capability)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		disableCache(w)
@@ -92,7 +95,7 @@ func (p *Plex) lineup(w ResponseWriter, r Request) {
 		return
 	}
 
-	channels, err := getChannel(p.config.Channel)
+	channels, err := p.loadChannels(r.Context())
 	if err != nil {
 		internalServerError(w, err.Error())
 		return
@@ -110,8 +113,33 @@ func (p *Plex) lineup(w ResponseWriter, r Request) {
 	writeJson(w, lineupData)
 }
 
+// status 正在播放的频道及源的运行状态
+func (p *Plex) status(w ResponseWriter, r Request) {
+	statusData := Object{
+		"version":      Version,
+		"stream_types": tv.StreamTypes(),
+		"broadcasts":   p.broadcastStatus(),
+	}
+	if p.env.Push != nil {
+		statusData["publishers"] = p.env.Push.Status()
+	}
+	if p.config.Channel != "" {
+		channels, err := p.loadChannels(r.Context())
+		if err != nil {
+			statusData["channels_error"] = err.Error()
+		} else {
+			list := make([]channelStatus, 0, len(channels))
+			for _, channel := range channels {
+				list = append(list, channel.status())
+			}
+			statusData["channels"] = list
+		}
+	}
+	writeJson(w, statusData)
+}
+
 func (p *Plex) stream(w ResponseWriter, r Request) {
-	channels, err := getChannel(p.config.Channel)
+	channels, err := p.getChannels(r.Context())
 	if err != nil {
 		internalServerError(w, err.Error())
 		return
@@ -132,47 +160,75 @@ func (p *Plex) stream(w ResponseWriter, r Request) {
 	}
 	disableKeepalive(w)
 
-	switch target.Type {
-	case "proxy", "hls":
+	p.prepareChannel(r.Context(), target)
+	if target.err != nil {
+		p.channelError(w, r, target, target.err)
+		return
+	}
+
+	streamType, ok := tv.LookupStreamType(target.Type)
+	if !ok {
+		internalServerError(w, "unsupport channel type:"+target.Type)
+		return
+	}
+	if streamType.Redirect {
+		http.Redirect(w, r, target.URL, http.StatusMovedPermanently)
+		return
+	}
+	if streamType.Shareable {
 		p.sharedStream(w, r, target)
-	case "rtsp":
+	} else {
 		p.unsharedStream(w, r, target)
-	case "bilibili":
-		p.sharedStream(w, r, target)
-	case "redirect":
-		http.Redirect(w, r, target.URL, http.StatusMovedPermanently)
-	default:
-		internalServerError(w, "unsupport channel type:"+target.Type)
 	}
 }
 
 func (p *Plex) sharedStream(w ResponseWriter, r Request, channel *Channel) {
-	reader, release, err := p.getChannelReader(channel)
+	reader, contentType, release, err := p.getChannelReader(channel)
 	if err != nil {
-		internalServerError(w, err.Error())
+		p.channelError(w, r, channel, err)
 		return
 	}
 	defer release()
-	p.warpReader(w, r, reader)
+	p.warpReader(w, r, reader, contentType)
 }
 
 func (p *Plex) unsharedStream(w ResponseWriter, r Request, channel *Channel) {
 	stream, err := p.createTVStream(channel)
 	if err != nil {
-		internalServerError(w, err.Error())
+		p.channelError(w, r, channel, err)
 		return
 	}
 	defer stream.Close()
 	if err := stream.Start(); err != nil {
-		internalServerError(w, err.Error())
+		p.channelError(w, r, channel, err)
+		return
+	}
+	p.warpReader(w, r, stream, getContentType(channel, stream))
+}
+
+// channelError 频道无法播放时按错误类型返回状态码，配置了error_slate时改为播放显示错误信息的待机画面
+func (p *Plex) channelError(w ResponseWriter, r Request, channel *Channel, err error) {
+	message := channel.redact(err.Error())
+	if !p.config.ErrorSlate {
+		streamError(w, err, message)
+		return
+	}
+	slate, slateErr := tv.NewErrorSlateStream(p.env, p.config.Slate, channel.Name+"\n"+message)
+	if slateErr != nil {
+		streamError(w, err, message)
+		return
+	}
+	defer slate.Close()
+	if slateErr = slate.Start(); slateErr != nil {
+		streamError(w, err, message)
 		return
 	}
-	p.warpReader(w, r, stream)
+	p.warpReader(w, r, slate, tv.ContentTypeTS)
 }
 
-func (p *Plex) warpReader(w ResponseWriter, r Request, reader io.Reader) {
+func (p *Plex) warpReader(w ResponseWriter, r Request, reader io.Reader, contentType string) {
 	if !isWebsocketUpgrade(r) {
-		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Type", contentType)
 		io.Copy(w, reader)
 		return
 	}
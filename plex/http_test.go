@@ -0,0 +1,65 @@
+package plex
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"plex-tuner/plex/tv"
+	"testing"
+)
+
+// newTestPlex 使用channels作为频道列表的Plex
+func newTestPlex(t *testing.T, channels string) *Plex {
+	channelFile := filepath.Join(t.TempDir(), "channel.json")
+	if err := os.WriteFile(channelFile, []byte(channels), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := New()
+	p.config = &Config{Channel: channelFile}
+	p.logger = log.New(os.Stderr, "", 0)
+	p.env = &tv.Env{Logger: p.logger}
+	return p
+}
+
+func TestStreamRedirect(t *testing.T) {
+	p := newTestPlex(t, `[{"id":"1","name":"Elsewhere","url":"http://other/live/1","type":"redirect"}]`)
+
+	w := httptest.NewRecorder()
+	p.stream(w, httptest.NewRequest("GET", "/stream/1", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "http://other/live/1" {
+		t.Errorf("response = %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	channels, err := p.loadChannels(httptest.NewRequest("GET", "/", nil).Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channels[0].err != nil || !channels[0].redirect() {
+		t.Errorf("channel err = %v, redirect = %v", channels[0].err, channels[0].redirect())
+	}
+	if _, err = tv.NewStream(p.env, channels[0].source()); err == nil {
+		t.Error("NewStream() for a redirect channel succeeded")
+	}
+}
+
+func TestStreamPushOffline(t *testing.T) {
+	p := newTestPlex(t, `[{"id":"1","name":"Camera","url":"cam","type":"push"}]`)
+
+	// 未配置推流服务
+	w := httptest.NewRecorder()
+	p.stream(w, httptest.NewRequest("GET", "/stream/1", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status without push server = %d %s", w.Code, w.Body.String())
+	}
+
+	// 推流码没有在推流
+	p = newTestPlex(t, `[{"id":"1","name":"Camera","url":"cam","type":"push"}]`)
+	p.env.Push = tv.NewPushServer(p.logger)
+	w = httptest.NewRecorder()
+	p.stream(w, httptest.NewRequest("GET", "/stream/1", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status while offline = %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,9 @@
+package plex
+
+import "plex-tuner/plex/live"
+
+var bilibili = live.NewBilibili(httpClient, live.BilibiliAPI)
+
+func init() {
+	live.Register(bilibili)
+}
@@ -0,0 +1,353 @@
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const BilibiliAPI = "https://api.live.bilibili.com"
+
+// BilibiliQualityOrigin 原画，未指定画质时请求的画质
+const BilibiliQualityOrigin = 10000
+
+const bilibiliUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// errBilibiliAPI 接口返回的错误码不为0
+var errBilibiliAPI = errors.New("bilibili api error")
+
+// bilibili的时间为北京时间
+var bilibiliLocation = time.FixedZone("CST", 8*60*60)
+
+// Bilibili b站直播
+type Bilibili struct {
+	client *http.Client
+	api    string
+
+	sessdataLock *sync.RWMutex
+	sessdata     string
+
+	// roomIds 直播间号(短号或长号)到直播间id的缓存，只缓存解析成功的结果
+	roomIdsLock *sync.Mutex
+	roomIds     map[string]string
+}
+
+// NewBilibili 创建b站直播的解析，api为接口地址，测试时可以替换为本地服务
+func NewBilibili(client *http.Client, api string) *Bilibili {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Bilibili{
+		client:       client,
+		api:          api,
+		sessdataLock: new(sync.RWMutex),
+		roomIdsLock:  new(sync.Mutex),
+		roomIds:      make(map[string]string),
+	}
+}
+
+// SetSESSDATA 设置登录后cookie中的SESSDATA，用于获取登录后才能观看的画质
+func (b *Bilibili) SetSESSDATA(sessdata string) {
+	b.sessdataLock.Lock()
+	defer b.sessdataLock.Unlock()
+	b.sessdata = sessdata
+}
+
+type bilibiliResult struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type bilibiliRoomInfo struct {
+	RoomId      int64  `json:"room_id"`
+	LiveStatus  int    `json:"live_status"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	UserCover   string `json:"user_cover"`
+	AreaName    string `json:"area_name"`
+	LiveTime    string `json:"live_time"`
+}
+
+type bilibiliPlayInfo struct {
+	RoomId      int64 `json:"room_id"`
+	LiveStatus  int   `json:"live_status"`
+	PlayUrlInfo *struct {
+		PlayUrl *struct {
+			Stream []*struct {
+				ProtocolName string `json:"protocol_name"`
+				Format       []*struct {
+					FormatName string `json:"format_name"`
+					Codec      []*struct {
+						CodecName string `json:"codec_name"`
+						CurrentQn int    `json:"current_qn"`
+						AcceptQn  []int  `json:"accept_qn"`
+						BaseUrl   string `json:"base_url"`
+						UrlInfo   []*struct {
+							Host  string `json:"host"`
+							Extra string `json:"extra"`
+						} `json:"url_info"`
+					} `json:"codec"`
+				} `json:"format"`
+			} `json:"stream"`
+		} `json:"playurl"`
+	} `json:"playurl_info"`
+}
+
+func (b *Bilibili) Name() string {
+	return "bilibili"
+}
+
+func (b *Bilibili) RoomInfo(ctx context.Context, id string) (*RoomInfo, error) {
+	data := new(bilibiliRoomInfo)
+	query := url.Values{"room_id": {id}}
+	if err := b.get(ctx, "/room/v1/Room/get_info", query, data); err != nil {
+		return nil, err
+	}
+	info := &RoomInfo{
+		Id:          strconv.FormatInt(data.RoomId, 10),
+		Live:        data.LiveStatus == 1,
+		Title:       data.Title,
+		Description: data.Description,
+		Cover:       data.UserCover,
+		Area:        data.AreaName,
+	}
+	if info.Live {
+		info.StartedAt, _ = time.ParseInLocation("2006-01-02 15:04:05", data.LiveTime, bilibiliLocation)
+	}
+	return info, nil
+}
+
+type bilibiliRoomInit struct {
+	RoomId int64 `json:"room_id"`
+}
+
+// RoomId 将直播间的短号或网页地址(如https://live.bilibili.com/h5/1)通过room_init接口解析为直播间的长号
+func (b *Bilibili) RoomId(ctx context.Context, input string) (string, error) {
+	number, err := bilibiliRoomNumber(strings.TrimSpace(input))
+	if err != nil {
+		return "", err
+	}
+	b.roomIdsLock.Lock()
+	id, ok := b.roomIds[number]
+	b.roomIdsLock.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	data := new(bilibiliRoomInit)
+	if err = b.get(ctx, "/room/v1/Room/room_init", url.Values{"id": {number}}, data); err != nil {
+		if errors.Is(err, errBilibiliAPI) {
+			return "", fmt.Errorf("%w: %s: %v", ErrInvalidRoom, input, err)
+		}
+		return "", err
+	}
+	if data.RoomId == 0 {
+		return "", fmt.Errorf("%w: %s", ErrInvalidRoom, input)
+	}
+	id = strconv.FormatInt(data.RoomId, 10)
+
+	b.roomIdsLock.Lock()
+	b.roomIds[number] = id
+	b.roomIdsLock.Unlock()
+	return id, nil
+}
+
+// bilibiliRoomNumber 从输入中取出直播间号，支持纯数字及live.bilibili.com的地址
+func bilibiliRoomNumber(input string) (string, error) {
+	if isDigits(input) {
+		return input, nil
+	}
+	raw := input
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !strings.HasSuffix(u.Hostname(), "live.bilibili.com") {
+		return "", fmt.Errorf("%w: %s", ErrInvalidRoom, input)
+	}
+	// 地址可能为/1、/h5/1、/blanc/1等形式，取最后一段数字
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if number := segments[len(segments)-1]; isDigits(number) {
+		return number, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidRoom, input)
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Bilibili) Resolve(ctx context.Context, id string, pref Preferences) ([]Candidate, error) {
+	requestQn := pref.Quality
+	if requestQn == 0 {
+		requestQn = BilibiliQualityOrigin
+	}
+	data, err := b.playInfo(ctx, id, requestQn)
+	if err != nil {
+		return nil, err
+	}
+	// 请求的画质不在可选画质中时，按可选画质重新请求最匹配的画质
+	acceptQn, currentQn := data.qualities()
+	if qn := pickQuality(acceptQn, pref.Quality); qn != 0 && qn != currentQn && qn != requestQn {
+		if data, err = b.playInfo(ctx, id, qn); err != nil {
+			return nil, err
+		}
+	}
+	if data.LiveStatus != 1 {
+		return nil, ErrNotLive
+	}
+	if data.PlayUrlInfo == nil || data.PlayUrlInfo.PlayUrl == nil {
+		return nil, ErrNoCandidate
+	}
+
+	var candidates []Candidate
+	for _, stream := range data.PlayUrlInfo.PlayUrl.Stream {
+		protocol := bilibiliProtocol(stream.ProtocolName)
+		if protocol == "" {
+			continue
+		}
+		for _, format := range stream.Format {
+			for _, codec := range format.Codec {
+				for _, urlInfo := range codec.UrlInfo {
+					candidates = append(candidates, Candidate{
+						URL:      urlInfo.Host + codec.BaseUrl + urlInfo.Extra,
+						Protocol: protocol,
+						Format:   format.FormatName,
+						Codec:    codec.CodecName,
+						Quality:  codec.CurrentQn,
+						Expires:  bilibiliExpires(urlInfo.Extra),
+					})
+				}
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoCandidate
+	}
+	return candidates, nil
+}
+
+func (b *Bilibili) playInfo(ctx context.Context, id string, qn int) (*bilibiliPlayInfo, error) {
+	data := new(bilibiliPlayInfo)
+	query := url.Values{
+		"room_id":  {id},
+		"protocol": {"0,1"},
+		"format":   {"0,1,2"},
+		"codec":    {"0,1"},
+		"qn":       {strconv.Itoa(qn)},
+	}
+	if err := b.get(ctx, "/xlive/web-room/v2/index/getRoomPlayInfo", query, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// qualities 返回可选的画质及当前的画质
+func (d *bilibiliPlayInfo) qualities() (acceptQn []int, currentQn int) {
+	if d.PlayUrlInfo == nil || d.PlayUrlInfo.PlayUrl == nil {
+		return nil, 0
+	}
+	for _, stream := range d.PlayUrlInfo.PlayUrl.Stream {
+		for _, format := range stream.Format {
+			for _, codec := range format.Codec {
+				if len(codec.AcceptQn) > len(acceptQn) {
+					acceptQn = codec.AcceptQn
+				}
+				if codec.CurrentQn > currentQn {
+					currentQn = codec.CurrentQn
+				}
+			}
+		}
+	}
+	return acceptQn, currentQn
+}
+
+// pickQuality 选择不超过quality的最高画质，都超过时选择最低画质，quality为0时选择最高画质
+func pickQuality(acceptQn []int, quality int) int {
+	best, lowest := 0, 0
+	for _, qn := range acceptQn {
+		if lowest == 0 || qn < lowest {
+			lowest = qn
+		}
+		if (quality == 0 || qn <= quality) && qn > best {
+			best = qn
+		}
+	}
+	if best == 0 {
+		return lowest
+	}
+	return best
+}
+
+// bilibiliExpires 解析签名参数中的过期时间
+func bilibiliExpires(extra string) time.Time {
+	query, err := url.ParseQuery(strings.TrimPrefix(extra, "?"))
+	if err != nil {
+		return time.Time{}
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || expires <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(expires, 0)
+}
+
+func bilibiliProtocol(name string) string {
+	switch name {
+	case "http_hls":
+		return ProtocolHLS
+	case "http_stream":
+		return ProtocolFLV
+	}
+	return ""
+}
+
+// get 请求接口，并将返回的data解析到v中
+func (b *Bilibili) get(ctx context.Context, path string, query url.Values, v any) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", b.api+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", bilibiliUserAgent)
+	request.Header.Set("Referer", "https://live.bilibili.com/")
+	b.sessdataLock.RLock()
+	if b.sessdata != "" {
+		request.AddCookie(&http.Cookie{Name: "SESSDATA", Value: b.sessdata})
+	}
+	b.sessdataLock.RUnlock()
+	resp, err := b.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+
+	r := new(bilibiliResult)
+	if err = json.NewDecoder(resp.Body).Decode(r); err != nil {
+		return err
+	}
+	if r.Code != 0 {
+		return fmt.Errorf("%w: %d %s", errBilibiliAPI, r.Code, r.Message)
+	}
+	if len(r.Data) == 0 || string(r.Data) == "null" {
+		return ErrNoCandidate
+	}
+	return json.Unmarshal(r.Data, v)
+}
@@ -0,0 +1,220 @@
+package live
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrDanmakuPacket = errors.New("bilibili: invalid danmaku packet")
+
+const (
+	bilibiliDanmakuHeaderLength = 16
+	// 心跳间隔，服务器约70秒没有收到心跳会断开连接
+	bilibiliHeartbeatInterval = 30 * time.Second
+
+	// 协议版本，0为json，1为心跳回复中的人气值，2为zlib压缩的多个包
+	bilibiliProtoJSON = 0
+	bilibiliProtoInt  = 1
+	bilibiliProtoZlib = 2
+
+	bilibiliOpHeartbeat = 2
+	bilibiliOpMessage   = 5
+	bilibiliOpAuth      = 7
+	bilibiliOpAuthReply = 8
+)
+
+type bilibiliDanmuInfo struct {
+	Token    string `json:"token"`
+	HostList []*struct {
+		Host    string `json:"host"`
+		WsPort  int    `json:"ws_port"`
+		WssPort int    `json:"wss_port"`
+	} `json:"host_list"`
+}
+
+type bilibiliDanmakuAuth struct {
+	Uid      int64  `json:"uid"`
+	RoomId   int64  `json:"roomid"`
+	Protover int    `json:"protover"`
+	Platform string `json:"platform"`
+	Type     int    `json:"type"`
+	Key      string `json:"key"`
+}
+
+type bilibiliDanmakuMessage struct {
+	Cmd  string            `json:"cmd"`
+	Info []json.RawMessage `json:"info"`
+}
+
+// ReceiveDanmaku 连接b站直播间的弹幕服务器，接口地址为https时使用wss，否则使用ws
+func (b *Bilibili) ReceiveDanmaku(ctx context.Context, id string, handler func(Danmaku)) error {
+	room, err := b.RoomInfo(ctx, id)
+	if err != nil {
+		return err
+	}
+	roomId, err := strconv.ParseInt(room.Id, 10, 64)
+	if err != nil {
+		return err
+	}
+	info := new(bilibiliDanmuInfo)
+	if err = b.get(ctx, "/xlive/web-room/v1/index/getDanmuInfo", url.Values{"id": {room.Id}}, info); err != nil {
+		return err
+	}
+	if len(info.HostList) == 0 {
+		return errors.New("bilibili: no danmaku server")
+	}
+
+	// 依次尝试所有服务器，直到连接成功
+	for _, host := range info.HostList {
+		addr := b.danmakuURL(host.Host, host.WsPort, host.WssPort)
+		header := http.Header{"User-Agent": {bilibiliUserAgent}}
+		var conn *websocket.Conn
+		conn, _, err = websocket.DefaultDialer.DialContext(ctx, addr, header)
+		if err != nil {
+			continue
+		}
+		auth := bilibiliDanmakuAuth{Uid: 0, RoomId: roomId, Protover: bilibiliProtoZlib, Platform: "web", Type: 2, Key: info.Token}
+		return b.serveDanmaku(ctx, conn, auth, handler)
+	}
+	return err
+}
+
+func (b *Bilibili) danmakuURL(host string, wsPort int, wssPort int) string {
+	if strings.HasPrefix(b.api, "https://") {
+		return "wss://" + host + ":" + strconv.Itoa(wssPort) + "/sub"
+	}
+	return "ws://" + host + ":" + strconv.Itoa(wsPort) + "/sub"
+}
+
+// serveDanmaku 认证后定时发送心跳，并解析收到的弹幕
+func (b *Bilibili) serveDanmaku(ctx context.Context, conn *websocket.Conn, auth bilibiliDanmakuAuth, handler func(Danmaku)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	body, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+	if err = conn.WriteMessage(websocket.BinaryMessage, bilibiliDanmakuPacket(bilibiliOpAuth, body)); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(bilibiliHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			if err := conn.WriteMessage(websocket.BinaryMessage, bilibiliDanmakuPacket(bilibiliOpHeartbeat, nil)); err != nil {
+				cancel()
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err = parseBilibiliDanmaku(data, handler); err != nil {
+			return err
+		}
+	}
+}
+
+// bilibiliDanmakuPacket 封装一个弹幕协议的数据包
+func bilibiliDanmakuPacket(op uint32, body []byte) []byte {
+	packet := make([]byte, bilibiliDanmakuHeaderLength+len(body))
+	binary.BigEndian.PutUint32(packet[0:4], uint32(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:6], bilibiliDanmakuHeaderLength)
+	binary.BigEndian.PutUint16(packet[6:8], bilibiliProtoInt)
+	binary.BigEndian.PutUint32(packet[8:12], op)
+	binary.BigEndian.PutUint32(packet[12:16], 1)
+	copy(packet[bilibiliDanmakuHeaderLength:], body)
+	return packet
+}
+
+// parseBilibiliDanmaku 解析一条websocket消息中的所有数据包
+func parseBilibiliDanmaku(data []byte, handler func(Danmaku)) error {
+	for len(data) > 0 {
+		if len(data) < bilibiliDanmakuHeaderLength {
+			return ErrDanmakuPacket
+		}
+		length := int(binary.BigEndian.Uint32(data[0:4]))
+		headerLength := int(binary.BigEndian.Uint16(data[4:6]))
+		proto := binary.BigEndian.Uint16(data[6:8])
+		op := binary.BigEndian.Uint32(data[8:12])
+		if length < headerLength || headerLength < bilibiliDanmakuHeaderLength || length > len(data) {
+			return ErrDanmakuPacket
+		}
+		body := data[headerLength:length]
+		data = data[length:]
+
+		if op != bilibiliOpMessage {
+			continue
+		}
+		switch proto {
+		case bilibiliProtoZlib:
+			r, err := zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			inflated, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			if err = parseBilibiliDanmaku(inflated, handler); err != nil {
+				return err
+			}
+		case bilibiliProtoJSON:
+			if d, ok := decodeBilibiliDanmaku(body); ok {
+				handler(d)
+			}
+		}
+	}
+	return nil
+}
+
+// decodeBilibiliDanmaku 从DANMU_MSG消息中取出用户名和内容，其余消息忽略
+func decodeBilibiliDanmaku(body []byte) (Danmaku, bool) {
+	message := new(bilibiliDanmakuMessage)
+	if err := json.Unmarshal(body, message); err != nil {
+		return Danmaku{}, false
+	}
+	// 新版本的cmd会带有后缀，如DANMU_MSG:4:0:2:2:2:0
+	if cmd, _, _ := strings.Cut(message.Cmd, ":"); cmd != "DANMU_MSG" || len(message.Info) < 3 {
+		return Danmaku{}, false
+	}
+	d := Danmaku{}
+	if err := json.Unmarshal(message.Info[1], &d.Text); err != nil || d.Text == "" {
+		return Danmaku{}, false
+	}
+	var user []json.RawMessage
+	if err := json.Unmarshal(message.Info[2], &user); err == nil && len(user) > 1 {
+		json.Unmarshal(user[1], &d.User)
+	}
+	return d, true
+}
@@ -0,0 +1,250 @@
+package live
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// danmakuTestPacket 封装一个指定协议版本的数据包
+func danmakuTestPacket(proto uint16, op uint32, body []byte) []byte {
+	packet := make([]byte, bilibiliDanmakuHeaderLength+len(body))
+	binary.BigEndian.PutUint32(packet[0:4], uint32(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:6], bilibiliDanmakuHeaderLength)
+	binary.BigEndian.PutUint16(packet[6:8], proto)
+	binary.BigEndian.PutUint32(packet[8:12], op)
+	binary.BigEndian.PutUint32(packet[12:16], 1)
+	copy(packet[bilibiliDanmakuHeaderLength:], body)
+	return packet
+}
+
+func danmakuTestZlib(t *testing.T, packets ...[]byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	for _, packet := range packets {
+		w.Write(packet)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return danmakuTestPacket(bilibiliProtoZlib, bilibiliOpMessage, buf.Bytes())
+}
+
+func danmuMsg(cmd string, user string, text string) []byte {
+	return []byte(fmt.Sprintf(`{"cmd":%q,"info":[[0,1,25,16777215,1682942405000,0,0,"c4b9b0a2",0,0,0,"",0,"{}","{}",{"mode":0}],%q,[9617619,%q,0,0,0,10000,1,""],[],[0,0,9868950,">50000",0],["",""],0,0,null,{"ts":1682942405,"ct":"A1B2"},0,0,null,null,0,7]}`, cmd, text, user))
+}
+
+// fakeDanmakuServer 模拟b站的接口及弹幕服务器，第一个弹幕服务器无法连接
+type fakeDanmakuServer struct {
+	*httptest.Server
+	t     *testing.T
+	auth  chan bilibiliDanmakuAuth
+	beats chan struct{}
+	send  func(conn *websocket.Conn)
+}
+
+func newFakeDanmakuServer(t *testing.T, send func(conn *websocket.Conn)) *fakeDanmakuServer {
+	// 占用一个端口后关闭，作为无法连接的服务器
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	s := &fakeDanmakuServer{t: t, auth: make(chan bilibiliDanmakuAuth, 1), beats: make(chan struct{}, 8), send: send}
+	upgrader := websocket.Upgrader{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case bilibiliGetInfoPath:
+			data, _ := os.ReadFile(filepath.Join("testdata", "bilibili_get_info.json"))
+			w.Write(data)
+		case "/xlive/web-room/v1/index/getDanmuInfo":
+			if r.URL.Query().Get("id") != "23900931" {
+				t.Errorf("getDanmuInfo id = %s", r.URL.Query().Get("id"))
+			}
+			u, _ := url.Parse(s.URL)
+			fmt.Fprintf(w, `{"code":0,"message":"0","ttl":1,"data":{"group":"live","business_id":0,"refresh_row_factor":0.125,"refresh_rate":100,"max_delay":5000,"token":"tok-123","host_list":[{"host":"127.0.0.1","port":2243,"wss_port":443,"ws_port":%d},{"host":"%s","port":2243,"wss_port":443,"ws_port":%s}]}}`, deadPort, u.Hostname(), u.Port())
+		case "/sub":
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			s.serve(conn)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeDanmakuServer) serve(conn *websocket.Conn) {
+	// 第一个包为认证包
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+	if op := binary.BigEndian.Uint32(data[8:12]); op != bilibiliOpAuth || int(binary.BigEndian.Uint32(data[0:4])) != len(data) {
+		s.t.Errorf("first packet op = %d, length = %d/%d", op, binary.BigEndian.Uint32(data[0:4]), len(data))
+		return
+	}
+	auth := bilibiliDanmakuAuth{}
+	if err = json.Unmarshal(data[bilibiliDanmakuHeaderLength:], &auth); err != nil {
+		s.t.Error(err)
+	}
+	s.auth <- auth
+	conn.WriteMessage(websocket.BinaryMessage, danmakuTestPacket(bilibiliProtoInt, bilibiliOpAuthReply, []byte(`{"code":0}`)))
+
+	s.send(conn)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if binary.BigEndian.Uint32(data[8:12]) == bilibiliOpHeartbeat {
+			s.beats <- struct{}{}
+			// 心跳回复中为人气值
+			conn.WriteMessage(websocket.BinaryMessage, danmakuTestPacket(bilibiliProtoInt, 3, []byte{0, 0, 0x30, 0x39}))
+		}
+	}
+}
+
+func TestBilibiliReceiveDanmaku(t *testing.T) {
+	server := newFakeDanmakuServer(t, func(conn *websocket.Conn) {
+		conn.WriteMessage(websocket.BinaryMessage, danmakuTestZlib(t,
+			danmakuTestPacket(bilibiliProtoJSON, bilibiliOpMessage, danmuMsg("DANMU_MSG:4:0:2:2:2:0", "张三", "<b>hello</b>")),
+			danmakuTestPacket(bilibiliProtoJSON, bilibiliOpMessage, []byte(`{"cmd":"INTERACT_WORD","data":{"uname":"李四","msg_type":1}}`)),
+			danmakuTestPacket(bilibiliProtoJSON, bilibiliOpMessage, danmuMsg("DANMU_MSG", "李四", "第二条")),
+		))
+		conn.WriteMessage(websocket.BinaryMessage, danmakuTestPacket(bilibiliProtoJSON, bilibiliOpMessage, []byte(`{"cmd":"SEND_GIFT","data":{"giftName":"辣条"}}`)))
+		conn.WriteMessage(websocket.BinaryMessage, danmakuTestPacket(bilibiliProtoJSON, bilibiliOpMessage, danmuMsg("DANMU_MSG", "王五", "未压缩")))
+	})
+	b := NewBilibili(server.Client(), server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	received := make(chan Danmaku, 8)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.ReceiveDanmaku(ctx, "23900931", func(d Danmaku) {
+			received <- d
+		})
+	}()
+
+	select {
+	case auth := <-server.auth:
+		want := bilibiliDanmakuAuth{Uid: 0, RoomId: 23900931, Protover: bilibiliProtoZlib, Platform: "web", Type: 2, Key: "tok-123"}
+		if auth != want {
+			t.Errorf("auth = %+v, want %+v", auth, want)
+		}
+	case <-ctx.Done():
+		t.Fatal("no auth packet")
+	}
+	select {
+	case <-server.beats:
+	case <-ctx.Done():
+		t.Fatal("no heartbeat")
+	}
+
+	var got []Danmaku
+	for len(got) < 3 {
+		select {
+		case d := <-received:
+			got = append(got, d)
+		case err := <-done:
+			t.Fatalf("ReceiveDanmaku() returned early: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("got %d danmaku", len(got))
+		}
+	}
+	want := []Danmaku{{User: "张三", Text: "<b>hello</b>"}, {User: "李四", Text: "第二条"}, {User: "王五", Text: "未压缩"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("danmaku = %+v, want %+v", got, want)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("ReceiveDanmaku() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiveDanmaku() did not return after cancel")
+	}
+}
+
+func TestBilibiliReceiveDanmakuInvalidPacket(t *testing.T) {
+	server := newFakeDanmakuServer(t, func(conn *websocket.Conn) {
+		packet := danmakuTestPacket(bilibiliProtoJSON, bilibiliOpMessage, []byte(`{}`))
+		// 长度超过实际数据
+		binary.BigEndian.PutUint32(packet[0:4], 100)
+		conn.WriteMessage(websocket.BinaryMessage, packet)
+	})
+	b := NewBilibili(server.Client(), server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := b.ReceiveDanmaku(ctx, "23900931", func(Danmaku) {})
+	if !errors.Is(err, ErrDanmakuPacket) {
+		t.Errorf("ReceiveDanmaku() error = %v, want ErrDanmakuPacket", err)
+	}
+}
+
+func TestParseBilibiliDanmaku(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []Danmaku
+		err  error
+	}{
+		{"heartbeat reply", danmakuTestPacket(bilibiliProtoInt, 3, []byte{0, 0, 0, 1}), nil, nil},
+		{"other cmd", danmakuTestPacket(bilibiliProtoJSON, bilibiliOpMessage, []byte(`{"cmd":"ONLINE_RANK_COUNT"}`)), nil, nil},
+		{"empty text", danmakuTestPacket(bilibiliProtoJSON, bilibiliOpMessage, danmuMsg("DANMU_MSG", "a", "")), nil, nil},
+		{"two packets", append(
+			danmakuTestPacket(bilibiliProtoJSON, bilibiliOpMessage, danmuMsg("DANMU_MSG", "a", "1")),
+			danmakuTestPacket(bilibiliProtoJSON, bilibiliOpMessage, danmuMsg("DANMU_MSG", "b", "2"))...,
+		), []Danmaku{{User: "a", Text: "1"}, {User: "b", Text: "2"}}, nil},
+		{"short header", []byte{0, 0, 0, 16}, nil, ErrDanmakuPacket},
+		{"bad header length", func() []byte {
+			packet := danmakuTestPacket(bilibiliProtoJSON, bilibiliOpMessage, nil)
+			binary.BigEndian.PutUint16(packet[4:6], 8)
+			return packet
+		}(), nil, ErrDanmakuPacket},
+	}
+	for _, test := range tests {
+		var got []Danmaku
+		err := parseBilibiliDanmaku(test.data, func(d Danmaku) {
+			got = append(got, d)
+		})
+		if !errors.Is(err, test.err) || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, %v, want %+v, %v", test.name, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestBilibiliDanmakuURL(t *testing.T) {
+	if got := NewBilibili(nil, BilibiliAPI).danmakuURL("broadcastlv.chat.bilibili.com", 2244, 443); got != "wss://broadcastlv.chat.bilibili.com:443/sub" {
+		t.Errorf("https api url = %s", got)
+	}
+	if got := NewBilibili(nil, "http://127.0.0.1:8080").danmakuURL("127.0.0.1", 2244, 443); got != "ws://127.0.0.1:2244/sub" {
+		t.Errorf("http api url = %s", got)
+	}
+}
@@ -0,0 +1,250 @@
+package live
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bilibiliFixtures 按接口路径返回testdata中录制的响应
+type bilibiliFixtures struct {
+	t        *testing.T
+	files    map[string]string
+	lock     sync.Mutex
+	requests []*http.Request
+}
+
+func newBilibiliServer(t *testing.T, files map[string]string) (*httptest.Server, *bilibiliFixtures) {
+	f := &bilibiliFixtures{t: t, files: files}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return server, f
+}
+
+func (f *bilibiliFixtures) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	f.requests = append(f.requests, r)
+	f.lock.Unlock()
+	name, ok := f.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		f.t.Error(err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+}
+
+func (f *bilibiliFixtures) queries(key string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var values []string
+	for _, r := range f.requests {
+		values = append(values, r.URL.Query().Get(key))
+	}
+	return values
+}
+
+const (
+	bilibiliPlayInfoPath = "/xlive/web-room/v2/index/getRoomPlayInfo"
+	bilibiliGetInfoPath  = "/room/v1/Room/get_info"
+	bilibiliRoomInitPath = "/room/v1/Room/room_init"
+)
+
+func TestBilibiliRoomInfo(t *testing.T) {
+	server, fixtures := newBilibiliServer(t, map[string]string{bilibiliGetInfoPath: "bilibili_get_info.json"})
+	b := NewBilibili(server.Client(), server.URL)
+
+	info, err := b.RoomInfo(context.Background(), "23900931")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &RoomInfo{
+		Id:          "23900931",
+		Live:        true,
+		Title:       "晚间杂谈",
+		Description: "<p>每天晚上八点直播</p>",
+		Cover:       "https://i0.hdslb.com/bfs/live/new_room_cover/cover.jpg",
+		Area:        "虚拟日常",
+		StartedAt:   time.Date(2023, 5, 1, 12, 0, 5, 0, time.UTC),
+	}
+	if !info.StartedAt.Equal(want.StartedAt) {
+		t.Errorf("StartedAt = %v, want %v", info.StartedAt, want.StartedAt)
+	}
+	info.StartedAt = want.StartedAt
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("RoomInfo() = %+v, want %+v", info, want)
+	}
+	if got := fixtures.queries("room_id"); !reflect.DeepEqual(got, []string{"23900931"}) {
+		t.Errorf("room_id = %v", got)
+	}
+}
+
+func TestBilibiliResolve(t *testing.T) {
+	server, fixtures := newBilibiliServer(t, map[string]string{bilibiliPlayInfoPath: "bilibili_play_info.json"})
+	b := NewBilibili(server.Client(), server.URL)
+	b.SetSESSDATA("sess")
+
+	candidates, err := b.Resolve(context.Background(), "23900931", Preferences{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		host, protocol, format, codec string
+		quality                       int
+	}
+	var got []summary
+	for _, c := range candidates {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, summary{u.Host, c.Protocol, c.Format, c.Codec, c.Quality})
+		if !c.Expires.Equal(time.Unix(1682949605, 0)) {
+			t.Errorf("%s expires = %v", c.URL, c.Expires)
+		}
+	}
+	want := []summary{
+		{"cn-gddg-ct-01-09.bilivideo.com", ProtocolFLV, FormatFLV, CodecAVC, 10000},
+		{"cn-gddg-ct-01-09.bilivideo.com", ProtocolHLS, FormatTS, CodecAVC, 10000},
+		{"d1--cn-gotcha03.bilivideo.com", ProtocolHLS, FormatTS, CodecAVC, 10000},
+		{"cn-gddg-ct-01-09.bilivideo.com", ProtocolHLS, FormatFMP4, CodecAVC, 10000},
+		{"cn-gddg-ct-01-09.bilivideo.com", ProtocolHLS, FormatFMP4, CodecHEVC, 10000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("candidates = %+v, want %+v", got, want)
+	}
+	wantURL := "https://cn-gddg-ct-01-09.bilivideo.com/live-bvc/738905/live_50329118_bs_4218954/index.m3u8?expires=1682949605&len=0&oi=0&pt=h5&qn=10000&trid=1003f7d4&sigparams=cdn,expires,len,oi,pt,qn,trid&cdn=cn-gotcha01&sign=8c1d"
+	if candidates[1].URL != wantURL {
+		t.Errorf("url = %s, want %s", candidates[1].URL, wantURL)
+	}
+
+	r := fixtures.requests[0]
+	if got := r.URL.Query().Get("qn"); got != "10000" {
+		t.Errorf("qn = %s, want origin quality", got)
+	}
+	if cookie, err := r.Cookie("SESSDATA"); err != nil || cookie.Value != "sess" {
+		t.Errorf("SESSDATA cookie = %v, %v", cookie, err)
+	}
+	if r.Header.Get("Referer") != "https://live.bilibili.com/" || r.Header.Get("User-Agent") != bilibiliUserAgent {
+		t.Errorf("headers = %v", r.Header)
+	}
+}
+
+func TestBilibiliResolveRequestsAcceptedQuality(t *testing.T) {
+	server, fixtures := newBilibiliServer(t, map[string]string{bilibiliPlayInfoPath: "bilibili_play_info.json"})
+	b := NewBilibili(server.Client(), server.URL)
+
+	if _, err := b.Resolve(context.Background(), "23900931", Preferences{Quality: 300}); err != nil {
+		t.Fatal(err)
+	}
+	// 300不在accept_qn中，按不超过300的最高画质250重新请求
+	if got := fixtures.queries("qn"); !reflect.DeepEqual(got, []string{"300", "250"}) {
+		t.Errorf("qn = %v", got)
+	}
+}
+
+func TestBilibiliResolveOffline(t *testing.T) {
+	server, _ := newBilibiliServer(t, map[string]string{bilibiliPlayInfoPath: "bilibili_play_info_offline.json"})
+	b := NewBilibili(server.Client(), server.URL)
+
+	if _, err := b.Resolve(context.Background(), "23900931", Preferences{}); !errors.Is(err, ErrNotLive) {
+		t.Errorf("Resolve() error = %v, want ErrNotLive", err)
+	}
+}
+
+func TestBilibiliRoomId(t *testing.T) {
+	server, fixtures := newBilibiliServer(t, map[string]string{bilibiliRoomInitPath: "bilibili_room_init.json"})
+	b := NewBilibili(server.Client(), server.URL)
+
+	for _, input := range []string{"1", " 1 ", "live.bilibili.com/1", "https://live.bilibili.com/h5/1?broadcast_type=0"} {
+		id, err := b.RoomId(context.Background(), input)
+		if err != nil || id != "5440" {
+			t.Errorf("RoomId(%q) = %q, %v", input, id, err)
+		}
+	}
+	// 解析成功的结果被缓存，只请求一次
+	if got := fixtures.queries("id"); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("room_init requests = %v", got)
+	}
+
+	if _, err := b.RoomId(context.Background(), "https://www.bilibili.com/1"); !errors.Is(err, ErrInvalidRoom) {
+		t.Errorf("other site error = %v", err)
+	}
+}
+
+func TestBilibiliRoomIdMissing(t *testing.T) {
+	server, fixtures := newBilibiliServer(t, map[string]string{bilibiliRoomInitPath: "bilibili_room_init_missing.json"})
+	b := NewBilibili(server.Client(), server.URL)
+
+	for i := 0; i < 2; i++ {
+		if _, err := b.RoomId(context.Background(), "999"); !errors.Is(err, ErrInvalidRoom) {
+			t.Errorf("RoomId() error = %v, want ErrInvalidRoom", err)
+		}
+	}
+	// 失败的结果不缓存
+	if got := len(fixtures.queries("id")); got != 2 {
+		t.Errorf("room_init requests = %d", got)
+	}
+}
+
+func TestBilibiliRoomNumber(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"5440", "5440"},
+		{"live.bilibili.com/1", "1"},
+		{"https://live.bilibili.com/h5/22637261", "22637261"},
+		{"https://live.bilibili.com/blanc/21452505?liteVersion=true", "21452505"},
+		{"https://live.bilibili.com/", ""},
+		{"https://live.bilibili.com/p/html/live-app", ""},
+		{"https://www.douyu.com/1", ""},
+		{"abc", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		got, err := bilibiliRoomNumber(test.input)
+		if test.want == "" {
+			if !errors.Is(err, ErrInvalidRoom) {
+				t.Errorf("bilibiliRoomNumber(%q) = %q, %v, want ErrInvalidRoom", test.input, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("bilibiliRoomNumber(%q) = %q, %v, want %q", test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestPickQuality(t *testing.T) {
+	accept := []int{10000, 400, 250, 150}
+	tests := []struct {
+		acceptQn []int
+		quality  int
+		want     int
+	}{
+		{accept, 0, 10000},
+		{accept, 10000, 10000},
+		{accept, 300, 250},
+		{accept, 250, 250},
+		{accept, 80, 150},
+		{nil, 400, 0},
+	}
+	for _, test := range tests {
+		if got := pickQuality(test.acceptQn, test.quality); got != test.want {
+			t.Errorf("pickQuality(%v, %d) = %d, want %d", test.acceptQn, test.quality, got, test.want)
+		}
+	}
+}
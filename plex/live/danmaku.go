@@ -0,0 +1,76 @@
+package live
+
+import (
+	"context"
+	"plex-tuner/plex/tv"
+	"time"
+)
+
+const (
+	// 每条弹幕字幕显示的时间
+	danmakuDuration = 5 * time.Second
+	// 弹幕连接断开后重连的间隔
+	danmakuRetryInterval = 5 * time.Second
+)
+
+// Danmaku 一条弹幕
+type Danmaku struct {
+	User string
+	Text string
+}
+
+// DanmakuReceiver 可选接口，支持弹幕的直播平台实现
+type DanmakuReceiver interface {
+	// ReceiveDanmaku 连接直播间的弹幕并回调handler，直到ctx结束或连接出错
+	ReceiveDanmaku(ctx context.Context, id string, handler func(Danmaku)) error
+}
+
+// danmakuStream 将弹幕作为字幕轨道加入直播流
+type danmakuStream struct {
+	*liveStream
+	receiver  DanmakuReceiver
+	subtitles *tv.SubtitleMuxer
+}
+
+func newDanmakuStream(s *liveStream, receiver DanmakuReceiver) *danmakuStream {
+	return &danmakuStream{
+		liveStream: s,
+		receiver:   receiver,
+		subtitles:  tv.NewSubtitleMuxer(s),
+	}
+}
+
+func (s *danmakuStream) Start() error {
+	if err := s.liveStream.Start(); err != nil {
+		return err
+	}
+	go s.receive()
+	return nil
+}
+
+func (s *danmakuStream) Read(b []byte) (int, error) {
+	return s.subtitles.Read(b)
+}
+
+// receive 接收弹幕，连接断开后自动重连
+func (s *danmakuStream) receive() {
+	ctx := s.liveStream.ctx
+	for {
+		err := s.receiver.ReceiveDanmaku(ctx, s.source.URL, func(d Danmaku) {
+			s.subtitles.AddCue(tv.SubtitleCue{Speaker: d.User, Text: d.Text, Duration: danmakuDuration})
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && s.env.Logger != nil {
+			s.env.Logger.Printf("[danmaku %s] %v", s.source.Id, err)
+		}
+		timer := time.NewTimer(danmakuRetryInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package live
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"plex-tuner/plex/tv"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLive     = errors.New("live: room is not live")
+	ErrNoCandidate = errors.New("live: no playable stream found")
+
+	ErrDanmakuUnsupported = errors.New("live: danmaku is not supported")
+	ErrInvalidRoom        = errors.New("live: invalid room")
+)
+
+const (
+	ProtocolHLS = "hls"
+	ProtocolFLV = "flv"
+
+	FormatTS   = "ts"
+	FormatFMP4 = "fmp4"
+	FormatFLV  = "flv"
+
+	CodecAVC  = "avc"
+	CodecHEVC = "hevc"
+)
+
+// Preferences 选择直播流时的偏好，为空的项不限制
+type Preferences struct {
+	// Quality 平台定义的画质编号，选择不超过该值的最高画质，0为最高画质
+	Quality int `json:"quality"`
+	// Codec 视频编码，avc或hevc
+	Codec string `json:"codec"`
+	// Format 封装格式，ts、fmp4或flv
+	Format string `json:"format"`
+}
+
+// Candidate 一个可以播放的直播流地址
+type Candidate struct {
+	URL      string `json:"url"`
+	Protocol string `json:"protocol"`
+	Format   string `json:"format"`
+	Codec    string `json:"codec"`
+	Quality  int    `json:"quality"`
+	// Expires 签名地址的过期时间，零值表示不会过期
+	Expires time.Time `json:"expires"`
+}
+
+// RoomInfo 直播间的信息
+type RoomInfo struct {
+	Id          string    `json:"id"`
+	Live        bool      `json:"live"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Cover       string    `json:"cover"`
+	Area        string    `json:"area"`
+	StartedAt   time.Time `json:"started_at"`
+}
+
+// Resolver 直播平台，将直播间id解析为直播流地址
+type Resolver interface {
+	// Name 平台名称，同时作为频道的type
+	Name() string
+	// RoomInfo 查询直播间的信息及直播状态
+	RoomInfo(ctx context.Context, id string) (*RoomInfo, error)
+	// Resolve 返回直播流的候选地址，未开播时返回ErrNotLive
+	Resolve(ctx context.Context, id string, pref Preferences) ([]Candidate, error)
+}
+
+// RoomIdResolver 可选接口，将短号、直播间网页地址等解析为直播间的id
+type RoomIdResolver interface {
+	// RoomId 返回直播间的id，无法解析时返回ErrInvalidRoom
+	RoomId(ctx context.Context, input string) (string, error)
+}
+
+var (
+	resolversLock = new(sync.RWMutex)
+	resolvers     = make(map[string]Resolver)
+)
+
+// Register 注册直播平台，同时注册以平台名称为type的源类型
+func Register(r Resolver) {
+	resolversLock.Lock()
+	defer resolversLock.Unlock()
+	if _, exists := resolvers[r.Name()]; exists {
+		panic("live: register resolver twice: " + r.Name())
+	}
+	resolvers[r.Name()] = r
+	t := tv.StreamType{
+		Name:        r.Name(),
+		Shareable:   true,
+		ContentType: tv.ContentTypeTS,
+		New: func(env *tv.Env, source tv.Source) (tv.TVStream, error) {
+			stream, err := newLiveStream(env, r, source)
+			if err != nil {
+				return nil, err
+			}
+			if receiver, ok := r.(DanmakuReceiver); ok && stream.opt.Danmaku {
+				return newDanmakuStream(stream, receiver), nil
+			}
+			return stream, nil
+		},
+		Validate: func(env *tv.Env, source tv.Source) error {
+			opt := liveOptions{}
+			if err := source.DecodeOptions(&opt); err != nil {
+				return err
+			}
+			if _, ok := r.(DanmakuReceiver); opt.Danmaku && !ok {
+				return fmt.Errorf("%w: %s", ErrDanmakuUnsupported, r.Name())
+			}
+			return nil
+		},
+	}
+	if roomIdResolver, ok := r.(RoomIdResolver); ok {
+		t.ResolveURL = func(ctx context.Context, env *tv.Env, source tv.Source) (string, error) {
+			return roomIdResolver.RoomId(ctx, source.URL)
+		}
+	}
+	tv.RegisterStreamType(t)
+}
+
+// Lookup 查找已注册的直播平台
+func Lookup(name string) (Resolver, bool) {
+	resolversLock.RLock()
+	defer resolversLock.RUnlock()
+	r, ok := resolvers[name]
+	return r, ok
+}
+
+// SortCandidates 按偏好排序，越靠前越符合偏好
+func SortCandidates(candidates []Candidate, pref Preferences) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidateScore(candidates[i], pref) > candidateScore(candidates[j], pref)
+	})
+}
+
+func candidateScore(c Candidate, pref Preferences) int {
+	score := 0
+	if pref.Format == "" || c.Format == pref.Format {
+		score += 4
+	}
+	if pref.Codec == "" || c.Codec == pref.Codec {
+		score += 2
+	}
+	if pref.Quality == 0 || c.Quality <= pref.Quality {
+		score += 1
+	}
+	// 同等条件下画质越高越好
+	return score<<16 + c.Quality
+}
+
+// hlsPlayable 可以通过hls直接播放的候选地址
+func hlsPlayable(c Candidate) bool {
+	return c.Protocol == ProtocolHLS && c.Format == FormatTS
+}
+
+// fmp4Playable 分片为fmp4的hls地址，转封装为ts播放，支持hevc
+func fmp4Playable(c Candidate) bool {
+	return c.Protocol == ProtocolHLS && c.Format == FormatFMP4
+}
+
+// flvPlayable 可以通过flv转封装播放的候选地址，vdk的flv只支持h264
+func flvPlayable(c Candidate) bool {
+	return c.Protocol == ProtocolFLV && c.Format == FormatFLV && c.Codec != CodecHEVC
+}
+
+// newHLSStream 创建直播间的hls流，地址失效时自动切换
+func newHLSStream(r Resolver, id string, pref Preferences) *tv.HLSStream {
+	switcher := &candidateSwitcher{resolver: r, id: id, pref: pref, playable: hlsPlayable}
+	return tv.NewResolvingHLSStream(switcher.next)
+}
+
+// newFMP4HLSStream 创建直播间的fmp4 hls流，转封装为ts输出，地址失效时自动切换
+func newFMP4HLSStream(r Resolver, id string, pref Preferences) *tv.FMP4HLSStream {
+	switcher := &candidateSwitcher{resolver: r, id: id, pref: pref, playable: fmp4Playable}
+	return tv.NewResolvingFMP4HLSStream(switcher.next)
+}
+
+// newFLVStream 创建直播间的flv流，转封装为ts输出，地址失效时自动切换
+func newFLVStream(r Resolver, id string, pref Preferences) *tv.FLVStream {
+	switcher := &candidateSwitcher{resolver: r, id: id, pref: pref, playable: flvPlayable}
+	return tv.NewResolvingFLVStream(switcher.next)
+}
+
+// roomFormats 按偏好排列的播放方式，默认依次为hls(ts)、hls(fmp4)和flv。
+// 偏好flv时优先使用flv，偏好fmp4或hevc时优先使用fmp4，只有fmp4的hls地址提供hevc
+func roomFormats(pref Preferences) []string {
+	switch {
+	case pref.Format == FormatFLV:
+		return []string{FormatFLV, FormatTS, FormatFMP4}
+	case pref.Format == FormatFMP4 || (pref.Format == "" && pref.Codec == CodecHEVC):
+		return []string{FormatFMP4, FormatTS, FormatFLV}
+	}
+	return []string{FormatTS, FormatFMP4, FormatFLV}
+}
+
+// startRoomStream 按roomFormats的顺序开始播放直播间，没有可用的地址时尝试下一种方式
+func startRoomStream(r Resolver, id string, pref Preferences) (tv.TVStream, error) {
+	var err error
+	for _, format := range roomFormats(pref) {
+		var stream tv.TVStream
+		switch format {
+		case FormatTS:
+			stream = newHLSStream(r, id, pref)
+		case FormatFMP4:
+			stream = newFMP4HLSStream(r, id, pref)
+		default:
+			stream = newFLVStream(r, id, pref)
+		}
+		if err = stream.Start(); err == nil {
+			return stream, nil
+		}
+		stream.Close()
+		if !errors.Is(err, ErrNoCandidate) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// candidateSwitcher 依次尝试所有候选地址，都失败或地址即将过期时重新解析
+type candidateSwitcher struct {
+	resolver   Resolver
+	id         string
+	pref       Preferences
+	playable   func(Candidate) bool
+	candidates []Candidate
+	index      int
+}
+
+func (s *candidateSwitcher) next(ctx context.Context, failed *url.URL) (*url.URL, time.Time, error) {
+	if failed != nil {
+		s.index++
+	}
+	if failed == nil || s.index >= len(s.candidates) {
+		if err := s.resolve(ctx); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	c := s.candidates[s.index]
+	playlistUrl, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return playlistUrl, c.Expires, nil
+}
+
+func (s *candidateSwitcher) resolve(ctx context.Context) error {
+	candidates, err := s.resolver.Resolve(ctx, s.id, s.pref)
+	if err != nil {
+		return err
+	}
+	SortCandidates(candidates, s.pref)
+	s.candidates = s.candidates[:0]
+	for _, c := range candidates {
+		if s.playable(c) {
+			s.candidates = append(s.candidates, c)
+		}
+	}
+	s.index = 0
+	if len(s.candidates) == 0 {
+		return fmt.Errorf("%w: %s %s", ErrNoCandidate, s.resolver.Name(), s.id)
+	}
+	return nil
+}
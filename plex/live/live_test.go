@@ -0,0 +1,170 @@
+package live
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"plex-tuner/plex/tv"
+	"reflect"
+	"testing"
+)
+
+func TestSortCandidates(t *testing.T) {
+	candidates := []Candidate{
+		{URL: "flv-avc-10000", Format: FormatFLV, Codec: CodecAVC, Quality: 10000},
+		{URL: "ts-avc-400", Format: FormatTS, Codec: CodecAVC, Quality: 400},
+		{URL: "ts-avc-10000", Format: FormatTS, Codec: CodecAVC, Quality: 10000},
+		{URL: "fmp4-hevc-10000", Format: FormatFMP4, Codec: CodecHEVC, Quality: 10000},
+		{URL: "ts-hevc-250", Format: FormatTS, Codec: CodecHEVC, Quality: 250},
+	}
+	tests := []struct {
+		pref Preferences
+		want []string
+	}{
+		// 没有偏好时按画质从高到低，画质相同时保持原来的顺序
+		{Preferences{}, []string{"flv-avc-10000", "ts-avc-10000", "fmp4-hevc-10000", "ts-avc-400", "ts-hevc-250"}},
+		// 格式优先于编码，编码优先于画质
+		{Preferences{Format: FormatTS, Codec: CodecHEVC}, []string{"ts-hevc-250", "ts-avc-10000", "ts-avc-400", "fmp4-hevc-10000", "flv-avc-10000"}},
+		{Preferences{Quality: 400}, []string{"ts-avc-400", "ts-hevc-250", "flv-avc-10000", "ts-avc-10000", "fmp4-hevc-10000"}},
+	}
+	for _, test := range tests {
+		sorted := append([]Candidate(nil), candidates...)
+		SortCandidates(sorted, test.pref)
+		var got []string
+		for _, c := range sorted {
+			got = append(got, c.URL)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SortCandidates(%+v) = %v, want %v", test.pref, got, test.want)
+		}
+	}
+}
+
+// countingResolver 每次解析返回固定的候选地址并记录次数
+type countingResolver struct {
+	candidates []Candidate
+	err        error
+	resolves   int
+}
+
+func (r *countingResolver) Name() string {
+	return "counting"
+}
+
+func (r *countingResolver) RoomInfo(ctx context.Context, id string) (*RoomInfo, error) {
+	return &RoomInfo{Id: id, Live: r.err == nil}, nil
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, id string, pref Preferences) ([]Candidate, error) {
+	r.resolves++
+	return append([]Candidate(nil), r.candidates...), r.err
+}
+
+func TestCandidateSwitcherFailover(t *testing.T) {
+	resolver := &countingResolver{candidates: []Candidate{
+		{URL: "https://a/flv", Protocol: ProtocolFLV, Format: FormatFLV, Codec: CodecAVC, Quality: 10000},
+		{URL: "https://b/ts-low", Protocol: ProtocolHLS, Format: FormatTS, Codec: CodecAVC, Quality: 400},
+		{URL: "https://c/ts", Protocol: ProtocolHLS, Format: FormatTS, Codec: CodecAVC, Quality: 10000},
+		{URL: "https://d/fmp4", Protocol: ProtocolHLS, Format: FormatFMP4, Codec: CodecAVC, Quality: 10000},
+	}}
+	s := &candidateSwitcher{resolver: resolver, id: "1", playable: hlsPlayable}
+	ctx := context.Background()
+
+	var got []string
+	var failed *url.URL
+	for i := 0; i < 4; i++ {
+		u, _, err := s.next(ctx, failed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, u.String())
+		failed = u
+	}
+	// 只使用可以播放的地址，按画质排序，全部失败后重新解析
+	want := []string{"https://c/ts", "https://b/ts-low", "https://c/ts", "https://b/ts-low"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("next() = %v, want %v", got, want)
+	}
+	if resolver.resolves != 2 {
+		t.Errorf("resolves = %d, want 2", resolver.resolves)
+	}
+
+	// 重新开始时重新解析
+	if u, _, err := s.next(ctx, nil); err != nil || u.String() != "https://c/ts" {
+		t.Errorf("next(nil) = %v, %v", u, err)
+	}
+	if resolver.resolves != 3 {
+		t.Errorf("resolves = %d, want 3", resolver.resolves)
+	}
+}
+
+func TestCandidateSwitcherNoCandidate(t *testing.T) {
+	resolver := &countingResolver{candidates: []Candidate{
+		{URL: "https://a/hevc.flv", Protocol: ProtocolFLV, Format: FormatFLV, Codec: CodecHEVC},
+	}}
+	s := &candidateSwitcher{resolver: resolver, id: "1", playable: flvPlayable}
+	if _, _, err := s.next(context.Background(), nil); !errors.Is(err, ErrNoCandidate) {
+		t.Errorf("next() error = %v, want ErrNoCandidate", err)
+	}
+
+	resolver.err = ErrNotLive
+	if _, _, err := s.next(context.Background(), nil); !errors.Is(err, ErrNotLive) {
+		t.Errorf("next() error = %v, want ErrNotLive", err)
+	}
+}
+
+func TestRoomFormats(t *testing.T) {
+	tests := []struct {
+		pref Preferences
+		want []string
+	}{
+		{Preferences{}, []string{FormatTS, FormatFMP4, FormatFLV}},
+		{Preferences{Format: FormatFLV, Codec: CodecHEVC}, []string{FormatFLV, FormatTS, FormatFMP4}},
+		{Preferences{Format: FormatFMP4}, []string{FormatFMP4, FormatTS, FormatFLV}},
+		// 只有fmp4的hls地址提供hevc
+		{Preferences{Codec: CodecHEVC}, []string{FormatFMP4, FormatTS, FormatFLV}},
+		{Preferences{Format: FormatTS, Codec: CodecHEVC}, []string{FormatTS, FormatFMP4, FormatFLV}},
+	}
+	for _, test := range tests {
+		if got := roomFormats(test.pref); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("roomFormats(%+v) = %v, want %v", test.pref, got, test.want)
+		}
+	}
+}
+
+func TestStartRoomStreamHEVC(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:1,\nseg1.m4s\n")
+	}))
+	defer server.Close()
+	resolver := &countingResolver{candidates: []Candidate{
+		{URL: server.URL + "/ts.m3u8", Protocol: ProtocolHLS, Format: FormatTS, Codec: CodecAVC, Quality: 10000},
+		{URL: server.URL + "/avc.m3u8", Protocol: ProtocolHLS, Format: FormatFMP4, Codec: CodecAVC, Quality: 10000},
+		{URL: server.URL + "/hevc.m3u8", Protocol: ProtocolHLS, Format: FormatFMP4, Codec: CodecHEVC, Quality: 10000},
+	}}
+
+	var requested []string
+	s := &candidateSwitcher{resolver: resolver, id: "1", pref: Preferences{Codec: CodecHEVC}, playable: fmp4Playable}
+	for failed := (*url.URL)(nil); len(requested) < 2; {
+		u, _, err := s.next(context.Background(), failed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requested, failed = append(requested, u.Path), u
+	}
+	if !reflect.DeepEqual(requested, []string{"/hevc.m3u8", "/avc.m3u8"}) {
+		t.Errorf("fmp4 candidates = %v", requested)
+	}
+
+	stream, err := startRoomStream(resolver, "1", Preferences{Codec: CodecHEVC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, ok := stream.(*tv.FMP4HLSStream); !ok {
+		t.Errorf("stream = %T, want *tv.FMP4HLSStream", stream)
+	}
+}
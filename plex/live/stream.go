@@ -0,0 +1,227 @@
+package live
+
+import (
+	"context"
+	"errors"
+	"io"
+	"plex-tuner/plex/tv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 待机画面按整数个ts包读取，切换流时不会截断ts包
+const slateReadSize = 188 * 7
+
+// 未开播时默认显示的文字，内置的测试画面只能显示ascii字符
+const defaultOfflineText = "{name}\nOffline"
+
+// liveOptions 直播平台频道的选项
+type liveOptions struct {
+	Preferences
+	// Slate 未开播时的待机画面，未配置的项使用全局配置
+	Slate tv.SlateConfig `json:"slate"`
+	// PollInterval 未开播时检查直播状态的间隔，单位秒，默认30秒
+	PollInterval int `json:"poll_interval"`
+	// OfflineText 未开播时待机画面上的文字，{name}替换为频道名称
+	OfflineText string `json:"offline_text"`
+	// Danmaku 将弹幕作为WebVTT字幕轨道加入输出的ts，平台需要支持弹幕
+	Danmaku bool `json:"danmaku"`
+}
+
+func (o liveOptions) offlineText(name string) string {
+	text := o.OfflineText
+	if text == "" {
+		text = defaultOfflineText
+	}
+	return strings.ReplaceAll(text, "{name}", name)
+}
+
+func (o liveOptions) pollInterval() time.Duration {
+	if o.PollInterval <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(o.PollInterval) * time.Second
+}
+
+// liveStream 直播间的流，未开播或直播中断时输出待机画面，开播后自动切换到直播
+type liveStream struct {
+	env      *tv.Env
+	resolver Resolver
+	source   tv.Source
+	opt      liveOptions
+
+	lock    *sync.Mutex
+	current tv.TVStream
+	onSlate bool
+	ready   chan tv.TVStream
+	pending []byte
+	buf     []byte
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newLiveStream(env *tv.Env, r Resolver, source tv.Source) (*liveStream, error) {
+	opt := liveOptions{}
+	if err := source.DecodeOptions(&opt); err != nil {
+		return nil, err
+	}
+	opt.Slate = opt.Slate.Merge(env.Slate)
+	s := &liveStream{
+		env:      env,
+		resolver: r,
+		source:   source,
+		opt:      opt,
+		lock:     new(sync.Mutex),
+		ready:    make(chan tv.TVStream, 1),
+		buf:      make([]byte, slateReadSize),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+func (s *liveStream) Start() error {
+	stream, err := startRoomStream(s.resolver, s.source.URL, s.opt.Preferences)
+	if err == nil {
+		s.setCurrent(stream, false)
+		return nil
+	}
+	if !errors.Is(err, ErrNotLive) {
+		return err
+	}
+	if slateErr := s.startSlate(); slateErr != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *liveStream) Read(b []byte) (int, error) {
+	for {
+		if len(s.pending) > 0 {
+			n := copy(b, s.pending)
+			s.pending = s.pending[n:]
+			return n, nil
+		}
+		if s.ctx.Err() != nil {
+			return 0, tv.ErrReadClosedStream
+		}
+
+		current, onSlate := s.getCurrent()
+		if onSlate {
+			// 只在完整的ts包之间切换到直播
+			select {
+			case stream := <-s.ready:
+				current.Close()
+				s.setCurrent(stream, false)
+				continue
+			default:
+			}
+			n, err := io.ReadFull(current, s.buf)
+			if err != nil {
+				return 0, err
+			}
+			s.pending = s.buf[:n]
+			continue
+		}
+
+		n, err := current.Read(b)
+		if err == nil || n > 0 {
+			return n, nil
+		}
+		current.Close()
+		if s.ctx.Err() != nil {
+			return 0, tv.ErrReadClosedStream
+		}
+		// 直播中断时切换到待机画面，等待重新开播
+		if slateErr := s.startSlate(); slateErr != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *liveStream) Close() error {
+	s.cancel()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.current != nil {
+		s.current.Close()
+	}
+	select {
+	case stream := <-s.ready:
+		stream.Close()
+	default:
+	}
+	return nil
+}
+
+func (s *liveStream) ContentType() string {
+	return tv.ContentTypeTS
+}
+
+func (s *liveStream) getCurrent() (tv.TVStream, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.current, s.onSlate
+}
+
+func (s *liveStream) setCurrent(stream tv.TVStream, onSlate bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.current = stream
+	s.onSlate = onSlate
+	if s.ctx.Err() != nil {
+		// 已经关闭时直接关闭新的流
+		stream.Close()
+	}
+}
+
+// startSlate 开始输出待机画面，并在后台等待开播
+func (s *liveStream) startSlate() error {
+	slate, err := tv.NewSlateStream(s.env, s.opt.Slate, s.opt.offlineText(s.source.Name))
+	if err != nil {
+		return err
+	}
+	if err = slate.Start(); err != nil {
+		slate.Close()
+		return err
+	}
+	s.setCurrent(slate, true)
+	go s.waitLive()
+	return nil
+}
+
+// waitLive 定时检查直播状态，开播后创建直播流等待切换
+func (s *liveStream) waitLive() {
+	interval := time.Duration(0)
+	for {
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+		interval = s.opt.pollInterval()
+
+		info, err := s.resolver.RoomInfo(s.ctx, s.source.URL)
+		if err != nil || !info.Live {
+			continue
+		}
+		stream, err := startRoomStream(s.resolver, s.source.URL, s.opt.Preferences)
+		if err != nil {
+			continue
+		}
+		// 与Close互斥，避免关闭后放入的流没有被关闭
+		s.lock.Lock()
+		closed := s.ctx.Err() != nil
+		if !closed {
+			s.ready <- stream
+		}
+		s.lock.Unlock()
+		if closed {
+			stream.Close()
+		}
+		return
+	}
+}
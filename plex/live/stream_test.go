@@ -0,0 +1,19 @@
+package live
+
+import "testing"
+
+func TestOfflineText(t *testing.T) {
+	tests := []struct {
+		opt  liveOptions
+		want string
+	}{
+		{liveOptions{}, "Room 1\nOffline"},
+		{liveOptions{OfflineText: "{name} is not live"}, "Room 1 is not live"},
+		{liveOptions{OfflineText: "Back soon"}, "Back soon"},
+	}
+	for _, test := range tests {
+		if got := test.opt.offlineText("Room 1"); got != test.want {
+			t.Errorf("offlineText() = %q, want %q", got, test.want)
+		}
+	}
+}
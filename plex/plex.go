@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"plex-tuner/plex/tv"
 	"runtime"
 	"sync"
 )
@@ -16,6 +17,7 @@ const Version = "1.0.5"
 
 type Plex struct {
 	config *Config
+	env    *tv.Env
 	ctx    context.Context
 	cancel context.CancelFunc
 
@@ -64,6 +66,20 @@ func (p *Plex) Serve(ctx context.Context) error {
 		p.logWriter = logFile
 	}
 	p.logger = log.New(p.logWriter, "plex-tuner", log.LstdFlags)
+	p.env = &tv.Env{
+		FFMpeg:            p.config.FFMpeg,
+		Logger:            p.logger,
+		TranscodeProfiles: p.config.TranscodeProfiles,
+		Commands:          p.config.Commands,
+		Slate:             p.config.Slate,
+	}
+	bilibili.SetSESSDATA(p.config.Bilibili.SESSDATA)
+	if p.config.RTMP.Listen != "" {
+		p.servePush()
+	}
+	if p.config.Channel != "" {
+		go p.refreshProviders(p.ctx)
+	}
 	p.server = &http.Server{
 		Addr:     p.config.Listen,
 		Handler:  p.newHttpHandler(),
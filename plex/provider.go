@@ -0,0 +1,235 @@
+package plex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"plex-tuner/plex/tv"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 导入的频道默认的重新导入间隔
+	providerRefresh = 10 * time.Minute
+	// 后台检查频道来源是否需要重新导入的间隔
+	providerCheckInterval = time.Minute
+	// 后台重新导入一个来源的超时，避免无响应的服务阻塞之后的导入
+	providerRefreshTimeout = time.Minute
+)
+
+var ErrProviderNoChannels = errors.New("provider: no channels")
+
+// channelProvider 频道列表中的一种条目类型，加载时展开为远程设备或服务提供的频道
+type channelProvider func(ctx context.Context, entry *Channel, opt ProviderOptions) ([]*Channel, error)
+
+var channelProviders = map[string]channelProvider{
+	"tuner":  loadTunerChannels,
+	"xtream": loadXtreamChannels,
+}
+
+// ProviderOptions 所有频道来源通用的选项
+type ProviderOptions struct {
+	// Prefix 导入的频道id的前缀，用于区分不同来源的同号频道
+	Prefix string `json:"prefix"`
+	// Filter 正则表达式，只导入id、名称或分组匹配的频道
+	Filter string `json:"filter"`
+	// Refresh 重新导入频道的间隔，单位秒，默认600
+	Refresh int `json:"refresh"`
+	// TunerCount tuner来源的调谐器数量，默认使用远程设备的数量
+	TunerCount int `json:"tuner_count"`
+}
+
+type providerCache struct {
+	channels []*Channel
+	loadedAt time.Time
+}
+
+var (
+	providerCacheLock = new(sync.Mutex)
+	providerCaches    = make(map[string]*providerCache)
+)
+
+// expandChannels 将频道来源条目展开为其提供的频道，导入失败时沿用上次的结果
+func (p *Plex) expandChannels(ctx context.Context, channels []*Channel) []*Channel {
+	list := make([]*Channel, 0, len(channels))
+	for _, entry := range channels {
+		provider, ok := channelProviders[entry.Type]
+		if !ok {
+			list = append(list, entry)
+			continue
+		}
+		imported, err := loadProviderChannels(ctx, provider, entry)
+		if err != nil {
+			p.logger.Printf("[provider %s] %v", entry.Type+" "+entry.URL, err)
+		}
+		list = append(list, imported...)
+	}
+	return list
+}
+
+// loadProviderChannels 返回来源导入的频道，已导入过时直接使用缓存，由后台定时重新导入
+func loadProviderChannels(ctx context.Context, provider channelProvider, entry *Channel) ([]*Channel, error) {
+	providerCacheLock.Lock()
+	cache, ok := providerCaches[providerKey(entry)]
+	providerCacheLock.Unlock()
+	if ok {
+		return copyChannels(cache.channels), nil
+	}
+	return refreshProvider(ctx, provider, entry)
+}
+
+// refreshProvider 重新导入来源的频道，失败时沿用上次的结果
+func refreshProvider(ctx context.Context, provider channelProvider, entry *Channel) ([]*Channel, error) {
+	opt, err := providerOptions(entry)
+	if err != nil {
+		return nil, err
+	}
+	key := providerKey(entry)
+	channels, err := provider(ctx, entry, opt)
+	if err == nil {
+		channels, err = filterChannels(channels, opt)
+	}
+	if err != nil {
+		providerCacheLock.Lock()
+		cache, ok := providerCaches[key]
+		providerCacheLock.Unlock()
+		if ok {
+			return copyChannels(cache.channels), err
+		}
+		return nil, err
+	}
+	providerCacheLock.Lock()
+	providerCaches[key] = &providerCache{channels: channels, loadedAt: time.Now()}
+	providerCacheLock.Unlock()
+	return copyChannels(channels), nil
+}
+
+// refreshProviders 在后台按每个来源的refresh间隔重新导入频道，直到ctx结束
+func (p *Plex) refreshProviders(ctx context.Context) {
+	ticker := time.NewTicker(providerCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		channels, err := getChannel(p.config.Channel)
+		if err != nil {
+			p.logger.Printf("[provider] %v", err)
+			continue
+		}
+		for _, entry := range channels {
+			provider, ok := channelProviders[entry.Type]
+			if !ok || !providerExpired(entry) {
+				continue
+			}
+			refreshCtx, cancel := context.WithTimeout(ctx, providerRefreshTimeout)
+			_, err = refreshProvider(refreshCtx, provider, entry)
+			cancel()
+			if err != nil {
+				p.logger.Printf("[provider %s] %v", entry.Type+" "+entry.URL, err)
+			}
+		}
+	}
+}
+
+// providerExpired 来源还没有导入过，或者距上次导入已超过refresh间隔
+func providerExpired(entry *Channel) bool {
+	refresh := providerRefresh
+	if opt, err := providerOptions(entry); err == nil && opt.Refresh > 0 {
+		refresh = time.Duration(opt.Refresh) * time.Second
+	}
+	providerCacheLock.Lock()
+	defer providerCacheLock.Unlock()
+	cache, ok := providerCaches[providerKey(entry)]
+	return !ok || time.Since(cache.loadedAt) >= refresh
+}
+
+func providerOptions(entry *Channel) (ProviderOptions, error) {
+	opt := ProviderOptions{}
+	if len(entry.Options) > 0 {
+		if err := json.Unmarshal(entry.Options, &opt); err != nil {
+			return opt, err
+		}
+	}
+	return opt, nil
+}
+
+func providerKey(entry *Channel) string {
+	return entry.Type + "-" + entry.URL + "-" + string(entry.Options)
+}
+
+// filterChannels 按filter筛选频道并给id加上前缀
+func filterChannels(channels []*Channel, opt ProviderOptions) ([]*Channel, error) {
+	var filter *regexp.Regexp
+	if opt.Filter != "" {
+		var err error
+		if filter, err = regexp.Compile(opt.Filter); err != nil {
+			return nil, err
+		}
+	}
+	list := make([]*Channel, 0, len(channels))
+	for _, channel := range channels {
+		if filter != nil && !filter.MatchString(channel.Id) && !filter.MatchString(channel.Name) &&
+			!filter.MatchString(channel.Group) {
+			continue
+		}
+		channel.Id = opt.Prefix + channel.Id
+		list = append(list, channel)
+	}
+	if len(list) == 0 {
+		return nil, ErrProviderNoChannels
+	}
+	return list, nil
+}
+
+// copyChannels 加载频道时会修改频道的状态，每次返回缓存的副本
+func copyChannels(channels []*Channel) []*Channel {
+	list := make([]*Channel, len(channels))
+	for i, channel := range channels {
+		c := *channel
+		list[i] = &c
+	}
+	return list
+}
+
+// loadTunerChannels 导入远程HDHomeRun或plex-tuner的频道，url为设备的地址
+func loadTunerChannels(ctx context.Context, entry *Channel, opt ProviderOptions) ([]*Channel, error) {
+	device := strings.TrimRight(entry.URL, "/")
+	info, lineup, err := tv.FetchTunerLineup(ctx, httpClient, device)
+	if err != nil {
+		return nil, err
+	}
+	tunerCount := opt.TunerCount
+	if tunerCount <= 0 {
+		tunerCount = info.TunerCount
+	}
+	options, err := json.Marshal(tv.TunerOptions{Device: device, TunerCount: tunerCount})
+	if err != nil {
+		return nil, err
+	}
+
+	channels := make([]*Channel, 0, len(lineup))
+	for _, item := range lineup {
+		// 加密的频道无法转发
+		if item.DRM != 0 || item.URL == "" {
+			continue
+		}
+		channels = append(channels, &Channel{
+			Id:      item.GuideNumber,
+			Name:    item.GuideName,
+			URL:     item.URL,
+			Type:    "tuner-stream",
+			Options: options,
+		})
+	}
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrProviderNoChannels, device)
+	}
+	return channels, nil
+}
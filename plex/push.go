@@ -0,0 +1,40 @@
+package plex
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"plex-tuner/plex/tv"
+)
+
+// servePush 启动rtmp推流服务
+func (p *Plex) servePush() {
+	p.env.Push = tv.NewPushServer(p.logger)
+	p.env.Push.Authorize = p.authorizePush
+	go func() {
+		if err := p.env.Push.ListenAndServe(p.config.RTMP.Listen); err != nil {
+			p.logger.Printf("[push] %v", err)
+		}
+	}()
+}
+
+// authorizePush 推流码需要对应一个push类型的频道，频道配置了密码时还需要校验密码
+func (p *Plex) authorizePush(key string, password string) error {
+	channels, err := getChannel(p.config.Channel)
+	if err != nil {
+		return err
+	}
+	for _, channel := range channels {
+		if channel.Type != "push" || channel.URL != key {
+			continue
+		}
+		opt := tv.PushOptions{}
+		if err = channel.source().DecodeOptions(&opt); err != nil {
+			return err
+		}
+		if opt.Password != "" && subtle.ConstantTimeCompare([]byte(opt.Password), []byte(password)) != 1 {
+			return fmt.Errorf("%w: %s", tv.ErrPushUnauthorized, key)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s", tv.ErrPushInvalidKey, key)
+}
@@ -3,84 +3,174 @@ package plex
 import (
 	"errors"
 	"io"
-	"net/url"
 	"plex-tuner/myio"
 	"plex-tuner/plex/tv"
+	"time"
 )
 
 type broadcast struct {
+	channel     *Channel
 	source      tv.TVStream
 	piper       *myio.MultiReaderPipe
+	contentType string
 	readerCount int
+	startAt     time.Time
+
+	// ready 源启动完成后关闭，err为启动失败的原因
+	ready chan struct{}
+	err   error
 }
 
-func (p *Plex) getChannelReader(channel *Channel) (reader io.Reader, release func(), err error) {
+func (p *Plex) getChannelReader(channel *Channel) (reader io.Reader, contentType string, release func(), err error) {
+	key := channel.Type + "-" + channel.URL + "-" + string(channel.Options)
 	p.broadcastsLock.Lock()
-	defer p.broadcastsLock.Unlock()
-
-	key := channel.Type + "-" + channel.URL
 	b, exists := p.broadcasts[key]
 	if !exists {
-		b = &broadcast{}
-		b.source, err = p.createTVStream(channel)
-		if err != nil {
-			return
-		}
-		err = b.source.Start()
-		if err != nil {
-			b.source.Close()
-			return
+		b = &broadcast{
+			channel: channel,
+			piper:   myio.NewMultiReaderPipe(),
+			startAt: time.Now(),
+			ready:   make(chan struct{}),
 		}
-		b.piper = myio.NewMultiReaderPipe()
 		p.broadcasts[key] = b
-
-		go func() {
-			defer b.piper.Close()
-			defer b.source.Close()
-			io.Copy(b.piper, b.source)
-		}()
 	}
-
+	// 等待启动的读者也计入，避免启动期间广播被关闭
 	consumer := b.piper.PipeReader()
 	b.readerCount++
-	release = func() {
+	p.broadcastsLock.Unlock()
+
+	// 解析地址、连接及等待第一个数据可能耗时较长，不能持有全局锁，
+	// 同一频道的其他读者等待这次启动的结果
+	if !exists {
+		p.startBroadcast(key, b)
+	}
+	<-b.ready
+	if b.err != nil {
 		consumer.Close()
 		p.broadcastsLock.Lock()
-		defer p.broadcastsLock.Unlock()
+		b.readerCount--
+		p.broadcastsLock.Unlock()
+		return nil, "", nil, b.err
+	}
 
+	release = func() {
+		consumer.Close()
+		p.broadcastsLock.Lock()
 		b.readerCount--
-		if b.readerCount == 0 {
+		last := b.readerCount == 0
+		if last && p.broadcasts[key] == b {
+			delete(p.broadcasts, key)
+		}
+		p.broadcastsLock.Unlock()
+
+		// 关闭源可能要等待子进程退出，不能持有全局锁
+		if last {
 			b.piper.Close()
 			b.source.Close()
+		}
+	}
+	return consumer, b.contentType, release, nil
+}
+
+// startBroadcast 创建并启动广播的源，失败时移除广播
+func (p *Plex) startBroadcast(key string, b *broadcast) {
+	defer close(b.ready)
+	source, err := p.createTVStream(b.channel)
+	if err == nil {
+		if err = source.Start(); err != nil {
+			source.Close()
+		}
+	}
+	if err != nil {
+		b.err = err
+		b.piper.Close()
+		p.broadcastsLock.Lock()
+		if p.broadcasts[key] == b {
 			delete(p.broadcasts, key)
 		}
+		p.broadcastsLock.Unlock()
+		return
 	}
-	return consumer, release, nil
+
+	p.broadcastsLock.Lock()
+	b.source = source
+	b.contentType = getContentType(b.channel, source)
+	p.broadcastsLock.Unlock()
+
+	go func() {
+		defer p.endBroadcast(key, b)
+		var err error
+		if frames, ok := source.(tv.FrameReader); ok {
+			err = copyFrames(b.piper, frames)
+		} else {
+			_, err = io.Copy(b.piper, source)
+		}
+		if err != nil && !errors.Is(err, tv.ErrReadClosedStream) && !errors.Is(err, myio.ErrWriteClosedIO) {
+			p.logger.Printf("[stream %s] %s", b.channel.Id, b.channel.redact(err.Error()))
+		}
+	}()
 }
 
-func (p *Plex) createTVStream(channel *Channel) (tv.TVStream, error) {
-	switch channel.Type {
-	case "proxy":
-		return tv.NewHttpSteam(channel.URL), nil
-	case "hls":
-		playlistUrl, err := url.Parse(channel.URL)
-		if err != nil {
-			return nil, err
+// broadcastStatus 当前所有广播的状态
+func (p *Plex) broadcastStatus() Array {
+	p.broadcastsLock.Lock()
+	defer p.broadcastsLock.Unlock()
+
+	list := Array{}
+	for _, b := range p.broadcasts {
+		// 还在启动的广播没有状态
+		if b.source == nil {
+			continue
 		}
-		return tv.NewHLSStream(playlistUrl), nil
-	case "rtsp":
-		return tv.NewRTSPStream(channel.URL), nil
-	case "bilibili":
-		playlistUrl, err := Bilibili.TS(channel.URL)
+		item := Object{
+			"channel_id":   b.channel.Id,
+			"channel_name": b.channel.Name,
+			"type":         b.channel.Type,
+			"content_type": b.contentType,
+			"readers":      b.readerCount,
+			"start_at":     b.startAt,
+		}
+		if reporter, ok := b.source.(tv.StatusReporter); ok {
+			item["source"] = reporter.Status()
+		}
+		list = append(list, item)
+	}
+	return list
+}
+
+// endBroadcast 源结束后关闭广播，之后的读者会重新创建源
+func (p *Plex) endBroadcast(key string, b *broadcast) {
+	b.piper.Close()
+	b.source.Close()
+
+	p.broadcastsLock.Lock()
+	defer p.broadcastsLock.Unlock()
+	if p.broadcasts[key] == b {
+		delete(p.broadcasts, key)
+	}
+}
+
+// copyFrames 按数据块复制，头部和关键帧会被管道缓存给之后加入的读者
+func copyFrames(piper *myio.MultiReaderPipe, frames tv.FrameReader) error {
+	for {
+		frame, err := frames.ReadFrame()
 		if err != nil {
-			return nil, err
+			return err
+		}
+		switch {
+		case frame.Header:
+			_, err = piper.WriteHeader(frame.Data)
+		case frame.KeyFrame:
+			_, err = piper.WriteKeyFrame(frame.Data)
+		default:
+			_, err = piper.Write(frame.Data)
 		}
-		channelUrl, err := url.Parse(playlistUrl)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		return tv.NewHLSStream(channelUrl), nil
-
 	}
-	return nil, errors.New("unsupport channel type")
+}
+
+func (p *Plex) createTVStream(channel *Channel) (tv.TVStream, error) {
+	return tv.NewStream(p.env, channel.source())
 }
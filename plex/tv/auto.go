@@ -0,0 +1,281 @@
+package tv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/codec/aacparser"
+)
+
+const (
+	// 判断类型时读取的数据长度
+	autoSniffSize = 4096
+	// 判断类型的超时时间
+	autoProbeTimeout = 10 * time.Second
+	// 判断结果的缓存时间
+	autoCacheTTL = time.Hour
+)
+
+// auto类型额外识别的格式，直接转发数据
+const (
+	autoTypeTS  = "ts"
+	autoTypeMP4 = "mp4"
+)
+
+var ErrAutoUnrecognized = errors.New("auto: unrecognized source")
+
+type autoCacheEntry struct {
+	typ        string
+	detectedAt time.Time
+}
+
+var (
+	autoCacheLock = new(sync.Mutex)
+	// autoCache 按频道记录判断出的类型
+	autoCache = make(map[string]autoCacheEntry)
+)
+
+func autoCacheKey(source Source) string {
+	return source.Id + "-" + source.URL
+}
+
+// AutoDetectedType 返回auto类型的频道最近一次判断出的类型，未判断过时为空
+func AutoDetectedType(source Source) string {
+	autoCacheLock.Lock()
+	defer autoCacheLock.Unlock()
+	return autoCache[autoCacheKey(source)].typ
+}
+
+// detectAutoType 判断频道的类型，优先使用缓存
+func detectAutoType(env *Env, source Source) (string, error) {
+	key := autoCacheKey(source)
+	autoCacheLock.Lock()
+	entry, ok := autoCache[key]
+	autoCacheLock.Unlock()
+	if ok && time.Since(entry.detectedAt) < autoCacheTTL {
+		return entry.typ, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), autoProbeTimeout)
+	defer cancel()
+	typ, err := DetectSourceType(ctx, env, source.URL)
+	if err != nil {
+		return "", err
+	}
+	autoCacheLock.Lock()
+	autoCache[key] = autoCacheEntry{typ: typ, detectedAt: time.Now()}
+	autoCacheLock.Unlock()
+	return typ, nil
+}
+
+// forgetAutoType 播放失败时清除缓存，下次播放重新判断
+func forgetAutoType(source Source) {
+	autoCacheLock.Lock()
+	defer autoCacheLock.Unlock()
+	delete(autoCache, autoCacheKey(source))
+}
+
+// DetectSourceType 根据url的协议、开头的数据、Content-Type和扩展名判断源类型，
+// 返回hls、dash、flv、radio、rtsp、udp、rtp、file、ffmpeg，或者直接转发的ts、mp4
+func DetectSourceType(ctx context.Context, env *Env, rawUrl string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+	case "rtsp", "rtsps":
+		return "rtsp", nil
+	case "udp", "rtp":
+		return strings.ToLower(u.Scheme), nil
+	case "", "file":
+		return "file", nil
+	default:
+		// 其余协议交给ffmpeg
+		if env.FFMpeg == "" {
+			return "", fmt.Errorf("%w: %s", ErrAutoUnrecognized, u.Scheme)
+		}
+		return "ffmpeg", nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", rawUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Icy-MetaData", "1")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	if err = checkStatus(resp); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	head := make([]byte, autoSniffSize)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	head = head[:n]
+
+	if typ := sniffSourceType(head); typ != "" {
+		return typ, nil
+	}
+	if resp.Header.Get("icy-name") != "" || resp.Header.Get("icy-metaint") != "" {
+		return "radio", nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if isHTML(head) {
+		return "", fmt.Errorf("%w: html page: %s", ErrAutoUnrecognized, rawUrl)
+	}
+	switch mediaType {
+	case "application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl", "audio/x-mpegurl":
+		return "hls", nil
+	case "application/dash+xml":
+		return "dash", nil
+	case "video/x-flv":
+		return "flv", nil
+	case ContentTypeTS:
+		return autoTypeTS, nil
+	case ContentTypeMP4:
+		return autoTypeMP4, nil
+	case "audio/mpeg", "audio/mp3", "audio/aac", "audio/aacp", "audio/x-aac":
+		return "radio", nil
+	case "text/html":
+		return "", fmt.Errorf("%w: html page: %s", ErrAutoUnrecognized, rawUrl)
+	}
+	switch {
+	case strings.HasSuffix(u.Path, ".m3u8"):
+		return "hls", nil
+	case strings.HasSuffix(u.Path, ".mpd"):
+		return "dash", nil
+	case strings.HasSuffix(u.Path, ".flv"):
+		return "flv", nil
+	}
+	return "", fmt.Errorf("%w: %s %s", ErrAutoUnrecognized, mediaType, rawUrl)
+}
+
+// sniffSourceType 根据开头的数据判断格式，无法判断时返回空
+func sniffSourceType(head []byte) string {
+	text := bytes.TrimLeft(head, "\xef\xbb\xbf \t\r\n")
+	switch {
+	case bytes.HasPrefix(text, []byte("#EXTM3U")):
+		return "hls"
+	case bytes.Contains(head, []byte("<MPD")):
+		return "dash"
+	case bytes.HasPrefix(head, []byte("FLV\x01")):
+		return "flv"
+	case len(head) > 188 && head[0] == 0x47 && head[188] == 0x47:
+		return autoTypeTS
+	case len(head) >= 8 && (string(head[4:8]) == "ftyp" || string(head[4:8]) == "styp" || string(head[4:8]) == "moof"):
+		return autoTypeMP4
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return "radio"
+	}
+	if len(head) >= aacparser.ADTSHeaderLength && head[0] == 0xFF && head[1]&0xF6 == 0xF0 {
+		return "radio"
+	}
+	if _, frameLen, ok := parseMPEGAudioHeader(head); ok {
+		// 检查下一帧的帧头，避免把其他数据误认为mp3
+		if frameLen+mpegAudioHeaderLength > len(head) {
+			return "radio"
+		}
+		if _, _, ok = parseMPEGAudioHeader(head[frameLen:]); ok {
+			return "radio"
+		}
+	}
+	return ""
+}
+
+// isHTML 上游返回的是网页，一般是错误页或登录页
+func isHTML(head []byte) bool {
+	text := bytes.ToLower(bytes.TrimLeft(head, "\xef\xbb\xbf \t\r\n"))
+	return bytes.HasPrefix(text, []byte("<!doctype html")) || bytes.HasPrefix(text, []byte("<html"))
+}
+
+// NewAutoStream 判断频道的类型后按该类型创建流，ts直接转发，mp4转封装为ts
+func NewAutoStream(env *Env, source Source) (TVStream, error) {
+	typ, err := detectAutoType(env, source)
+	if err != nil {
+		return nil, err
+	}
+	s := &AutoStream{source: source, detected: typ}
+	switch typ {
+	case autoTypeTS, autoTypeMP4:
+		s.TVStream, s.contentType = NewHttpSteam(source.URL), ContentTypeTS
+		if typ == autoTypeMP4 {
+			s.TVStream = NewMP4HttpStream(source.URL)
+		}
+		opt := TranscodeOptions{}
+		if err = source.DecodeOptions(&opt); err == nil && opt.Transcode != "" {
+			var profile TranscodeProfile
+			if profile, err = env.TranscodeProfile(opt.Transcode); err == nil {
+				s.TVStream = NewFFMpegPipeStream(env.FFMpeg, s.TVStream, profile, opt.ffmpegOptions(env, source))
+				s.contentType = profile.ContentType()
+			}
+		}
+	default:
+		detected := source
+		detected.Type = typ
+		s.TVStream, err = NewStream(env, detected)
+	}
+	if err != nil {
+		forgetAutoType(source)
+		return nil, err
+	}
+	if _, ok := s.TVStream.(FrameReader); ok {
+		return &autoFrameStream{s}, nil
+	}
+	return s, nil
+}
+
+// AutoStream auto类型的流，播放失败时清除判断结果
+type AutoStream struct {
+	TVStream
+	source      Source
+	detected    string
+	contentType string
+}
+
+func (s *AutoStream) Start() error {
+	err := s.TVStream.Start()
+	if err != nil {
+		forgetAutoType(s.source)
+	}
+	return err
+}
+
+func (s *AutoStream) ContentType() string {
+	if s.contentType != "" {
+		return s.contentType
+	}
+	t, _ := LookupStreamType(s.detected)
+	return StreamContentType(t, s.TVStream)
+}
+
+// Status 判断出的类型及该类型的流的状态
+func (s *AutoStream) Status() any {
+	status := map[string]any{"detected_type": s.detected}
+	if reporter, ok := s.TVStream.(StatusReporter); ok {
+		status["source"] = reporter.Status()
+	}
+	return status
+}
+
+// autoFrameStream 判断出的类型按数据块输出时，保留FrameReader接口
+type autoFrameStream struct {
+	*AutoStream
+}
+
+func (s *autoFrameStream) ReadFrame() (Frame, error) {
+	return s.TVStream.(FrameReader).ReadFrame()
+}
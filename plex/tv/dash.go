@@ -0,0 +1,664 @@
+package tv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+var (
+	ErrDASHInvalidOption    = errors.New("dash: invalid option")
+	ErrDASHNoRepresentation = errors.New("dash: no playable representation")
+)
+
+const (
+	// 没有指定延迟时，直播从倒数第几个分片开始播放
+	dashLiveSegments = 3
+	// mpd刷新的最小间隔
+	dashMinRefresh = 500 * time.Millisecond
+	// 切换period后时间轴在上一帧基础上推进的间隔
+	dashPeriodGap = 40 * time.Millisecond
+)
+
+// DASHOptions dash类型的选项
+type DASHOptions struct {
+	// Quality 在符合限制的表示中选择码率最高(highest，默认)或最低(lowest)的
+	Quality string `json:"quality"`
+	// MaxHeight 视频的最大高度，0为不限制
+	MaxHeight int `json:"max_height"`
+	// MaxBandwidth 视频的最大码率，单位bps，0为不限制
+	MaxBandwidth int `json:"max_bandwidth"`
+	// AudioLanguage 优先选择的音轨语言，如zh、en，没有时使用第一个音轨
+	AudioLanguage string `json:"audio_language"`
+	// LiveDelay 直播时距离最新分片的延迟，单位秒，默认使用mpd的suggestedPresentationDelay，没有时从倒数第3个分片开始
+	LiveDelay int `json:"live_delay"`
+}
+
+// Validate 检查配置是否有效
+func (o DASHOptions) Validate() error {
+	switch o.Quality {
+	case "", "highest", "lowest":
+	default:
+		return fmt.Errorf("%w: quality %s", ErrDASHInvalidOption, o.Quality)
+	}
+	if o.MaxHeight < 0 || o.MaxBandwidth < 0 || o.LiveDelay < 0 {
+		return fmt.Errorf("%w: negative limit", ErrDASHInvalidOption)
+	}
+	return nil
+}
+
+// better 按Quality判断a是否优于b
+func (o DASHOptions) better(a *dashRepresentation, b *dashRepresentation) bool {
+	if o.Quality == "lowest" {
+		return a.Bandwidth < b.Bandwidth
+	}
+	return a.Bandwidth > b.Bandwidth
+}
+
+// dashKind 返回表示的类型，video或audio，不支持的编码及封装返回空字符串
+func dashKind(set *dashAdaptationSet, rep *dashRepresentation) string {
+	mimeType := rep.MimeType
+	if mimeType == "" {
+		mimeType = set.MimeType
+	}
+	codecs := rep.Codecs
+	if codecs == "" {
+		codecs = set.Codecs
+	}
+	if mimeType != "" && mimeType != "video/mp4" && mimeType != "audio/mp4" {
+		return ""
+	}
+	for _, prefix := range []string{"avc1", "avc3", "hvc1", "hev1"} {
+		if strings.HasPrefix(codecs, prefix) {
+			return "video"
+		}
+	}
+	if strings.HasPrefix(codecs, "mp4a") {
+		return "audio"
+	}
+	if codecs != "" {
+		return ""
+	}
+	// 没有codecs时根据类型判断
+	switch {
+	case set.ContentType == "video" || strings.HasPrefix(mimeType, "video/"):
+		return "video"
+	case set.ContentType == "audio" || strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	}
+	return ""
+}
+
+// dashChoice 选中的一个表示
+type dashChoice struct {
+	set *dashAdaptationSet
+	rep *dashRepresentation
+}
+
+// selectRepresentations 按选项选择一路视频和一路音频，加密的内容会被跳过
+func (o DASHOptions) selectRepresentations(period *dashPeriod) []dashChoice {
+	var video, audio []dashChoice
+	for _, set := range period.AdaptationSets {
+		if len(set.ContentProtections) > 0 {
+			continue
+		}
+		for _, rep := range set.Representations {
+			switch dashKind(set, rep) {
+			case "video":
+				video = append(video, dashChoice{set, rep})
+			case "audio":
+				audio = append(audio, dashChoice{set, rep})
+			}
+		}
+	}
+
+	var choices []dashChoice
+	if len(video) > 0 {
+		var fit []dashChoice
+		for _, c := range video {
+			if (o.MaxHeight == 0 || c.rep.Height <= o.MaxHeight) && (o.MaxBandwidth == 0 || c.rep.Bandwidth <= o.MaxBandwidth) {
+				fit = append(fit, c)
+			}
+		}
+		best := dashChoice{}
+		if len(fit) == 0 {
+			// 都超出限制时使用码率最低的
+			for _, c := range video {
+				if best.rep == nil || c.rep.Bandwidth < best.rep.Bandwidth {
+					best = c
+				}
+			}
+		} else {
+			for _, c := range fit {
+				if best.rep == nil || o.better(c.rep, best.rep) {
+					best = c
+				}
+			}
+		}
+		choices = append(choices, best)
+	}
+	if len(audio) > 0 {
+		if o.AudioLanguage != "" {
+			var matched []dashChoice
+			for _, c := range audio {
+				if strings.HasPrefix(strings.ToLower(c.set.Lang), strings.ToLower(o.AudioLanguage)) {
+					matched = append(matched, c)
+				}
+			}
+			if len(matched) > 0 {
+				audio = matched
+			}
+		}
+		// 只在第一个音轨中选择码率
+		best := dashChoice{}
+		for _, c := range audio {
+			if c.set != audio[0].set {
+				continue
+			}
+			if best.rep == nil || o.better(c.rep, best.rep) {
+				best = c
+			}
+		}
+		choices = append(choices, best)
+	}
+	return choices
+}
+
+// dashTrack 正在下载的一路表示
+type dashTrack struct {
+	choice dashChoice
+	fmp4   []*fmp4Track
+	codec  av.CodecData
+	// pto 表示的presentationTimeOffset
+	pto      time.Duration
+	segments []dashSegment
+	// next 下一个要下载的分片的开始时间
+	next time.Duration
+}
+
+// nextSegment 返回开始于next的分片
+func (t *dashTrack) nextSegment() (dashSegment, bool) {
+	for _, segment := range t.segments {
+		if segment.end > t.next {
+			return segment, true
+		}
+	}
+	return dashSegment{}, false
+}
+
+// dashSample 等待按时间顺序输出的帧
+type dashSample struct {
+	time   time.Duration
+	packet av.Packet
+}
+
+// DASHStream 拉取mpeg-dash直播或点播，下载fmp4分片并转封装为ts。
+// 支持SegmentTemplate的$Number$、$Time$以及SegmentTimeline，视频支持h264、h265，音频支持aac
+type DASHStream struct {
+	mpdUrl *url.URL
+	opt    DASHOptions
+
+	mpd         *dashMPD
+	period      *dashPeriod
+	periodIndex int
+	tracks      []*dashTrack
+	codecs      []av.CodecData
+	buffer      []dashSample
+	// clockOffset 服务器时间与本地时间的差值，来自mpd响应的Date头
+	clockOffset time.Duration
+
+	muxer   *tsMuxer
+	frames  chan Frame
+	pending []byte
+	loopErr error
+
+	started  bool
+	hasVideo bool
+	first    time.Duration
+	timeline timeline
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewDASHStream(mpdUrl *url.URL, opt DASHOptions) *DASHStream {
+	s := &DASHStream{
+		mpdUrl: mpdUrl,
+		opt:    opt,
+		muxer:  newTSMuxer(),
+		frames: make(chan Frame),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// Start 获取mpd并下载初始化分片，选不出可以播放的表示时返回错误
+func (s *DASHStream) Start() error {
+	mpd, err := s.fetchMPD()
+	if err != nil {
+		return err
+	}
+	s.mpd = mpd
+	period := mpd.Periods[0]
+	if mpd.dynamic() {
+		period = mpd.livePeriod(s.now())
+	}
+	if err = s.selectPeriod(period); err != nil {
+		return err
+	}
+	go s.loop()
+	return nil
+}
+
+func (s *DASHStream) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		s.pending = frame.Data
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *DASHStream) ReadFrame() (Frame, error) {
+	select {
+	case frame, ok := <-s.frames:
+		if !ok {
+			if s.loopErr != nil {
+				return Frame{}, s.loopErr
+			}
+			return Frame{}, ErrReadClosedStream
+		}
+		return frame, nil
+	case <-s.ctx.Done():
+		return Frame{}, ErrReadClosedStream
+	}
+}
+
+func (s *DASHStream) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *DASHStream) ContentType() string {
+	return ContentTypeTS
+}
+
+func (s *DASHStream) now() time.Time {
+	return time.Now().Add(s.clockOffset)
+}
+
+// loop 下载已经生成的分片，动态mpd定时刷新，静态mpd播放完所有period后结束
+func (s *DASHStream) loop() {
+	defer close(s.frames)
+	for {
+		if err := s.download(); err != nil {
+			if s.ctx.Err() == nil {
+				s.loopErr = err
+			}
+			return
+		}
+
+		if !s.mpd.dynamic() {
+			if s.periodIndex+1 >= len(s.mpd.Periods) {
+				s.flush(-1)
+				return
+			}
+			s.periodIndex++
+			if s.loopErr = s.switchPeriod(s.mpd.Periods[s.periodIndex]); s.loopErr != nil {
+				return
+			}
+			continue
+		}
+
+		timer := time.NewTimer(s.refreshInterval())
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		mpd, err := s.fetchMPD()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				s.loopErr = err
+			}
+			return
+		}
+		s.mpd = mpd
+		period := mpd.livePeriod(s.now())
+		if period.Id != s.period.Id {
+			err = s.switchPeriod(period)
+		} else {
+			err = s.updateSegments(period)
+		}
+		if err != nil {
+			s.loopErr = err
+			return
+		}
+	}
+}
+
+// refreshInterval 动态mpd的刷新间隔，没有minimumUpdatePeriod时使用最后一个分片的时长
+func (s *DASHStream) refreshInterval() time.Duration {
+	interval := s.mpd.updatePeriod
+	if interval <= 0 {
+		segments := s.tracks[0].segments
+		if len(segments) > 0 {
+			last := segments[len(segments)-1]
+			interval = last.end - last.start
+		}
+	}
+	if interval < dashMinRefresh {
+		interval = dashMinRefresh
+	}
+	return interval
+}
+
+// switchPeriod 输出完缓存的帧后切换到新的period，时间戳保持连续
+func (s *DASHStream) switchPeriod(period *dashPeriod) error {
+	s.flush(-1)
+	s.started = false
+	s.timeline.advance(dashPeriodGap)
+	return s.selectPeriod(period)
+}
+
+// selectPeriod 选择period中的表示，下载初始化分片，并确定开始播放的位置
+func (s *DASHStream) selectPeriod(period *dashPeriod) error {
+	choices := s.opt.selectRepresentations(period)
+	if len(choices) == 0 {
+		return ErrDASHNoRepresentation
+	}
+	s.period = period
+	s.tracks = nil
+	s.codecs = nil
+	s.hasVideo = false
+	for _, choice := range choices {
+		track, err := s.loadTrack(period, choice)
+		if err != nil {
+			return err
+		}
+		s.tracks = append(s.tracks, track)
+		s.codecs = append(s.codecs, track.codec)
+		if track.codec.Type().IsVideo() {
+			s.hasVideo = true
+		}
+	}
+	if err := s.updateSegments(period); err != nil {
+		return err
+	}
+
+	// 静态mpd从头播放，直播从距离最新分片一定延迟的位置开始
+	reference := s.tracks[0].segments
+	start := time.Duration(-1 << 62)
+	if s.mpd.dynamic() && len(reference) > 0 {
+		index := len(reference) - dashLiveSegments
+		delay := time.Duration(s.opt.LiveDelay) * time.Second
+		if delay == 0 {
+			delay = s.mpd.presentationDelay
+		}
+		if delay > 0 {
+			edge := reference[len(reference)-1].end - delay
+			for index = len(reference) - 1; index > 0 && reference[index].start > edge; index-- {
+			}
+		}
+		if index < 0 {
+			index = 0
+		}
+		start = reference[index].start
+	}
+	for _, track := range s.tracks {
+		track.next = start
+	}
+	return nil
+}
+
+// loadTrack 下载表示的初始化分片并读取编码信息
+func (s *DASHStream) loadTrack(period *dashPeriod, choice dashChoice) (*dashTrack, error) {
+	template := mergeSegmentTemplate(period.SegmentTemplate, choice.set.SegmentTemplate, choice.rep.SegmentTemplate)
+	if template == nil || template.Media == "" || template.Initialization == "" {
+		return nil, fmt.Errorf("%w: representation %s has no segment template", ErrDASHInvalidMPD, choice.rep.Id)
+	}
+	base, err := resolveBaseURL(s.mpdUrl, s.mpd.BaseURL, period.BaseURL, choice.set.BaseURL, choice.rep.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	initUrl, err := base.Parse(template.expand(template.Initialization, choice.rep, template.startNumber(), 0))
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.fetch(initUrl)
+	if err != nil {
+		return nil, err
+	}
+	fmp4Tracks, err := parseFMP4Init(data)
+	if err != nil {
+		return nil, err
+	}
+
+	track := &dashTrack{
+		choice: choice,
+		pto:    scaleDuration(template.presentationTimeOffset(), template.timescale()),
+	}
+	isVideo := dashKind(choice.set, choice.rep) == "video"
+	for _, t := range fmp4Tracks {
+		if t.codec.Type().IsVideo() == isVideo {
+			track.fmp4 = []*fmp4Track{t}
+			track.codec = t.codec
+			break
+		}
+	}
+	if track.codec == nil {
+		return nil, fmt.Errorf("%w: representation %s", ErrFMP4Unsupported, choice.rep.Id)
+	}
+	return track, nil
+}
+
+// updateSegments 根据最新的mpd更新各路表示的分片列表
+func (s *DASHStream) updateSegments(period *dashPeriod) error {
+	now := s.now()
+	for _, track := range s.tracks {
+		rep := track.choice.rep
+		// 刷新后按表示的id找到对应的表示
+		for _, set := range period.AdaptationSets {
+			for _, r := range set.Representations {
+				if r.Id == rep.Id {
+					track.choice = dashChoice{set, r}
+				}
+			}
+		}
+		template := mergeSegmentTemplate(period.SegmentTemplate, track.choice.set.SegmentTemplate, track.choice.rep.SegmentTemplate)
+		if template == nil {
+			return fmt.Errorf("%w: representation %s has no segment template", ErrDASHInvalidMPD, rep.Id)
+		}
+		base, err := resolveBaseURL(s.mpdUrl, s.mpd.BaseURL, period.BaseURL, track.choice.set.BaseURL, track.choice.rep.BaseURL)
+		if err != nil {
+			return err
+		}
+		segments, err := template.segments(s.mpd, period, track.choice.rep, base, now)
+		if err != nil {
+			return err
+		}
+		track.segments = segments
+	}
+	return nil
+}
+
+// download 总是下载进度最慢的一路的下一个分片，直到它没有可以下载的分片
+func (s *DASHStream) download() error {
+	for {
+		var track *dashTrack
+		for _, t := range s.tracks {
+			if track == nil || t.next < track.next {
+				track = t
+			}
+		}
+		segment, ok := track.nextSegment()
+		if !ok {
+			return nil
+		}
+		data, err := s.fetch(segment.url)
+		if err != nil {
+			var statusErr *StatusError
+			if s.mpd.dynamic() && errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+				// 直播的分片可能已经过期，跳过
+				track.next = segment.end
+				continue
+			}
+			return err
+		}
+		samples, err := parseFMP4Segment(data, track.fmp4)
+		if err != nil {
+			return err
+		}
+
+		idx := int8(0)
+		for i, t := range s.tracks {
+			if t == track {
+				idx = int8(i)
+			}
+		}
+		for _, sample := range samples {
+			composition := scaleDuration(uint64(sample.cts), uint64(sample.track.timescale))
+			if sample.cts < 0 {
+				composition = -scaleDuration(uint64(-sample.cts), uint64(sample.track.timescale))
+			}
+			s.buffer = append(s.buffer, dashSample{
+				time: sample.Time() - track.pto,
+				packet: av.Packet{
+					Idx:             idx,
+					IsKeyFrame:      sample.keyFrame,
+					CompositionTime: composition,
+					Data:            sample.data,
+				},
+			})
+		}
+		track.next = segment.end
+
+		limit := track.next
+		for _, t := range s.tracks {
+			if t.next < limit {
+				limit = t.next
+			}
+		}
+		if err = s.flush(limit); err != nil {
+			return err
+		}
+	}
+}
+
+// flush 按时间顺序输出早于limit的帧，limit为负数时输出全部
+func (s *DASHStream) flush(limit time.Duration) error {
+	sort.SliceStable(s.buffer, func(i, j int) bool {
+		return s.buffer[i].time < s.buffer[j].time
+	})
+	n := 0
+	for ; n < len(s.buffer); n++ {
+		sample := s.buffer[n]
+		if limit >= 0 && sample.time >= limit {
+			break
+		}
+		if err := s.writeSample(sample); err != nil {
+			s.buffer = s.buffer[n+1:]
+			return err
+		}
+	}
+	s.buffer = append(s.buffer[:0], s.buffer[n:]...)
+	return nil
+}
+
+// writeSample 从第一个视频关键帧开始输出，时间戳从0开始
+func (s *DASHStream) writeSample(sample dashSample) error {
+	packet := sample.packet
+	if !s.started {
+		if s.hasVideo && !(packet.IsKeyFrame && s.codecs[packet.Idx].Type().IsVideo()) {
+			return nil
+		}
+		header, err := s.muxer.WriteHeader(s.codecs)
+		if err != nil {
+			return err
+		}
+		if err = s.emit(Frame{Data: header, Header: true}); err != nil {
+			return err
+		}
+		s.started = true
+		s.first = sample.time
+	}
+	packet.Time = sample.time - s.first
+	if packet.Time < 0 {
+		packet.Time = 0
+	}
+	packet.Time = s.timeline.stamp(packet.Time)
+
+	data, keyFrame, err := s.muxer.WritePacket(packet)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return s.emit(Frame{Data: data, KeyFrame: keyFrame})
+}
+
+// fetchMPD 获取并解析mpd，同时根据响应的Date头校准时钟
+func (s *DASHStream) fetchMPD() (mpd *dashMPD, err error) {
+	err = tryTimes(s.ctx, 3, func() error {
+		request, err := http.NewRequestWithContext(s.ctx, "GET", s.mpdUrl.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		if err = checkStatus(resp); err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if mpd, err = parseMPD(data); err != nil {
+			return err
+		}
+		if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+			s.clockOffset = time.Until(date)
+			// Date头只精确到秒，误差较小时使用本地时间
+			if s.clockOffset > -2*time.Second && s.clockOffset < 2*time.Second {
+				s.clockOffset = 0
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (s *DASHStream) fetch(u *url.URL) (data []byte, err error) {
+	err = tryTimes(s.ctx, 3, func() error {
+		data, err = fetchMapData(s.ctx, u.String())
+		return err
+	})
+	return
+}
+
+func (s *DASHStream) emit(frame Frame) error {
+	select {
+	case s.frames <- frame:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
@@ -0,0 +1,425 @@
+package tv
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrDASHInvalidMPD = errors.New("dash: invalid mpd")
+
+// 动态mpd没有timeShiftBufferDepth时，按编号计算分片时最多回看的时长
+const dashDefaultTimeShift = time.Minute
+
+type dashMPD struct {
+	Type                       string        `xml:"type,attr"`
+	AvailabilityStartTime      string        `xml:"availabilityStartTime,attr"`
+	MediaPresentationDuration  string        `xml:"mediaPresentationDuration,attr"`
+	MinimumUpdatePeriod        string        `xml:"minimumUpdatePeriod,attr"`
+	TimeShiftBufferDepth       string        `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string        `xml:"suggestedPresentationDelay,attr"`
+	BaseURL                    []string      `xml:"BaseURL"`
+	Periods                    []*dashPeriod `xml:"Period"`
+
+	// 以下字段由parseMPD填充
+	availabilityStart time.Time
+	duration          time.Duration
+	updatePeriod      time.Duration
+	timeShift         time.Duration
+	presentationDelay time.Duration
+}
+
+type dashPeriod struct {
+	Id              string               `xml:"id,attr"`
+	Start           string               `xml:"start,attr"`
+	Duration        string               `xml:"duration,attr"`
+	BaseURL         []string             `xml:"BaseURL"`
+	SegmentTemplate *dashSegmentTemplate `xml:"SegmentTemplate"`
+	AdaptationSets  []*dashAdaptationSet `xml:"AdaptationSet"`
+
+	start    time.Duration
+	duration time.Duration
+}
+
+type dashAdaptationSet struct {
+	Id                 string                `xml:"id,attr"`
+	ContentType        string                `xml:"contentType,attr"`
+	MimeType           string                `xml:"mimeType,attr"`
+	Codecs             string                `xml:"codecs,attr"`
+	Lang               string                `xml:"lang,attr"`
+	BaseURL            []string              `xml:"BaseURL"`
+	ContentProtections []struct{}            `xml:"ContentProtection"`
+	SegmentTemplate    *dashSegmentTemplate  `xml:"SegmentTemplate"`
+	Representations    []*dashRepresentation `xml:"Representation"`
+}
+
+type dashRepresentation struct {
+	Id              string               `xml:"id,attr"`
+	Bandwidth       int                  `xml:"bandwidth,attr"`
+	Width           int                  `xml:"width,attr"`
+	Height          int                  `xml:"height,attr"`
+	MimeType        string               `xml:"mimeType,attr"`
+	Codecs          string               `xml:"codecs,attr"`
+	BaseURL         []string             `xml:"BaseURL"`
+	SegmentTemplate *dashSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type dashSegmentTemplate struct {
+	Media                  string               `xml:"media,attr"`
+	Initialization         string               `xml:"initialization,attr"`
+	Timescale              *uint64              `xml:"timescale,attr"`
+	Duration               *uint64              `xml:"duration,attr"`
+	StartNumber            *uint64              `xml:"startNumber,attr"`
+	PresentationTimeOffset *uint64              `xml:"presentationTimeOffset,attr"`
+	SegmentTimeline        *dashSegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type dashSegmentTimeline struct {
+	S []struct {
+		T *uint64 `xml:"t,attr"`
+		D uint64  `xml:"d,attr"`
+		R int64   `xml:"r,attr"`
+	} `xml:"S"`
+}
+
+// dashSegment 一个媒体分片，时间为相对于period开始的展示时间
+type dashSegment struct {
+	url   *url.URL
+	start time.Duration
+	end   time.Duration
+}
+
+// parseMPD 解析mpd并计算各个period的开始时间
+func parseMPD(data []byte) (*dashMPD, error) {
+	mpd := new(dashMPD)
+	if err := xml.Unmarshal(data, mpd); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDASHInvalidMPD, err)
+	}
+	if len(mpd.Periods) == 0 {
+		return nil, fmt.Errorf("%w: no period", ErrDASHInvalidMPD)
+	}
+	var err error
+	if mpd.AvailabilityStartTime != "" {
+		if mpd.availabilityStart, err = time.Parse(time.RFC3339, mpd.AvailabilityStartTime); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDASHInvalidMPD, err)
+		}
+	}
+	for _, field := range []struct {
+		value string
+		to    *time.Duration
+	}{
+		{mpd.MediaPresentationDuration, &mpd.duration},
+		{mpd.MinimumUpdatePeriod, &mpd.updatePeriod},
+		{mpd.TimeShiftBufferDepth, &mpd.timeShift},
+		{mpd.SuggestedPresentationDelay, &mpd.presentationDelay},
+	} {
+		if *field.to, err = parseISODuration(field.value); err != nil {
+			return nil, err
+		}
+	}
+
+	// 没有start的period紧接着上一个period
+	var next time.Duration
+	for _, period := range mpd.Periods {
+		if period.start, err = parseISODuration(period.Start); err != nil {
+			return nil, err
+		}
+		if period.Start == "" {
+			period.start = next
+		}
+		if period.duration, err = parseISODuration(period.Duration); err != nil {
+			return nil, err
+		}
+		next = period.start + period.duration
+	}
+	for i, period := range mpd.Periods {
+		if period.duration != 0 {
+			continue
+		}
+		if i+1 < len(mpd.Periods) {
+			period.duration = mpd.Periods[i+1].start - period.start
+		} else if mpd.duration != 0 {
+			period.duration = mpd.duration - period.start
+		}
+	}
+	return mpd, nil
+}
+
+func (m *dashMPD) dynamic() bool {
+	return m.Type == "dynamic"
+}
+
+// elapsed 直播开始到now经过的时间
+func (m *dashMPD) elapsed(now time.Time) time.Duration {
+	return now.Sub(m.availabilityStart)
+}
+
+// livePeriod 返回动态mpd中正在直播的period
+func (m *dashMPD) livePeriod(now time.Time) *dashPeriod {
+	elapsed := m.elapsed(now)
+	current := m.Periods[0]
+	for _, period := range m.Periods {
+		if period.start <= elapsed {
+			current = period
+		}
+	}
+	return current
+}
+
+// parseISODuration 解析PT1H2M3.5S形式的时长，空字符串返回0
+func parseISODuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	invalid := fmt.Errorf("%w: invalid duration %q", ErrDASHInvalidMPD, s)
+	if !strings.HasPrefix(s, "P") {
+		return 0, invalid
+	}
+	rest := s[1:]
+	var d time.Duration
+	inTime := false
+	for rest != "" {
+		if rest[0] == 'T' {
+			inTime, rest = true, rest[1:]
+			continue
+		}
+		i := strings.IndexAny(rest, "YMWDHS")
+		if i <= 0 {
+			return 0, invalid
+		}
+		value, err := strconv.ParseFloat(rest[:i], 64)
+		if err != nil {
+			return 0, invalid
+		}
+		var unit time.Duration
+		switch {
+		case rest[i] == 'Y' && !inTime:
+			unit = 365 * 24 * time.Hour
+		case rest[i] == 'M' && !inTime:
+			unit = 30 * 24 * time.Hour
+		case rest[i] == 'W' && !inTime:
+			unit = 7 * 24 * time.Hour
+		case rest[i] == 'D' && !inTime:
+			unit = 24 * time.Hour
+		case rest[i] == 'H' && inTime:
+			unit = time.Hour
+		case rest[i] == 'M' && inTime:
+			unit = time.Minute
+		case rest[i] == 'S' && inTime:
+			unit = time.Second
+		default:
+			return 0, invalid
+		}
+		d += time.Duration(value * float64(unit))
+		rest = rest[i+1:]
+	}
+	return d, nil
+}
+
+// resolveBaseURL 依次叠加各层的BaseURL
+func resolveBaseURL(base *url.URL, levels ...[]string) (*url.URL, error) {
+	for _, baseUrls := range levels {
+		if len(baseUrls) == 0 || strings.TrimSpace(baseUrls[0]) == "" {
+			continue
+		}
+		next, err := base.Parse(strings.TrimSpace(baseUrls[0]))
+		if err != nil {
+			return nil, err
+		}
+		base = next
+	}
+	return base, nil
+}
+
+// mergeSegmentTemplate 合并各层的SegmentTemplate，下层的属性覆盖上层
+func mergeSegmentTemplate(templates ...*dashSegmentTemplate) *dashSegmentTemplate {
+	var merged *dashSegmentTemplate
+	for _, t := range templates {
+		if t == nil {
+			continue
+		}
+		if merged == nil {
+			merged = new(dashSegmentTemplate)
+		}
+		if t.Media != "" {
+			merged.Media = t.Media
+		}
+		if t.Initialization != "" {
+			merged.Initialization = t.Initialization
+		}
+		if t.Timescale != nil {
+			merged.Timescale = t.Timescale
+		}
+		if t.Duration != nil {
+			merged.Duration = t.Duration
+		}
+		if t.StartNumber != nil {
+			merged.StartNumber = t.StartNumber
+		}
+		if t.PresentationTimeOffset != nil {
+			merged.PresentationTimeOffset = t.PresentationTimeOffset
+		}
+		if t.SegmentTimeline != nil {
+			merged.SegmentTimeline = t.SegmentTimeline
+		}
+	}
+	return merged
+}
+
+func (t *dashSegmentTemplate) timescale() uint64 {
+	if t.Timescale == nil || *t.Timescale == 0 {
+		return 1
+	}
+	return *t.Timescale
+}
+
+func (t *dashSegmentTemplate) startNumber() uint64 {
+	if t.StartNumber == nil {
+		return 1
+	}
+	return *t.StartNumber
+}
+
+func (t *dashSegmentTemplate) presentationTimeOffset() uint64 {
+	if t.PresentationTimeOffset == nil {
+		return 0
+	}
+	return *t.PresentationTimeOffset
+}
+
+// expand 替换模板中的$RepresentationID$、$Number$、$Time$、$Bandwidth$，支持%05d形式的宽度
+func (t *dashSegmentTemplate) expand(tpl string, rep *dashRepresentation, number uint64, time uint64) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(tpl, '$')
+		if start < 0 {
+			b.WriteString(tpl)
+			return b.String()
+		}
+		end := strings.IndexByte(tpl[start+1:], '$')
+		if end < 0 {
+			b.WriteString(tpl)
+			return b.String()
+		}
+		end += start + 1
+		b.WriteString(tpl[:start])
+		name, format, _ := strings.Cut(tpl[start+1:end], "%")
+		if format == "" {
+			format = "d"
+		}
+		switch name {
+		case "":
+			b.WriteByte('$')
+		case "RepresentationID":
+			b.WriteString(rep.Id)
+		case "Number":
+			b.WriteString(fmt.Sprintf("%"+format, number))
+		case "Time":
+			b.WriteString(fmt.Sprintf("%"+format, time))
+		case "Bandwidth":
+			b.WriteString(fmt.Sprintf("%"+format, rep.Bandwidth))
+		default:
+			b.WriteString(tpl[start : end+1])
+		}
+		tpl = tpl[end+1:]
+	}
+}
+
+// segments 列出当前可以下载的分片，动态mpd按编号计算时只包含now之前已经生成且在时移窗口内的分片
+func (t *dashSegmentTemplate) segments(mpd *dashMPD, period *dashPeriod, rep *dashRepresentation, base *url.URL, now time.Time) ([]dashSegment, error) {
+	timescale := t.timescale()
+	pto := t.presentationTimeOffset()
+	// available 为period内已经生成完的时长，静态mpd为period的时长
+	available := period.duration
+	if mpd.dynamic() {
+		available = mpd.elapsed(now) - period.start
+		if period.duration != 0 && available > period.duration {
+			available = period.duration
+		}
+	}
+	timeShift := mpd.timeShift
+	if timeShift == 0 {
+		timeShift = dashDefaultTimeShift
+	}
+
+	var segments []dashSegment
+	add := func(number uint64, ticks uint64, duration uint64) error {
+		start := scaleDuration(ticks-pto, timescale)
+		if ticks < pto {
+			start = -scaleDuration(pto-ticks, timescale)
+		}
+		end := start + scaleDuration(duration, timescale)
+		segmentUrl, err := base.Parse(t.expand(t.Media, rep, number, ticks))
+		if err != nil {
+			return err
+		}
+		segments = append(segments, dashSegment{url: segmentUrl, start: start, end: end})
+		return nil
+	}
+
+	number := t.startNumber()
+	if t.SegmentTimeline != nil {
+		entries := t.SegmentTimeline.S
+		var ticks uint64
+		for i, s := range entries {
+			if s.T != nil {
+				ticks = *s.T
+			}
+			if s.D == 0 {
+				return nil, fmt.Errorf("%w: zero segment duration", ErrDASHInvalidMPD)
+			}
+			repeat := s.R
+			if repeat < 0 {
+				// r为-1时重复到下一个S的开始、period结束或者当前时间
+				switch {
+				case i+1 < len(entries) && entries[i+1].T != nil:
+					repeat = int64((*entries[i+1].T-ticks)/s.D) - 1
+				case available > 0:
+					limit := pto + uint64(available/time.Second)*timescale + uint64(available%time.Second)*timescale/uint64(time.Second)
+					if limit > ticks {
+						repeat = int64((limit-ticks)/s.D) - 1
+						// 静态mpd的最后一个分片可以超出period的结束时间
+						if !mpd.dynamic() && (limit-ticks)%s.D != 0 {
+							repeat++
+						}
+					}
+				}
+			}
+			for j := int64(0); j <= repeat; j++ {
+				if err := add(number, ticks, s.D); err != nil {
+					return nil, err
+				}
+				number++
+				ticks += s.D
+			}
+		}
+	} else if t.Duration != nil && *t.Duration > 0 {
+		duration := *t.Duration
+		segmentDuration := scaleDuration(duration, timescale)
+		count := uint64(0)
+		if available > 0 {
+			count = uint64(available / segmentDuration)
+			if !mpd.dynamic() && available%segmentDuration != 0 {
+				count++
+			}
+		}
+		first := uint64(0)
+		if mpd.dynamic() {
+			if window := uint64(timeShift / segmentDuration); count > window {
+				first = count - window
+			}
+		}
+		for i := first; i < count; i++ {
+			if err := add(number+i, pto+i*duration, duration); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		return nil, fmt.Errorf("%w: segment template without duration or timeline", ErrDASHInvalidMPD)
+	}
+	return segments, nil
+}
@@ -0,0 +1,285 @@
+package tv
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseISODuration(t *testing.T) {
+	tests := []struct {
+		input string
+		want  time.Duration
+		err   bool
+	}{
+		{"", 0, false},
+		{"PT0S", 0, false},
+		{"PT1H2M3.5S", time.Hour + 2*time.Minute + 3500*time.Millisecond, false},
+		{"PT30M", 30 * time.Minute, false},
+		{"P1DT12H", 36 * time.Hour, false},
+		{"P1W", 7 * 24 * time.Hour, false},
+		{"PT1.92S", 1920 * time.Millisecond, false},
+		{"1H", 0, true},
+		{"PT1D", 0, true},
+		{"P1S", 0, true},
+		{"PTxS", 0, true},
+		{"PT5", 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseISODuration(test.input)
+		if test.err {
+			if !errors.Is(err, ErrDASHInvalidMPD) {
+				t.Errorf("parseISODuration(%q) = %v, %v, want ErrDASHInvalidMPD", test.input, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseISODuration(%q) = %v, %v, want %v", test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestParseMPDPeriods(t *testing.T) {
+	mpd, err := parseMPD([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT1M">
+  <Period id="p0" duration="PT10S"/>
+  <Period id="p1"/>
+  <Period id="p2" start="PT40S"/>
+</MPD>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有start的period紧接着上一个，没有duration的period到下一个period或整个节目结束
+	want := [][2]time.Duration{{0, 10 * time.Second}, {10 * time.Second, 30 * time.Second}, {40 * time.Second, 20 * time.Second}}
+	for i, period := range mpd.Periods {
+		if got := [2]time.Duration{period.start, period.duration}; got != want[i] {
+			t.Errorf("period %s start, duration = %v, want %v", period.Id, got, want[i])
+		}
+	}
+
+	mpd, err = parseMPD([]byte(`<MPD type="dynamic" availabilityStartTime="2023-05-01T12:00:00Z" timeShiftBufferDepth="PT30S" minimumUpdatePeriod="PT2S">
+  <Period id="a" start="PT0S"/>
+  <Period id="b" start="PT1H"/>
+</MPD>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	if !mpd.dynamic() || !mpd.availabilityStart.Equal(start) || mpd.timeShift != 30*time.Second || mpd.updatePeriod != 2*time.Second {
+		t.Errorf("mpd = %+v", mpd)
+	}
+	if p := mpd.livePeriod(start.Add(30 * time.Minute)); p.Id != "a" {
+		t.Errorf("live period = %s, want a", p.Id)
+	}
+	if p := mpd.livePeriod(start.Add(90 * time.Minute)); p.Id != "b" {
+		t.Errorf("live period = %s, want b", p.Id)
+	}
+
+	for _, data := range []string{
+		`<MPD type="static"></MPD>`,
+		`<MPD type="static" mediaPresentationDuration="1M"><Period/></MPD>`,
+		`<MPD type="dynamic" availabilityStartTime="yesterday"><Period/></MPD>`,
+		`<MPD`,
+	} {
+		if _, err := parseMPD([]byte(data)); !errors.Is(err, ErrDASHInvalidMPD) {
+			t.Errorf("parseMPD(%q) error = %v", data, err)
+		}
+	}
+}
+
+func TestDASHTemplateExpand(t *testing.T) {
+	rep := &dashRepresentation{Id: "video=1500", Bandwidth: 1500000}
+	tpl := new(dashSegmentTemplate)
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"$RepresentationID$/seg-$Number$.m4s", "video=1500/seg-42.m4s"},
+		{"seg-$Number%05d$.m4s", "seg-00042.m4s"},
+		{"$Bandwidth$/$Time$.m4s", "1500000/900000.m4s"},
+		{"t$Time%012d$.mp4", "t000000900000.mp4"},
+		{"price$$5-$Number$", "price$5-42"},
+		// 不认识的标识符和不成对的$原样保留
+		{"$Unknown$-$Number$", "$Unknown$-42"},
+		{"init$Number", "init$Number"},
+		{"init.mp4", "init.mp4"},
+	}
+	for _, test := range tests {
+		if got := tpl.expand(test.template, rep, 42, 900000); got != test.want {
+			t.Errorf("expand(%q) = %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func uint64Ptr(v uint64) *uint64 {
+	return &v
+}
+
+// dashSegmentSummary 把分片列表转换为"路径 开始-结束"的形式
+func dashSegmentSummary(segments []dashSegment) []string {
+	var summary []string
+	for _, s := range segments {
+		summary = append(summary, fmt.Sprintf("%s %v-%v", s.url.Path, s.start, s.end))
+	}
+	return summary
+}
+
+func TestDASHSegmentsNumber(t *testing.T) {
+	base, _ := url.Parse("http://cdn.example.com/live/")
+	rep := &dashRepresentation{Id: "v1"}
+	tpl := &dashSegmentTemplate{Media: "$RepresentationID$/$Number%03d$.m4s", Timescale: uint64Ptr(1000), Duration: uint64Ptr(4000), StartNumber: uint64Ptr(5)}
+
+	// 静态mpd最后一个分片不完整时也要包含
+	static := &dashMPD{Type: "static"}
+	segments, err := tpl.segments(static, &dashPeriod{duration: 10 * time.Second}, rep, base, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/live/v1/005.m4s 0s-4s", "/live/v1/006.m4s 4s-8s", "/live/v1/007.m4s 8s-12s"}
+	if got := dashSegmentSummary(segments); !reflect.DeepEqual(got, want) {
+		t.Errorf("static segments = %v, want %v", got, want)
+	}
+
+	// 动态mpd只包含已经生成完的分片，并且只保留时移窗口内的
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	dynamic := &dashMPD{Type: "dynamic", availabilityStart: start, timeShift: 10 * time.Second}
+	segments, err = tpl.segments(dynamic, &dashPeriod{start: 20 * time.Second}, rep, base, start.Add(43*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 已经生成5个分片，10秒的窗口内保留最后2个
+	want = []string{"/live/v1/008.m4s 12s-16s", "/live/v1/009.m4s 16s-20s"}
+	if got := dashSegmentSummary(segments); !reflect.DeepEqual(got, want) {
+		t.Errorf("dynamic segments = %v, want %v", got, want)
+	}
+
+	// 直播还没有到period的开始
+	if segments, err = tpl.segments(dynamic, &dashPeriod{start: time.Hour}, rep, base, start.Add(time.Minute)); err != nil || len(segments) != 0 {
+		t.Errorf("future period segments = %v, %v", dashSegmentSummary(segments), err)
+	}
+
+	if _, err = (&dashSegmentTemplate{Media: "$Number$"}).segments(static, &dashPeriod{duration: time.Second}, rep, base, time.Time{}); !errors.Is(err, ErrDASHInvalidMPD) {
+		t.Errorf("template without duration error = %v", err)
+	}
+}
+
+func TestDASHSegmentsTimeline(t *testing.T) {
+	base, _ := url.Parse("http://cdn.example.com/vod/manifest.mpd")
+	rep := &dashRepresentation{Id: "a1"}
+	parse := func(t *testing.T, timeline string) *dashSegmentTemplate {
+		t.Helper()
+		mpd, err := parseMPD([]byte(`<MPD type="static"><Period duration="PT20S"><AdaptationSet><Representation id="a1">
+<SegmentTemplate media="$RepresentationID$/$Time$.m4s" timescale="1000" presentationTimeOffset="1000"><SegmentTimeline>` + timeline + `</SegmentTimeline></SegmentTemplate>
+</Representation></AdaptationSet></Period></MPD>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mpd.Periods[0].AdaptationSets[0].Representations[0].SegmentTemplate
+	}
+	static := &dashMPD{Type: "static"}
+	period := &dashPeriod{duration: 9 * time.Second}
+
+	tests := []struct {
+		name     string
+		timeline string
+		want     []string
+	}{
+		{
+			// 没有t的S紧接着上一个分片，时间减去presentationTimeOffset
+			name:     "repeat and implicit time",
+			timeline: `<S t="1000" d="2000" r="2"/><S d="1000"/>`,
+			want:     []string{"/vod/a1/1000.m4s 0s-2s", "/vod/a1/3000.m4s 2s-4s", "/vod/a1/5000.m4s 4s-6s", "/vod/a1/7000.m4s 6s-7s"},
+		},
+		{
+			name:     "repeat until next S",
+			timeline: `<S t="1000" d="2000" r="-1"/><S t="7000" d="3000"/>`,
+			want:     []string{"/vod/a1/1000.m4s 0s-2s", "/vod/a1/3000.m4s 2s-4s", "/vod/a1/5000.m4s 4s-6s", "/vod/a1/7000.m4s 6s-9s"},
+		},
+		{
+			// 重复到period结束，最后一个分片超出结束时间
+			name:     "repeat until period end",
+			timeline: `<S t="1000" d="4000" r="-1"/>`,
+			want:     []string{"/vod/a1/1000.m4s 0s-4s", "/vod/a1/5000.m4s 4s-8s", "/vod/a1/9000.m4s 8s-12s"},
+		},
+		{
+			name:     "time before presentation offset",
+			timeline: `<S t="0" d="2000"/>`,
+			want:     []string{"/vod/a1/0.m4s -1s-1s"},
+		},
+	}
+	for _, test := range tests {
+		segments, err := parse(t, test.timeline).segments(static, period, rep, base, time.Time{})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := dashSegmentSummary(segments); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: segments = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// 动态mpd重复到当前时间，不包含还没生成完的分片
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	dynamic := &dashMPD{Type: "dynamic", availabilityStart: start}
+	segments, err := parse(t, `<S t="1000" d="2000" r="-1"/>`).segments(dynamic, &dashPeriod{}, rep, base, start.Add(7*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/vod/a1/1000.m4s 0s-2s", "/vod/a1/3000.m4s 2s-4s", "/vod/a1/5000.m4s 4s-6s"}
+	if got := dashSegmentSummary(segments); !reflect.DeepEqual(got, want) {
+		t.Errorf("dynamic segments = %v, want %v", got, want)
+	}
+
+	if _, err = parse(t, `<S t="0" d="0"/>`).segments(static, period, rep, base, time.Time{}); !errors.Is(err, ErrDASHInvalidMPD) {
+		t.Errorf("zero duration error = %v", err)
+	}
+}
+
+func TestMergeSegmentTemplate(t *testing.T) {
+	if mergeSegmentTemplate(nil, nil) != nil {
+		t.Error("merge of nil templates is not nil")
+	}
+	period := &dashSegmentTemplate{Media: "$Number$.m4s", Initialization: "init.mp4", Timescale: uint64Ptr(90000), Duration: uint64Ptr(180000)}
+	adaptation := &dashSegmentTemplate{StartNumber: uint64Ptr(10)}
+	rep := &dashSegmentTemplate{Media: "$RepresentationID$/$Number$.m4s", Timescale: uint64Ptr(48000)}
+
+	merged := mergeSegmentTemplate(period, nil, adaptation, rep)
+	if merged.Media != rep.Media || merged.Initialization != "init.mp4" || merged.timescale() != 48000 ||
+		*merged.Duration != 180000 || merged.startNumber() != 10 || merged.presentationTimeOffset() != 0 {
+		t.Errorf("merged = %+v", merged)
+	}
+	// 合并不修改原来的模板
+	if period.Media != "$Number$.m4s" || *period.Timescale != 90000 {
+		t.Errorf("period template changed: %+v", period)
+	}
+	if tpl := new(dashSegmentTemplate); tpl.timescale() != 1 || tpl.startNumber() != 1 {
+		t.Errorf("defaults = %d, %d", tpl.timescale(), tpl.startNumber())
+	}
+}
+
+func TestResolveBaseURL(t *testing.T) {
+	manifest, _ := url.Parse("http://origin.example.com/live/channel/manifest.mpd?token=1")
+	tests := []struct {
+		levels [][]string
+		want   string
+	}{
+		{nil, manifest.String()},
+		{[][]string{{"http://cdn1.example.com/a/"}, {"dash/"}, nil, {" v1/ "}}, "http://cdn1.example.com/a/dash/v1/"},
+		{[][]string{{""}, {"../other/"}}, "http://origin.example.com/live/other/"},
+		{[][]string{{"dash/"}, {"/root/"}}, "http://origin.example.com/root/"},
+		// 有多个BaseURL时使用第一个
+		{[][]string{{"a/", "b/"}}, "http://origin.example.com/live/channel/a/"},
+	}
+	for _, test := range tests {
+		got, err := resolveBaseURL(manifest, test.levels...)
+		if err != nil || got.String() != test.want {
+			t.Errorf("resolveBaseURL(%q) = %v, %v, want %s", test.levels, got, err, test.want)
+		}
+	}
+	if _, err := resolveBaseURL(manifest, []string{"http://[::1"}); err == nil {
+		t.Error("invalid base url accepted")
+	}
+}
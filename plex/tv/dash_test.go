@@ -0,0 +1,291 @@
+package tv
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/format/ts"
+)
+
+func TestDASHOptionsValidate(t *testing.T) {
+	for _, opt := range []DASHOptions{{}, {Quality: "lowest", MaxHeight: 720, MaxBandwidth: 3000000, LiveDelay: 10}} {
+		if err := opt.Validate(); err != nil {
+			t.Errorf("Validate(%+v) = %v", opt, err)
+		}
+	}
+	for _, opt := range []DASHOptions{{Quality: "best"}, {MaxHeight: -1}, {LiveDelay: -1}} {
+		if err := opt.Validate(); !errors.Is(err, ErrDASHInvalidOption) {
+			t.Errorf("Validate(%+v) = %v, want ErrDASHInvalidOption", opt, err)
+		}
+	}
+}
+
+func TestDASHKind(t *testing.T) {
+	tests := []struct {
+		set  dashAdaptationSet
+		rep  dashRepresentation
+		want string
+	}{
+		{dashAdaptationSet{MimeType: "video/mp4"}, dashRepresentation{Codecs: "avc1.64001f"}, "video"},
+		{dashAdaptationSet{MimeType: "video/mp4", Codecs: "hev1.1.6.L93.B0"}, dashRepresentation{}, "video"},
+		{dashAdaptationSet{}, dashRepresentation{MimeType: "audio/mp4", Codecs: "mp4a.40.2"}, "audio"},
+		// 没有codecs时根据类型判断
+		{dashAdaptationSet{ContentType: "video"}, dashRepresentation{}, "video"},
+		{dashAdaptationSet{MimeType: "audio/mp4"}, dashRepresentation{}, "audio"},
+		{dashAdaptationSet{MimeType: "video/mp4"}, dashRepresentation{Codecs: "vp09.00.10.08"}, ""},
+		{dashAdaptationSet{MimeType: "audio/mp4"}, dashRepresentation{Codecs: "ec-3"}, ""},
+		{dashAdaptationSet{MimeType: "video/webm"}, dashRepresentation{Codecs: "avc1.64001f"}, ""},
+		{dashAdaptationSet{MimeType: "application/mp4", ContentType: "text"}, dashRepresentation{Codecs: "wvtt"}, ""},
+	}
+	for _, test := range tests {
+		if got := dashKind(&test.set, &test.rep); got != test.want {
+			t.Errorf("dashKind(%+v, %+v) = %q, want %q", test.set, test.rep, got, test.want)
+		}
+	}
+}
+
+func TestDASHSelectRepresentations(t *testing.T) {
+	video := &dashAdaptationSet{MimeType: "video/mp4", Codecs: "avc1.64001f", Representations: []*dashRepresentation{
+		{Id: "v720", Bandwidth: 2500000, Height: 720},
+		{Id: "v1080", Bandwidth: 5000000, Height: 1080},
+		{Id: "v360", Bandwidth: 800000, Height: 360},
+	}}
+	encrypted := &dashAdaptationSet{MimeType: "video/mp4", Codecs: "avc1.640032", ContentProtections: []struct{}{{}},
+		Representations: []*dashRepresentation{{Id: "v2160", Bandwidth: 15000000, Height: 2160}}}
+	vp9 := &dashAdaptationSet{MimeType: "video/mp4", Codecs: "vp09.00.40.08", Representations: []*dashRepresentation{{Id: "vp9", Bandwidth: 9000000, Height: 1440}}}
+	english := &dashAdaptationSet{MimeType: "audio/mp4", Codecs: "mp4a.40.2", Lang: "en", Representations: []*dashRepresentation{
+		{Id: "en64", Bandwidth: 64000},
+		{Id: "en128", Bandwidth: 128000},
+	}}
+	chinese := &dashAdaptationSet{MimeType: "audio/mp4", Codecs: "mp4a.40.2", Lang: "zh-Hans", Representations: []*dashRepresentation{
+		{Id: "zh96", Bandwidth: 96000},
+		{Id: "zh192", Bandwidth: 192000},
+	}}
+	period := &dashPeriod{AdaptationSets: []*dashAdaptationSet{encrypted, vp9, video, english, chinese}}
+
+	tests := []struct {
+		name string
+		opt  DASHOptions
+		want []string
+	}{
+		// 默认选择码率最高的视频和第一个音轨中码率最高的音频，跳过加密和不支持的编码
+		{"default", DASHOptions{}, []string{"v1080", "en128"}},
+		{"lowest", DASHOptions{Quality: "lowest"}, []string{"v360", "en64"}},
+		{"max height", DASHOptions{MaxHeight: 720}, []string{"v720", "en128"}},
+		{"max bandwidth", DASHOptions{MaxBandwidth: 1000000}, []string{"v360", "en128"}},
+		// 都超出限制时使用码率最低的
+		{"all exceed", DASHOptions{MaxHeight: 240}, []string{"v360", "en128"}},
+		{"audio language", DASHOptions{AudioLanguage: "ZH"}, []string{"v1080", "zh192"}},
+		{"missing language", DASHOptions{AudioLanguage: "ja"}, []string{"v1080", "en128"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, choice := range test.opt.selectRepresentations(period) {
+			got = append(got, choice.rep.Id)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: selected %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// 只有音频
+	choices := DASHOptions{}.selectRepresentations(&dashPeriod{AdaptationSets: []*dashAdaptationSet{chinese}})
+	if len(choices) != 1 || choices[0].rep.Id != "zh192" {
+		t.Errorf("audio only choices = %+v", choices)
+	}
+	if choices := (DASHOptions{}).selectRepresentations(&dashPeriod{AdaptationSets: []*dashAdaptationSet{encrypted, vp9}}); len(choices) != 0 {
+		t.Errorf("unplayable choices = %+v", choices)
+	}
+}
+
+// dashTestServer 提供mpd、初始化分片和媒体分片。
+// 视频分片为2秒50帧，路径以编号或t加时间结尾；音频分片为94帧，路径以时间结尾
+type dashTestServer struct {
+	t        *testing.T
+	mpd      string
+	lock     sync.Mutex
+	requests []string
+}
+
+func newDASHTestServer(t *testing.T, mpd string) (*dashTestServer, *url.URL) {
+	s := &dashTestServer{t: t, mpd: mpd}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL + "/dash/manifest.mpd")
+	return s, u
+}
+
+func (s *dashTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.requests = append(s.requests, r.URL.Path)
+	s.lock.Unlock()
+	p := r.URL.Path
+	name := strings.TrimSuffix(p[strings.LastIndex(p, "_")+1:], ".m4s")
+	switch {
+	case p == "/dash/manifest.mpd":
+		w.Header().Set("Content-Type", "application/dash+xml")
+		io.WriteString(w, s.mpd)
+	case strings.HasSuffix(p, "/video-init.mp4"):
+		w.Write(fmp4InitSegment(s.t, 1))
+	case strings.HasSuffix(p, "/audio-init.mp4"):
+		w.Write(fmp4InitSegment(s.t, 2))
+	case strings.Contains(p, "/video_") && strings.HasPrefix(name, "t"):
+		dts, _ := strconv.ParseUint(name[1:], 10, 64)
+		w.Write(fmp4MediaSegment(1, dts, testVideoSamples(50)))
+	case strings.Contains(p, "/video_"):
+		number, _ := strconv.ParseUint(name, 10, 64)
+		w.Write(fmp4MediaSegment(1, (number-1)*180000, testVideoSamples(50)))
+	case strings.Contains(p, "/audio_"):
+		dts, _ := strconv.ParseUint(name, 10, 64)
+		w.Write(fmp4MediaSegment(2, dts, testAudioSamples(94)))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *dashTestServer) paths() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func TestDASHStreamStatic(t *testing.T) {
+	server, mpdUrl := newDASHTestServer(t, `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT6S">
+ <Period>
+  <AdaptationSet mimeType="video/mp4" codecs="avc1.64001e">
+   <SegmentTemplate timescale="90000" initialization="video-init.mp4" media="video_$RepresentationID$_t$Time$.m4s">
+    <SegmentTimeline><S t="0" d="180000" r="2"/></SegmentTimeline>
+   </SegmentTemplate>
+   <Representation id="v" bandwidth="1000000" width="640" height="360"/>
+  </AdaptationSet>
+  <AdaptationSet mimeType="audio/mp4" codecs="mp4a.40.2">
+   <SegmentTemplate timescale="48000" initialization="audio-init.mp4" media="audio_$Time$.m4s">
+    <SegmentTimeline><S t="0" d="96256" r="-1"/></SegmentTimeline>
+   </SegmentTemplate>
+   <Representation id="a" bandwidth="128000"/>
+  </AdaptationSet>
+ </Period>
+</MPD>`)
+	s := NewDASHStream(mpdUrl, DASHOptions{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	codecs, packets, err := demuxTSOutput(t, s)
+	if !errors.Is(err, ErrReadClosedStream) {
+		t.Fatalf("read error = %v, want ErrReadClosedStream", err)
+	}
+	// 3个视频分片，音频重复到period结束共3个分片
+	checkTSOutput(t, codecs, packets, 150, 3*94)
+
+	want := []string{"/dash/video_v_t0.m4s", "/dash/video_v_t180000.m4s", "/dash/video_v_t360000.m4s", "/dash/audio_0.m4s", "/dash/audio_96256.m4s", "/dash/audio_192512.m4s"}
+	requested := strings.Join(server.paths(), " ")
+	for _, path := range want {
+		if !strings.Contains(requested, path) {
+			t.Errorf("%s not requested: %s", path, requested)
+		}
+	}
+}
+
+func TestDASHStreamLive(t *testing.T) {
+	// 时间只精确到秒，直播已经进行20.5到21.5秒
+	start := time.Now().Add(-20500 * time.Millisecond).UTC().Format(time.RFC3339)
+	server, mpdUrl := newDASHTestServer(t, `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" availabilityStartTime="`+start+`" minimumUpdatePeriod="PT2S" timeShiftBufferDepth="PT30S">
+ <Period id="p0" start="PT0S">
+  <BaseURL>live/</BaseURL>
+  <AdaptationSet mimeType="video/mp4" contentType="video">
+   <SegmentTemplate timescale="90000" duration="180000" startNumber="1" initialization="$RepresentationID$/video-init.mp4" media="$RepresentationID$/video_$Number%05d$.m4s"/>
+   <Representation id="v1080" bandwidth="5000000" width="1920" height="1080" codecs="avc1.640028"/>
+   <Representation id="v720" bandwidth="2500000" width="1280" height="720" codecs="avc1.64001f"/>
+  </AdaptationSet>
+  <AdaptationSet mimeType="audio/mp4" lang="de">
+   <SegmentTemplate timescale="48000" initialization="de/audio-init.mp4" media="de/audio_$Time$.m4s"><SegmentTimeline><S t="0" d="96256" r="-1"/></SegmentTimeline></SegmentTemplate>
+   <Representation id="de" bandwidth="128000" codecs="mp4a.40.2"/>
+  </AdaptationSet>
+  <AdaptationSet mimeType="audio/mp4" lang="en">
+   <SegmentTemplate timescale="48000" initialization="en/audio-init.mp4" media="en/audio_$Time$.m4s"><SegmentTimeline><S t="0" d="96256" r="-1"/></SegmentTimeline></SegmentTemplate>
+   <Representation id="en" bandwidth="128000" codecs="mp4a.40.2"/>
+  </AdaptationSet>
+ </Period>
+</MPD>`)
+	s := NewDASHStream(mpdUrl, DASHOptions{MaxHeight: 720, AudioLanguage: "en"})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	timer := time.AfterFunc(10*time.Second, func() { s.Close() })
+	defer timer.Stop()
+
+	demuxer := ts.NewDemuxer(s)
+	codecs, err := demuxer.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var video, audio int
+	var last time.Duration
+	for video < 100 {
+		packet, err := demuxer.ReadPacket()
+		if err != nil {
+			t.Fatalf("got %d video %d audio: %v", video, audio, err)
+		}
+		if !codecs[packet.Idx].Type().IsVideo() {
+			audio++
+			continue
+		}
+		if video == 0 && !packet.IsKeyFrame {
+			t.Fatal("first video frame is not a key frame")
+		}
+		if video > 0 && packet.Time <= last {
+			t.Fatalf("video time %v after %v", packet.Time, last)
+		}
+		last = packet.Time
+		video++
+	}
+	if audio == 0 {
+		t.Error("no audio")
+	}
+
+	paths := server.paths()
+	for _, path := range paths {
+		if strings.Contains(path, "v1080") || strings.Contains(path, "/de/") {
+			t.Errorf("unexpected request %s", path)
+		}
+	}
+	// 已经生成10个分片，从倒数第3个开始播放
+	var first string
+	for _, path := range paths {
+		if strings.Contains(path, "/video_") {
+			first = path
+			break
+		}
+	}
+	if first != "/dash/live/v720/video_00008.m4s" {
+		t.Errorf("first video segment = %s, requests = %v", first, paths)
+	}
+}
+
+func TestDASHStreamNoRepresentation(t *testing.T) {
+	_, mpdUrl := newDASHTestServer(t, `<MPD type="static" mediaPresentationDuration="PT6S"><Period>
+  <AdaptationSet mimeType="video/mp4" codecs="avc1.64001e">
+   <ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cenc"/>
+   <SegmentTemplate timescale="90000" duration="180000" initialization="video-init.mp4" media="video_$Number$.m4s"/>
+   <Representation id="v" bandwidth="1000000"/>
+  </AdaptationSet>
+</Period></MPD>`)
+	s := NewDASHStream(mpdUrl, DASHOptions{})
+	defer s.Close()
+	if err := s.Start(); !errors.Is(err, ErrDASHNoRepresentation) {
+		t.Errorf("Start() error = %v, want ErrDASHNoRepresentation", err)
+	}
+}
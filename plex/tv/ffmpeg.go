@@ -1,40 +1,429 @@
 package tv
 
 import (
+	"context"
+	"errors"
 	"io"
+	"log"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	TranscodeFormatTS  = "ts"
+	TranscodeFormatMP4 = "mp4"
+)
+
+const (
+	// 重启ffmpeg前的等待时间
+	ffmpegRestartDelay = time.Second
+	// 运行超过该时间后重新计算重启次数
+	ffmpegStableDuration = time.Minute
+)
+
+var ErrUnsupportedTranscodeFormat = errors.New("unsupported transcode format")
+
+// TranscodeProfile ffmpeg的转码配置，编码为空且不需要滤镜时直接复制
+type TranscodeProfile struct {
+	// VideoCodec 视频编码器，如libx264、h264_vaapi，默认为copy
+	VideoCodec string `json:"video_codec"`
+	// VideoBitrate 视频码率，如4M
+	VideoBitrate string `json:"video_bitrate"`
+	// Preset 编码器预设，如veryfast
+	Preset string `json:"preset"`
+	// Width 输出宽度，只设置高度时按比例缩放
+	Width int `json:"width"`
+	// Height 输出高度，只设置宽度时按比例缩放
+	Height int `json:"height"`
+	// Deinterlace 反交错
+	Deinterlace bool `json:"deinterlace"`
+	// AudioCodec 音频编码器，如aac，默认为copy
+	AudioCodec string `json:"audio_codec"`
+	// AudioBitrate 音频码率，如128k
+	AudioBitrate string `json:"audio_bitrate"`
+	// Loudnorm 音量标准化
+	Loudnorm bool `json:"loudnorm"`
+	// Format 输出的封装格式，ts或mp4，默认为ts
+	Format string `json:"format"`
+
+	// cover 不为空时以该图片作为静态画面，与输入的音频合成视频
+	cover string
+}
+
+// Validate 检查配置是否有效
+func (p TranscodeProfile) Validate() error {
+	switch p.Format {
+	case "", TranscodeFormatTS, TranscodeFormatMP4:
+	default:
+		return ErrUnsupportedTranscodeFormat
+	}
+	if p.Width < 0 || p.Height < 0 {
+		return errors.New("invalid transcode resolution")
+	}
+	return nil
+}
+
+// ContentType 输出数据的媒体类型
+func (p TranscodeProfile) ContentType() string {
+	if p.Format == TranscodeFormatMP4 {
+		return ContentTypeMP4
+	}
+	return ContentTypeTS
+}
+
+// args 生成输入之后的ffmpeg参数
+func (p TranscodeProfile) args() []string {
+	var videoFilters []string
+	if p.Deinterlace {
+		videoFilters = append(videoFilters, "yadif")
+	}
+	if p.cover != "" {
+		videoFilters = append(videoFilters, p.coverFilter())
+	} else if p.Width > 0 || p.Height > 0 {
+		videoFilters = append(videoFilters, "scale="+scaleSize(p.Width)+":"+scaleSize(p.Height))
+	}
+
+	// 使用滤镜时不能复制，需要重新编码
+	videoCodec := p.VideoCodec
+	if videoCodec == "" {
+		videoCodec = "copy"
+		if len(videoFilters) > 0 || p.VideoBitrate != "" {
+			videoCodec = "libx264"
+		}
+	}
+	if p.cover != "" && videoCodec == "copy" {
+		videoCodec = "libx264"
+	}
+	audioCodec := p.AudioCodec
+	if audioCodec == "" {
+		audioCodec = "copy"
+		if p.Loudnorm || p.AudioBitrate != "" {
+			audioCodec = "aac"
+		}
+	}
+
+	args := []string{"-map", "0:v:0?", "-map", "0:a:0?", "-c:v", videoCodec}
+	gop := "50"
+	if p.cover != "" {
+		// 封面作为第二路输入循环读取，画面静止，降低帧率并缩短关键帧间隔
+		args = []string{"-loop", "1", "-framerate", "5", "-i", p.cover, "-map", "1:v:0", "-map", "0:a:0", "-c:v", videoCodec}
+		if videoCodec == "libx264" {
+			args = append(args, "-tune", "stillimage")
+		}
+		gop = "10"
+	}
+	if videoCodec != "copy" {
+		if len(videoFilters) > 0 {
+			args = append(args, "-vf", strings.Join(videoFilters, ","))
+		}
+		if p.VideoBitrate != "" {
+			args = append(args, "-b:v", p.VideoBitrate)
+		}
+		if p.Preset != "" {
+			args = append(args, "-preset", p.Preset)
+		}
+		// 固定关键帧间隔，中途加入的观看者可以尽快开始解码
+		args = append(args, "-g", gop)
+	}
+
+	args = append(args, "-c:a", audioCodec)
+	if audioCodec != "copy" {
+		if p.Loudnorm {
+			args = append(args, "-af", "loudnorm")
+		}
+		if p.AudioBitrate != "" {
+			args = append(args, "-b:a", p.AudioBitrate)
+		}
+	}
+
+	if p.Format == TranscodeFormatMP4 {
+		args = append(args, "-f", "mp4", "-movflags", "frag_keyframe+empty_moov+default_base_moof")
+	} else {
+		args = append(args, "-f", "mpegts")
+	}
+	return append(args, "-y", "pipe:1")
+}
+
+// coverFilter 将封面缩放到输出尺寸，比例不同时补黑边，未配置尺寸时为1280x720
+func (p TranscodeProfile) coverFilter() string {
+	width, height := "1280", "720"
+	if p.Width > 0 && p.Height > 0 {
+		width, height = strconv.Itoa(p.Width), strconv.Itoa(p.Height)
+	}
+	return "scale=" + width + ":" + height + ":force_original_aspect_ratio=decrease," +
+		"pad=" + width + ":" + height + ":(ow-iw)/2:(oh-ih)/2,format=yuv420p"
+}
+
+func scaleSize(size int) string {
+	if size <= 0 {
+		// -2 表示按比例缩放并保持偶数
+		return "-2"
+	}
+	return strconv.Itoa(size)
+}
+
+// FFMpegOptions ffmpeg进程的管理配置
+type FFMpegOptions struct {
+	// Restart ffmpeg异常退出后自动重启的次数，0为不重启
+	Restart int
+	// Logger ffmpeg的错误输出写入的日志，为空时丢弃
+	Logger *log.Logger
+	// Tag 日志中标识ffmpeg进程的名称，一般为频道id
+	Tag string
+}
+
+// FFMpegStream 通过ffmpeg转码的流，ffmpeg异常退出时按配置重启
 type FFMpegStream struct {
-	cmd *exec.Cmd
-	r   *io.PipeReader
-	w   *io.PipeWriter
+	ffmpeg  string
+	input   string
+	source  TVStream
+	profile TranscodeProfile
+	opt     FFMpegOptions
+	r       *io.PipeReader
+	w       *io.PipeWriter
+
+	stdinLock *sync.Mutex
+	stdin     io.WriteCloser
+	inputDone chan struct{}
+
+	progressLock *sync.Mutex
+	progress     FFMpegProgress
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started bool
+	exited  chan struct{}
 }
 
-func NewFFMpegStream(ffmpeg string, url string) *FFMpegStream {
-	s := &FFMpegStream{}
+// NewFFMpegStream 使用ffmpeg读取input，按profile转码输出
+func NewFFMpegStream(ffmpeg string, input string, profile TranscodeProfile, opt FFMpegOptions) *FFMpegStream {
+	return newFFMpegStream(ffmpeg, input, nil, profile, opt)
+}
+
+// NewFFMpegPipeStream 将source的数据通过标准输入交给ffmpeg，按profile转码输出
+func NewFFMpegPipeStream(ffmpeg string, source TVStream, profile TranscodeProfile, opt FFMpegOptions) *FFMpegStream {
+	return newFFMpegStream(ffmpeg, "pipe:0", source, profile, opt)
+}
+
+func newFFMpegStream(ffmpeg string, input string, source TVStream, profile TranscodeProfile, opt FFMpegOptions) *FFMpegStream {
+	s := &FFMpegStream{
+		ffmpeg:       ffmpeg,
+		input:        input,
+		source:       source,
+		profile:      profile,
+		opt:          opt,
+		stdinLock:    new(sync.Mutex),
+		inputDone:    make(chan struct{}),
+		progressLock: new(sync.Mutex),
+		exited:       make(chan struct{}),
+	}
 	s.r, s.w = io.Pipe()
-	s.cmd = exec.Command(ffmpeg,
-		"-i", url,
-		"-c", "copy",
-		"-f", "mp4",
-		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
-		"-g", "52",
-		"-y", "pipe:1")
-	s.cmd.Stdout = s.w
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	return s
 }
 
 func (s *FFMpegStream) Start() error {
-	return s.cmd.Start()
+	if s.source != nil {
+		if err := s.source.Start(); err != nil {
+			return err
+		}
+	}
+	process, err := s.startProcess()
+	if err != nil {
+		return err
+	}
+	if s.source != nil {
+		go s.copyInput()
+	}
+	go s.supervise(process)
+	s.started = true
+	return nil
+}
+
+func (s *FFMpegStream) Read(b []byte) (int, error) {
+	return s.r.Read(b)
 }
 
 func (s *FFMpegStream) Close() error {
-	s.w.Close()
-	s.cmd.Process.Kill()
-	return s.cmd.Wait()
+	s.cancel()
+	if s.source != nil {
+		s.source.Close()
+	}
+	s.r.Close()
+	// 未成功Start时没有需要等待的进程
+	if s.started {
+		<-s.exited
+	}
+	return nil
 }
 
-func (s *FFMpegStream) Read(b []byte) (int, error) {
-	return s.r.Read(b)
+func (s *FFMpegStream) ContentType() string {
+	return s.profile.ContentType()
+}
+
+// Status 当前ffmpeg的运行状态
+func (s *FFMpegStream) Status() any {
+	s.progressLock.Lock()
+	defer s.progressLock.Unlock()
+	return s.progress
+}
+
+func (s *FFMpegStream) startProcess() (*childProcess, error) {
+	args := []string{"-hide_banner", "-loglevel", "warning", "-nostats", "-progress", "pipe:2", "-i", s.input}
+	cmd := exec.Command(s.ffmpeg, append(args, s.profile.args()...)...)
+	cmd.Stdout = s.w
+	var stdin io.WriteCloser
+	if s.source != nil {
+		var err error
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return nil, err
+		}
+	}
+	process, err := startChildProcess(cmd, s.opt.Logger, s.opt.Tag, s.updateProgress)
+	if err != nil {
+		return nil, err
+	}
+	if stdin != nil {
+		s.stdinLock.Lock()
+		s.stdin = stdin
+		s.stdinLock.Unlock()
+	}
+	return process, nil
+}
+
+// supervise 等待ffmpeg退出，异常退出时重启，直到流被关闭或者重启次数用完
+func (s *FFMpegStream) supervise(process *childProcess) {
+	defer close(s.exited)
+	restarts := 0
+	for {
+		started := time.Now()
+		select {
+		case <-s.ctx.Done():
+			process.Stop()
+			s.w.CloseWithError(ErrReadClosedStream)
+			return
+		case <-process.Done():
+		}
+
+		err := process.Err()
+		if err == nil {
+			s.w.Close()
+			return
+		}
+		process.logf("exited: %v", err)
+		if time.Since(started) > ffmpegStableDuration {
+			restarts = 0
+		}
+		if restarts >= s.opt.Restart || s.inputClosed() {
+			s.w.CloseWithError(err)
+			return
+		}
+		restarts++
+
+		timer := time.NewTimer(ffmpegRestartDelay)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			s.w.CloseWithError(ErrReadClosedStream)
+			return
+		case <-timer.C:
+		}
+		s.progressLock.Lock()
+		s.progress.Restarts++
+		s.progressLock.Unlock()
+		if process, err = s.startProcess(); err != nil {
+			s.w.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// updateProgress 解析错误输出中的进度行
+func (s *FFMpegStream) updateProgress(line string) bool {
+	s.progressLock.Lock()
+	defer s.progressLock.Unlock()
+	return s.progress.update(line)
+}
+
+// copyInput 将源数据写入当前ffmpeg进程，ffmpeg重启期间的数据会被丢弃
+func (s *FFMpegStream) copyInput() {
+	defer close(s.inputDone)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := s.source.Read(buf)
+		if n > 0 {
+			s.stdinLock.Lock()
+			stdin := s.stdin
+			s.stdinLock.Unlock()
+			stdin.Write(buf[:n])
+		}
+		if err != nil {
+			// 源结束后关闭输入，ffmpeg处理完剩余数据后正常退出
+			s.stdinLock.Lock()
+			s.stdin.Close()
+			s.stdinLock.Unlock()
+			return
+		}
+	}
+}
+
+func (s *FFMpegStream) inputClosed() bool {
+	if s.source == nil {
+		return false
+	}
+	select {
+	case <-s.inputDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// FFMpegProgress 从ffmpeg的-progress输出中解析的运行状态
+type FFMpegProgress struct {
+	Frame      int64         `json:"frame"`
+	FPS        float64       `json:"fps"`
+	Bitrate    string        `json:"bitrate"`
+	Speed      string        `json:"speed"`
+	OutTime    time.Duration `json:"out_time"`
+	DupFrames  int64         `json:"dup_frames"`
+	DropFrames int64         `json:"drop_frames"`
+	Restarts   int           `json:"restarts"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+}
+
+// update 解析一行key=value格式的进度，返回是否为进度行
+func (p *FFMpegProgress) update(line string) bool {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return false
+	}
+	value = strings.TrimSpace(value)
+	switch key {
+	case "frame":
+		p.Frame, _ = strconv.ParseInt(value, 10, 64)
+	case "fps":
+		p.FPS, _ = strconv.ParseFloat(value, 64)
+	case "bitrate":
+		p.Bitrate = value
+	case "speed":
+		p.Speed = value
+	case "out_time_us", "out_time_ms":
+		// 两者的单位实际都是微秒
+		us, _ := strconv.ParseInt(value, 10, 64)
+		p.OutTime = time.Duration(us) * time.Microsecond
+	case "dup_frames":
+		p.DupFrames, _ = strconv.ParseInt(value, 10, 64)
+	case "drop_frames":
+		p.DropFrames, _ = strconv.ParseInt(value, 10, 64)
+	case "progress":
+		p.UpdatedAt = time.Now()
+	case "total_size", "out_time", "stream_0_0_q", "stream_0_1_q":
+	default:
+		return strings.HasPrefix(key, "stream_") && !strings.ContainsAny(key, " :")
+	}
+	return true
 }
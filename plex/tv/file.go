@@ -0,0 +1,804 @@
+package tv
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/deepch/vdk/format/mp4/mp4io"
+	"github.com/deepch/vdk/format/ts"
+)
+
+var (
+	ErrFileEmpty           = errors.New("file: no playable file")
+	ErrFileInvalidSchedule = errors.New("file: invalid schedule")
+	ErrFileUnknownDuration = errors.New("file: unknown duration")
+	ErrFileUnsupported     = errors.New("file: unsupported media")
+)
+
+const (
+	// 输出落后于节目表超过该时长时，按当前时间重新定位
+	fileResyncThreshold = 2 * time.Second
+	// 定位到文件中的位置小于该值时从头播放
+	fileMinSeek = time.Second
+	// ts文件探测时长时在开头和结尾读取的数据量
+	fileProbeSize = 2 * 1024 * 1024
+	// 节目单中最多的节目数，避免大量很短的文件
+	fileMaxProgrammes = 5000
+)
+
+// 可以播放的文件扩展名，视频需为h264或h265，音频需为aac
+var fileExtensions = map[string]bool{
+	".ts":  true,
+	".mp4": true,
+	".m4v": true,
+	".mov": true,
+}
+
+// FileOptions file类型的选项
+type FileOptions struct {
+	// Shuffle 每轮循环时随机排列目录中的文件，同一轮中所有观看者看到的顺序相同
+	Shuffle bool `json:"shuffle"`
+	// Epoch 播放列表的起点，RFC3339格式，默认为1970-01-01T00:00:00Z
+	Epoch string `json:"epoch"`
+	// Schedule 每天的节目表，配置后按时间段播放不同的文件或目录
+	Schedule []FileScheduleEntry `json:"schedule"`
+}
+
+// FileScheduleEntry 节目表中的一个时间段，播放到下一个时间段开始
+type FileScheduleEntry struct {
+	// Start 每天开始的时间，如20:00，使用本地时区
+	Start string `json:"start"`
+	// Path 播放的文件或目录，为空时使用频道的url
+	Path string `json:"path"`
+	// Title 节目名称，为空时节目单中使用每个文件的文件名
+	Title string `json:"title"`
+	// Description 节目简介
+	Description string `json:"description"`
+}
+
+// Validate 检查配置是否有效，不会探测文件的时长
+func (o FileOptions) Validate(path string) error {
+	if _, err := o.epoch(); err != nil {
+		return err
+	}
+	if len(o.Schedule) == 0 {
+		_, err := os.Stat(path)
+		return err
+	}
+	for _, entry := range o.Schedule {
+		if _, _, err := entry.clock(); err != nil {
+			return err
+		}
+		if _, err := os.Stat(entry.path(path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o FileOptions) epoch() (time.Time, error) {
+	if o.Epoch == "" {
+		return time.Unix(0, 0), nil
+	}
+	epoch, err := time.Parse(time.RFC3339, o.Epoch)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: epoch %s", ErrFileInvalidSchedule, o.Epoch)
+	}
+	return epoch, nil
+}
+
+func (e FileScheduleEntry) clock() (hour int, minute int, err error) {
+	t, err := time.Parse("15:04", e.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: start %s", ErrFileInvalidSchedule, e.Start)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+func (e FileScheduleEntry) path(def string) string {
+	if e.Path == "" {
+		return def
+	}
+	return e.Path
+}
+
+// filePath 频道url中的文件路径，支持file://前缀
+func filePath(url string) string {
+	return strings.TrimPrefix(url, "file://")
+}
+
+// fileItem 播放列表中的一个文件
+type fileItem struct {
+	path     string
+	title    string
+	duration time.Duration
+}
+
+// filePlaylist 循环播放的一组文件
+type filePlaylist struct {
+	items   []fileItem
+	total   time.Duration
+	shuffle bool
+	seed    int64
+}
+
+// loadFilePlaylist 列出目录中可以播放的文件并探测时长，path为文件时只包含该文件
+func loadFilePlaylist(env *Env, tag string, path string, shuffle bool) (*filePlaylist, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		names = names[:0]
+		for _, entry := range entries {
+			if !entry.IsDir() && fileExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+				names = append(names, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(names)
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(tag + "\x00" + path))
+	playlist := &filePlaylist{shuffle: shuffle, seed: int64(hash.Sum64())}
+	for _, name := range names {
+		duration, err := probeFileDuration(name)
+		if err != nil {
+			if env.Logger != nil {
+				env.Logger.Printf("[file %s] skip %s: %v", tag, name, err)
+			}
+			continue
+		}
+		base := filepath.Base(name)
+		playlist.items = append(playlist.items, fileItem{
+			path:     name,
+			title:    strings.TrimSuffix(base, filepath.Ext(base)),
+			duration: duration,
+		})
+		playlist.total += duration
+	}
+	if len(playlist.items) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrFileEmpty, path)
+	}
+	return playlist, nil
+}
+
+// order 第cycle轮的播放顺序
+func (p *filePlaylist) order(cycle int64) []int {
+	order := make([]int, len(p.items))
+	for i := range order {
+		order[i] = i
+	}
+	if p.shuffle {
+		r := rand.New(rand.NewSource(p.seed + cycle))
+		r.Shuffle(len(order), func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+	}
+	return order
+}
+
+// locate 返回播放列表开始后pos处的文件，以及该文件相对播放列表开始的位置
+func (p *filePlaylist) locate(pos time.Duration) (fileItem, time.Duration) {
+	cycle := pos / p.total
+	if pos%p.total < 0 {
+		cycle--
+	}
+	start := cycle * p.total
+	order := p.order(int64(cycle))
+	for _, i := range order {
+		item := p.items[i]
+		if pos < start+item.duration {
+			return item, start
+		}
+		start += item.duration
+	}
+	last := p.items[order[len(order)-1]]
+	return last, start - last.duration
+}
+
+// fileBlock 节目表中的一段时间，从start开始循环播放playlist，end为零值时没有结束
+type fileBlock struct {
+	start       time.Time
+	end         time.Time
+	playlist    *filePlaylist
+	title       string
+	description string
+}
+
+// fileSlot 每天的一个时间段
+type fileSlot struct {
+	hour        int
+	minute      int
+	playlist    *filePlaylist
+	title       string
+	description string
+}
+
+// fileSchedule file类型的节目表，没有配置时从epoch开始一直循环播放同一个播放列表
+type fileSchedule struct {
+	epoch    time.Time
+	playlist *filePlaylist
+	slots    []fileSlot
+}
+
+// loadFileSchedule 加载频道的节目表，并探测所有文件的时长
+func loadFileSchedule(env *Env, source Source) (*fileSchedule, error) {
+	opt := FileOptions{}
+	if err := source.DecodeOptions(&opt); err != nil {
+		return nil, err
+	}
+	epoch, err := opt.epoch()
+	if err != nil {
+		return nil, err
+	}
+	path := filePath(source.URL)
+	schedule := &fileSchedule{epoch: epoch}
+	if len(opt.Schedule) == 0 {
+		if schedule.playlist, err = loadFilePlaylist(env, source.Id, path, opt.Shuffle); err != nil {
+			return nil, err
+		}
+		return schedule, nil
+	}
+
+	for _, entry := range opt.Schedule {
+		slot := fileSlot{title: entry.Title, description: entry.Description}
+		if slot.hour, slot.minute, err = entry.clock(); err != nil {
+			return nil, err
+		}
+		if slot.playlist, err = loadFilePlaylist(env, source.Id, entry.path(path), opt.Shuffle); err != nil {
+			return nil, err
+		}
+		schedule.slots = append(schedule.slots, slot)
+	}
+	sort.SliceStable(schedule.slots, func(i, j int) bool {
+		a, b := schedule.slots[i], schedule.slots[j]
+		return a.hour*60+a.minute < b.hour*60+b.minute
+	})
+	return schedule, nil
+}
+
+// blockAt 返回t所在的时间段
+func (s *fileSchedule) blockAt(t time.Time) fileBlock {
+	if len(s.slots) == 0 {
+		return fileBlock{start: s.epoch, playlist: s.playlist}
+	}
+	t = t.In(time.Local)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	// 当天第一个时间段之前属于前一天的最后一个时间段
+	index, start := len(s.slots)-1, s.slotStart(day.AddDate(0, 0, -1), len(s.slots)-1)
+	for i := range s.slots {
+		if slotStart := s.slotStart(day, i); !slotStart.After(t) {
+			index, start = i, slotStart
+		}
+	}
+	var end time.Time
+	switch {
+	case start.Before(day):
+		end = s.slotStart(day, 0)
+	case index+1 < len(s.slots):
+		end = s.slotStart(day, index+1)
+	default:
+		end = s.slotStart(day.AddDate(0, 0, 1), 0)
+	}
+	slot := s.slots[index]
+	return fileBlock{
+		start:       start,
+		end:         end,
+		playlist:    slot.playlist,
+		title:       slot.title,
+		description: slot.description,
+	}
+}
+
+func (s *fileSchedule) slotStart(day time.Time, index int) time.Time {
+	slot := s.slots[index]
+	return time.Date(day.Year(), day.Month(), day.Day(), slot.hour, slot.minute, 0, 0, time.Local)
+}
+
+// itemAt 返回t时刻播放的文件，以及它在节目表中的开始和结束时间，结束时间不超过所在时间段的结束
+func (s *fileSchedule) itemAt(t time.Time) (fileBlock, fileItem, time.Time, time.Time) {
+	block := s.blockAt(t)
+	item, itemStart := block.playlist.locate(t.Sub(block.start))
+	start := block.start.Add(itemStart)
+	end := start.Add(item.duration)
+	if !block.end.IsZero() && end.After(block.end) {
+		end = block.end
+	}
+	return block, item, start, end
+}
+
+// Guide 返回from到to之间的节目，配置了名称的时间段作为一个节目，否则每个文件作为一个节目
+func (s *fileSchedule) Guide(from time.Time, to time.Time) []Programme {
+	var programmes []Programme
+	for t := from; t.Before(to) && len(programmes) < fileMaxProgrammes; {
+		block, item, start, end := s.itemAt(t)
+		if block.title != "" {
+			programmes = append(programmes, Programme{
+				Start:       block.start,
+				Stop:        block.end,
+				Title:       block.title,
+				Description: block.description,
+			})
+			t = block.end
+			continue
+		}
+		programmes = append(programmes, Programme{Start: start, Stop: end, Title: item.title})
+		t = end
+	}
+	return programmes
+}
+
+// opener 按节目表依次打开文件，第一个文件以及输出落后时按当前时间定位
+func (s *fileSchedule) opener() demuxerOpener {
+	var cursor time.Time
+	return func() (av.Demuxer, io.Closer, error) {
+		now := time.Now()
+		if cursor.IsZero() || now.Sub(cursor) > fileResyncThreshold {
+			cursor = now
+		}
+		_, item, start, end := s.itemAt(cursor)
+		seek := cursor.Sub(start)
+		if seek < fileMinSeek {
+			seek = 0
+		}
+		var limit time.Duration
+		if end.Before(start.Add(item.duration)) {
+			// 时间段结束时切换到下一个时间段
+			limit = end.Sub(cursor)
+		}
+		cursor = end
+		return openFileDemuxer(item.path, item.duration, seek, limit)
+	}
+}
+
+// NewFileStream 按节目表实时播放本地文件，播放位置由当前时间决定，所有观看者看到的内容相同
+func NewFileStream(env *Env, source Source) (TVStream, error) {
+	schedule, err := loadFileSchedule(env, source)
+	if err != nil {
+		return nil, err
+	}
+	return newPacedStream(schedule.opener()), nil
+}
+
+// openFileDemuxer 打开文件并定位到seek处，limit大于0时只读取limit时长的数据
+func openFileDemuxer(path string, duration time.Duration, seek time.Duration, limit time.Duration) (av.Demuxer, io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var demuxer av.Demuxer
+	if strings.ToLower(filepath.Ext(path)) == ".ts" {
+		demuxer, err = openTSFile(f, duration, seek)
+	} else {
+		demuxer, err = openMP4File(f, seek)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	fd, err := newFileDemuxer(demuxer, limit)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return fd, f, nil
+}
+
+// newFileDemuxer 读取demuxer的轨道信息，返回从关键帧开始输出的demuxer
+func newFileDemuxer(demuxer av.Demuxer, limit time.Duration) (*fileDemuxer, error) {
+	var codecs []av.CodecData
+	err := demuxSafely(func() (err error) {
+		codecs, err = demuxer.Streams()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	fd := &fileDemuxer{Demuxer: demuxer, codecs: codecs, limit: limit}
+	for _, codec := range codecs {
+		if codec.Type().IsVideo() {
+			fd.hasVideo = true
+		}
+	}
+	return fd, nil
+}
+
+func openMP4File(f io.ReadSeeker, seek time.Duration) (av.Demuxer, error) {
+	demuxer := mp4.NewDemuxer(f)
+	if _, err := demuxer.Streams(); err != nil {
+		return nil, err
+	}
+	if seek > 0 {
+		if err := demuxer.SeekToTime(seek); err != nil {
+			return nil, err
+		}
+	}
+	return demuxer, nil
+}
+
+// openTSFile 按码率估算seek对应的位置，并在前面补上文件开头的PAT和PMT
+func openTSFile(f *os.File, duration time.Duration, seek time.Duration) (av.Demuxer, error) {
+	if seek <= 0 || duration <= 0 {
+		return ts.NewDemuxer(bufio.NewReader(f)), nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, fileProbeSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	sync := tsSyncOffset(head)
+	if sync < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrFileUnknownDuration, f.Name())
+	}
+	psi := tsPSIPackets(head[sync:])
+
+	pos := int64(float64(info.Size()) * float64(seek) / float64(duration))
+	pos = int64(sync) + (pos-int64(sync))/188*188
+	if pos < int64(sync) {
+		pos = int64(sync)
+	}
+	if _, err = f.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := &tsSeekReader{r: bufio.NewReader(f), started: make(map[uint16]bool)}
+	return ts.NewDemuxer(io.MultiReader(bytes.NewReader(psi), reader)), nil
+}
+
+// tsSeekReader 丢弃定位后第一个视频关键帧之前的ts包，之后每路流从pes开始处读取，避免不完整的pes
+type tsSeekReader struct {
+	r       io.Reader
+	packet  [188]byte
+	pending []byte
+	keyed   bool
+	started map[uint16]bool
+}
+
+func (r *tsSeekReader) Read(b []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if _, err := io.ReadFull(r.r, r.packet[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		packet := r.packet[:]
+		if packet[0] != 0x47 {
+			return 0, fmt.Errorf("%w: lost ts sync", ErrFileUnknownDuration)
+		}
+		if !r.keyed {
+			if !tsIsKeyFramePacket(packet) {
+				continue
+			}
+			r.keyed = true
+		}
+		pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+		if !r.started[pid] {
+			if packet[1]&0x40 == 0 {
+				continue
+			}
+			r.started[pid] = true
+		}
+		r.pending = packet
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// tsIsKeyFramePacket 判断ts包是否为视频关键帧的开始，根据随机访问标志或pes中的sps/vps
+func tsIsKeyFramePacket(packet []byte) bool {
+	if packet[1]&0x40 == 0 {
+		return false
+	}
+	control := (packet[3] >> 4) & 0x3
+	pos := 4
+	if control&0x2 != 0 {
+		pos += 1 + int(packet[4])
+	}
+	if control&0x1 == 0 || pos+9 > 188 {
+		return false
+	}
+	pes := packet[pos:]
+	if pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || pes[3] < 0xE0 || pes[3] > 0xEF {
+		return false
+	}
+	if control&0x2 != 0 && packet[4] > 0 && packet[5]&0x40 != 0 {
+		return true
+	}
+	if 9+int(pes[8]) > len(pes) {
+		return false
+	}
+	data := pes[9+int(pes[8]):]
+	for i := 0; i+4 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		// h264 sps或h265 vps
+		if nalu := data[i+3]; nalu&0x9F == 7 || (nalu == 0x40 && data[i+4] == 0x01) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileDemuxer 从第一个视频关键帧开始读取，读满limit后返回io.EOF
+type fileDemuxer struct {
+	av.Demuxer
+	codecs   []av.CodecData
+	hasVideo bool
+	started  bool
+	first    time.Duration
+	limit    time.Duration
+}
+
+func (d *fileDemuxer) ReadPacket() (av.Packet, error) {
+	for {
+		var packet av.Packet
+		err := demuxSafely(func() (err error) {
+			packet, err = d.Demuxer.ReadPacket()
+			return err
+		})
+		if err != nil {
+			return packet, err
+		}
+		if int(packet.Idx) >= len(d.codecs) {
+			continue
+		}
+		codec := d.codecs[packet.Idx]
+		if codec.Type().IsVideo() && !packet.IsKeyFrame {
+			// ts文件没有随机访问标志时根据nalu类型判断关键帧
+			packet.IsKeyFrame = isKeyFrameData(codec.Type(), packet.Data)
+		}
+		if !d.started {
+			if d.hasVideo && !(packet.IsKeyFrame && codec.Type().IsVideo()) {
+				continue
+			}
+			d.started = true
+			d.first = packet.Time
+		}
+		if d.limit > 0 && packet.Time-d.first >= d.limit {
+			return av.Packet{}, io.EOF
+		}
+		return packet, nil
+	}
+}
+
+// demuxSafely 解复用不支持的数据时vdk可能panic，如sps中没有帧率信息的ts文件，转换为错误返回
+func demuxSafely(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrFileUnsupported, r)
+		}
+	}()
+	return fn()
+}
+
+// isKeyFrameData 判断avcc格式的视频帧中是否包含idr
+func isKeyFrameData(codec av.CodecType, data []byte) bool {
+	nalus, _ := h264parser.SplitNALUs(data)
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch codec {
+		case av.H264:
+			if nalu[0]&0x1F == 5 {
+				return true
+			}
+		case av.H265:
+			if t := (nalu[0] >> 1) & 0x3F; t >= 16 && t <= 21 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fileProbe 缓存的文件时长，文件大小或修改时间变化时重新探测
+type fileProbe struct {
+	size     int64
+	modTime  time.Time
+	duration time.Duration
+}
+
+var (
+	fileProbesLock = new(sync.Mutex)
+	fileProbes     = make(map[string]fileProbe)
+)
+
+// probeFileDuration 探测文件的时长，mp4读取moov中的时长，ts根据开头和结尾的pts计算
+func probeFileDuration(path string) (time.Duration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	fileProbesLock.Lock()
+	probe, ok := fileProbes[path]
+	fileProbesLock.Unlock()
+	if ok && probe.size == info.Size() && probe.modTime.Equal(info.ModTime()) {
+		return probe.duration, nil
+	}
+
+	var duration time.Duration
+	if strings.ToLower(filepath.Ext(path)) == ".ts" {
+		duration, err = probeTSDuration(f, info.Size())
+	} else {
+		duration, err = probeMP4Duration(f)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%w: %s", ErrFileUnknownDuration, path)
+	}
+	fileProbesLock.Lock()
+	fileProbes[path] = fileProbe{size: info.Size(), modTime: info.ModTime(), duration: duration}
+	fileProbesLock.Unlock()
+	return duration, nil
+}
+
+func probeMP4Duration(f *os.File) (time.Duration, error) {
+	atoms, err := mp4io.ReadFileAtoms(f)
+	if err != nil {
+		return 0, err
+	}
+	for _, atom := range atoms {
+		if moov, ok := atom.(*mp4io.Movie); ok && moov.Header != nil && moov.Header.TimeScale > 0 {
+			return scaleDuration(uint64(uint32(moov.Header.Duration)), uint64(moov.Header.TimeScale)), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrFileUnknownDuration, f.Name())
+}
+
+func probeTSDuration(f *os.File, size int64) (time.Duration, error) {
+	head := make([]byte, fileProbeSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	pid, first, ok := tsFirstPTS(head[:n])
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrFileUnknownDuration, f.Name())
+	}
+
+	tailStart := size - fileProbeSize
+	if tailStart < 0 {
+		tailStart = 0
+	}
+	tail := make([]byte, size-tailStart)
+	if _, err = f.ReadAt(tail, tailStart); err != nil && err != io.EOF {
+		return 0, err
+	}
+	last, ok := tsLastPTS(tail, pid)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrFileUnknownDuration, f.Name())
+	}
+	// pts为33位，可能回绕
+	ticks := (last - first) & (1<<33 - 1)
+	return scaleDuration(ticks, 90000), nil
+}
+
+// tsSyncOffset 返回第一个连续两个包都以0x47开始的位置
+func tsSyncOffset(data []byte) int {
+	for i := 0; i+188 < len(data) && i < 188; i++ {
+		if data[i] == 0x47 && data[i+188] == 0x47 {
+			return i
+		}
+	}
+	return -1
+}
+
+// tsPacketPTS 返回ts包中pes头部的pts
+func tsPacketPTS(packet []byte) (pid uint16, pts uint64, ok bool) {
+	if len(packet) < 188 || packet[0] != 0x47 || packet[1]&0x40 == 0 {
+		return 0, 0, false
+	}
+	pid = uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+	control := (packet[3] >> 4) & 0x3
+	pos := 4
+	if control&0x2 != 0 {
+		pos += 1 + int(packet[4])
+	}
+	if control&0x1 == 0 || pos+14 > 188 {
+		return 0, 0, false
+	}
+	pes := packet[pos:188]
+	if pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || pes[7]&0x80 == 0 {
+		return 0, 0, false
+	}
+	// 只统计音视频流
+	if id := pes[3]; !(id >= 0xC0 && id <= 0xEF) {
+		return 0, 0, false
+	}
+	b := pes[9:14]
+	pts = uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+	return pid, pts, true
+}
+
+func tsFirstPTS(data []byte) (uint16, uint64, bool) {
+	sync := tsSyncOffset(data)
+	if sync < 0 {
+		return 0, 0, false
+	}
+	for i := sync; i+188 <= len(data); i += 188 {
+		if pid, pts, ok := tsPacketPTS(data[i : i+188]); ok {
+			return pid, pts, true
+		}
+	}
+	return 0, 0, false
+}
+
+func tsLastPTS(data []byte, pid uint16) (uint64, bool) {
+	sync := tsSyncOffset(data)
+	if sync < 0 {
+		return 0, false
+	}
+	var last uint64
+	found := false
+	for i := sync; i+188 <= len(data); i += 188 {
+		if p, pts, ok := tsPacketPTS(data[i : i+188]); ok && p == pid {
+			last, found = pts, true
+		}
+	}
+	return last, found
+}
+
+// tsPSIPackets 返回data中第一个PAT包及其指向的PMT包
+func tsPSIPackets(data []byte) []byte {
+	var pat []byte
+	pmtPID := -1
+	for i := 0; i+188 <= len(data); i += 188 {
+		packet := data[i : i+188]
+		if packet[0] != 0x47 {
+			continue
+		}
+		pid := int(packet[1]&0x1F)<<8 | int(packet[2])
+		if pat == nil && pid == 0 {
+			pat = packet
+			// 跳过pointer_field及PAT头部，读取第一个节目的PMT PID
+			pos := 4
+			if (packet[3]>>4)&0x2 != 0 {
+				pos += 1 + int(packet[4])
+			}
+			pos += 1 + int(packet[pos])
+			if pos+12 <= 188 {
+				pmtPID = int(packet[pos+10]&0x1F)<<8 | int(packet[pos+11])
+			}
+			continue
+		}
+		if pat != nil && pid == pmtPID {
+			return append(append([]byte(nil), pat...), packet...)
+		}
+	}
+	return nil
+}
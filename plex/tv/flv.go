@@ -0,0 +1,242 @@
+package tv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/flv"
+)
+
+// errFLVExpiring 地址即将过期，需要重新获取地址
+var errFLVExpiring = errors.New("flv: url expiring")
+
+// FLVStream 拉取http-flv流并转封装为ts，仅支持h264和aac。
+// 断开后自动重连，重连后时间戳保持连续
+type FLVStream struct {
+	url      *url.URL
+	resolver PlaylistResolver
+	expires  time.Time
+
+	muxer   *tsMuxer
+	frames  chan Frame
+	pending []byte
+	loopErr error
+
+	backoff  reconnectBackoff
+	timeline timeline
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewFLVStream(flvUrl *url.URL) *FLVStream {
+	s := &FLVStream{
+		url:    flvUrl,
+		muxer:  newTSMuxer(),
+		frames: make(chan Frame),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// NewResolvingFLVStream 创建地址由resolver提供的flv流，连接失败或地址即将过期时重新获取地址
+func NewResolvingFLVStream(resolver PlaylistResolver) *FLVStream {
+	s := NewFLVStream(nil)
+	s.resolver = resolver
+	return s
+}
+
+func (s *FLVStream) Start() error {
+	if s.resolver != nil {
+		var err error
+		if s.url, s.expires, err = s.resolver(s.ctx, nil); err != nil {
+			return err
+		}
+	}
+	body, demuxer, err := s.connect()
+	if err != nil {
+		return err
+	}
+	go s.loop(body, demuxer)
+	return nil
+}
+
+func (s *FLVStream) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		s.pending = frame.Data
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *FLVStream) ReadFrame() (Frame, error) {
+	select {
+	case frame, ok := <-s.frames:
+		if !ok {
+			if s.loopErr != nil {
+				return Frame{}, s.loopErr
+			}
+			return Frame{}, ErrReadClosedStream
+		}
+		return frame, nil
+	case <-s.ctx.Done():
+		return Frame{}, ErrReadClosedStream
+	}
+}
+
+func (s *FLVStream) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *FLVStream) ContentType() string {
+	return ContentTypeTS
+}
+
+// connect 请求flv地址并读取编码信息
+func (s *FLVStream) connect() (io.ReadCloser, *flv.Demuxer, error) {
+	request, err := http.NewRequestWithContext(s.ctx, "GET", s.url.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = checkStatus(resp); err != nil {
+		return nil, nil, err
+	}
+	demuxer := flv.NewDemuxer(resp.Body)
+	if _, err = demuxer.Streams(); err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	return resp.Body, demuxer, nil
+}
+
+// loop 持续输出数据，连接断开或地址即将过期时重连，直到流被关闭或者连续重连失败
+func (s *FLVStream) loop(body io.ReadCloser, demuxer *flv.Demuxer) {
+	defer close(s.frames)
+	for {
+		played, err := s.play(demuxer)
+		body.Close()
+		if s.ctx.Err() != nil {
+			return
+		}
+		if played {
+			s.backoff.reset()
+		}
+		s.timeline.advance(reconnectGap)
+
+		failed := s.url
+		if err == errFLVExpiring {
+			failed = nil
+		}
+		for {
+			if err != errFLVExpiring {
+				if err = s.backoff.wait(s.ctx, err); err != nil {
+					s.loopErr = err
+					return
+				}
+			}
+
+			if s.resolver != nil {
+				var flvUrl *url.URL
+				var expires time.Time
+				if flvUrl, expires, err = s.resolver(s.ctx, failed); err != nil {
+					continue
+				}
+				s.url, s.expires = flvUrl, expires
+			}
+			if body, demuxer, err = s.connect(); err == nil {
+				break
+			}
+			failed = s.url
+		}
+	}
+}
+
+// play 输出一次连接的数据，played表示是否成功输出过数据
+func (s *FLVStream) play(demuxer *flv.Demuxer) (played bool, err error) {
+	codecs, err := demuxer.Streams()
+	if err != nil {
+		return false, err
+	}
+	header, err := s.muxer.WriteHeader(codecs)
+	if err != nil {
+		return false, err
+	}
+	if err = s.emit(Frame{Data: header, Header: true}); err != nil {
+		return false, err
+	}
+
+	hasVideo := false
+	for _, codec := range codecs {
+		if codec.Type().IsVideo() {
+			hasVideo = true
+		}
+	}
+	// 有视频时从第一个关键帧开始输出
+	started := !hasVideo
+	first := time.Duration(-1)
+	for {
+		var packet av.Packet
+		if packet, err = demuxer.ReadPacket(); err != nil {
+			return played, err
+		}
+		if !started {
+			if !packet.IsKeyFrame || !codecs[packet.Idx].Type().IsVideo() {
+				continue
+			}
+			started = true
+		}
+		// 签名地址即将过期时，在关键帧处切换到新的地址
+		if packet.IsKeyFrame && played && s.expiring() {
+			return played, errFLVExpiring
+		}
+
+		if first < 0 {
+			first = packet.Time
+		}
+		packet.Time -= first
+		if packet.Time < 0 {
+			packet.Time = 0
+		}
+		packet.Time = s.timeline.stamp(packet.Time)
+
+		data, keyFrame, err := s.muxer.WritePacket(packet)
+		if err != nil {
+			return played, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if err = s.emit(Frame{Data: data, KeyFrame: keyFrame}); err != nil {
+			return played, err
+		}
+		played = true
+	}
+}
+
+func (s *FLVStream) expiring() bool {
+	return s.resolver != nil && !s.expires.IsZero() && time.Until(s.expires) < hlsRefreshBefore
+}
+
+func (s *FLVStream) emit(frame Frame) error {
+	select {
+	case s.frames <- frame:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
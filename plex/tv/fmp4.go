@@ -0,0 +1,470 @@
+package tv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/format/mp4/mp4io"
+)
+
+var (
+	ErrFMP4Invalid     = errors.New("fmp4: invalid box")
+	ErrFMP4Unsupported = errors.New("fmp4: unsupported codec")
+)
+
+const (
+	fmp4TfhdBaseDataOffset = 0x01
+	fmp4TfhdSampleDescIdx  = 0x02
+	fmp4TfhdDuration       = 0x08
+	fmp4TfhdSize           = 0x10
+	fmp4TfhdFlags          = 0x20
+
+	fmp4TrunDataOffset      = 0x01
+	fmp4TrunFirstSampleFlag = 0x04
+	fmp4TrunDuration        = 0x100
+	fmp4TrunSize            = 0x200
+	fmp4TrunFlags           = 0x400
+	fmp4TrunCts             = 0x800
+
+	// sample_flags中的sample_is_non_sync_sample
+	fmp4NonSyncSample = 0x10000
+)
+
+// fmp4Box 一个mp4 box，data不包含头部
+type fmp4Box struct {
+	typ    string
+	offset int
+	data   []byte
+}
+
+// fmp4Boxes 解析data中的所有box，offset为data在整个文件中的位置
+func fmp4Boxes(data []byte, offset int) ([]fmp4Box, error) {
+	var boxes []fmp4Box
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 8 {
+			return nil, ErrFMP4Invalid
+		}
+		size := uint64(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data) - pos)
+		case 1:
+			if len(data)-pos < 16 {
+				return nil, ErrFMP4Invalid
+			}
+			size, header = binary.BigEndian.Uint64(data[pos+8:]), 16
+		}
+		if size < header || size > uint64(len(data)-pos) {
+			return nil, fmt.Errorf("%w: %s", ErrFMP4Invalid, typ)
+		}
+		boxes = append(boxes, fmp4Box{typ: typ, offset: offset + pos, data: data[pos+int(header) : pos+int(size)]})
+		pos += int(size)
+	}
+	return boxes, nil
+}
+
+// fmp4Child 返回路径上的第一个子box
+func fmp4Child(data []byte, path ...string) (fmp4Box, bool) {
+	box := fmp4Box{data: data}
+	for _, typ := range path {
+		boxes, err := fmp4Boxes(box.data, 0)
+		if err != nil {
+			return fmp4Box{}, false
+		}
+		found := false
+		for _, child := range boxes {
+			if child.typ == typ {
+				box, found = child, true
+				break
+			}
+		}
+		if !found {
+			return fmp4Box{}, false
+		}
+	}
+	return box, true
+}
+
+// fmp4Track 初始化分片中的一路轨道
+type fmp4Track struct {
+	id        uint32
+	timescale uint32
+	codec     av.CodecData
+
+	// trex中的默认值
+	defaultDuration uint32
+	defaultSize     uint32
+	defaultFlags    uint32
+}
+
+// fmp4Sample 媒体分片中的一帧，时间单位为轨道的timescale
+type fmp4Sample struct {
+	track    *fmp4Track
+	dts      uint64
+	cts      int64
+	keyFrame bool
+	data     []byte
+}
+
+// Time 帧的解码时间
+func (s fmp4Sample) Time() time.Duration {
+	return scaleDuration(s.dts, uint64(s.track.timescale))
+}
+
+// parseFMP4Init 解析初始化分片，返回支持的轨道，不支持的编码会被忽略
+func parseFMP4Init(data []byte) ([]*fmp4Track, error) {
+	moov, ok := fmp4Child(data, "moov")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing moov", ErrFMP4Invalid)
+	}
+	boxes, err := fmp4Boxes(moov.data, 0)
+	if err != nil {
+		return nil, err
+	}
+	var tracks []*fmp4Track
+	var lastErr error
+	for _, box := range boxes {
+		if box.typ != "trak" {
+			continue
+		}
+		track, err := parseFMP4Trak(box.data)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+	if len(tracks) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("%w: no track", ErrFMP4Invalid)
+		}
+		return nil, lastErr
+	}
+
+	if mvex, ok := fmp4Child(moov.data, "mvex"); ok {
+		boxes, err := fmp4Boxes(mvex.data, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, box := range boxes {
+			if box.typ != "trex" || len(box.data) < 24 {
+				continue
+			}
+			id := binary.BigEndian.Uint32(box.data[4:])
+			for _, track := range tracks {
+				if track.id == id {
+					track.defaultDuration = binary.BigEndian.Uint32(box.data[12:])
+					track.defaultSize = binary.BigEndian.Uint32(box.data[16:])
+					track.defaultFlags = binary.BigEndian.Uint32(box.data[20:])
+				}
+			}
+		}
+	}
+	return tracks, nil
+}
+
+func parseFMP4Trak(trak []byte) (*fmp4Track, error) {
+	track := &fmp4Track{}
+	tkhd, ok := fmp4Child(trak, "tkhd")
+	if !ok || len(tkhd.data) < 1 {
+		return nil, fmt.Errorf("%w: missing tkhd", ErrFMP4Invalid)
+	}
+	// version 1使用64位的时间
+	idPos := 12
+	if tkhd.data[0] == 1 {
+		idPos = 20
+	}
+	if len(tkhd.data) < idPos+4 {
+		return nil, fmt.Errorf("%w: tkhd", ErrFMP4Invalid)
+	}
+	track.id = binary.BigEndian.Uint32(tkhd.data[idPos:])
+
+	mdhd, ok := fmp4Child(trak, "mdia", "mdhd")
+	if !ok || len(mdhd.data) < 1 {
+		return nil, fmt.Errorf("%w: missing mdhd", ErrFMP4Invalid)
+	}
+	scalePos := 12
+	if mdhd.data[0] == 1 {
+		scalePos = 20
+	}
+	if len(mdhd.data) < scalePos+4 {
+		return nil, fmt.Errorf("%w: mdhd", ErrFMP4Invalid)
+	}
+	track.timescale = binary.BigEndian.Uint32(mdhd.data[scalePos:])
+	if track.timescale == 0 {
+		return nil, fmt.Errorf("%w: zero timescale", ErrFMP4Invalid)
+	}
+
+	stsd, ok := fmp4Child(trak, "mdia", "minf", "stbl", "stsd")
+	if !ok || len(stsd.data) < 8 {
+		return nil, fmt.Errorf("%w: missing stsd", ErrFMP4Invalid)
+	}
+	entries, err := fmp4Boxes(stsd.data[8:], 0)
+	if err != nil || len(entries) == 0 {
+		return nil, fmt.Errorf("%w: stsd", ErrFMP4Invalid)
+	}
+	if track.codec, err = parseFMP4SampleEntry(entries[0]); err != nil {
+		return nil, err
+	}
+	return track, nil
+}
+
+// parseFMP4SampleEntry 从stsd的第一个条目中读取编码信息
+func parseFMP4SampleEntry(entry fmp4Box) (av.CodecData, error) {
+	const (
+		visualEntryLength = 78
+		audioEntryLength  = 28
+	)
+	switch entry.typ {
+	case "avc1", "avc3":
+		if len(entry.data) < visualEntryLength {
+			return nil, fmt.Errorf("%w: %s", ErrFMP4Invalid, entry.typ)
+		}
+		avcC, ok := fmp4Child(entry.data[visualEntryLength:], "avcC")
+		if !ok {
+			return nil, fmt.Errorf("%w: missing avcC", ErrFMP4Invalid)
+		}
+		return h264parser.NewCodecDataFromAVCDecoderConfRecord(avcC.data)
+	case "hvc1", "hev1":
+		if len(entry.data) < visualEntryLength {
+			return nil, fmt.Errorf("%w: %s", ErrFMP4Invalid, entry.typ)
+		}
+		hvcC, ok := fmp4Child(entry.data[visualEntryLength:], "hvcC")
+		if !ok {
+			return nil, fmt.Errorf("%w: missing hvcC", ErrFMP4Invalid)
+		}
+		return h265parser.NewCodecDataFromAVCDecoderConfRecord(hvcC.data)
+	case "mp4a":
+		if len(entry.data) < audioEntryLength {
+			return nil, fmt.Errorf("%w: %s", ErrFMP4Invalid, entry.typ)
+		}
+		esdsBox, ok := fmp4Child(entry.data[audioEntryLength:], "esds")
+		if !ok {
+			return nil, fmt.Errorf("%w: missing esds", ErrFMP4Invalid)
+		}
+		// ElemStreamDesc需要带头部的完整box
+		full := make([]byte, 8+len(esdsBox.data))
+		binary.BigEndian.PutUint32(full, uint32(len(full)))
+		copy(full[4:], "esds")
+		copy(full[8:], esdsBox.data)
+		esds := new(mp4io.ElemStreamDesc)
+		if _, err := esds.Unmarshal(full, 0); err != nil {
+			return nil, err
+		}
+		if len(esds.DecConfig) == 0 {
+			return nil, fmt.Errorf("%w: missing aac config", ErrFMP4Invalid)
+		}
+		return aacparser.NewCodecDataFromMPEG4AudioConfigBytes(esds.DecConfig)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrFMP4Unsupported, entry.typ)
+}
+
+// parseFMP4Segment 解析媒体分片中所有moof描述的帧，不属于tracks的轨道会被忽略
+func parseFMP4Segment(data []byte, tracks []*fmp4Track) ([]fmp4Sample, error) {
+	boxes, err := fmp4Boxes(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	var samples []fmp4Sample
+	for _, moof := range boxes {
+		if moof.typ != "moof" {
+			continue
+		}
+		// moof.offset为box头部的位置，数据偏移以它为基准
+		moofStart := moof.offset
+		trafs, err := fmp4Boxes(moof.data, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, traf := range trafs {
+			if traf.typ != "traf" {
+				continue
+			}
+			if samples, err = parseFMP4Traf(data, moofStart, traf.data, tracks, samples); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return samples, nil
+}
+
+func parseFMP4Traf(data []byte, moofStart int, traf []byte, tracks []*fmp4Track, samples []fmp4Sample) ([]fmp4Sample, error) {
+	boxes, err := fmp4Boxes(traf, 0)
+	if err != nil {
+		return nil, err
+	}
+	var track *fmp4Track
+	base := uint64(moofStart)
+	var duration, size, flags uint32
+	var dts uint64
+	for _, box := range boxes {
+		b := box.data
+		switch box.typ {
+		case "tfhd":
+			if len(b) < 8 {
+				return nil, fmt.Errorf("%w: tfhd", ErrFMP4Invalid)
+			}
+			tfhdFlags := binary.BigEndian.Uint32(b) & 0xFFFFFF
+			id := binary.BigEndian.Uint32(b[4:])
+			for _, t := range tracks {
+				if t.id == id {
+					track = t
+				}
+			}
+			if track == nil {
+				return samples, nil
+			}
+			duration, size, flags = track.defaultDuration, track.defaultSize, track.defaultFlags
+			pos := 8
+			read := func(n int) (uint64, error) {
+				if len(b) < pos+n {
+					return 0, fmt.Errorf("%w: tfhd", ErrFMP4Invalid)
+				}
+				var v uint64
+				if n == 8 {
+					v = binary.BigEndian.Uint64(b[pos:])
+				} else {
+					v = uint64(binary.BigEndian.Uint32(b[pos:]))
+				}
+				pos += n
+				return v, nil
+			}
+			fields := []struct {
+				flag  uint32
+				size  int
+				value func(uint64)
+			}{
+				{fmp4TfhdBaseDataOffset, 8, func(v uint64) { base = v }},
+				{fmp4TfhdSampleDescIdx, 4, func(uint64) {}},
+				{fmp4TfhdDuration, 4, func(v uint64) { duration = uint32(v) }},
+				{fmp4TfhdSize, 4, func(v uint64) { size = uint32(v) }},
+				{fmp4TfhdFlags, 4, func(v uint64) { flags = uint32(v) }},
+			}
+			for _, field := range fields {
+				if tfhdFlags&field.flag == 0 {
+					continue
+				}
+				v, err := read(field.size)
+				if err != nil {
+					return nil, err
+				}
+				field.value(v)
+			}
+		case "tfdt":
+			if len(b) < 8 {
+				return nil, fmt.Errorf("%w: tfdt", ErrFMP4Invalid)
+			}
+			if b[0] == 1 {
+				if len(b) < 12 {
+					return nil, fmt.Errorf("%w: tfdt", ErrFMP4Invalid)
+				}
+				dts = binary.BigEndian.Uint64(b[4:])
+			} else {
+				dts = uint64(binary.BigEndian.Uint32(b[4:]))
+			}
+		}
+	}
+	if track == nil {
+		return samples, nil
+	}
+
+	// 没有data_offset的trun紧接着上一个trun的数据
+	next := base
+	for _, box := range boxes {
+		if box.typ != "trun" {
+			continue
+		}
+		b := box.data
+		if len(b) < 8 {
+			return nil, fmt.Errorf("%w: trun", ErrFMP4Invalid)
+		}
+		version := b[0]
+		trunFlags := binary.BigEndian.Uint32(b) & 0xFFFFFF
+		count := int(binary.BigEndian.Uint32(b[4:]))
+		pos := 8
+		offset := next
+		if trunFlags&fmp4TrunDataOffset != 0 {
+			if len(b) < pos+4 {
+				return nil, fmt.Errorf("%w: trun", ErrFMP4Invalid)
+			}
+			offset = uint64(int64(base) + int64(int32(binary.BigEndian.Uint32(b[pos:]))))
+			pos += 4
+		}
+		firstFlags, hasFirstFlags := uint32(0), false
+		if trunFlags&fmp4TrunFirstSampleFlag != 0 {
+			if len(b) < pos+4 {
+				return nil, fmt.Errorf("%w: trun", ErrFMP4Invalid)
+			}
+			firstFlags, hasFirstFlags = binary.BigEndian.Uint32(b[pos:]), true
+			pos += 4
+		}
+		entrySize := 0
+		for _, flag := range []uint32{fmp4TrunDuration, fmp4TrunSize, fmp4TrunFlags, fmp4TrunCts} {
+			if trunFlags&flag != 0 {
+				entrySize += 4
+			}
+		}
+		if count < 0 || len(b) < pos+count*entrySize {
+			return nil, fmt.Errorf("%w: trun", ErrFMP4Invalid)
+		}
+
+		for i := 0; i < count; i++ {
+			sampleDuration, sampleSize, sampleFlags := duration, size, flags
+			var cts int64
+			if trunFlags&fmp4TrunDuration != 0 {
+				sampleDuration = binary.BigEndian.Uint32(b[pos:])
+				pos += 4
+			}
+			if trunFlags&fmp4TrunSize != 0 {
+				sampleSize = binary.BigEndian.Uint32(b[pos:])
+				pos += 4
+			}
+			if trunFlags&fmp4TrunFlags != 0 {
+				sampleFlags = binary.BigEndian.Uint32(b[pos:])
+				pos += 4
+			} else if i == 0 && hasFirstFlags {
+				sampleFlags = firstFlags
+			}
+			if trunFlags&fmp4TrunCts != 0 {
+				if version == 0 {
+					cts = int64(binary.BigEndian.Uint32(b[pos:]))
+				} else {
+					cts = int64(int32(binary.BigEndian.Uint32(b[pos:])))
+				}
+				pos += 4
+			}
+
+			end := offset + uint64(sampleSize)
+			if end > uint64(len(data)) {
+				return nil, fmt.Errorf("%w: sample out of range", ErrFMP4Invalid)
+			}
+			samples = append(samples, fmp4Sample{
+				track:    track,
+				dts:      dts,
+				cts:      cts,
+				keyFrame: sampleFlags&fmp4NonSyncSample == 0,
+				data:     data[offset:end],
+			})
+			offset = end
+			dts += uint64(sampleDuration)
+		}
+		next = offset
+	}
+	return samples, nil
+}
+
+// scaleDuration 将以timescale为单位的时间转换为time.Duration，避免直接相乘溢出
+func scaleDuration(ticks uint64, timescale uint64) time.Duration {
+	if timescale == 0 {
+		return 0
+	}
+	return time.Duration(ticks/timescale)*time.Second + time.Duration(ticks%timescale*uint64(time.Second)/timescale)
+}
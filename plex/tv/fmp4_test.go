@@ -0,0 +1,273 @@
+package tv
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// fmp4TestFragment 生成moof和mdat，traf的data_offset参数为mdat内容相对moof开头的位置
+func fmp4TestFragment(traf func(dataOffset uint32) []byte, mdat []byte) []byte {
+	moof := func(dataOffset uint32) []byte {
+		return mp4Box("moof", mp4Box("mfhd", be32(0, 1)), traf(dataOffset))
+	}
+	fragment := moof(uint32(len(moof(0)) + 8))
+	return append(fragment, mp4Box("mdat", mdat)...)
+}
+
+func tfdtV1(dts uint64) []byte {
+	return mp4Box("tfdt", be32(0x01000000), be64(dts))
+}
+
+func TestParseFMP4Init(t *testing.T) {
+	tracks, err := parseFMP4Init(fmp4InitSegment(t, 1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 {
+		t.Fatalf("got %d tracks", len(tracks))
+	}
+	if tracks[0].id != 1 || tracks[0].timescale != 90000 || tracks[0].codec.Type() != av.H264 {
+		t.Errorf("video track = %+v", tracks[0])
+	}
+	video := tracks[0].codec.(av.VideoCodecData)
+	if video.Width() != 640 || video.Height() != 360 {
+		t.Errorf("video size = %dx%d", video.Width(), video.Height())
+	}
+	if tracks[1].id != 2 || tracks[1].timescale != 48000 || tracks[1].codec.Type() != av.AAC {
+		t.Errorf("audio track = %+v", tracks[1])
+	}
+	if audio := tracks[1].codec.(av.AudioCodecData); audio.SampleRate() != 48000 {
+		t.Errorf("sample rate = %d", audio.SampleRate())
+	}
+
+	// trex中的默认值
+	init := append(mp4Box("ftyp", []byte("iso6"), be32(0)), mp4Box("moov",
+		fmp4Trak(t, 1, 90000),
+		mp4Box("mvex", mp4Box("trex", be32(0, 1, 1, 3000, 4, fmp4NonSyncSample))))...)
+	if tracks, err = parseFMP4Init(init); err != nil {
+		t.Fatal(err)
+	}
+	if track := tracks[0]; track.defaultDuration != 3000 || track.defaultSize != 4 || track.defaultFlags != fmp4NonSyncSample {
+		t.Errorf("trex defaults = %+v", track)
+	}
+}
+
+func TestParseFMP4InitUnsupported(t *testing.T) {
+	ac3 := mp4Box("trak",
+		mp4Box("tkhd", be32(0, 0, 0, 3, 0, 0)),
+		mp4Box("mdia",
+			mp4Box("mdhd", be32(0, 0, 0, 48000, 0, 0)),
+			mp4Box("minf", mp4Box("stbl", mp4Box("stsd", be32(0, 1), mp4Box("ac-3", make([]byte, 28)))))))
+
+	// 不支持的轨道被忽略
+	init := append(mp4Box("ftyp", []byte("iso6"), be32(0)), mp4Box("moov", fmp4Trak(t, 1, 90000), ac3)...)
+	tracks, err := parseFMP4Init(init)
+	if err != nil || len(tracks) != 1 || tracks[0].id != 1 {
+		t.Errorf("parseFMP4Init() = %v, %v", tracks, err)
+	}
+
+	init = append(mp4Box("ftyp", []byte("iso6"), be32(0)), mp4Box("moov", ac3)...)
+	if _, err = parseFMP4Init(init); !errors.Is(err, ErrFMP4Unsupported) {
+		t.Errorf("only unsupported tracks error = %v", err)
+	}
+	if _, err = parseFMP4Init(mp4Box("ftyp", []byte("iso6"), be32(0))); !errors.Is(err, ErrFMP4Invalid) {
+		t.Errorf("missing moov error = %v", err)
+	}
+}
+
+func TestParseFMP4Segment(t *testing.T) {
+	type sample struct {
+		dts  uint64
+		cts  int64
+		key  bool
+		data string
+	}
+	tests := []struct {
+		name string
+		traf func(dataOffset uint32) []byte
+		mdat string
+		want []sample
+		err  error
+	}{
+		{
+			name: "tfhd defaults",
+			traf: func(off uint32) []byte {
+				return mp4Box("traf",
+					mp4Box("tfhd", be32(0x020000|fmp4TfhdDuration|fmp4TfhdSize|fmp4TfhdFlags, 1, 3000, 3, fmp4NonSyncSample)),
+					tfdtV1(90000),
+					mp4Box("trun", be32(fmp4TrunDataOffset, 2, off)))
+			},
+			mdat: "aaabbb",
+			want: []sample{{90000, 0, false, "aaa"}, {93000, 0, false, "bbb"}},
+		},
+		{
+			name: "trex defaults",
+			traf: func(off uint32) []byte {
+				return mp4Box("traf",
+					mp4Box("tfhd", be32(0x020000, 1)),
+					tfdtV1(0),
+					mp4Box("trun", be32(fmp4TrunDataOffset|fmp4TrunSize, 2, off, 4, 2)))
+			},
+			mdat: "aaaabb",
+			want: []sample{{0, 0, false, "aaaa"}, {3000, 0, false, "bb"}},
+		},
+		{
+			name: "first sample flags",
+			traf: func(off uint32) []byte {
+				return mp4Box("traf",
+					mp4Box("tfhd", be32(0x020000|fmp4TfhdDuration|fmp4TfhdFlags, 1, 3600, fmp4NonSyncSample)),
+					tfdtV1(0),
+					mp4Box("trun", be32(fmp4TrunDataOffset|fmp4TrunFirstSampleFlag|fmp4TrunSize, 3, off, 0x02000000, 1, 1, 1)))
+			},
+			mdat: "abc",
+			want: []sample{{0, 0, true, "a"}, {3600, 0, false, "b"}, {7200, 0, false, "c"}},
+		},
+		{
+			name: "per sample fields and negative cts",
+			traf: func(off uint32) []byte {
+				flags := uint32(fmp4TrunDataOffset | fmp4TrunDuration | fmp4TrunSize | fmp4TrunFlags | fmp4TrunCts)
+				return mp4Box("traf",
+					mp4Box("tfhd", be32(0x020000, 1)),
+					tfdtV1(0),
+					mp4Box("trun", be32(0x01000000|flags, 2, off, 3000, 2, 0, 3000, 6000, 1, fmp4NonSyncSample, uint32(0xffffffff-2999))))
+			},
+			mdat: "aab",
+			want: []sample{{0, 3000, true, "aa"}, {3000, -3000, false, "b"}},
+		},
+		{
+			name: "base data offset",
+			traf: func(off uint32) []byte {
+				// moof在数据开头，data_offset就是mdat内容的绝对位置
+				return mp4Box("traf",
+					mp4Box("tfhd", append(be32(fmp4TfhdBaseDataOffset|fmp4TfhdDuration, 1), append(be64(uint64(off)), be32(1000)...)...)),
+					tfdtV1(0),
+					mp4Box("trun", be32(fmp4TrunSize, 2, 1, 2)))
+			},
+			mdat: "abb",
+			want: []sample{{0, 0, false, "a"}, {1000, 0, false, "bb"}},
+		},
+		{
+			name: "second trun continues after the first",
+			traf: func(off uint32) []byte {
+				return mp4Box("traf",
+					mp4Box("tfhd", be32(0x020000|fmp4TfhdDuration, 1, 1000)),
+					tfdtV1(0),
+					mp4Box("trun", be32(fmp4TrunDataOffset|fmp4TrunSize, 1, off, 2)),
+					mp4Box("trun", be32(fmp4TrunSize, 1, 3)))
+			},
+			mdat: "aabbb",
+			want: []sample{{0, 0, false, "aa"}, {1000, 0, false, "bbb"}},
+		},
+		{
+			name: "tfdt version 0",
+			traf: func(off uint32) []byte {
+				return mp4Box("traf",
+					mp4Box("tfhd", be32(0x020000|fmp4TfhdDuration|fmp4TfhdSize, 1, 1000, 1)),
+					mp4Box("tfdt", be32(0, 450000)),
+					mp4Box("trun", be32(fmp4TrunDataOffset, 1, off)))
+			},
+			mdat: "a",
+			want: []sample{{450000, 0, false, "a"}},
+		},
+		{
+			name: "unknown track",
+			traf: func(off uint32) []byte {
+				return mp4Box("traf",
+					mp4Box("tfhd", be32(0x020000|fmp4TfhdSize, 9, 1)),
+					tfdtV1(0),
+					mp4Box("trun", be32(fmp4TrunDataOffset, 1, off)))
+			},
+			mdat: "a",
+		},
+		{
+			name: "sample out of range",
+			traf: func(off uint32) []byte {
+				return mp4Box("traf",
+					mp4Box("tfhd", be32(0x020000, 1)),
+					tfdtV1(0),
+					mp4Box("trun", be32(fmp4TrunDataOffset|fmp4TrunSize, 1, off, 100)))
+			},
+			mdat: "a",
+			err:  ErrFMP4Invalid,
+		},
+		{
+			name: "truncated trun",
+			traf: func(off uint32) []byte {
+				return mp4Box("traf",
+					mp4Box("tfhd", be32(0x020000, 1)),
+					mp4Box("trun", be32(fmp4TrunDataOffset|fmp4TrunSize, 5, off, 1)))
+			},
+			mdat: "a",
+			err:  ErrFMP4Invalid,
+		},
+	}
+
+	tracks := []*fmp4Track{{id: 1, timescale: 90000, defaultDuration: 3000, defaultSize: 4, defaultFlags: fmp4NonSyncSample}}
+	for _, test := range tests {
+		samples, err := parseFMP4Segment(fmp4TestFragment(test.traf, []byte(test.mdat)), tracks)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: error = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		var got []sample
+		for _, s := range samples {
+			got = append(got, sample{s.dts, s.cts, s.keyFrame, string(s.data)})
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: samples = %+v, want %+v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: sample %d = %+v, want %+v", test.name, i, got[i], test.want[i])
+			}
+		}
+	}
+}
+
+func TestParseFMP4SegmentMultipleFragments(t *testing.T) {
+	tracks, err := parseFMP4Init(fmp4InitSegment(t, 1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 一个分片中可以有多个moof和mdat，数据偏移分别以各自的moof为基准
+	data := append(fmp4MediaSegment(1, 180000, testVideoSamples(3)), fmp4MediaSegment(2, 96000, testAudioSamples(2))...)
+	samples, err := parseFMP4Segment(data, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 5 {
+		t.Fatalf("got %d samples", len(samples))
+	}
+	if s := samples[0]; s.track != tracks[0] || !s.keyFrame || s.Time() != 2*time.Second || string(s.data[4:]) != "\x65\x88" {
+		t.Errorf("first video sample = %+v", s)
+	}
+	if s := samples[2]; s.keyFrame || s.Time() != 2*time.Second+80*time.Millisecond || s.cts != 3600 {
+		t.Errorf("third video sample = %+v", s)
+	}
+	if s := samples[4]; s.track != tracks[1] || s.Time() != 2*time.Second+1024*time.Second/48000 || string(s.data) != "\x21\x10\x01" {
+		t.Errorf("second audio sample = %+v", s)
+	}
+}
+
+func TestScaleDuration(t *testing.T) {
+	tests := []struct {
+		ticks     uint64
+		timescale uint64
+		want      time.Duration
+	}{
+		{90000, 90000, time.Second},
+		{1024, 48000, 21333333 * time.Nanosecond},
+		// 直接相乘会溢出的大时间戳
+		{1 << 40, 10000000, time.Duration(1<<40) * 100 * time.Nanosecond},
+		{5, 0, 0},
+	}
+	for _, test := range tests {
+		if got := scaleDuration(test.ticks, test.timescale); got != test.want {
+			t.Errorf("scaleDuration(%d, %d) = %v, want %v", test.ticks, test.timescale, got, test.want)
+		}
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"plex-tuner/myio"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafov/m3u8"
@@ -18,15 +22,89 @@ import (
 var (
 	ErrUnkownM3u8PlaylistType = errors.New("unkown m3u8 playlist type")
 	ErrReadClosedStream       = errors.New("io: read/write on closed stream")
+
+	// 上游返回的错误，StatusError按状态码包装为其中之一
+	ErrUpstreamForbidden   = errors.New("upstream forbidden")
+	ErrUpstreamNotFound    = errors.New("upstream not found")
+	ErrUpstreamRateLimited = errors.New("upstream rate limited")
+	// ErrUpstreamNotMedia 上游返回了网页等非媒体数据
+	ErrUpstreamNotMedia = errors.New("upstream response is not media")
 )
 
 const MAX_DOWNLOADER = 5
 
+const (
+	// 播放列表地址在过期前多久切换为新的地址
+	hlsRefreshBefore = time.Minute
+	// 连续切换地址的最大次数
+	hlsMaxSwitches = 10
+	// 请求过于频繁时重试前等待的最长时间，Retry-After更长时也只等待这么久
+	maxRetryWait = 10 * time.Second
+	// 请求过于频繁但没有Retry-After时的等待时间
+	defaultRetryWait = time.Second
+)
+
+// HLSOptions hls类型的选项
+type HLSOptions struct {
+	// Tuner 配置后播放时占用设备的一个调谐器，同一设备的频道共享调谐器数量的限制。xtream来源导入hls频道时自动生成
+	Tuner *TunerOptions `json:"tuner"`
+}
+
+// StatusError 上游返回了非2xx的状态码
+type StatusError struct {
+	URL        string
+	StatusCode int
+	// RetryAfter 响应头Retry-After要求的等待时间，没有时为0
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("unexpected status %d (retry after %v): %s", e.StatusCode, e.RetryAfter, e.URL)
+	}
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.URL)
+}
+
+// Unwrap 可以通过errors.Is判断是否为禁止访问、不存在或者请求过于频繁
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrUpstreamForbidden
+	case e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone:
+		return ErrUpstreamNotFound
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrUpstreamRateLimited
+	case e.StatusCode == http.StatusServiceUnavailable && e.RetryAfter > 0:
+		return ErrUpstreamRateLimited
+	}
+	return nil
+}
+
+// RetryAfter 上游要求的重试等待时间，err不是StatusError或没有要求时为0
+func RetryAfter(err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// PlaylistResolver 返回新的播放列表地址及其过期时间，过期时间为零值时不会过期。
+// failed为请求失败的地址，为nil时表示首次获取或者地址即将过期。flv流也通过它获取新的地址
+type PlaylistResolver func(ctx context.Context, failed *url.URL) (*url.URL, time.Time, error)
+
 type HLSStream struct {
 	playlistUrl      *url.URL
 	lastSegmentSeqId uint64
 	loopErr          error
 
+	resolver    PlaylistResolver
+	expires     time.Time
+	switches    int
+	switched    bool
+	segmentLock *sync.Mutex
+	segmentErr  error
+
 	chunkChan    chan *myio.ChunkIO
 	currentChunk *myio.ChunkIO
 	ctx          context.Context
@@ -42,7 +120,37 @@ func NewHLSStream(playlistUrl *url.URL) *HLSStream {
 	return s
 }
 
+// NewResolvingHLSStream 创建播放列表地址由resolver提供的hls流，
+// 播放列表或分片请求失败、地址即将过期时会切换为resolver返回的新地址，观看不会中断
+func NewResolvingHLSStream(resolver PlaylistResolver) *HLSStream {
+	s := NewHLSStream(nil)
+	s.resolver = resolver
+	s.segmentLock = new(sync.Mutex)
+	return s
+}
+
 func (s *HLSStream) Start() error {
+	if s.resolver != nil {
+		var err error
+		s.playlistUrl, s.expires, err = s.resolver(s.ctx, nil)
+		if err != nil {
+			return err
+		}
+	}
+	// 先获取一次播放列表，所有地址都无法获取时直接返回错误，播放时可以返回对应的状态码
+	_, err := s.fetchPlaylist()
+	for err != nil && s.canSwitch() {
+		if !waitRetry(s.ctx, err) {
+			return ErrReadClosedStream
+		}
+		if switchErr := s.switchPlaylist(s.playlistUrl); switchErr != nil {
+			return err
+		}
+		_, err = s.fetchPlaylist()
+	}
+	if err != nil {
+		return err
+	}
 	go s.loopLoadSegmentData()
 	return nil
 }
@@ -83,6 +191,14 @@ HLSStreamReadStart:
 		}
 		goto HLSStreamReadStart
 	}
+	if errors.Is(err, myio.ErrReadClosedIO) {
+		// 分片下载失败时chunk会被关闭，等下载结束后返回失败的原因
+		for range s.chunkChan {
+		}
+		if s.loopErr != nil {
+			return n, s.loopErr
+		}
+	}
 
 	return n, err
 }
@@ -100,12 +216,31 @@ func (s *HLSStream) loopLoadSegmentData() {
 		default:
 		}
 
+		if s.resolver != nil && !s.expires.IsZero() && time.Until(s.expires) < hlsRefreshBefore {
+			if s.loopErr = s.switchPlaylist(nil); s.loopErr != nil {
+				close(s.chunkChan)
+				return
+			}
+		}
+
 		var playlist *m3u8.MediaPlaylist
 		playlist, s.loopErr = s.fetchPlaylist()
 		if s.loopErr != nil {
+			if s.canSwitch() && waitRetry(s.ctx, s.loopErr) {
+				if s.loopErr = s.switchPlaylist(s.playlistUrl); s.loopErr == nil {
+					continue
+				}
+			}
 			close(s.chunkChan)
 			return
 		}
+		// 切换地址后分片序号可能不连续，序号倒退时从新列表的开头开始
+		if s.switched {
+			s.switched = false
+			if n := len(playlist.Segments); n > 0 && playlist.SeqNo+uint64(n) <= s.lastSegmentSeqId {
+				s.lastSegmentSeqId = 0
+			}
+		}
 
 		startTime := time.Now()
 
@@ -153,6 +288,22 @@ func (s *HLSStream) loopLoadSegmentData() {
 				return
 			}
 		}
+		if s.resolver != nil {
+			// 分片下载失败时已跳过该分片，切换地址后继续
+			if err := s.takeSegmentErr(); err != nil {
+				if !s.canSwitch() || !waitRetry(s.ctx, err) {
+					s.loopErr = err
+					close(s.chunkChan)
+					return
+				}
+				if s.loopErr = s.switchPlaylist(s.playlistUrl); s.loopErr != nil {
+					close(s.chunkChan)
+					return
+				}
+				continue
+			}
+			s.switches = 0
+		}
 
 		var sleepDuration time.Duration = 0
 		// 整个列表返回的为空，则休眠一秒
@@ -211,7 +362,7 @@ func (s *HLSStream) parseSegmentUrl(uri string) (*url.URL, error) {
 
 func (s *HLSStream) fetchPlaylist() (playlist *m3u8.MediaPlaylist, err error) {
 	playlistUrl := s.playlistUrl.String()
-	tryTimes(3, func() error {
+	tryTimes(s.ctx, 3, func() error {
 		playlist, err = fetchPlaylist(s.ctx, playlistUrl)
 		return err
 	})
@@ -219,7 +370,7 @@ func (s *HLSStream) fetchPlaylist() (playlist *m3u8.MediaPlaylist, err error) {
 }
 
 func (s *HLSStream) fetchMapData(url string) (data []byte, err error) {
-	tryTimes(3, func() error {
+	tryTimes(s.ctx, 3, func() error {
 		data, err = fetchMapData(s.ctx, url)
 		return err
 	})
@@ -228,10 +379,44 @@ func (s *HLSStream) fetchMapData(url string) (data []byte, err error) {
 
 func (s *HLSStream) chunkDownloader(ctx context.Context, extMapData []byte, chunk *myio.ChunkIO, i int, url string) func() error {
 	return func() error {
-		return tryTimes(3, func() error {
+		err := tryTimes(ctx, 3, func() error {
 			return fetchSegment(ctx, url, chunk, i, extMapData)
 		})
+		if err != nil && s.resolver != nil && ctx.Err() == nil {
+			// 可以切换地址时跳过失败的分片，不中断观看
+			chunk.ZeroCopyFillChunk(i, nil)
+			s.segmentLock.Lock()
+			s.segmentErr = err
+			s.segmentLock.Unlock()
+			return nil
+		}
+		return err
+	}
+}
+
+func (s *HLSStream) takeSegmentErr() error {
+	s.segmentLock.Lock()
+	defer s.segmentLock.Unlock()
+	err := s.segmentErr
+	s.segmentErr = nil
+	return err
+}
+
+func (s *HLSStream) canSwitch() bool {
+	return s.resolver != nil && s.switches < hlsMaxSwitches && s.ctx.Err() == nil
+}
+
+// switchPlaylist 通过resolver切换播放列表地址，failed为失效的地址
+func (s *HLSStream) switchPlaylist(failed *url.URL) error {
+	s.switches++
+	playlistUrl, expires, err := s.resolver(s.ctx, failed)
+	if err != nil {
+		return err
 	}
+	s.playlistUrl = playlistUrl
+	s.expires = expires
+	s.switched = true
+	return nil
 }
 
 func fetchPlaylist(ctx context.Context, url string) (*m3u8.MediaPlaylist, error) {
@@ -244,13 +429,22 @@ func fetchPlaylist(ctx context.Context, url string) (*m3u8.MediaPlaylist, error)
 	if err != nil {
 		return nil, err
 	}
+	if err = checkStatus(resp); err != nil {
+		return nil, err
+	}
 
-	playlist, _, err := m3u8.DecodeFrom(resp.Body, false)
-	io.Copy(io.Discard, resp.Body)
+	data, err := io.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
 		return nil, err
 	}
+	if err = checkMedia(resp, data); err != nil {
+		return nil, err
+	}
+	playlist, _, err := m3u8.DecodeFrom(bytes.NewReader(data), false)
+	if err != nil {
+		return nil, err
+	}
 
 	if playlist, ok := playlist.(*m3u8.MediaPlaylist); ok {
 		return playlist, nil
@@ -268,7 +462,17 @@ func fetchMapData(ctx context.Context, url string) ([]byte, error) {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	return io.ReadAll(resp.Body)
+	if err = checkStatus(resp); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkMedia(resp, data); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 func fetchSegment(ctx context.Context, segmentUrl string, chunk *myio.ChunkIO, i int, extMapData []byte) error {
@@ -281,26 +485,117 @@ func fetchSegment(ctx context.Context, segmentUrl string, chunk *myio.ChunkIO, i
 		return err
 	}
 	defer resp.Body.Close()
-	var dataReader io.Reader
-	if len(extMapData) > 0 {
-		dataReader = io.MultiReader(bytes.NewReader(extMapData), resp.Body)
-	} else {
-		dataReader = resp.Body
+	if err = checkStatus(resp); err != nil {
+		return err
 	}
-	data, err := io.ReadAll(dataReader)
+	data, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
+	if err = checkMedia(resp, data); err != nil {
+		return err
+	}
+	// 没有EXT-X-MAP时分片应为ts，使用packed audio的分片以id3标签或音频帧开头
+	if len(extMapData) == 0 && len(data) > 0 && data[0] != 0x47 && sniffSourceType(data) != "radio" {
+		return fmt.Errorf("%w: missing ts sync byte: %s", ErrUpstreamNotMedia, segmentUrl)
+	}
+	if len(extMapData) > 0 {
+		data = append(append(make([]byte, 0, len(extMapData)+len(data)), extMapData...), data...)
+	}
 	chunk.ZeroCopyFillChunk(i, data)
 	return nil
 }
 
-func tryTimes(times int, fn func() error) error {
+// checkStatus 非2xx的状态码返回StatusError，并丢弃响应内容
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return &StatusError{
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter 解析秒数或者http时间格式的Retry-After
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		return 0
+	}
+	if date, err := http.ParseTime(value); err == nil && time.Until(date) > 0 {
+		return time.Until(date).Round(time.Second)
+	}
+	return 0
+}
+
+// checkMedia 响应为网页或json时返回ErrUpstreamNotMedia，一般是cdn的错误页或者登录页
+func checkMedia(resp *http.Response, head []byte) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "text/html" || isHTML(head):
+		return fmt.Errorf("%w: html page: %s", ErrUpstreamNotMedia, resp.Request.URL)
+	case mediaType == "application/json":
+		return fmt.Errorf("%w: json: %s", ErrUpstreamNotMedia, resp.Request.URL)
+	}
+	return nil
+}
+
+// retryable 禁止访问、不存在和非媒体数据重试也不会成功，交给切换地址或者重连的逻辑处理
+func retryable(err error) bool {
+	return !errors.Is(err, ErrUpstreamForbidden) && !errors.Is(err, ErrUpstreamNotFound) &&
+		!errors.Is(err, ErrUpstreamNotMedia)
+}
+
+// retryWait 重试前需要等待的时间，请求过于频繁时按Retry-After等待，最长maxRetryWait
+func retryWait(err error) time.Duration {
+	if !errors.Is(err, ErrUpstreamRateLimited) {
+		return 0
+	}
+	wait := RetryAfter(err)
+	if wait <= 0 {
+		wait = defaultRetryWait
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait
+}
+
+// waitRetry 等待retryWait的时间，ctx结束时返回false
+func waitRetry(ctx context.Context, err error) bool {
+	wait := retryWait(err)
+	if wait <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func tryTimes(ctx context.Context, times int, fn func() error) error {
 	var err error
 	for i := 0; i < times; i++ {
 		err = fn()
-		if err == nil {
-			return nil
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if i+1 < times && !waitRetry(ctx, err) {
+			return err
 		}
 	}
 	return err
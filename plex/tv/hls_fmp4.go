@@ -0,0 +1,166 @@
+package tv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// FMP4HLSStream 把分片为fmp4的hls转封装为ts输出，EXT-X-MAP中的编码信息作为ts的头部。
+// 下载、切换地址由HLSStream完成，每个分片前都带有初始化分片
+type FMP4HLSStream struct {
+	hls     *HLSStream
+	muxer   *tsMuxer
+	frames  chan Frame
+	pending []byte
+	loopErr error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewFMP4HLSStream(playlistUrl *url.URL) *FMP4HLSStream {
+	return newFMP4HLSStream(NewHLSStream(playlistUrl))
+}
+
+// NewResolvingFMP4HLSStream 创建播放列表地址由resolver提供的fmp4 hls流，地址的切换与NewResolvingHLSStream相同
+func NewResolvingFMP4HLSStream(resolver PlaylistResolver) *FMP4HLSStream {
+	return newFMP4HLSStream(NewResolvingHLSStream(resolver))
+}
+
+func newFMP4HLSStream(hls *HLSStream) *FMP4HLSStream {
+	s := &FMP4HLSStream{
+		hls:    hls,
+		muxer:  newTSMuxer(),
+		frames: make(chan Frame),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *FMP4HLSStream) Start() error {
+	if err := s.hls.Start(); err != nil {
+		return err
+	}
+	go s.loop()
+	return nil
+}
+
+func (s *FMP4HLSStream) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		s.pending = frame.Data
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *FMP4HLSStream) ReadFrame() (Frame, error) {
+	select {
+	case frame, ok := <-s.frames:
+		if !ok {
+			if s.loopErr != nil {
+				return Frame{}, s.loopErr
+			}
+			return Frame{}, ErrReadClosedStream
+		}
+		return frame, nil
+	case <-s.ctx.Done():
+		return Frame{}, ErrReadClosedStream
+	}
+}
+
+func (s *FMP4HLSStream) Close() error {
+	s.cancel()
+	return s.hls.Close()
+}
+
+func (s *FMP4HLSStream) ContentType() string {
+	return ContentTypeTS
+}
+
+func (s *FMP4HLSStream) loop() {
+	defer close(s.frames)
+	if err := s.play(); err != nil && s.ctx.Err() == nil {
+		s.loopErr = err
+	}
+}
+
+// play 读取第一个初始化分片得到编码信息，之后依次转封装分片中的帧
+func (s *FMP4HLSStream) play() error {
+	r := bufio.NewReader(s.hls)
+	var moov []byte
+	for moov == nil {
+		typ, header, size, err := readMP4BoxHeader(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case typ == "moov":
+			if moov, err = readMP4Box(r, header, size); err != nil {
+				return err
+			}
+		case typ == "moof":
+			return fmt.Errorf("%w: missing EXT-X-MAP", ErrFMP4Invalid)
+		case size == 0:
+			return fmt.Errorf("%w: missing moov", ErrFMP4Invalid)
+		default:
+			if _, err = r.Discard(int(size) - len(header)); err != nil {
+				return err
+			}
+		}
+	}
+	// 之后每个分片前重复的ftyp和moov会被跳过
+	demuxer, err := newFMP4StreamDemuxer(r, moov)
+	if err != nil {
+		return err
+	}
+	header, err := s.muxer.WriteHeader(demuxer.codecs)
+	if err != nil {
+		return err
+	}
+	if err = s.emit(Frame{Data: header, Header: true}); err != nil {
+		return err
+	}
+
+	// 直播的分片时间很大，从第一帧开始计时
+	first := time.Duration(-1)
+	for {
+		packet, err := demuxer.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if first < 0 {
+			first = packet.Time
+		}
+		packet.Time -= first
+		if packet.Time < 0 {
+			packet.Time = 0
+		}
+		data, keyFrame, err := s.muxer.WritePacket(packet)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if err = s.emit(Frame{Data: data, KeyFrame: keyFrame}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *FMP4HLSStream) emit(frame Frame) error {
+	select {
+	case s.frames <- frame:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
@@ -0,0 +1,264 @@
+package tv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tsSegment 以ts同步字节开头的分片内容
+func tsSegment(name string) []byte {
+	data := make([]byte, 188)
+	data[0] = 0x47
+	copy(data[4:], name)
+	return data
+}
+
+func newHLSServer(t *testing.T, handle func(w http.ResponseWriter, r *http.Request) bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handle != nil && handle(w, r) {
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".m3u8") {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:1,\nseg1.ts\n#EXT-X-ENDLIST\n")
+			return
+		}
+		w.Write(tsSegment(r.URL.Path))
+	}))
+}
+
+func TestHLSRetryAfter(t *testing.T) {
+	var limited int32
+	srv := newHLSServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasSuffix(r.URL.Path, ".m3u8") && atomic.AddInt32(&limited, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return true
+		}
+		return false
+	})
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL + "/live.m3u8")
+	s := NewHLSStream(u)
+	defer s.Close()
+	start := time.Now()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, want at least Retry-After", elapsed)
+	}
+	buf := make([]byte, 188)
+	if _, err := io.ReadFull(s, buf); err != nil || buf[0] != 0x47 {
+		t.Fatalf("read %x, %v", buf[:4], err)
+	}
+}
+
+func TestHLSNotMediaSegment(t *testing.T) {
+	srv := newHLSServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasSuffix(r.URL.Path, ".ts") {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>blocked</html>"))
+			return true
+		}
+		return false
+	})
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL + "/live.m3u8")
+	s := NewHLSStream(u)
+	defer s.Close()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := io.ReadAll(s)
+	if !errors.Is(err, ErrUpstreamNotMedia) {
+		t.Errorf("err = %v, want %v", err, ErrUpstreamNotMedia)
+	}
+}
+
+func TestResolvingHLSStartSwitches(t *testing.T) {
+	srv := newHLSServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Query().Get("host") == "bad" {
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+		return false
+	})
+	defer srv.Close()
+
+	var calls int
+	s := NewResolvingHLSStream(func(ctx context.Context, failed *url.URL) (*url.URL, time.Time, error) {
+		calls++
+		host := "bad"
+		if failed != nil {
+			host = "good"
+		}
+		u, _ := url.Parse(srv.URL + "/live.m3u8?host=" + host)
+		return u, time.Time{}, nil
+	})
+	defer s.Close()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || s.playlistUrl.Query().Get("host") != "good" {
+		t.Errorf("calls = %d, playlist = %s", calls, s.playlistUrl)
+	}
+}
+
+func TestResolvingHLSStartForbidden(t *testing.T) {
+	srv := newHLSServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	})
+	defer srv.Close()
+
+	s := NewResolvingHLSStream(func(ctx context.Context, failed *url.URL) (*url.URL, time.Time, error) {
+		u, _ := url.Parse(srv.URL + "/live.m3u8")
+		return u, time.Time{}, nil
+	})
+	defer s.Close()
+	err := s.Start()
+	if !errors.Is(err, ErrUpstreamForbidden) {
+		t.Errorf("err = %v, want %v", err, ErrUpstreamForbidden)
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	tests := []struct {
+		err  error
+		want time.Duration
+	}{
+		{&StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 3 * time.Second}, 3 * time.Second},
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, defaultRetryWait},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Hour}, maxRetryWait},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, 0},
+		{&StatusError{StatusCode: http.StatusForbidden, RetryAfter: time.Second}, 0},
+	}
+	for _, test := range tests {
+		if got := retryWait(test.err); got != test.want {
+			t.Errorf("retryWait(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestFMP4HLSStream(t *testing.T) {
+	init := fmp4InitSegment(t, 1, 2)
+	segment := func(i int) []byte {
+		data := fmp4MediaSegment(1, uint64(i)*90000, testVideoSamples(25))
+		return append(data, fmp4MediaSegment(2, uint64(i)*47*1024, testAudioSamples(47))...)
+	}
+	srv := newHLSServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		switch r.URL.Path {
+		case "/live.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:1\n#EXT-X-MAP:URI=\"init.mp4\"\n"+
+				"#EXTINF:1,\nseg0.m4s\n#EXTINF:1,\nseg1.m4s\n")
+		case "/init.mp4":
+			w.Write(init)
+		case "/seg0.m4s":
+			w.Write(segment(0))
+		case "/seg1.m4s":
+			w.Write(segment(1))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return true
+	})
+	defer srv.Close()
+
+	s := NewResolvingFMP4HLSStream(func(ctx context.Context, failed *url.URL) (*url.URL, time.Time, error) {
+		u, _ := url.Parse(srv.URL + "/live.m3u8")
+		return u, time.Time{}, nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// 头部及两个分片中的帧，第二个分片前重复的初始化分片被跳过
+	var output bytes.Buffer
+	for frames := 0; frames < 1+2*(25+47); frames++ {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (frames == 0) != frame.Header {
+			t.Fatalf("frame %d header = %v", frames, frame.Header)
+		}
+		output.Write(frame.Data)
+	}
+	s.Close()
+	codecs, packets, _ := demuxTSOutput(t, &output)
+	checkTSOutput(t, codecs, packets, 50, 94)
+	if packets[0].Time != tsTimeOffset {
+		t.Errorf("first packet time = %v", packets[0].Time)
+	}
+}
+
+func TestFMP4HLSStreamMissingMap(t *testing.T) {
+	srv := newHLSServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasSuffix(r.URL.Path, ".ts") {
+			w.Write(fmp4MediaSegment(1, 0, testVideoSamples(1)))
+			return true
+		}
+		return false
+	})
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL + "/live.m3u8")
+	s := NewFMP4HLSStream(u)
+	defer s.Close()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// 没有EXT-X-MAP时分片按ts检查
+	if _, err := s.ReadFrame(); !errors.Is(err, ErrUpstreamNotMedia) {
+		t.Errorf("err = %v, want %v", err, ErrUpstreamNotMedia)
+	}
+}
+
+func TestHLSTunerLimit(t *testing.T) {
+	srv := newHLSServer(t, nil)
+	defer srv.Close()
+
+	// 同一设备只有一个调谐器，第二个频道在第一个关闭前无法播放
+	options := json.RawMessage(`{"tuner":{"device":"panel#1","tuner_count":1}}`)
+	first, err := NewStream(&Env{}, Source{Id: "1", URL: srv.URL + "/1.m3u8", Type: "hls", Options: options})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if err = first.Start(); err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewStream(&Env{}, Source{Id: "2", URL: srv.URL + "/2.m3u8", Type: "hls", Options: options})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = second.Start(); !errors.Is(err, ErrTunerBusy) {
+		t.Fatalf("second Start() error = %v, want %v", err, ErrTunerBusy)
+	}
+	second.Close()
+	if status := first.(StatusReporter).Status().(map[string]any); status["in_use"] != 1 {
+		t.Errorf("status = %v", status)
+	}
+
+	first.Close()
+	third, err := NewStream(&Env{}, Source{Id: "3", URL: srv.URL + "/3.m3u8", Type: "hls", Options: options})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if err = third.Start(); err != nil {
+		t.Errorf("Start() after release error = %v", err)
+	}
+}
@@ -1,16 +1,25 @@
 package tv
 
 import (
+	"bufio"
 	"context"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
 )
 
+// 判断转发内容的格式时读取的长度，可以包含两个以上的ts包
+const httpSniffSize = 188 * 3
+
+// HttpSteam 直接转发http响应的内容，开始时检查状态码及内容是否为媒体数据
 type HttpSteam struct {
-	url    string
-	resp   *http.Response
-	ctx    context.Context
-	cancel context.CancelFunc
+	url         string
+	resp        *http.Response
+	body        *bufio.Reader
+	contentType string
+	ctx         context.Context
+	cancel      context.CancelFunc
 }
 
 func NewHttpSteam(url string) *HttpSteam {
@@ -29,12 +38,31 @@ func (s *HttpSteam) Start() error {
 	if err != nil {
 		return err
 	}
+	if err = checkStatus(resp); err != nil {
+		return err
+	}
 	s.resp = resp
+	s.body = bufio.NewReader(resp.Body)
+
+	head, err := s.body.Peek(httpSniffSize)
+	if len(head) == 0 && err != nil {
+		return err
+	}
+	if err = checkMedia(resp, head); err != nil {
+		return err
+	}
+	// 以ts同步字节开始的按ts输出，其余沿用mp4
+	s.contentType = ContentTypeMP4
+	if tsSyncOffset(head) >= 0 {
+		s.contentType = ContentTypeTS
+	} else if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == ContentTypeTS {
+		return fmt.Errorf("%w: missing ts sync byte: %s", ErrUpstreamNotMedia, s.url)
+	}
 	return nil
 }
 
 func (s *HttpSteam) Read(b []byte) (int, error) {
-	return s.resp.Body.Read(b)
+	return s.body.Read(b)
 }
 
 func (s *HttpSteam) Close() error {
@@ -45,3 +73,8 @@ func (s *HttpSteam) Close() error {
 	}
 	return nil
 }
+
+// ContentType 根据开头的数据判断的媒体类型
+func (s *HttpSteam) ContentType() string {
+	return s.contentType
+}
@@ -0,0 +1,369 @@
+package tv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/deepch/vdk/av"
+)
+
+const (
+	// 读入内存的box的最大长度，分片mp4的moof和mdat一般只有几MB
+	mp4HttpMaxBox = 64 << 20
+	// 向后seek的距离小于该值时丢弃中间的数据，不重新发起请求
+	mp4HttpSkipSize = 1 << 20
+)
+
+// MP4HttpStream 把http上的mp4转封装为ts输出。分片mp4边下载边解析，普通mp4通过Range请求读取
+type MP4HttpStream struct {
+	*pacedStream
+	url    string
+	first  av.Demuxer
+	closer io.Closer
+	opened bool
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewMP4HttpStream(url string) *MP4HttpStream {
+	s := &MP4HttpStream{url: url}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.pacedStream = newPacedStream(s.open)
+	return s
+}
+
+// Start 先打开mp4读取轨道信息，请求失败或格式不支持时直接返回错误
+func (s *MP4HttpStream) Start() error {
+	demuxer, closer, err := openMP4Http(s.ctx, s.url)
+	if err != nil {
+		return err
+	}
+	s.first, s.closer = demuxer, closer
+	return s.pacedStream.Start()
+}
+
+// open 只播放一次，第二次调用返回io.EOF
+func (s *MP4HttpStream) open() (av.Demuxer, io.Closer, error) {
+	if s.opened {
+		return nil, nil, io.EOF
+	}
+	s.opened = true
+	return s.first, s.closer, nil
+}
+
+func (s *MP4HttpStream) Close() error {
+	s.cancel()
+	return s.pacedStream.Close()
+}
+
+// openMP4Http 按顺序读取顶层box，moov中有mvex时按分片mp4继续读取响应，否则改用Range请求交给mp4解复用
+func openMP4Http(ctx context.Context, url string) (av.Demuxer, io.Closer, error) {
+	resp, err := httpGet(ctx, url, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	body := bufio.NewReader(resp.Body)
+	for {
+		typ, header, size, err := readMP4BoxHeader(body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, nil, err
+		}
+		switch typ {
+		case "moov":
+			box, err := readMP4Box(body, header, size)
+			if err != nil {
+				resp.Body.Close()
+				return nil, nil, err
+			}
+			if _, ok := fmp4Child(box, "moov", "mvex"); !ok {
+				resp.Body.Close()
+				return openMP4Range(ctx, url)
+			}
+			demuxer, err := newFMP4StreamDemuxer(body, box)
+			if err != nil {
+				resp.Body.Close()
+				return nil, nil, err
+			}
+			fd, err := newFileDemuxer(demuxer, 0)
+			if err != nil {
+				resp.Body.Close()
+				return nil, nil, err
+			}
+			return fd, resp.Body, nil
+		case "mdat":
+			// moov在文件末尾
+			resp.Body.Close()
+			return openMP4Range(ctx, url)
+		case "moof":
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("%w: missing init segment: %s", ErrFMP4Invalid, url)
+		}
+		if size == 0 {
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("%w: missing moov: %s", ErrFMP4Invalid, url)
+		}
+		if _, err = body.Discard(int(size) - len(header)); err != nil {
+			resp.Body.Close()
+			return nil, nil, err
+		}
+	}
+}
+
+// openMP4Range 通过Range请求随机读取普通mp4
+func openMP4Range(ctx context.Context, url string) (av.Demuxer, io.Closer, error) {
+	reader := &httpRangeReader{ctx: ctx, url: url}
+	var demuxer av.Demuxer
+	err := demuxSafely(func() (err error) {
+		demuxer, err = openMP4File(reader, 0)
+		return err
+	})
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+	fd, err := newFileDemuxer(demuxer, 0)
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+	return fd, reader, nil
+}
+
+func httpGet(ctx context.Context, url string, byteRange string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" {
+		request.Header.Set("Range", byteRange)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// readMP4BoxHeader 读取box头部，size为包含头部的长度，为0时表示直到文件末尾
+func readMP4BoxHeader(r *bufio.Reader) (typ string, header []byte, size uint64, err error) {
+	header = make([]byte, 8, 16)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return "", nil, 0, err
+	}
+	typ = string(header[4:8])
+	size = uint64(binary.BigEndian.Uint32(header))
+	if size == 1 {
+		header = header[:16]
+		if _, err = io.ReadFull(r, header[8:]); err != nil {
+			return "", nil, 0, err
+		}
+		size = binary.BigEndian.Uint64(header[8:])
+	}
+	if size != 0 && size < uint64(len(header)) {
+		return "", nil, 0, fmt.Errorf("%w: %s", ErrFMP4Invalid, typ)
+	}
+	return typ, header, size, nil
+}
+
+// readMP4Box 读取整个box，返回的数据包含头部
+func readMP4Box(r *bufio.Reader, header []byte, size uint64) ([]byte, error) {
+	if size == 0 || size > mp4HttpMaxBox {
+		return nil, fmt.Errorf("%w: %s size %d", ErrFMP4Invalid, header[4:8], size)
+	}
+	box := make([]byte, size)
+	copy(box, header)
+	if _, err := io.ReadFull(r, box[len(header):]); err != nil {
+		return nil, err
+	}
+	return box, nil
+}
+
+// fmp4StreamDemuxer 从响应中依次读取moof和mdat，解析出其中的帧
+type fmp4StreamDemuxer struct {
+	r       *bufio.Reader
+	tracks  []*fmp4Track
+	codecs  []av.CodecData
+	moof    []byte
+	pending []av.Packet
+}
+
+func newFMP4StreamDemuxer(r *bufio.Reader, moov []byte) (*fmp4StreamDemuxer, error) {
+	tracks, err := parseFMP4Init(moov)
+	if err != nil {
+		return nil, err
+	}
+	d := &fmp4StreamDemuxer{r: r, tracks: tracks}
+	for _, track := range tracks {
+		d.codecs = append(d.codecs, track.codec)
+	}
+	return d, nil
+}
+
+func (d *fmp4StreamDemuxer) Streams() ([]av.CodecData, error) {
+	return d.codecs, nil
+}
+
+func (d *fmp4StreamDemuxer) ReadPacket() (av.Packet, error) {
+	for len(d.pending) == 0 {
+		typ, header, size, err := readMP4BoxHeader(d.r)
+		if err != nil {
+			return av.Packet{}, err
+		}
+		switch {
+		case typ == "moof":
+			if d.moof, err = readMP4Box(d.r, header, size); err != nil {
+				return av.Packet{}, err
+			}
+		case typ == "mdat" && d.moof != nil:
+			mdat, err := readMP4Box(d.r, header, size)
+			if err != nil {
+				return av.Packet{}, err
+			}
+			// 数据偏移以moof的开头为基准，拼接后一起解析
+			samples, err := parseFMP4Segment(append(d.moof, mdat...), d.tracks)
+			d.moof = nil
+			if err != nil {
+				return av.Packet{}, err
+			}
+			d.queue(samples)
+		case size == 0:
+			return av.Packet{}, io.EOF
+		default:
+			if _, err = d.r.Discard(int(size) - len(header)); err != nil {
+				return av.Packet{}, err
+			}
+		}
+	}
+	packet := d.pending[0]
+	d.pending = d.pending[1:]
+	return packet, nil
+}
+
+// queue 把一个分片中各轨道的帧按时间排序后放入队列
+func (d *fmp4StreamDemuxer) queue(samples []fmp4Sample) {
+	for _, sample := range samples {
+		idx := int8(0)
+		for i, track := range d.tracks {
+			if track == sample.track {
+				idx = int8(i)
+			}
+		}
+		composition := scaleDuration(uint64(sample.cts), uint64(sample.track.timescale))
+		if sample.cts < 0 {
+			composition = -scaleDuration(uint64(-sample.cts), uint64(sample.track.timescale))
+		}
+		d.pending = append(d.pending, av.Packet{
+			Idx:             idx,
+			IsKeyFrame:      sample.keyFrame,
+			CompositionTime: composition,
+			Time:            sample.Time(),
+			Data:            sample.data,
+		})
+	}
+	sort.SliceStable(d.pending, func(i, j int) bool {
+		return d.pending[i].Time < d.pending[j].Time
+	})
+}
+
+// httpRangeReader 用Range请求实现io.ReadSeeker，顺序读取时复用同一个响应
+type httpRangeReader struct {
+	ctx  context.Context
+	url  string
+	size int64
+	pos  int64
+	// body对应的读取位置
+	bodyPos int64
+	body    io.ReadCloser
+}
+
+func (r *httpRangeReader) Read(b []byte) (int, error) {
+	if r.size > 0 && r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body != nil && r.pos != r.bodyPos {
+		if skip := r.pos - r.bodyPos; skip > 0 && skip < mp4HttpSkipSize {
+			n, err := io.CopyN(io.Discard, r.body, skip)
+			r.bodyPos += n
+			if err != nil {
+				r.closeBody()
+			}
+		} else {
+			r.closeBody()
+		}
+	}
+	if r.body == nil {
+		if err := r.request(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.body.Read(b)
+	r.pos += int64(n)
+	r.bodyPos = r.pos
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// request 从pos处开始请求，第一次请求时根据Content-Range得到文件长度
+func (r *httpRangeReader) request() error {
+	resp, err := httpGet(r.ctx, r.url, "bytes="+strconv.FormatInt(r.pos, 10)+"-")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return fmt.Errorf("%w: range not supported: %s", ErrFileUnsupported, r.url)
+	}
+	if r.size == 0 {
+		contentRange := resp.Header.Get("Content-Range")
+		if i := strings.LastIndexByte(contentRange, '/'); i >= 0 {
+			r.size, _ = strconv.ParseInt(contentRange[i+1:], 10, 64)
+		}
+	}
+	r.body, r.bodyPos = resp.Body, r.pos
+	return nil
+}
+
+func (r *httpRangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		if r.size == 0 {
+			if err := r.request(); err != nil {
+				return 0, err
+			}
+		}
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("%w: negative position", ErrFileUnsupported)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *httpRangeReader) closeBody() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+func (r *httpRangeReader) Close() error {
+	r.closeBody()
+	return nil
+}
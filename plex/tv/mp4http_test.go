@@ -0,0 +1,334 @@
+package tv
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/deepch/vdk/format/ts"
+)
+
+func mp4Box(typ string, parts ...[]byte) []byte {
+	box := make([]byte, 8)
+	copy(box[4:], typ)
+	for _, part := range parts {
+		box = append(box, part...)
+	}
+	binary.BigEndian.PutUint32(box, uint32(len(box)))
+	return box
+}
+
+func be32(values ...uint32) []byte {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+func be64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func testCodecs(t *testing.T) (video av.VideoCodecData, audio av.AudioCodecData) {
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(patternSPS(), patternPPS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err = aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{ObjectType: aacparser.AOT_AAC_LC, SampleRateIndex: 3, ChannelConfig: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video, audio
+}
+
+// fmp4Trak 轨道id为1时生成avc1，否则生成mp4a
+func fmp4Trak(t *testing.T, id uint32, timescale uint32) []byte {
+	video, audio := testCodecs(t)
+	var entry []byte
+	if id == 1 {
+		entry = mp4Box("avc1", make([]byte, 78), mp4Box("avcC", video.(h264parser.CodecData).AVCDecoderConfRecordBytes()))
+	} else {
+		descriptor := func(tag byte, body []byte) []byte {
+			return append([]byte{tag, byte(len(body))}, body...)
+		}
+		config := descriptor(5, audio.(aacparser.CodecData).MPEG4AudioConfigBytes())
+		decoder := descriptor(4, append(append([]byte{0x40, 0x15}, make([]byte, 11)...), config...))
+		entry = mp4Box("mp4a", make([]byte, 28), mp4Box("esds", be32(0), descriptor(3, append([]byte{0, 1, 0}, decoder...))))
+	}
+	return mp4Box("trak",
+		mp4Box("tkhd", be32(0, 0, 0, id, 0, 0)),
+		mp4Box("mdia",
+			mp4Box("mdhd", be32(0, 0, 0, timescale, 0, 0)),
+			mp4Box("minf", mp4Box("stbl", mp4Box("stsd", be32(0, 1), entry)))))
+}
+
+// fmp4InitSegment 生成ftyp和带mvex的moov，ids中为1的是90kHz的视频轨道，其余是48kHz的音频轨道
+func fmp4InitSegment(t *testing.T, ids ...uint32) []byte {
+	var children, trexs [][]byte
+	for _, id := range ids {
+		timescale := uint32(48000)
+		if id == 1 {
+			timescale = 90000
+		}
+		children = append(children, fmp4Trak(t, id, timescale))
+		trexs = append(trexs, mp4Box("trex", be32(0, id, 1, 0, 0, 0)))
+	}
+	children = append(children, mp4Box("mvex", trexs...))
+	return append(mp4Box("ftyp", []byte("iso6"), be32(0)), mp4Box("moov", children...)...)
+}
+
+type fmp4TestSample struct {
+	duration uint32
+	flags    uint32
+	cts      uint32
+	data     []byte
+}
+
+// fmp4MediaSegment 生成只有一个traf的moof和mdat，trun中带有每帧的时长、大小、标志和cts
+func fmp4MediaSegment(id uint32, dts uint64, samples []fmp4TestSample) []byte {
+	var entries, mdat []byte
+	for _, sample := range samples {
+		entries = append(entries, be32(sample.duration, uint32(len(sample.data)), sample.flags, sample.cts)...)
+		mdat = append(mdat, sample.data...)
+	}
+	return fmp4TestFragment(func(dataOffset uint32) []byte {
+		return mp4Box("traf",
+			mp4Box("tfhd", be32(0x020000, id)),
+			mp4Box("tfdt", be32(0x01000000), be64(dts)),
+			mp4Box("trun", be32(fmp4TrunDataOffset|fmp4TrunDuration|fmp4TrunSize|fmp4TrunFlags|fmp4TrunCts, uint32(len(samples)), dataOffset), entries))
+	}, mdat)
+}
+
+// testVideoSamples 25fps，第一帧为idr
+func testVideoSamples(count int) []fmp4TestSample {
+	var samples []fmp4TestSample
+	for i := 0; i < count; i++ {
+		nalu, flags := []byte{0x41, byte(i)}, uint32(fmp4NonSyncSample)
+		if i == 0 {
+			nalu, flags = []byte{0x65, 0x88}, 0
+		}
+		samples = append(samples, fmp4TestSample{duration: 3600, flags: flags, cts: 3600, data: append(be32(uint32(len(nalu))), nalu...)})
+	}
+	return samples
+}
+
+func testAudioSamples(count int) []fmp4TestSample {
+	var samples []fmp4TestSample
+	for i := 0; i < count; i++ {
+		samples = append(samples, fmp4TestSample{duration: 1024, data: []byte{0x21, 0x10, byte(i)}})
+	}
+	return samples
+}
+
+// testPackets 生成seconds秒25fps的视频帧和48kHz的aac帧，每秒一个关键帧
+func testPackets(t *testing.T, seconds int) ([]av.CodecData, []av.Packet) {
+	video, audio := testCodecs(t)
+	var packets []av.Packet
+	audioFrame := 1024 * time.Second / 48000
+	a := 0
+	for i := 0; i < seconds*25; i++ {
+		videoTime := time.Duration(i) * 40 * time.Millisecond
+		for ; time.Duration(a)*audioFrame <= videoTime; a++ {
+			packets = append(packets, av.Packet{Idx: 1, Time: time.Duration(a) * audioFrame, Duration: audioFrame, Data: []byte{0x21, 0x10, byte(a)}})
+		}
+		nalu := []byte{0x41, byte(i)}
+		if i%25 == 0 {
+			nalu = []byte{0x65, 0x88}
+		}
+		packets = append(packets, av.Packet{Idx: 0, IsKeyFrame: i%25 == 0, Time: videoTime, Duration: 40 * time.Millisecond, Data: append(be32(uint32(len(nalu))), nalu...)})
+	}
+	return []av.CodecData{video, audio}, packets
+}
+
+func writeTestMP4(t *testing.T, path string, seconds int) {
+	codecs, packets := testPackets(t, seconds)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	muxer := mp4.NewMuxer(f)
+	if err = muxer.WriteHeader(codecs); err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range packets {
+		if err = muxer.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// demuxTSOutput 解复用流输出的ts直到结束
+func demuxTSOutput(t *testing.T, stream io.Reader) ([]av.CodecData, []av.Packet, error) {
+	demuxer := ts.NewDemuxer(stream)
+	codecs, err := demuxer.Streams()
+	if err != nil {
+		return nil, nil, err
+	}
+	var packets []av.Packet
+	for {
+		packet, err := demuxer.ReadPacket()
+		if err != nil {
+			return codecs, packets, err
+		}
+		packets = append(packets, packet)
+	}
+}
+
+func checkTSOutput(t *testing.T, codecs []av.CodecData, packets []av.Packet, video, audio int) {
+	t.Helper()
+	if len(codecs) != 2 || codecs[0].Type() != av.H264 || codecs[1].Type() != av.AAC {
+		t.Fatalf("codecs = %v", codecs)
+	}
+	var gotVideo, gotAudio int
+	var last time.Duration
+	for _, packet := range packets {
+		if packet.Idx != 0 {
+			gotAudio++
+			continue
+		}
+		if gotVideo == 0 && !packet.IsKeyFrame {
+			t.Fatal("first video frame is not a key frame")
+		}
+		if gotVideo > 0 && packet.Time <= last {
+			t.Fatalf("video time %v after %v", packet.Time, last)
+		}
+		last = packet.Time
+		gotVideo++
+	}
+	// ts的最后一个pes在流结束时可能不会输出
+	if gotVideo < video-1 || gotVideo > video || gotAudio < audio-1 || gotAudio > audio {
+		t.Fatalf("got %d video %d audio, want %d video %d audio", gotVideo, gotAudio, video, audio)
+	}
+}
+
+func TestMP4HttpFragmented(t *testing.T) {
+	body := fmp4InitSegment(t, 1, 2)
+	body = append(body, fmp4MediaSegment(1, 0, testVideoSamples(25))...)
+	body = append(body, fmp4MediaSegment(2, 0, testAudioSamples(47))...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			t.Errorf("unexpected range request for fragmented mp4")
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	s := NewMP4HttpStream(server.URL + "/live.mp4")
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.ContentType() != ContentTypeTS {
+		t.Fatalf("content type = %s", s.ContentType())
+	}
+	codecs, packets, err := demuxTSOutput(t, s)
+	if err != io.EOF {
+		t.Fatalf("err = %v", err)
+	}
+	checkTSOutput(t, codecs, packets, 25, 47)
+}
+
+func TestMP4HttpProgressive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "movie.mp4")
+	writeTestMP4(t, path, 1)
+	var ranges int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges++
+		}
+		http.ServeFile(w, r, path)
+	}))
+	defer server.Close()
+
+	s := NewMP4HttpStream(server.URL + "/movie.mp4")
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	codecs, packets, err := demuxTSOutput(t, s)
+	if err != io.EOF {
+		t.Fatalf("err = %v", err)
+	}
+	checkTSOutput(t, codecs, packets, 25, 46)
+	if ranges == 0 {
+		t.Fatal("progressive mp4 was not read with range requests")
+	}
+}
+
+func TestMP4HttpRangeUnsupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "movie.mp4")
+	writeTestMP4(t, path, 1)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	s := NewMP4HttpStream(server.URL + "/movie.mp4")
+	defer s.Close()
+	if err = s.Start(); !errors.Is(err, ErrFileUnsupported) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestMP4HttpMissingInit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fmp4MediaSegment(1, 0, testVideoSamples(1)))
+	}))
+	defer server.Close()
+
+	s := NewMP4HttpStream(server.URL + "/live.mp4")
+	defer s.Close()
+	if err := s.Start(); !errors.Is(err, ErrFMP4Invalid) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestAutoStreamRemuxesMP4(t *testing.T) {
+	body := fmp4InitSegment(t, 1)
+	body = append(body, fmp4MediaSegment(1, 0, testVideoSamples(5))...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	source := Source{Type: "auto", URL: server.URL + "/auto.mp4"}
+	defer forgetAutoType(source)
+	s, err := NewAutoStream(&Env{}, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if typ := s.(ContentTyper).ContentType(); typ != ContentTypeTS {
+		t.Fatalf("content type = %s", typ)
+	}
+	_, packets, err := demuxTSOutput(t, s)
+	if err != io.EOF || len(packets) < 4 {
+		t.Fatalf("got %d packets, err %v", len(packets), err)
+	}
+}
@@ -0,0 +1,109 @@
+package tv
+
+import (
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// codecTypeMPEGAudio mp1/mp2/mp3音频，vdk中没有对应的类型
+var codecTypeMPEGAudio = av.MakeAudioCodecType(0x4d5033)
+
+const mpegAudioHeaderLength = 4
+
+var (
+	// 比特率表，单位kbps，按[mpeg1/mpeg2][layer-1]索引
+	mpegAudioBitrates = [2][3][15]int{
+		{
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		},
+		{
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		},
+	}
+	// 采样率表，按版本字段索引，1为保留值
+	mpegAudioSampleRates = [4][3]int{
+		{11025, 12000, 8000},
+		{},
+		{22050, 24000, 16000},
+		{44100, 48000, 32000},
+	}
+)
+
+// mpegAudioCodecData mpeg音频的编码信息，由帧头得到
+type mpegAudioCodecData struct {
+	// MPEG1 为mpeg1，否则为mpeg2或mpeg2.5
+	MPEG1    bool
+	Layer    int
+	Rate     int
+	Channels int
+	// Samples 每帧的采样数
+	Samples int
+}
+
+func (c mpegAudioCodecData) Type() av.CodecType {
+	return codecTypeMPEGAudio
+}
+
+func (c mpegAudioCodecData) SampleFormat() av.SampleFormat {
+	return av.FLTP
+}
+
+func (c mpegAudioCodecData) SampleRate() int {
+	return c.Rate
+}
+
+func (c mpegAudioCodecData) ChannelLayout() av.ChannelLayout {
+	if c.Channels == 1 {
+		return av.CH_MONO
+	}
+	return av.CH_STEREO
+}
+
+func (c mpegAudioCodecData) PacketDuration(data []byte) (time.Duration, error) {
+	return time.Duration(c.Samples) * time.Second / time.Duration(c.Rate), nil
+}
+
+// parseMPEGAudioHeader 解析mpeg音频帧头，返回编码信息和包含帧头的帧长度，不是有效的帧头时ok为false
+func parseMPEGAudioHeader(h []byte) (codec mpegAudioCodecData, frameLen int, ok bool) {
+	if len(h) < mpegAudioHeaderLength || h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return codec, 0, false
+	}
+	version := int(h[1]>>3) & 3
+	layer := 4 - int(h[1]>>1)&3
+	bitrateIndex := int(h[2] >> 4)
+	rateIndex := int(h[2]>>2) & 3
+	// 不支持自由比特率
+	if version == 1 || layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return codec, 0, false
+	}
+
+	codec.MPEG1 = version == 3
+	codec.Layer = layer
+	codec.Rate = mpegAudioSampleRates[version][rateIndex]
+	codec.Channels = 2
+	if h[3]>>6 == 3 {
+		codec.Channels = 1
+	}
+	table, slot := 1, 1
+	if codec.MPEG1 {
+		table = 0
+	}
+	switch {
+	case layer == 1:
+		codec.Samples, slot = 384, 4
+	case layer == 3 && !codec.MPEG1:
+		codec.Samples = 576
+	default:
+		codec.Samples = 1152
+	}
+
+	bitrate := mpegAudioBitrates[table][layer-1][bitrateIndex] * 1000
+	padding := int(h[2]>>1) & 1
+	frameLen = (codec.Samples/8*bitrate/codec.Rate/slot + padding) * slot
+	return codec, frameLen, true
+}
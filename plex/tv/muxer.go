@@ -0,0 +1,64 @@
+package tv
+
+import (
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4f"
+)
+
+// packetMuxer 将音视频数据包封装为输出格式的数据块
+type packetMuxer interface {
+	// WriteHeader 返回封装的初始化数据
+	WriteHeader(codecs []av.CodecData) ([]byte, error)
+	// WritePacket 返回已经可以输出的数据，数据未凑够一个输出单元时返回nil，
+	// keyFrame表示返回的数据是否从关键帧开始
+	WritePacket(packet av.Packet) (data []byte, keyFrame bool, err error)
+	ContentType() string
+}
+
+// mp4Muxer 基于vdk的mp4f封装，输出fragmented mp4，仅保留h264、h265和aac轨道
+type mp4Muxer struct {
+	muxer *mp4f.Muxer
+	index map[int8]int8
+}
+
+func newMP4Muxer() *mp4Muxer {
+	return &mp4Muxer{}
+}
+
+func (m *mp4Muxer) WriteHeader(codecs []av.CodecData) ([]byte, error) {
+	m.index = make(map[int8]int8)
+	supported := make([]av.CodecData, 0, len(codecs))
+	for i, codec := range codecs {
+		switch codec.Type() {
+		case av.H264, av.H265, av.AAC:
+			m.index[int8(i)] = int8(len(supported))
+			supported = append(supported, codec)
+		}
+	}
+
+	m.muxer = mp4f.NewMuxer(nil)
+	if err := m.muxer.WriteHeader(supported); err != nil {
+		return nil, err
+	}
+	_, init := m.muxer.GetInit(supported)
+	return init, nil
+}
+
+func (m *mp4Muxer) WritePacket(packet av.Packet) ([]byte, bool, error) {
+	idx, ok := m.index[packet.Idx]
+	if !ok {
+		return nil, false, nil
+	}
+	packet.Idx = idx
+
+	// 关键帧到来时输出上一个分片，分片总是从关键帧开始
+	ready, buf, err := m.muxer.WritePacket(packet, false)
+	if err != nil || !ready {
+		return nil, false, err
+	}
+	return buf, packet.IsKeyFrame, nil
+}
+
+func (m *mp4Muxer) ContentType() string {
+	return ContentTypeMP4
+}
@@ -0,0 +1,173 @@
+package tv
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/deepch/vdk/av"
+)
+
+// 相邻两个文件在时间轴上的间隔
+const pacedFileGap = 40 * time.Millisecond
+
+// demuxerOpener 返回下一个要播放的demuxer，没有更多内容时返回io.EOF
+type demuxerOpener func() (demuxer av.Demuxer, closer io.Closer, err error)
+
+// pacedStream 按实时速度输出demuxer中的数据包，封装为ts，多个文件的时间戳保持连续
+type pacedStream struct {
+	open    demuxerOpener
+	muxer   *tsMuxer
+	frames  chan Frame
+	pending []byte
+	loopErr error
+
+	// base为当前文件在输出时间轴上的起点，last为已输出的最大时间戳
+	base time.Duration
+	last time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newPacedStream(open demuxerOpener) *pacedStream {
+	s := &pacedStream{
+		open:   open,
+		muxer:  newTSMuxer(),
+		frames: make(chan Frame),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *pacedStream) Start() error {
+	go s.loop()
+	return nil
+}
+
+func (s *pacedStream) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		s.pending = frame.Data
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *pacedStream) ReadFrame() (Frame, error) {
+	select {
+	case frame, ok := <-s.frames:
+		if !ok {
+			if s.loopErr != nil {
+				return Frame{}, s.loopErr
+			}
+			return Frame{}, io.EOF
+		}
+		return frame, nil
+	case <-s.ctx.Done():
+		return Frame{}, ErrReadClosedStream
+	}
+}
+
+func (s *pacedStream) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *pacedStream) ContentType() string {
+	return ContentTypeTS
+}
+
+func (s *pacedStream) loop() {
+	defer close(s.frames)
+	wallStart := time.Now()
+	for {
+		demuxer, closer, err := s.open()
+		if err != nil {
+			if err != io.EOF {
+				s.loopErr = err
+			}
+			return
+		}
+		err = s.play(demuxer, wallStart)
+		closer.Close()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				s.loopErr = err
+			}
+			return
+		}
+		s.base = s.last + pacedFileGap
+	}
+}
+
+// play 输出一个demuxer的全部数据包，按时间戳等待到对应的时刻再输出
+func (s *pacedStream) play(demuxer av.Demuxer, wallStart time.Time) error {
+	codecs, err := demuxer.Streams()
+	if err != nil {
+		return err
+	}
+	header, err := s.muxer.WriteHeader(codecs)
+	if err != nil {
+		return err
+	}
+	if err = s.emit(Frame{Data: header, Header: true}); err != nil {
+		return err
+	}
+
+	first := time.Duration(-1)
+	for {
+		packet, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first < 0 {
+			first = packet.Time
+		}
+		packet.Time -= first
+		if packet.Time < 0 {
+			packet.Time = 0
+		}
+		packet.Time += s.base
+
+		if wait := time.Until(wallStart.Add(packet.Time)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-s.ctx.Done():
+				timer.Stop()
+				return s.ctx.Err()
+			}
+		}
+
+		data, keyFrame, err := s.muxer.WritePacket(packet)
+		if err != nil {
+			return err
+		}
+		if end := packet.Time + packet.Duration; end > s.last {
+			s.last = end
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if err = s.emit(Frame{Data: data, KeyFrame: keyFrame}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *pacedStream) emit(frame Frame) error {
+	select {
+	case s.frames <- frame:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
@@ -0,0 +1,415 @@
+package tv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+)
+
+var ErrTestPatternInvalidOption = errors.New("testpattern: invalid option")
+
+const (
+	// 关键帧间隔，I_PCM关键帧较大，间隔过短会占用较高的码率
+	patternGOP = 2 * patternFPS
+	// 彩条的高度，下方为文字区域
+	patternBarsHeight = 200
+	// 文字区域每行的最大字符数及行数
+	patternTextScale    = 3
+	patternTextColumns  = 34
+	patternTextLines    = 3
+	patternClockScale   = 6
+	patternClockY       = 298
+	patternTextY        = 210
+	patternLineSpacing  = 27
+	patternAACFrameSize = 1024
+)
+
+// TestPatternOptions testpattern类型的选项
+type TestPatternOptions struct {
+	// Pattern 画面的上部分，bars为彩条，solid为纯色，默认为bars
+	Pattern string `json:"pattern"`
+	// Color 纯色画面的颜色，如#2040a0
+	Color string `json:"color"`
+	// Text 显示的文字，默认为频道名称，只能显示ascii字符
+	Text string `json:"text"`
+	// Tone 为true时输出约1kHz的测试音，否则为静音
+	Tone bool `json:"tone"`
+}
+
+func (o TestPatternOptions) Validate() error {
+	switch o.Pattern {
+	case "", "bars":
+	case "solid":
+		if _, err := parsePatternColor(o.Color); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: pattern %s", ErrTestPatternInvalidOption, o.Pattern)
+	}
+	return nil
+}
+
+// NewTestPatternStream 生成测试画面，不依赖上游及ffmpeg，按实时速度输出ts，所有观看者共享
+func NewTestPatternStream(source Source) (TVStream, error) {
+	opt := TestPatternOptions{}
+	if err := source.DecodeOptions(&opt); err != nil {
+		return nil, err
+	}
+	if err := opt.Validate(); err != nil {
+		return nil, err
+	}
+	if opt.Text == "" {
+		opt.Text = source.Name
+	}
+	return newTestPatternStream(opt), nil
+}
+
+func newTestPatternStream(opt TestPatternOptions) TVStream {
+	started := false
+	return newPacedStream(func() (av.Demuxer, io.Closer, error) {
+		// 生成器不会结束，只在第一次时打开
+		if started {
+			return nil, nil, io.EOF
+		}
+		started = true
+		demuxer, err := newPatternDemuxer(opt)
+		if err != nil {
+			return nil, nil, err
+		}
+		return demuxer, demuxer, nil
+	})
+}
+
+// patternDemuxer 按时间顺序生成测试画面的视频帧和音频帧
+type patternDemuxer struct {
+	codecs  []av.CodecData
+	encoder *patternEncoder
+	base    *patternPicture
+	start   time.Time
+	clock   string
+	video   int
+	audio   int
+	aacData []byte
+}
+
+func newPatternDemuxer(opt TestPatternOptions) (*patternDemuxer, error) {
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(patternSPS(), patternPPS())
+	if err != nil {
+		return nil, err
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 3,
+		ChannelConfig:   1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	base, err := drawPatternBase(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &patternDemuxer{
+		codecs:  []av.CodecData{video, audio},
+		encoder: &patternEncoder{},
+		base:    base,
+		start:   time.Now(),
+		aacData: patternAACFrame(opt.Tone),
+	}, nil
+}
+
+func (d *patternDemuxer) Close() error {
+	return nil
+}
+
+func (d *patternDemuxer) Streams() ([]av.CodecData, error) {
+	return d.codecs, nil
+}
+
+func (d *patternDemuxer) ReadPacket() (av.Packet, error) {
+	videoTime := time.Duration(d.video) * time.Second / patternFPS
+	audioTime := time.Duration(d.audio) * patternAACFrameSize * time.Second / patternSampleRate
+	if audioTime < videoTime {
+		d.audio++
+		return av.Packet{
+			Idx:      1,
+			Time:     audioTime,
+			Duration: patternAACFrameSize * time.Second / patternSampleRate,
+			Data:     d.aacData,
+		}, nil
+	}
+
+	keyFrame := d.video%patternGOP == 0
+	d.video++
+	clock := d.start.Add(videoTime).Format("15:04:05")
+	var pic *patternPicture
+	if keyFrame || clock != d.clock {
+		d.clock = clock
+		pic = d.base.clone()
+		drawPatternText(pic, clock, patternClockScale, patternClockY)
+	} else {
+		// 画面不变时全部宏块跳过
+		pic = d.encoder.ref
+	}
+	return av.Packet{
+		Idx:        0,
+		IsKeyFrame: keyFrame,
+		Time:       videoTime,
+		Duration:   time.Second / patternFPS,
+		Data:       d.encoder.encode(pic, keyFrame),
+	}, nil
+}
+
+// patternYUV bt.601 limited range
+type patternYUV struct {
+	y, u, v byte
+}
+
+func rgbToYUV(r, g, b float64) patternYUV {
+	clamp := func(v float64) byte {
+		if v < 0 {
+			return 0
+		}
+		if v > 255 {
+			return 255
+		}
+		return byte(v + 0.5)
+	}
+	return patternYUV{
+		y: clamp(16 + 0.257*r + 0.504*g + 0.098*b),
+		u: clamp(128 - 0.148*r - 0.291*g + 0.439*b),
+		v: clamp(128 + 0.439*r - 0.368*g - 0.071*b),
+	}
+}
+
+func parsePatternColor(s string) (patternYUV, error) {
+	value, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return patternYUV{}, fmt.Errorf("%w: color %s", ErrTestPatternInvalidOption, s)
+	}
+	return rgbToYUV(float64(value>>16&0xFF), float64(value>>8&0xFF), float64(value&0xFF)), nil
+}
+
+// 75%彩条：白、黄、青、绿、品红、红、蓝
+var patternBars = []patternYUV{
+	rgbToYUV(191, 191, 191),
+	rgbToYUV(191, 191, 0),
+	rgbToYUV(0, 191, 191),
+	rgbToYUV(0, 191, 0),
+	rgbToYUV(191, 0, 191),
+	rgbToYUV(191, 0, 0),
+	rgbToYUV(0, 0, 191),
+}
+
+var (
+	patternBlack = rgbToYUV(0, 0, 0)
+	patternWhite = rgbToYUV(255, 255, 255)
+)
+
+// fillRect 填充矩形，色度按2x2采样，奇数坐标时包含边缘的色度采样
+func (p *patternPicture) fillRect(x0, y0, x1, y1 int, color patternYUV) {
+	stride := patternMbWidth * 16
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			p.y[y*stride+x] = color.y
+		}
+	}
+	for y := y0 / 2; y < (y1+1)/2; y++ {
+		for x := x0 / 2; x < (x1+1)/2; x++ {
+			p.u[y*stride/2+x] = color.u
+			p.v[y*stride/2+x] = color.v
+		}
+	}
+}
+
+// drawPatternBase 绘制不变的背景及文字
+func drawPatternBase(opt TestPatternOptions) (*patternPicture, error) {
+	pic := newPatternPicture()
+	if opt.Pattern == "solid" {
+		color, err := parsePatternColor(opt.Color)
+		if err != nil {
+			return nil, err
+		}
+		pic.fillRect(0, 0, patternWidth, patternBarsHeight, color)
+	} else {
+		for i, color := range patternBars {
+			x0 := i * patternWidth / len(patternBars) &^ 1
+			x1 := (i + 1) * patternWidth / len(patternBars) &^ 1
+			if i == len(patternBars)-1 {
+				x1 = patternWidth
+			}
+			pic.fillRect(x0, 0, x1, patternBarsHeight, color)
+		}
+	}
+	pic.fillRect(0, patternBarsHeight, patternWidth, patternMbHeight*16, patternBlack)
+	for i, line := range wrapPatternText(opt.Text) {
+		drawPatternText(pic, line, patternTextScale, patternTextY+i*patternLineSpacing)
+	}
+	return pic, nil
+}
+
+// wrapPatternText 去掉无法显示的字符，并按宽度折行
+func wrapPatternText(text string) []string {
+	var lines []string
+	for _, field := range strings.Split(text, "\n") {
+		var line []byte
+		for _, r := range field {
+			if r >= ' ' && r <= '~' {
+				line = append(line, byte(r))
+			}
+		}
+		text := strings.TrimSpace(string(line))
+		for len(text) > patternTextColumns {
+			cut := strings.LastIndexByte(text[:patternTextColumns+1], ' ')
+			if cut <= 0 {
+				cut = patternTextColumns
+			}
+			lines = append(lines, strings.TrimSpace(text[:cut]))
+			text = strings.TrimSpace(text[cut:])
+		}
+		if text != "" {
+			lines = append(lines, text)
+		}
+	}
+	if len(lines) > patternTextLines {
+		lines = lines[:patternTextLines]
+	}
+	return lines
+}
+
+// drawPatternText 在黑色背景上以白色水平居中绘制一行ascii文字
+func drawPatternText(pic *patternPicture, text string, scale int, top int) {
+	advance := (patternGlyphWidth + 1) * scale
+	left := (patternWidth - len(text)*advance + scale) / 2
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c < ' ' || c > '~' {
+			continue
+		}
+		glyph := patternFont[int(c-' ')*patternGlyphWidth:][:patternGlyphWidth]
+		for col, bits := range glyph {
+			for row := 0; row < patternGlyphHeight; row++ {
+				if bits>>row&1 == 0 {
+					continue
+				}
+				x := left + i*advance + col*scale
+				y := top + row*scale
+				if x < 0 || x+scale > patternWidth {
+					continue
+				}
+				pic.fillRect(x, y, x+scale, y+scale, patternWhite)
+			}
+		}
+	}
+}
+
+const (
+	patternGlyphWidth  = 5
+	patternGlyphHeight = 7
+)
+
+// patternFont 5x7点阵字体，ascii 0x20-0x7e，每个字符5列，低位在上
+var patternFont = []byte{
+	0x00, 0x00, 0x00, 0x00, 0x00, // ' '
+	0x00, 0x00, 0x5F, 0x00, 0x00, // !
+	0x00, 0x07, 0x00, 0x07, 0x00, // "
+	0x14, 0x7F, 0x14, 0x7F, 0x14, // #
+	0x24, 0x2A, 0x7F, 0x2A, 0x12, // $
+	0x23, 0x13, 0x08, 0x64, 0x62, // %
+	0x36, 0x49, 0x55, 0x22, 0x50, // &
+	0x00, 0x05, 0x03, 0x00, 0x00, // '
+	0x00, 0x1C, 0x22, 0x41, 0x00, // (
+	0x00, 0x41, 0x22, 0x1C, 0x00, // )
+	0x14, 0x08, 0x3E, 0x08, 0x14, // *
+	0x08, 0x08, 0x3E, 0x08, 0x08, // +
+	0x00, 0x50, 0x30, 0x00, 0x00, // ,
+	0x08, 0x08, 0x08, 0x08, 0x08, // -
+	0x00, 0x60, 0x60, 0x00, 0x00, // .
+	0x20, 0x10, 0x08, 0x04, 0x02, // /
+	0x3E, 0x51, 0x49, 0x45, 0x3E, // 0
+	0x00, 0x42, 0x7F, 0x40, 0x00, // 1
+	0x42, 0x61, 0x51, 0x49, 0x46, // 2
+	0x21, 0x41, 0x45, 0x4B, 0x31, // 3
+	0x18, 0x14, 0x12, 0x7F, 0x10, // 4
+	0x27, 0x45, 0x45, 0x45, 0x39, // 5
+	0x3C, 0x4A, 0x49, 0x49, 0x30, // 6
+	0x01, 0x71, 0x09, 0x05, 0x03, // 7
+	0x36, 0x49, 0x49, 0x49, 0x36, // 8
+	0x06, 0x49, 0x49, 0x29, 0x1E, // 9
+	0x00, 0x36, 0x36, 0x00, 0x00, // :
+	0x00, 0x56, 0x36, 0x00, 0x00, // ;
+	0x08, 0x14, 0x22, 0x41, 0x00, // <
+	0x14, 0x14, 0x14, 0x14, 0x14, // =
+	0x00, 0x41, 0x22, 0x14, 0x08, // >
+	0x02, 0x01, 0x51, 0x09, 0x06, // ?
+	0x32, 0x49, 0x79, 0x41, 0x3E, // @
+	0x7E, 0x11, 0x11, 0x11, 0x7E, // A
+	0x7F, 0x49, 0x49, 0x49, 0x36, // B
+	0x3E, 0x41, 0x41, 0x41, 0x22, // C
+	0x7F, 0x41, 0x41, 0x22, 0x1C, // D
+	0x7F, 0x49, 0x49, 0x49, 0x41, // E
+	0x7F, 0x09, 0x09, 0x09, 0x01, // F
+	0x3E, 0x41, 0x49, 0x49, 0x7A, // G
+	0x7F, 0x08, 0x08, 0x08, 0x7F, // H
+	0x00, 0x41, 0x7F, 0x41, 0x00, // I
+	0x20, 0x40, 0x41, 0x3F, 0x01, // J
+	0x7F, 0x08, 0x14, 0x22, 0x41, // K
+	0x7F, 0x40, 0x40, 0x40, 0x40, // L
+	0x7F, 0x02, 0x0C, 0x02, 0x7F, // M
+	0x7F, 0x04, 0x08, 0x10, 0x7F, // N
+	0x3E, 0x41, 0x41, 0x41, 0x3E, // O
+	0x7F, 0x09, 0x09, 0x09, 0x06, // P
+	0x3E, 0x41, 0x51, 0x21, 0x5E, // Q
+	0x7F, 0x09, 0x19, 0x29, 0x46, // R
+	0x46, 0x49, 0x49, 0x49, 0x31, // S
+	0x01, 0x01, 0x7F, 0x01, 0x01, // T
+	0x3F, 0x40, 0x40, 0x40, 0x3F, // U
+	0x1F, 0x20, 0x40, 0x20, 0x1F, // V
+	0x3F, 0x40, 0x38, 0x40, 0x3F, // W
+	0x63, 0x14, 0x08, 0x14, 0x63, // X
+	0x07, 0x08, 0x70, 0x08, 0x07, // Y
+	0x61, 0x51, 0x49, 0x45, 0x43, // Z
+	0x00, 0x7F, 0x41, 0x41, 0x00, // [
+	0x02, 0x04, 0x08, 0x10, 0x20, // \
+	0x00, 0x41, 0x41, 0x7F, 0x00, // ]
+	0x04, 0x02, 0x01, 0x02, 0x04, // ^
+	0x40, 0x40, 0x40, 0x40, 0x40, // _
+	0x00, 0x01, 0x02, 0x04, 0x00, // `
+	0x20, 0x54, 0x54, 0x54, 0x78, // a
+	0x7F, 0x48, 0x44, 0x44, 0x38, // b
+	0x38, 0x44, 0x44, 0x44, 0x20, // c
+	0x38, 0x44, 0x44, 0x48, 0x7F, // d
+	0x38, 0x54, 0x54, 0x54, 0x18, // e
+	0x08, 0x7E, 0x09, 0x01, 0x02, // f
+	0x0C, 0x52, 0x52, 0x52, 0x3E, // g
+	0x7F, 0x08, 0x04, 0x04, 0x78, // h
+	0x00, 0x44, 0x7D, 0x40, 0x00, // i
+	0x20, 0x40, 0x44, 0x3D, 0x00, // j
+	0x7F, 0x10, 0x28, 0x44, 0x00, // k
+	0x00, 0x41, 0x7F, 0x40, 0x00, // l
+	0x7C, 0x04, 0x18, 0x04, 0x78, // m
+	0x7C, 0x08, 0x04, 0x04, 0x78, // n
+	0x38, 0x44, 0x44, 0x44, 0x38, // o
+	0x7C, 0x14, 0x14, 0x14, 0x08, // p
+	0x08, 0x14, 0x14, 0x18, 0x7C, // q
+	0x7C, 0x08, 0x04, 0x04, 0x08, // r
+	0x48, 0x54, 0x54, 0x54, 0x20, // s
+	0x04, 0x3F, 0x44, 0x40, 0x20, // t
+	0x3C, 0x40, 0x40, 0x20, 0x7C, // u
+	0x1C, 0x20, 0x40, 0x20, 0x1C, // v
+	0x3C, 0x40, 0x30, 0x40, 0x3C, // w
+	0x44, 0x28, 0x10, 0x28, 0x44, // x
+	0x0C, 0x50, 0x50, 0x50, 0x3C, // y
+	0x44, 0x64, 0x54, 0x4C, 0x44, // z
+	0x00, 0x08, 0x36, 0x41, 0x00, // {
+	0x00, 0x00, 0x7F, 0x00, 0x00, // |
+	0x00, 0x41, 0x36, 0x08, 0x00, // }
+	0x08, 0x04, 0x08, 0x10, 0x08, // ~
+}
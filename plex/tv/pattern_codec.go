@@ -0,0 +1,346 @@
+package tv
+
+import (
+	"encoding/binary"
+)
+
+// 测试画面使用的最简编码：视频为全部I_PCM宏块的h264，画面不变的宏块在P帧中跳过；
+// 音频为只有一个脉冲频点的aac，每帧内容相同，解码后是连续的正弦波
+
+// bitWriter 按位写入，用于生成h264和aac的语法元素
+type bitWriter struct {
+	buf  []byte
+	bits uint
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			w.buf[len(w.buf)-1] |= 0x80 >> (w.bits % 8)
+		}
+		w.bits++
+	}
+}
+
+func (w *bitWriter) writeFlag(v bool) {
+	if v {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+}
+
+// writeUE 无符号指数哥伦布编码
+func (w *bitWriter) writeUE(v uint32) {
+	v++
+	n := uint(0)
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.writeBits(0, n)
+	w.writeBits(uint64(v), n+1)
+}
+
+// writeSE 有符号指数哥伦布编码
+func (w *bitWriter) writeSE(v int32) {
+	if v > 0 {
+		w.writeUE(uint32(2*v - 1))
+	} else {
+		w.writeUE(uint32(-2 * v))
+	}
+}
+
+// align 补0到字节边界
+func (w *bitWriter) align() {
+	for w.bits%8 != 0 {
+		w.writeBits(0, 1)
+	}
+}
+
+// trailing 写入rbsp_trailing_bits
+func (w *bitWriter) trailing() {
+	w.writeBits(1, 1)
+	w.align()
+}
+
+const (
+	patternWidth    = 640
+	patternHeight   = 360
+	patternMbWidth  = patternWidth / 16
+	patternMbHeight = (patternHeight + 15) / 16
+	patternFPS      = 25
+	// log2_max_frame_num
+	patternFrameNumBits = 4
+)
+
+// patternPicture yuv420p画面，高度补齐到宏块的整数倍
+type patternPicture struct {
+	y, u, v []byte
+}
+
+func newPatternPicture() *patternPicture {
+	return &patternPicture{
+		y: make([]byte, patternMbWidth*16*patternMbHeight*16),
+		u: make([]byte, patternMbWidth*8*patternMbHeight*8),
+		v: make([]byte, patternMbWidth*8*patternMbHeight*8),
+	}
+}
+
+func (p *patternPicture) clone() *patternPicture {
+	return &patternPicture{
+		y: append([]byte(nil), p.y...),
+		u: append([]byte(nil), p.u...),
+		v: append([]byte(nil), p.v...),
+	}
+}
+
+// macroblockEqual 比较两幅画面中的一个宏块
+func (p *patternPicture) macroblockEqual(o *patternPicture, mbx, mby int) bool {
+	for row := 0; row < 16; row++ {
+		off := (mby*16+row)*patternMbWidth*16 + mbx*16
+		if string(p.y[off:off+16]) != string(o.y[off:off+16]) {
+			return false
+		}
+	}
+	for row := 0; row < 8; row++ {
+		off := (mby*8+row)*patternMbWidth*8 + mbx*8
+		if string(p.u[off:off+8]) != string(o.u[off:off+8]) || string(p.v[off:off+8]) != string(o.v[off:off+8]) {
+			return false
+		}
+	}
+	return true
+}
+
+// writePCM 写入一个I_PCM宏块的采样
+func (p *patternPicture) writePCM(w *bitWriter, mbx, mby int) {
+	for row := 0; row < 16; row++ {
+		off := (mby*16+row)*patternMbWidth*16 + mbx*16
+		w.buf = append(w.buf, p.y[off:off+16]...)
+	}
+	for _, plane := range [][]byte{p.u, p.v} {
+		for row := 0; row < 8; row++ {
+			off := (mby*8+row)*patternMbWidth*8 + mbx*8
+			w.buf = append(w.buf, plane[off:off+8]...)
+		}
+	}
+	w.bits += 384 * 8
+}
+
+// patternSPS baseline profile，带有帧率信息
+func patternSPS() []byte {
+	w := &bitWriter{}
+	w.writeBits(0x67, 8)
+	w.writeBits(66, 8)   // profile_idc
+	w.writeBits(0xC0, 8) // constraint_set0_flag, constraint_set1_flag
+	w.writeBits(30, 8)   // level_idc
+	w.writeUE(0)         // seq_parameter_set_id
+	w.writeUE(patternFrameNumBits - 4)
+	w.writeUE(2) // pic_order_cnt_type
+	w.writeUE(1) // max_num_ref_frames
+	w.writeFlag(false)
+	w.writeUE(patternMbWidth - 1)
+	w.writeUE(patternMbHeight - 1)
+	w.writeFlag(true) // frame_mbs_only_flag
+	w.writeFlag(true) // direct_8x8_inference_flag
+	if crop := patternMbHeight*16 - patternHeight; crop > 0 {
+		w.writeFlag(true)
+		w.writeUE(0)
+		w.writeUE(0)
+		w.writeUE(0)
+		w.writeUE(uint32(crop / 2))
+	} else {
+		w.writeFlag(false)
+	}
+	w.writeFlag(true)  // vui_parameters_present_flag
+	w.writeFlag(true)  // aspect_ratio_info_present_flag
+	w.writeBits(1, 8)  // 1:1
+	w.writeFlag(false) // overscan_info_present_flag
+	w.writeFlag(false) // video_signal_type_present_flag
+	w.writeFlag(false) // chroma_loc_info_present_flag
+	w.writeFlag(true)  // timing_info_present_flag
+	w.writeBits(1, 32) // num_units_in_tick
+	w.writeBits(2*patternFPS, 32)
+	w.writeFlag(true)  // fixed_frame_rate_flag
+	w.writeFlag(false) // nal_hrd_parameters_present_flag
+	w.writeFlag(false) // vcl_hrd_parameters_present_flag
+	w.writeFlag(false) // pic_struct_present_flag
+	w.writeFlag(false) // bitstream_restriction_flag
+	w.trailing()
+	return escapeNALU(w.buf)
+}
+
+func patternPPS() []byte {
+	w := &bitWriter{}
+	w.writeBits(0x68, 8)
+	w.writeUE(0)       // pic_parameter_set_id
+	w.writeUE(0)       // seq_parameter_set_id
+	w.writeFlag(false) // entropy_coding_mode_flag
+	w.writeFlag(false) // bottom_field_pic_order_in_frame_present_flag
+	w.writeUE(0)       // num_slice_groups_minus1
+	w.writeUE(0)       // num_ref_idx_l0_default_active_minus1
+	w.writeUE(0)       // num_ref_idx_l1_default_active_minus1
+	w.writeFlag(false) // weighted_pred_flag
+	w.writeBits(0, 2)  // weighted_bipred_idc
+	w.writeSE(0)       // pic_init_qp_minus26
+	w.writeSE(0)       // pic_init_qs_minus26
+	w.writeSE(0)       // chroma_qp_index_offset
+	w.writeFlag(true)  // deblocking_filter_control_present_flag
+	w.writeFlag(false) // constrained_intra_pred_flag
+	w.writeFlag(false) // redundant_pic_cnt_present_flag
+	w.trailing()
+	return escapeNALU(w.buf)
+}
+
+// patternEncoder 生成h264帧，每帧都作为参考帧
+type patternEncoder struct {
+	frameNum uint32
+	idrId    uint32
+	ref      *patternPicture
+}
+
+// encode 编码一帧，返回avcc格式的数据。keyFrame时输出全部宏块，否则只输出与上一帧不同的宏块。
+// pic会作为之后的参考帧，调用后不能再修改
+func (e *patternEncoder) encode(pic *patternPicture, keyFrame bool) []byte {
+	w := &bitWriter{}
+	if keyFrame || e.ref == nil {
+		keyFrame = true
+		e.frameNum = 0
+		w.writeBits(0x65, 8)
+	} else {
+		w.writeBits(0x41, 8)
+	}
+	w.writeUE(0) // first_mb_in_slice
+	if keyFrame {
+		w.writeUE(7) // I slice
+	} else {
+		w.writeUE(5) // P slice
+	}
+	w.writeUE(0) // pic_parameter_set_id
+	w.writeBits(uint64(e.frameNum), patternFrameNumBits)
+	if keyFrame {
+		w.writeUE(e.idrId)
+		e.idrId = (e.idrId + 1) % 2
+	} else {
+		w.writeFlag(false) // num_ref_idx_active_override_flag
+		w.writeFlag(false) // ref_pic_list_modification_flag_l0
+	}
+	w.writeFlag(false) // no_output_of_prior_pics_flag或adaptive_ref_pic_marking_mode_flag
+	if keyFrame {
+		w.writeFlag(false) // long_term_reference_flag
+	}
+	w.writeSE(0) // slice_qp_delta
+	w.writeUE(1) // disable_deblocking_filter_idc
+
+	skip := uint32(0)
+	for mby := 0; mby < patternMbHeight; mby++ {
+		for mbx := 0; mbx < patternMbWidth; mbx++ {
+			if !keyFrame {
+				if pic == e.ref || pic.macroblockEqual(e.ref, mbx, mby) {
+					skip++
+					continue
+				}
+				w.writeUE(skip) // mb_skip_run
+				skip = 0
+				w.writeUE(30) // I_PCM
+			} else {
+				w.writeUE(25) // I_PCM
+			}
+			w.align()
+			pic.writePCM(w, mbx, mby)
+		}
+	}
+	if skip > 0 {
+		w.writeUE(skip)
+	}
+	w.trailing()
+
+	e.frameNum = (e.frameNum + 1) % (1 << patternFrameNumBits)
+	e.ref = pic
+	nalu := escapeNALU(w.buf)
+	data := make([]byte, 4+len(nalu))
+	binary.BigEndian.PutUint32(data, uint32(len(nalu)))
+	copy(data[4:], nalu)
+	return data
+}
+
+// escapeNALU 插入防竞争字节
+func escapeNALU(rbsp []byte) []byte {
+	out := make([]byte, 0, len(rbsp)+len(rbsp)/64)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+const (
+	patternSampleRate = 48000
+	// 48kHz长窗口第10个频带从第40个频点开始
+	patternToneBand       = 10
+	patternToneBandOffset = 40
+	patternToneBandWidth  = 8
+	// 第42个频点，解码后约为42*48000/2048=984Hz
+	patternToneBin  = 42
+	patternToneGain = 170
+	patternToneAmp  = 8
+)
+
+// patternAACFrame 生成单声道aac帧，tone为false时为静音
+func patternAACFrame(tone bool) []byte {
+	w := &bitWriter{}
+	w.writeBits(0, 3) // ID_SCE
+	w.writeBits(0, 4) // element_instance_tag
+	if !tone {
+		w.writeBits(0, 8)  // global_gain
+		w.writeBits(0, 1)  // ics_reserved_bit
+		w.writeBits(0, 2)  // ONLY_LONG_SEQUENCE
+		w.writeBits(0, 1)  // window_shape
+		w.writeBits(0, 6)  // max_sfb
+		w.writeFlag(false) // predictor_data_present
+		w.writeFlag(false) // pulse_data_present
+		w.writeFlag(false) // tns_data_present
+		w.writeFlag(false) // gain_control_data_present
+	} else {
+		w.writeBits(patternToneGain, 8)
+		w.writeBits(0, 1)
+		w.writeBits(0, 2)
+		// 使用正弦窗，相同的帧重叠相加后幅度恒定
+		w.writeBits(0, 1)
+		w.writeBits(patternToneBand+1, 6)
+		w.writeFlag(false)
+		// section_data：之前的频带为ZERO_HCB，脉冲所在的频带使用码本1
+		w.writeBits(0, 4)
+		w.writeBits(patternToneBand, 5)
+		w.writeBits(1, 4)
+		w.writeBits(1, 5)
+		// scale_factor_data：与global_gain相同，差值60的码字为0
+		w.writeBits(0, 1)
+		// pulse_data
+		w.writeFlag(true)
+		w.writeBits(0, 2) // number_pulse-1
+		w.writeBits(patternToneBand, 6)
+		w.writeBits(patternToneBin-patternToneBandOffset, 5)
+		w.writeBits(patternToneAmp, 4)
+		w.writeFlag(false) // tns_data_present
+		w.writeFlag(false) // gain_control_data_present
+		// spectral_data：码本1中全0的四元组码字为0
+		for i := 0; i < patternToneBandWidth/4; i++ {
+			w.writeBits(0, 1)
+		}
+	}
+	w.writeBits(7, 3) // ID_END
+	w.align()
+	return w.buf
+}
@@ -0,0 +1,442 @@
+package tv
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/format/ts/tsio"
+)
+
+// bitReader 按位读取，用于检查生成的语法元素
+type bitReader struct {
+	t   *testing.T
+	buf []byte
+	pos int
+}
+
+func (r *bitReader) readBits(n int) uint64 {
+	r.t.Helper()
+	var v uint64
+	for i := 0; i < n; i++ {
+		if r.pos/8 >= len(r.buf) {
+			r.t.Fatalf("read past end at bit %d", r.pos)
+		}
+		v = v<<1 | uint64(r.buf[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) readUE() uint32 {
+	r.t.Helper()
+	zeros := 0
+	for r.readBits(1) == 0 {
+		zeros++
+	}
+	return uint32(1<<zeros-1) + uint32(r.readBits(zeros))
+}
+
+func (r *bitReader) readSE() int32 {
+	r.t.Helper()
+	v := r.readUE()
+	if v%2 == 1 {
+		return int32(v+1) / 2
+	}
+	return -int32(v / 2)
+}
+
+// expectTrailing 检查rbsp_trailing_bits并且已经读到结尾
+func (r *bitReader) expectTrailing() {
+	r.t.Helper()
+	if r.readBits(1) != 1 {
+		r.t.Fatal("missing stop bit")
+	}
+	for r.pos%8 != 0 {
+		if r.readBits(1) != 0 {
+			r.t.Fatal("non-zero trailing bit")
+		}
+	}
+	if r.pos/8 != len(r.buf) {
+		r.t.Fatalf("%d bytes after trailing bits", len(r.buf)-r.pos/8)
+	}
+}
+
+func TestBitWriter(t *testing.T) {
+	w := &bitWriter{}
+	w.writeBits(0x5, 3)
+	w.writeBits(0x1ff, 9)
+	w.writeFlag(true)
+	values := []uint32{0, 1, 2, 7, 255, 1 << 20}
+	for _, v := range values {
+		w.writeUE(v)
+	}
+	signed := []int32{0, 1, -1, 30, -30}
+	for _, v := range signed {
+		w.writeSE(v)
+	}
+	w.trailing()
+
+	r := &bitReader{t: t, buf: w.buf}
+	if r.readBits(3) != 0x5 || r.readBits(9) != 0x1ff || r.readBits(1) != 1 {
+		t.Fatal("bits mismatch")
+	}
+	for _, v := range values {
+		if got := r.readUE(); got != v {
+			t.Errorf("ue = %d, want %d", got, v)
+		}
+	}
+	for _, v := range signed {
+		if got := r.readSE(); got != v {
+			t.Errorf("se = %d, want %d", got, v)
+		}
+	}
+	r.expectTrailing()
+	if w.bits != uint(len(w.buf))*8 {
+		t.Errorf("bits = %d, bytes = %d", w.bits, len(w.buf))
+	}
+}
+
+func TestEscapeNALU(t *testing.T) {
+	tests := []struct {
+		input []byte
+		want  []byte
+	}{
+		{[]byte{0x65, 0, 0, 0, 1}, []byte{0x65, 0, 0, 3, 0, 1}},
+		{[]byte{0, 0, 3}, []byte{0, 0, 3, 3}},
+		{[]byte{0, 0, 4, 0, 0, 2}, []byte{0, 0, 4, 0, 0, 3, 2}},
+		{[]byte{0, 0, 0, 0, 0}, []byte{0, 0, 3, 0, 0, 3, 0}},
+		{[]byte{1, 0, 1, 0, 0}, []byte{1, 0, 1, 0, 0}},
+	}
+	for _, test := range tests {
+		got := escapeNALU(test.input)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("escapeNALU(%x) = %x, want %x", test.input, got, test.want)
+		}
+		if back := h264parser.RemoveH264orH265EmulationBytes(got); !bytes.Equal(back, test.input) {
+			t.Errorf("unescape(%x) = %x, want %x", got, back, test.input)
+		}
+	}
+}
+
+func TestPatternParameterSets(t *testing.T) {
+	sps := patternSPS()
+	info, err := h264parser.ParseSPS(sps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ProfileIdc != 66 || info.LevelIdc != 30 || info.Width != patternWidth || info.Height != patternHeight || info.FPS != patternFPS {
+		t.Errorf("sps = %+v", info)
+	}
+	if info.MbWidth != patternMbWidth || info.MbHeight != patternMbHeight {
+		t.Errorf("macroblocks = %dx%d", info.MbWidth, info.MbHeight)
+	}
+	codec, err := h264parser.NewCodecDataFromSPSAndPPS(sps, patternPPS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec.Width() != patternWidth || codec.Height() != patternHeight {
+		t.Errorf("codec size = %dx%d", codec.Width(), codec.Height())
+	}
+
+	// PPS使用CAVLC，单个slice group，允许在slice中关闭去块滤波
+	r := &bitReader{t: t, buf: h264parser.RemoveH264orH265EmulationBytes(patternPPS())}
+	if r.readBits(8) != 0x68 || r.readUE() != 0 || r.readUE() != 0 {
+		t.Fatal("pps ids")
+	}
+	if r.readBits(1) != 0 || r.readBits(1) != 0 || r.readUE() != 0 {
+		t.Fatal("pps entropy coding or slice groups")
+	}
+	if r.readUE() != 0 || r.readUE() != 0 || r.readBits(1) != 0 || r.readBits(2) != 0 {
+		t.Fatal("pps reference settings")
+	}
+	if r.readSE() != 0 || r.readSE() != 0 || r.readSE() != 0 {
+		t.Fatal("pps qp")
+	}
+	if r.readBits(1) != 1 || r.readBits(1) != 0 || r.readBits(1) != 0 {
+		t.Fatal("pps flags")
+	}
+	r.expectTrailing()
+}
+
+// patternSlice 解码后的slice头部
+type patternSlice struct {
+	idr       bool
+	sliceType uint32
+	frameNum  uint64
+	idrPicId  uint32
+	coded     int
+}
+
+// decodePatternSlice 按PPS和SPS的设置解码测试画面的slice，P帧在ref的基础上更新
+func decodePatternSlice(t *testing.T, nalu []byte, ref *patternPicture) (*patternPicture, patternSlice) {
+	t.Helper()
+	rbsp := h264parser.RemoveH264orH265EmulationBytes(nalu)
+	r := &bitReader{t: t, buf: rbsp}
+	slice := patternSlice{}
+	header := r.readBits(8)
+	slice.idr = header == 0x65
+	if !slice.idr && header != 0x41 {
+		t.Fatalf("nalu header %x", header)
+	}
+	if r.readUE() != 0 {
+		t.Fatal("first_mb_in_slice is not 0")
+	}
+	slice.sliceType = r.readUE()
+	if r.readUE() != 0 {
+		t.Fatal("pic_parameter_set_id is not 0")
+	}
+	slice.frameNum = r.readBits(patternFrameNumBits)
+	if slice.idr {
+		slice.idrPicId = r.readUE()
+	} else if r.readBits(1) != 0 || r.readBits(1) != 0 {
+		t.Fatal("ref list override")
+	}
+	r.readBits(1)
+	if slice.idr {
+		r.readBits(1)
+	}
+	if r.readSE() != 0 || r.readUE() != 1 {
+		t.Fatal("qp delta or deblocking")
+	}
+
+	pic := newPatternPicture()
+	if !slice.idr {
+		if ref == nil {
+			t.Fatal("p slice without reference")
+		}
+		pic = ref.clone()
+	}
+	total := patternMbWidth * patternMbHeight
+	for mb := 0; mb < total; mb++ {
+		if slice.sliceType == 5 {
+			mb += int(r.readUE())
+			if mb >= total {
+				break
+			}
+			if r.readUE() != 30 {
+				t.Fatal("p slice macroblock is not I_PCM")
+			}
+		} else if r.readUE() != 25 {
+			t.Fatal("i slice macroblock is not I_PCM")
+		}
+		for r.pos%8 != 0 {
+			if r.readBits(1) != 0 {
+				t.Fatal("pcm_alignment_zero_bit is not 0")
+			}
+		}
+		mbx, mby := mb%patternMbWidth, mb/patternMbWidth
+		p := r.pos / 8
+		for row := 0; row < 16; row++ {
+			p += copy(pic.y[(mby*16+row)*patternMbWidth*16+mbx*16:][:16], rbsp[p:])
+		}
+		for _, plane := range [][]byte{pic.u, pic.v} {
+			for row := 0; row < 8; row++ {
+				p += copy(plane[(mby*8+row)*patternMbWidth*8+mbx*8:][:8], rbsp[p:])
+			}
+		}
+		r.pos = p * 8
+		slice.coded++
+	}
+	r.expectTrailing()
+	return pic, slice
+}
+
+func TestPatternEncoderDecode(t *testing.T) {
+	demuxer, err := newPatternDemuxer(TestPatternOptions{Text: "CCTV-1 测试频道"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ref *patternPicture
+	var idrIds []uint32
+	for frame := 0; frame < 2*patternGOP+1; {
+		packet, err := demuxer.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.Idx != 0 {
+			continue
+		}
+		nalus, _ := h264parser.SplitNALUs(packet.Data)
+		if len(nalus) != 1 {
+			t.Fatalf("frame %d has %d nalus", frame, len(nalus))
+		}
+		var slice patternSlice
+		ref, slice = decodePatternSlice(t, nalus[0], ref)
+		want := demuxer.encoder.ref
+		if !bytes.Equal(ref.y, want.y) || !bytes.Equal(ref.u, want.u) || !bytes.Equal(ref.v, want.v) {
+			t.Fatalf("frame %d decodes to a different picture", frame)
+		}
+
+		keyFrame := frame%patternGOP == 0
+		if packet.IsKeyFrame != keyFrame || slice.idr != keyFrame {
+			t.Fatalf("frame %d key frame = %v, idr = %v", frame, packet.IsKeyFrame, slice.idr)
+		}
+		if want := uint64(frame % patternGOP % (1 << patternFrameNumBits)); slice.frameNum != want {
+			t.Errorf("frame %d frame_num = %d, want %d", frame, slice.frameNum, want)
+		}
+		if keyFrame {
+			idrIds = append(idrIds, slice.idrPicId)
+			if slice.sliceType != 7 || slice.coded != patternMbWidth*patternMbHeight {
+				t.Errorf("frame %d slice type %d with %d macroblocks", frame, slice.sliceType, slice.coded)
+			}
+		} else if slice.sliceType != 5 || slice.coded == patternMbWidth*patternMbHeight {
+			t.Errorf("frame %d slice type %d with %d macroblocks", frame, slice.sliceType, slice.coded)
+		}
+		frame++
+	}
+	// 相邻idr帧的idr_pic_id不同
+	if len(idrIds) != 3 || idrIds[0] == idrIds[1] || idrIds[1] == idrIds[2] {
+		t.Errorf("idr_pic_id = %v", idrIds)
+	}
+
+	// 画面不变的P帧跳过全部宏块
+	encoder := &patternEncoder{}
+	pic := newPatternPicture()
+	encoder.encode(pic, true)
+	data := encoder.encode(pic, false)
+	if _, slice := decodePatternSlice(t, data[4:], pic); slice.coded != 0 || len(data) > 16 {
+		t.Errorf("unchanged frame is %d bytes with %d macroblocks", len(data), slice.coded)
+	}
+}
+
+// patternAAC 解析出的aac帧，只支持测试画面使用的长窗口和码本0、1
+type patternAAC struct {
+	globalGain uint64
+	maxSfb     uint64
+	pulses     [][2]uint64
+}
+
+func parsePatternAAC(t *testing.T, frame []byte) patternAAC {
+	t.Helper()
+	r := &bitReader{t: t, buf: frame}
+	aac := patternAAC{}
+	if r.readBits(3) != 0 || r.readBits(4) != 0 {
+		t.Fatal("not a single channel element")
+	}
+	aac.globalGain = r.readBits(8)
+	if r.readBits(1) != 0 || r.readBits(2) != 0 {
+		t.Fatal("not a long window")
+	}
+	r.readBits(1)
+	aac.maxSfb = r.readBits(6)
+	if r.readBits(1) != 0 {
+		t.Fatal("predictor data")
+	}
+	var codebooks []uint64
+	for uint64(len(codebooks)) < aac.maxSfb {
+		codebook := r.readBits(4)
+		length := uint64(0)
+		for {
+			n := r.readBits(5)
+			length += n
+			if n != 31 {
+				break
+			}
+		}
+		for i := uint64(0); i < length; i++ {
+			codebooks = append(codebooks, codebook)
+		}
+	}
+	if uint64(len(codebooks)) != aac.maxSfb {
+		t.Fatalf("sections cover %d bands, max_sfb %d", len(codebooks), aac.maxSfb)
+	}
+	for _, codebook := range codebooks {
+		switch codebook {
+		case 0:
+		case 1:
+			// 与global_gain相同的比例因子
+			if r.readBits(1) != 0 {
+				t.Fatal("scale factor differs from global gain")
+			}
+		default:
+			t.Fatalf("unexpected codebook %d", codebook)
+		}
+	}
+	if r.readBits(1) == 1 {
+		count := r.readBits(2) + 1
+		start := r.readBits(6)
+		// pulse_offset相对于起始频带的第一条谱线
+		offset := uint64(patternToneBandOffset)
+		if start != patternToneBand {
+			t.Fatalf("pulse in band %d", start)
+		}
+		for i := uint64(0); i < count; i++ {
+			offset += r.readBits(5)
+			aac.pulses = append(aac.pulses, [2]uint64{offset, r.readBits(4)})
+		}
+	}
+	if r.readBits(1) != 0 || r.readBits(1) != 0 {
+		t.Fatal("tns or gain control data")
+	}
+	// 码本1中全0的四元组
+	for _, codebook := range codebooks {
+		if codebook == 1 {
+			for i := 0; i < patternToneBandWidth/4; i++ {
+				if r.readBits(1) != 0 {
+					t.Fatal("non-zero spectral data")
+				}
+			}
+		}
+	}
+	if r.readBits(3) != 7 {
+		t.Fatal("missing ID_END")
+	}
+	for r.pos%8 != 0 {
+		if r.readBits(1) != 0 {
+			t.Fatal("non-zero padding")
+		}
+	}
+	if r.pos/8 != len(frame) {
+		t.Fatalf("%d bytes after ID_END", len(frame)-r.pos/8)
+	}
+	return aac
+}
+
+func TestPatternAACFrame(t *testing.T) {
+	silent := parsePatternAAC(t, patternAACFrame(false))
+	if silent.globalGain != 0 || silent.maxSfb != 0 || len(silent.pulses) != 0 {
+		t.Errorf("silent frame = %+v", silent)
+	}
+	tone := parsePatternAAC(t, patternAACFrame(true))
+	if tone.globalGain != patternToneGain || tone.maxSfb != patternToneBand+1 ||
+		len(tone.pulses) != 1 || tone.pulses[0] != [2]uint64{patternToneBin, patternToneAmp} {
+		t.Errorf("tone frame = %+v", tone)
+	}
+}
+
+func TestPatternADTS(t *testing.T) {
+	// ts中的aac带有ADTS头，内容为原始的aac帧
+	sample := parseTSSample(t, patternTS(t, 10, false))
+	audioPID := sample.pmt.streams[1].pid
+	frames := 0
+	for _, pes := range sample.pes {
+		if pes.pid != audioPID {
+			continue
+		}
+		hdrlen, _, _, _, _, err := tsio.ParsePESHeader(pes.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := pes.data[hdrlen:]
+		for len(payload) > 0 {
+			config, adtsLen, frameLen, samples, err := aacparser.ParseADTSHeader(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ObjectType != aacparser.AOT_AAC_LC || config.SampleRate != patternSampleRate || config.ChannelConfig != 1 || samples != patternAACFrameSize {
+				t.Fatalf("adts config = %+v, samples %d", config, samples)
+			}
+			if frameLen > len(payload) || !bytes.Equal(payload[adtsLen:frameLen], patternAACFrame(false)) {
+				t.Fatalf("adts frame %x", payload[:frameLen])
+			}
+			payload = payload[frameLen:]
+			frames++
+		}
+	}
+	// 10帧视频约0.4秒，48kHz每帧1024个采样
+	if frames < 17 || frames > 19 {
+		t.Errorf("got %d aac frames", frames)
+	}
+}
@@ -0,0 +1,205 @@
+package tv
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var (
+	ErrCommandEmpty        = errors.New("command args is empty")
+	ErrCommandStartTimeout = errors.New("command start timeout")
+	ErrCommandNoURL        = errors.New("command printed no url")
+)
+
+// Command 外部命令的配置，Args和Env中的{id}、{name}、{url}会被替换为频道的信息
+type Command struct {
+	// Args 命令及参数，第一个为可执行文件
+	Args []string `json:"args"`
+	// Env 额外的环境变量
+	Env map[string]string `json:"env"`
+	// Timeout pipe类型等待第一个数据或exec-resolve类型等待命令结束的超时，单位秒，默认30秒
+	Timeout int `json:"timeout"`
+	// Format pipe类型输出的封装格式，ts或mp4，默认为ts
+	Format string `json:"format"`
+}
+
+// Validate 检查配置是否有效
+func (c Command) Validate() error {
+	if len(c.Args) == 0 || c.Args[0] == "" {
+		return ErrCommandEmpty
+	}
+	switch c.Format {
+	case "", TranscodeFormatTS, TranscodeFormatMP4:
+	default:
+		return ErrUnsupportedTranscodeFormat
+	}
+	return nil
+}
+
+// Expand 返回替换占位符后的命令
+func (c Command) Expand(vars map[string]string) Command {
+	pairs := make([]string, 0, len(vars)*2)
+	for k, v := range vars {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	expanded := c
+	expanded.Args = make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		expanded.Args[i] = replacer.Replace(arg)
+	}
+	expanded.Env = make(map[string]string, len(c.Env))
+	for k, v := range c.Env {
+		expanded.Env[k] = replacer.Replace(v)
+	}
+	return expanded
+}
+
+func (c Command) timeout() time.Duration {
+	return secondsOrDefault(c.Timeout, 30*time.Second)
+}
+
+func (c Command) command() *exec.Cmd {
+	cmd := exec.Command(c.Args[0], c.Args[1:]...)
+	// streamlink、yt-dlp等会再启动ffmpeg，结束时需要结束整个进程组
+	newProcessGroup(cmd)
+	cmd.Env = os.Environ()
+	for k, v := range c.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	return cmd
+}
+
+// PipeStream 运行外部命令，将其标准输出作为流
+type PipeStream struct {
+	command Command
+	logger  *log.Logger
+	tag     string
+	process *childProcess
+	pipe    *os.File
+	stdout  *bufio.Reader
+}
+
+// NewPipeStream 创建外部命令的流，命令的错误输出以tag为前缀写入logger
+func NewPipeStream(command Command, logger *log.Logger, tag string) *PipeStream {
+	return &PipeStream{
+		command: command,
+		logger:  logger,
+		tag:     tag,
+	}
+}
+
+// Start 启动命令并等待第一个数据，超时或命令提前退出时返回错误
+func (s *PipeStream) Start() error {
+	if err := s.command.Validate(); err != nil {
+		return err
+	}
+	// 自行创建管道，使命令退出后仍能读完剩余的数据
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd := s.command.command()
+	cmd.Stdout = w
+	s.process, err = startChildProcess(cmd, s.logger, s.tag, nil)
+	w.Close()
+	if err != nil {
+		r.Close()
+		return err
+	}
+	s.pipe = r
+	s.stdout = bufio.NewReader(r)
+
+	peeked := make(chan error, 1)
+	go func() {
+		_, err := s.stdout.Peek(1)
+		peeked <- err
+	}()
+	timer := time.NewTimer(s.command.timeout())
+	defer timer.Stop()
+	select {
+	case err = <-peeked:
+		if err != nil {
+			<-s.process.Done()
+			if s.process.Err() != nil {
+				return s.process.Err()
+			}
+			return err
+		}
+		return nil
+	case <-timer.C:
+		s.process.Stop()
+		return ErrCommandStartTimeout
+	}
+}
+
+func (s *PipeStream) Read(b []byte) (int, error) {
+	n, err := s.stdout.Read(b)
+	if err == io.EOF {
+		// 命令异常退出时返回其错误，而不是普通的EOF
+		<-s.process.Done()
+		if s.process.Err() != nil {
+			return n, s.process.Err()
+		}
+	}
+	return n, err
+}
+
+// Close 结束命令，命令没有及时退出时强制结束
+func (s *PipeStream) Close() error {
+	if s.process != nil {
+		s.process.Stop()
+		s.pipe.Close()
+	}
+	return nil
+}
+
+func (s *PipeStream) ContentType() string {
+	if s.command.Format == TranscodeFormatMP4 {
+		return ContentTypeMP4
+	}
+	return ContentTypeTS
+}
+
+// ResolveCommand 运行外部命令，返回其标准输出中第一个有效的url
+func ResolveCommand(command Command, logger *log.Logger, tag string) (string, error) {
+	if err := command.Validate(); err != nil {
+		return "", err
+	}
+	cmd := command.command()
+	stdout := new(bytes.Buffer)
+	cmd.Stdout = stdout
+	process, err := startChildProcess(cmd, logger, tag, nil)
+	if err != nil {
+		return "", err
+	}
+	timer := time.NewTimer(command.timeout())
+	defer timer.Stop()
+	select {
+	case <-process.Done():
+	case <-timer.C:
+		process.Stop()
+		return "", ErrCommandStartTimeout
+	}
+	if process.Err() != nil {
+		return "", process.Err()
+	}
+
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		line = strings.TrimSpace(line)
+		u, err := url.Parse(line)
+		if err == nil && u.Scheme != "" && u.Host != "" {
+			return line, nil
+		}
+	}
+	return "", ErrCommandNoURL
+}
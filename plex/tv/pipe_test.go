@@ -0,0 +1,93 @@
+package tv
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os/exec"
+	"testing"
+)
+
+func shCommand(t *testing.T, script string) Command {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	return Command{Args: []string{"sh", "-c", script}}
+}
+
+func TestPipeStream(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	command := shCommand(t, `printf 'hello '; sleep 0.1; printf "$GREETING"`)
+	command.Env = map[string]string{"GREETING": "world"}
+	stream := NewPipeStream(command, logger, "pipe")
+	if err := stream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	data, err := io.ReadAll(stream)
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("ReadAll() = %q, %v", data, err)
+	}
+	if stream.ContentType() != ContentTypeTS {
+		t.Errorf("ContentType() = %s", stream.ContentType())
+	}
+
+	// 输出数据后异常退出，读完数据后返回命令的错误
+	stream = NewPipeStream(shCommand(t, `printf data; echo broken >&2; exit 3`), logger, "pipe")
+	if err = stream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	data, err = io.ReadAll(stream)
+	var processErr *ProcessError
+	var exitErr *exec.ExitError
+	if string(data) != "data" || !errors.As(err, &processErr) || processErr.Stderr != "broken" ||
+		!errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("ReadAll() = %q, %v", data, err)
+	}
+
+	// 没有输出就退出时Start返回命令的错误
+	stream = NewPipeStream(shCommand(t, `echo failed >&2; exit 2`), logger, "pipe")
+	if err = stream.Start(); !errors.As(err, &processErr) || processErr.Stderr != "failed" {
+		t.Errorf("Start() = %v", err)
+	}
+	stream.Close()
+}
+
+func TestPipeStreamStartTimeout(t *testing.T) {
+	command := shCommand(t, `sleep 5`)
+	command.Timeout = 1
+	stream := NewPipeStream(command, log.New(io.Discard, "", 0), "pipe")
+	defer stream.Close()
+	if err := stream.Start(); !errors.Is(err, ErrCommandStartTimeout) {
+		t.Errorf("Start() = %v", err)
+	}
+}
+
+func TestResolveCommand(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	tests := []struct {
+		script string
+		want   string
+		err    error
+	}{
+		// 跳过不是url的行，去掉首尾的空白
+		{`echo 'resolving...'; printf '  https://cdn.example.com/live.m3u8?token=1 \r\n'; echo http://second/`, "https://cdn.example.com/live.m3u8?token=1", nil},
+		{`echo 'no url here'; echo /relative/path`, "", ErrCommandNoURL},
+	}
+	for _, test := range tests {
+		got, err := ResolveCommand(shCommand(t, test.script), logger, "resolve")
+		if got != test.want || !errors.Is(err, test.err) {
+			t.Errorf("ResolveCommand(%q) = %q, %v, want %q, %v", test.script, got, err, test.want, test.err)
+		}
+	}
+
+	// 命令异常退出时不使用其输出
+	var processErr *ProcessError
+	if got, err := ResolveCommand(shCommand(t, `echo http://cdn.example.com/live.m3u8; exit 1`), logger, "resolve"); got != "" || !errors.As(err, &processErr) {
+		t.Errorf("ResolveCommand() = %q, %v", got, err)
+	}
+	if _, err := ResolveCommand(Command{}, logger, "resolve"); !errors.Is(err, ErrCommandEmpty) {
+		t.Errorf("ResolveCommand() without args = %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package tv
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 子进程收到SIGTERM后等待退出的时间，超时后强制结束
+const processStopTimeout = 3 * time.Second
+
+// ProcessError 子进程异常退出的错误，带有最后一行错误输出
+type ProcessError struct {
+	Name   string
+	Err    error
+	Stderr string
+}
+
+func (e *ProcessError) Error() string {
+	if e.Stderr == "" {
+		return e.Name + ": " + e.Err.Error()
+	}
+	return e.Name + ": " + e.Err.Error() + ": " + e.Stderr
+}
+
+func (e *ProcessError) Unwrap() error {
+	return e.Err
+}
+
+// childProcess 一个子进程，错误输出逐行写入日志
+type childProcess struct {
+	cmd      *exec.Cmd
+	name     string
+	logger   *log.Logger
+	tag      string
+	filter   func(line string) bool
+	exited   chan struct{}
+	err      error
+	lastLine string
+}
+
+// startChildProcess 启动子进程，filter返回true的错误输出行不会写入日志
+func startChildProcess(cmd *exec.Cmd, logger *log.Logger, tag string, filter func(line string) bool) (*childProcess, error) {
+	p := &childProcess{
+		cmd:    cmd,
+		name:   filepath.Base(cmd.Path),
+		logger: logger,
+		tag:    tag,
+		filter: filter,
+		exited: make(chan struct{}),
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		p.readStderr(stderr)
+	}()
+	go func() {
+		// 需要先读完错误输出再Wait，否则可能丢失最后的错误信息
+		<-stderrDone
+		err := cmd.Wait()
+		if err != nil {
+			err = &ProcessError{Name: p.name, Err: err, Stderr: p.lastLine}
+		}
+		p.err = err
+		close(p.exited)
+	}()
+	return p, nil
+}
+
+func (p *childProcess) readStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || (p.filter != nil && p.filter(line)) {
+			continue
+		}
+		p.lastLine = line
+		p.logf("%s", line)
+	}
+}
+
+func (p *childProcess) logf(format string, v ...any) {
+	if p.logger != nil {
+		p.logger.Printf("["+p.name+" "+p.tag+"] "+format, v...)
+	}
+}
+
+// Done 子进程退出后关闭
+func (p *childProcess) Done() <-chan struct{} {
+	return p.exited
+}
+
+// Err 子进程退出的错误，正常退出时为nil，需要在Done之后调用
+func (p *childProcess) Err() error {
+	return p.err
+}
+
+// Stop 先发送SIGTERM让子进程正常结束，超时后强制结束
+func (p *childProcess) Stop() {
+	select {
+	case <-p.exited:
+		return
+	default:
+	}
+	if err := signalProcess(p.cmd, syscall.SIGTERM); err != nil {
+		signalProcess(p.cmd, syscall.SIGKILL)
+	}
+	timer := time.NewTimer(processStopTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.exited:
+	case <-timer.C:
+		signalProcess(p.cmd, syscall.SIGKILL)
+		<-p.exited
+	}
+}
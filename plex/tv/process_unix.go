@@ -0,0 +1,21 @@
+//go:build !windows
+
+package tv
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// newProcessGroup 外部命令在新的进程组中运行，结束时连同它启动的子进程一起结束
+func newProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcess 发送信号，有自己的进程组时发送给整个进程组
+func signalProcess(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		return syscall.Kill(-cmd.Process.Pid, sig)
+	}
+	return cmd.Process.Signal(sig)
+}
@@ -0,0 +1,16 @@
+package tv
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// newProcessGroup windows没有进程组，只结束外部命令本身
+func newProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcess(cmd *exec.Cmd, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return cmd.Process.Kill()
+	}
+	return cmd.Process.Signal(sig)
+}
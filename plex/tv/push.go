@@ -0,0 +1,390 @@
+package tv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtmp"
+)
+
+var (
+	ErrPushNotConfigured = errors.New("push: rtmp server not configured")
+	ErrPushOffline       = errors.New("push: publisher offline")
+	ErrPushBusy          = errors.New("push: stream key is already publishing")
+	ErrPushInvalidKey    = errors.New("push: invalid stream key")
+	ErrPushUnauthorized  = errors.New("push: wrong password")
+	ErrPushSlowReader    = errors.New("push: reader too slow")
+)
+
+// 每个观看者缓存的数据包数量，超过时断开该观看者
+const pushReaderBuffer = 512
+
+// PushOptions push类型的选项
+type PushOptions struct {
+	// Password 推流密码，推流码后加上?password=密码，为空时不校验
+	Password string `json:"password"`
+}
+
+// PushServer rtmp推流服务，推流地址为rtmp://host/app/推流码，按推流码分发给push类型的频道
+type PushServer struct {
+	// Authorize 检查推流码及密码，返回错误时拒绝推流
+	Authorize func(key string, password string) error
+	logger    *log.Logger
+
+	lock     *sync.Mutex
+	sessions map[string]*pushSession
+}
+
+func NewPushServer(logger *log.Logger) *PushServer {
+	return &PushServer{
+		logger:   logger,
+		lock:     new(sync.Mutex),
+		sessions: make(map[string]*pushSession),
+	}
+}
+
+// ListenAndServe 监听rtmp推流，会一直阻塞
+func (s *PushServer) ListenAndServe(addr string) error {
+	server := &rtmp.Server{
+		Addr: addr,
+		HandlePublish: func(conn *rtmp.Conn) {
+			defer conn.Close()
+			if err := s.publish(conn); err != nil {
+				s.logf("[push %s] %v", conn.NetConn().RemoteAddr(), err)
+			}
+		},
+		HandlePlay: func(conn *rtmp.Conn) {
+			conn.Close()
+		},
+	}
+	return server.ListenAndServe()
+}
+
+// pushSessionStatus 推流在状态接口中的信息
+type pushSessionStatus struct {
+	Key       string    `json:"key"`
+	Remote    string    `json:"remote"`
+	Codecs    []string  `json:"codecs"`
+	Readers   int       `json:"readers"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Status 正在推流的推流码
+func (s *PushServer) Status() any {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list := make([]pushSessionStatus, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		list = append(list, session.status())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+func (s *PushServer) publish(conn *rtmp.Conn) error {
+	_, key := rtmp.SplitPath(conn.URL)
+	key, _, _ = strings.Cut(key, "?")
+	password := conn.URL.Query().Get("password")
+	if key == "" {
+		return ErrPushInvalidKey
+	}
+	if s.Authorize != nil {
+		if err := s.Authorize(key, password); err != nil {
+			return err
+		}
+	}
+	codecs, err := conn.Streams()
+	if err != nil {
+		return err
+	}
+
+	session := &pushSession{
+		key:       key,
+		remote:    conn.NetConn().RemoteAddr(),
+		codecs:    codecs,
+		lock:      new(sync.Mutex),
+		readers:   make(map[*pushReader]struct{}),
+		startedAt: time.Now(),
+	}
+	s.lock.Lock()
+	if _, exists := s.sessions[key]; exists {
+		s.lock.Unlock()
+		return fmt.Errorf("%w: %s", ErrPushBusy, key)
+	}
+	s.sessions[key] = session
+	s.lock.Unlock()
+	s.logf("[push %s] publish from %s", key, session.remote)
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.sessions, key)
+		s.lock.Unlock()
+		session.close()
+		s.logf("[push %s] unpublish", key)
+	}()
+	for {
+		packet, err := conn.ReadPacket()
+		if err != nil {
+			return err
+		}
+		session.write(packet)
+	}
+}
+
+// subscribe 订阅推流码的数据，没有在推流时返回ErrPushOffline
+func (s *PushServer) subscribe(key string) (*pushSession, *pushReader, error) {
+	s.lock.Lock()
+	session, ok := s.sessions[key]
+	s.lock.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrPushOffline, key)
+	}
+	reader, err := session.subscribe()
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, reader, nil
+}
+
+func (s *PushServer) logf(format string, v ...any) {
+	if s.logger != nil {
+		s.logger.Printf(format, v...)
+	}
+}
+
+// pushSession 一路推流，将数据包分发给所有观看者
+type pushSession struct {
+	key       string
+	remote    net.Addr
+	codecs    []av.CodecData
+	startedAt time.Time
+
+	lock    *sync.Mutex
+	readers map[*pushReader]struct{}
+	closed  bool
+}
+
+// pushReader 一个观看者，推流结束或者读取过慢时packets会被关闭
+type pushReader struct {
+	packets chan av.Packet
+	err     error
+}
+
+func (s *pushSession) subscribe() (*pushReader, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("%w: %s", ErrPushOffline, s.key)
+	}
+	reader := &pushReader{packets: make(chan av.Packet, pushReaderBuffer)}
+	s.readers[reader] = struct{}{}
+	return reader, nil
+}
+
+func (s *pushSession) unsubscribe(reader *pushReader) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.readers[reader]; ok {
+		delete(s.readers, reader)
+		close(reader.packets)
+	}
+}
+
+func (s *pushSession) write(packet av.Packet) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for reader := range s.readers {
+		select {
+		case reader.packets <- packet:
+		default:
+			reader.err = ErrPushSlowReader
+			delete(s.readers, reader)
+			close(reader.packets)
+		}
+	}
+}
+
+// close 推流结束，通知所有观看者
+func (s *pushSession) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for reader := range s.readers {
+		reader.err = fmt.Errorf("%w: %s", ErrPushOffline, s.key)
+		delete(s.readers, reader)
+		close(reader.packets)
+	}
+}
+
+func (s *pushSession) status() pushSessionStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := pushSessionStatus{
+		Key:       s.key,
+		Remote:    s.remote.String(),
+		Readers:   len(s.readers),
+		StartedAt: s.startedAt,
+	}
+	for _, codec := range s.codecs {
+		status.Codecs = append(status.Codecs, codec.Type().String())
+	}
+	return status
+}
+
+// PushStream 推流码对应的频道，将推流的数据转封装为ts输出，推流结束时返回ErrPushOffline
+type PushStream struct {
+	server *PushServer
+	key    string
+
+	session *pushSession
+	reader  *pushReader
+	muxer   *tsMuxer
+	frames  chan Frame
+	pending []byte
+	loopErr error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewPushStream(server *PushServer, key string) *PushStream {
+	s := &PushStream{
+		server: server,
+		key:    key,
+		muxer:  newTSMuxer(),
+		frames: make(chan Frame),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *PushStream) Start() error {
+	session, reader, err := s.server.subscribe(s.key)
+	if err != nil {
+		return err
+	}
+	s.session, s.reader = session, reader
+	go s.loop()
+	return nil
+}
+
+func (s *PushStream) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		s.pending = frame.Data
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *PushStream) ReadFrame() (Frame, error) {
+	select {
+	case frame, ok := <-s.frames:
+		if !ok {
+			if s.loopErr != nil {
+				return Frame{}, s.loopErr
+			}
+			return Frame{}, ErrReadClosedStream
+		}
+		return frame, nil
+	case <-s.ctx.Done():
+		return Frame{}, ErrReadClosedStream
+	}
+}
+
+func (s *PushStream) Close() error {
+	s.cancel()
+	if s.session != nil {
+		s.session.unsubscribe(s.reader)
+	}
+	return nil
+}
+
+func (s *PushStream) ContentType() string {
+	return ContentTypeTS
+}
+
+// loop 从第一个关键帧开始输出，时间戳从0开始
+func (s *PushStream) loop() {
+	defer close(s.frames)
+	codecs := s.session.codecs
+	hasVideo := false
+	for _, codec := range codecs {
+		if codec.Type().IsVideo() {
+			hasVideo = true
+		}
+	}
+	started := false
+	first := time.Duration(0)
+	for {
+		var packet av.Packet
+		var ok bool
+		select {
+		case packet, ok = <-s.reader.packets:
+		case <-s.ctx.Done():
+			return
+		}
+		if !ok {
+			s.loopErr = s.reader.err
+			return
+		}
+		if int(packet.Idx) >= len(codecs) {
+			continue
+		}
+
+		if !started {
+			if hasVideo && !(packet.IsKeyFrame && codecs[packet.Idx].Type().IsVideo()) {
+				continue
+			}
+			header, err := s.muxer.WriteHeader(codecs)
+			if err != nil {
+				s.loopErr = err
+				return
+			}
+			if s.emit(Frame{Data: header, Header: true}) != nil {
+				return
+			}
+			started = true
+			first = packet.Time
+		}
+		packet.Time -= first
+		if packet.Time < 0 {
+			packet.Time = 0
+		}
+
+		data, keyFrame, err := s.muxer.WritePacket(packet)
+		if err != nil {
+			s.loopErr = err
+			return
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if s.emit(Frame{Data: data, KeyFrame: keyFrame}) != nil {
+			return
+		}
+	}
+}
+
+func (s *PushStream) emit(frame Frame) error {
+	select {
+	case s.frames <- frame:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
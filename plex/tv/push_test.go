@@ -0,0 +1,146 @@
+package tv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/format/rtmp"
+)
+
+// startPushServer 在随机端口上启动推流服务，返回推流地址的前缀
+func startPushServer(t *testing.T, server *PushServer) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	go server.ListenAndServe(addr)
+	return "rtmp://" + addr + "/live/"
+}
+
+// dialPush 连接推流服务，服务可能还没有开始监听
+func dialPush(t *testing.T, uri string) *rtmp.Conn {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		conn, err := rtmp.Dial(uri)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitPublishers 等待正在推流的推流码数量变为count
+func waitPublishers(t *testing.T, server *PushServer, count int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for len(server.Status().([]pushSessionStatus)) != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("publishers = %+v, want %d", server.Status(), count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPushStream(t *testing.T) {
+	server := NewPushServer(nil)
+	server.Authorize = func(key string, password string) error {
+		if password != "secret" {
+			return ErrPushUnauthorized
+		}
+		return nil
+	}
+	base := startPushServer(t, server)
+
+	// 还没有推流时无法播放
+	if err := NewPushStream(server, "cam").Start(); !errors.Is(err, ErrPushOffline) {
+		t.Fatalf("Start() before publish = %v", err)
+	}
+
+	codecs, packets := testPackets(t, 2)
+	// 服务端收到20个数据后才能确定编码信息，第一秒的数据用于等待推流开始，从第二秒的关键帧开始观看
+	live := 0
+	for packets[live].Idx != 0 || packets[live].Time != time.Second {
+		live++
+	}
+	publisher := dialPush(t, base+"cam?password=secret")
+	if err := publisher.WriteHeader(codecs); err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range packets[:live] {
+		if err := publisher.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 写入的数据需要刷新才会发送
+	if err := publisher.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	waitPublishers(t, server, 1)
+
+	stream := NewPushStream(server, "cam")
+	if err := stream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if status := server.Status().([]pushSessionStatus); status[0].Key != "cam" || status[0].Readers != 1 {
+		t.Errorf("status = %+v", status)
+	}
+
+	go func() {
+		for _, packet := range packets[live:] {
+			if err := publisher.WritePacket(packet); err != nil {
+				return
+			}
+		}
+		publisher.WriteTrailer()
+		publisher.Close()
+	}()
+	gotCodecs, gotPackets, err := demuxTSOutput(t, stream)
+	if !errors.Is(err, ErrPushOffline) {
+		t.Errorf("error after unpublish = %v", err)
+	}
+	checkTSOutput(t, gotCodecs, gotPackets, 25, len(packets)-live-25)
+
+	// 推流结束后重新变为离线
+	waitPublishers(t, server, 0)
+	if err = NewPushStream(server, "cam").Start(); !errors.Is(err, ErrPushOffline) {
+		t.Errorf("Start() after unpublish = %v", err)
+	}
+}
+
+func TestPushUnauthorized(t *testing.T) {
+	authorized := make(chan string, 1)
+	server := NewPushServer(nil)
+	server.Authorize = func(key string, password string) error {
+		authorized <- fmt.Sprintf("%s:%s", key, password)
+		return ErrPushUnauthorized
+	}
+	base := startPushServer(t, server)
+
+	codecs, _ := testPackets(t, 0)
+	publisher := dialPush(t, base+"cam?password=wrong")
+	defer publisher.Close()
+	// 推流请求在写入头部时发送
+	publisher.WriteHeader(codecs)
+	publisher.WriteTrailer()
+	select {
+	case got := <-authorized:
+		if got != "cam:wrong" {
+			t.Errorf("Authorize(%s)", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Authorize was not called")
+	}
+	waitPublishers(t, server, 0)
+	if err := NewPushStream(server, "cam").Start(); !errors.Is(err, ErrPushOffline) {
+		t.Errorf("Start() = %v", err)
+	}
+}
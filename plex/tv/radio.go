@@ -0,0 +1,846 @@
+package tv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/format/ts"
+	"github.com/grafov/m3u8"
+)
+
+const (
+	// 查找帧头时最多跳过的字节数
+	radioSyncLimit = 64 * 1024
+	// 未播放的电台获取正在播放信息的超时时间
+	radioProbeTimeout = 5 * time.Second
+	// 未播放的电台正在播放信息的缓存时间
+	radioProbeCache = time.Minute
+)
+
+var (
+	ErrRadioNoAudio = errors.New("radio: no audio stream")
+	ErrRadioCover   = errors.New("radio: cover not found")
+)
+
+// RadioOptions radio类型的选项
+type RadioOptions struct {
+	TranscodeOptions
+	// Cover 封面图片的路径或地址，配置后通过ffmpeg合成静态画面的视频
+	Cover string `json:"cover"`
+}
+
+// Validate 检查选项是否有效，配置了封面或转码时需要ffmpeg
+func (o RadioOptions) Validate(env *Env) error {
+	if o.Cover == "" && o.Transcode == "" {
+		return nil
+	}
+	if _, err := env.TranscodeProfile(o.Transcode); err != nil {
+		return err
+	}
+	if o.Cover != "" && !strings.Contains(o.Cover, "://") {
+		if _, err := os.Stat(o.Cover); err != nil {
+			return fmt.Errorf("%w: %s", ErrRadioCover, o.Cover)
+		}
+	}
+	return nil
+}
+
+// NewRadio 创建电台流，配置了封面或转码时经过ffmpeg输出
+func NewRadio(env *Env, source Source) (TVStream, error) {
+	radioUrl, err := url.Parse(source.URL)
+	if err != nil {
+		return nil, err
+	}
+	opt := RadioOptions{}
+	if err = source.DecodeOptions(&opt); err != nil {
+		return nil, err
+	}
+	stream := NewRadioStream(radioUrl, source.Id)
+	if opt.Cover == "" && opt.Transcode == "" {
+		return stream, nil
+	}
+	profile, err := env.TranscodeProfile(opt.Transcode)
+	if err != nil {
+		return nil, err
+	}
+	profile.cover = opt.Cover
+	return NewFFMpegPipeStream(env.FFMpeg, stream, profile, opt.ffmpegOptions(env, source)), nil
+}
+
+// RadioInfo 电台的正在播放信息
+type RadioInfo struct {
+	Station     string    `json:"station"`
+	Description string    `json:"description,omitempty"`
+	Title       string    `json:"title"`
+	Since       time.Time `json:"since"`
+	Codec       string    `json:"codec,omitempty"`
+}
+
+type radioInfoEntry struct {
+	info    RadioInfo
+	playing bool
+	checked time.Time
+}
+
+var (
+	radioInfoLock = new(sync.Mutex)
+	// radioInfos 按频道id记录的正在播放信息，播放中的流会持续更新
+	radioInfos = make(map[string]*radioInfoEntry)
+)
+
+// RadioStream 拉取Icecast/Shoutcast或hls音频并封装为ts，支持aac和mp3。
+// 解析icy元数据中的标题作为正在播放信息，断开后自动重连
+type RadioStream struct {
+	url *url.URL
+	id  string
+
+	muxer   *tsMuxer
+	frames  chan Frame
+	pending []byte
+	loopErr error
+
+	backoff  reconnectBackoff
+	timeline timeline
+
+	infoLock *sync.Mutex
+	info     RadioInfo
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewRadioStream(radioUrl *url.URL, id string) *RadioStream {
+	s := &RadioStream{
+		url:      radioUrl,
+		id:       id,
+		muxer:    newTSMuxer(),
+		frames:   make(chan Frame),
+		infoLock: new(sync.Mutex),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *RadioStream) Start() error {
+	body, err := s.connect()
+	if err != nil {
+		return err
+	}
+	go s.loop(body)
+	return nil
+}
+
+func (s *RadioStream) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		s.pending = frame.Data
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *RadioStream) ReadFrame() (Frame, error) {
+	select {
+	case frame, ok := <-s.frames:
+		if !ok {
+			if s.loopErr != nil {
+				return Frame{}, s.loopErr
+			}
+			return Frame{}, ErrReadClosedStream
+		}
+		return frame, nil
+	case <-s.ctx.Done():
+		return Frame{}, ErrReadClosedStream
+	}
+}
+
+func (s *RadioStream) Close() error {
+	s.cancel()
+	radioInfoLock.Lock()
+	defer radioInfoLock.Unlock()
+	if entry, ok := radioInfos[s.id]; ok {
+		entry.playing = false
+		entry.checked = time.Now()
+	}
+	return nil
+}
+
+func (s *RadioStream) ContentType() string {
+	return ContentTypeTS
+}
+
+// Status 电台名称和正在播放的标题
+func (s *RadioStream) Status() any {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	return s.info
+}
+
+// updateInfo 修改正在播放信息，并同步给节目单
+func (s *RadioStream) updateInfo(fn func(info *RadioInfo)) {
+	s.infoLock.Lock()
+	fn(&s.info)
+	info := s.info
+	s.infoLock.Unlock()
+
+	radioInfoLock.Lock()
+	defer radioInfoLock.Unlock()
+	radioInfos[s.id] = &radioInfoEntry{info: info, playing: s.ctx.Err() == nil}
+}
+
+func (s *RadioStream) setTitle(title string) {
+	s.updateInfo(func(info *RadioInfo) {
+		if info.Title != title {
+			info.Title, info.Since = title, time.Now()
+		}
+	})
+}
+
+// connect 连接电台，hls地址返回分片数据，其余地址请求icy元数据并去除
+func (s *RadioStream) connect() (io.ReadCloser, error) {
+	if strings.HasSuffix(s.url.Path, ".m3u8") {
+		playlistUrl, err := resolveRadioPlaylist(s.ctx, s.url)
+		if err != nil {
+			return nil, err
+		}
+		hls := NewHLSStream(playlistUrl)
+		if err = hls.Start(); err != nil {
+			return nil, err
+		}
+		return newRadioBody(s.ctx, hls, hls), nil
+	}
+
+	resp, err := requestRadio(s.ctx, s.url)
+	if err != nil {
+		return nil, err
+	}
+	station, description := radioStation(resp.Header)
+	s.updateInfo(func(info *RadioInfo) {
+		info.Station, info.Description = station, description
+	})
+	return newRadioBody(s.ctx, icyBody(resp, s.setTitle), resp.Body), nil
+}
+
+// loop 持续输出数据，连接断开时重连，直到流被关闭或者连续重连失败
+func (s *RadioStream) loop(body io.ReadCloser) {
+	defer close(s.frames)
+	for {
+		played, err := s.play(body)
+		body.Close()
+		if s.ctx.Err() != nil {
+			return
+		}
+		if played {
+			s.backoff.reset()
+		}
+		s.timeline.advance(reconnectGap)
+
+		for {
+			if err = s.backoff.wait(s.ctx, err); err != nil {
+				s.loopErr = err
+				return
+			}
+			if body, err = s.connect(); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// play 输出一次连接的数据，ts直接转封装，其余按aac或mp3帧解析
+func (s *RadioStream) play(body io.Reader) (played bool, err error) {
+	r := bufio.NewReaderSize(body, radioSyncLimit)
+	head, _ := r.Peek(189)
+	if len(head) == 189 && head[0] == 0x47 && head[188] == 0x47 {
+		return s.playTS(r)
+	}
+	return s.playES(r)
+}
+
+// playES 解析音频帧，按采样数计算时间戳
+func (s *RadioStream) playES(r *bufio.Reader) (played bool, err error) {
+	parser := &radioParser{r: r, onTitle: s.setTitle}
+	elapsed := time.Duration(0)
+	for {
+		frame, err := parser.next()
+		if err != nil {
+			return played, err
+		}
+		if frame.Codec != nil {
+			if err = s.writeHeader(frame.Codec); err != nil {
+				return played, err
+			}
+		}
+		packet := av.Packet{Data: frame.Data, Time: s.timeline.stamp(elapsed)}
+		elapsed += frame.Duration
+		if err = s.writePacket(packet); err != nil {
+			return played, err
+		}
+		played = true
+	}
+}
+
+// playTS 转封装ts中的音频，丢弃视频等其余轨道
+func (s *RadioStream) playTS(r io.Reader) (played bool, err error) {
+	demuxer := ts.NewDemuxer(r)
+	var codecs []av.CodecData
+	if err = demuxSafely(func() (err error) {
+		codecs, err = demuxer.Streams()
+		return err
+	}); err != nil {
+		return false, err
+	}
+	index := make(map[int8]int8)
+	var audio []av.CodecData
+	for i, codec := range codecs {
+		if codec.Type().IsAudio() {
+			index[int8(i)] = int8(len(audio))
+			audio = append(audio, codec)
+		}
+	}
+	if len(audio) == 0 {
+		return false, ErrRadioNoAudio
+	}
+	if err = s.writeHeader(audio...); err != nil {
+		return false, err
+	}
+
+	first := time.Duration(-1)
+	for {
+		var packet av.Packet
+		if err = demuxSafely(func() (err error) {
+			packet, err = demuxer.ReadPacket()
+			return err
+		}); err != nil {
+			return played, err
+		}
+		idx, ok := index[packet.Idx]
+		if !ok {
+			continue
+		}
+		packet.Idx = idx
+		if first < 0 {
+			first = packet.Time
+		}
+		packet.Time -= first
+		if packet.Time < 0 {
+			packet.Time = 0
+		}
+		packet.Time = s.timeline.stamp(packet.Time)
+		if err = s.writePacket(packet); err != nil {
+			return played, err
+		}
+		played = true
+	}
+}
+
+func (s *RadioStream) writeHeader(codecs ...av.CodecData) error {
+	header, err := s.muxer.WriteHeader(codecs)
+	if err != nil {
+		return err
+	}
+	s.updateInfo(func(info *RadioInfo) {
+		info.Codec = codecs[0].Type().String()
+		if codecs[0].Type() == codecTypeMPEGAudio {
+			info.Codec = "MP3"
+		}
+	})
+	return s.emit(Frame{Data: header, Header: true})
+}
+
+// writePacket 输出一帧音频，纯音频的每一帧都可以作为新读者的起点
+func (s *RadioStream) writePacket(packet av.Packet) error {
+	data, _, err := s.muxer.WritePacket(packet)
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	return s.emit(Frame{Data: data, KeyFrame: true})
+}
+
+func (s *RadioStream) emit(frame Frame) error {
+	select {
+	case s.frames <- frame:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// radioBody 连接的数据，流被关闭时同时关闭连接，使阻塞的读取返回
+type radioBody struct {
+	io.Reader
+	closer io.Closer
+	done   chan struct{}
+	once   *sync.Once
+}
+
+func newRadioBody(ctx context.Context, r io.Reader, closer io.Closer) *radioBody {
+	b := &radioBody{Reader: r, closer: closer, done: make(chan struct{}), once: new(sync.Once)}
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.Close()
+		case <-b.done:
+		}
+	}()
+	return b
+}
+
+func (b *radioBody) Close() error {
+	var err error
+	b.once.Do(func() {
+		close(b.done)
+		err = b.closer.Close()
+	})
+	return err
+}
+
+// requestRadio 请求电台地址，要求服务器在数据中插入icy元数据
+func requestRadio(ctx context.Context, radioUrl *url.URL) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", radioUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Icy-MetaData", "1")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// radioStation 从响应头中读取电台名称和简介
+func radioStation(header http.Header) (string, string) {
+	return icyText(header.Get("icy-name")), icyText(header.Get("icy-description"))
+}
+
+// icyBody 返回去除icy元数据后的音频数据，服务器不支持元数据时原样返回
+func icyBody(resp *http.Response, onTitle func(string)) io.Reader {
+	metaint, _ := strconv.Atoi(resp.Header.Get("icy-metaint"))
+	if metaint <= 0 {
+		return resp.Body
+	}
+	return &icyReader{r: resp.Body, metaint: metaint, left: metaint, onTitle: onTitle}
+}
+
+// icyReader 每metaint字节的音频后跟随一个元数据块，读取时去除元数据块并解析其中的标题
+type icyReader struct {
+	r       io.Reader
+	metaint int
+	left    int
+	onTitle func(string)
+}
+
+func (r *icyReader) Read(b []byte) (int, error) {
+	if r.left == 0 {
+		if err := r.readMeta(); err != nil {
+			return 0, err
+		}
+		r.left = r.metaint
+	}
+	if len(b) > r.left {
+		b = b[:r.left]
+	}
+	n, err := r.r.Read(b)
+	r.left -= n
+	return n, err
+}
+
+func (r *icyReader) readMeta() error {
+	var length [1]byte
+	if _, err := io.ReadFull(r.r, length[:]); err != nil {
+		return err
+	}
+	if length[0] == 0 {
+		return nil
+	}
+	meta := make([]byte, int(length[0])*16)
+	if _, err := io.ReadFull(r.r, meta); err != nil {
+		return err
+	}
+	if title, ok := parseStreamTitle(string(meta)); ok && r.onTitle != nil {
+		r.onTitle(title)
+	}
+	return nil
+}
+
+// parseStreamTitle 解析元数据中的StreamTitle='...';
+func parseStreamTitle(meta string) (string, bool) {
+	const prefix = "StreamTitle='"
+	start := strings.Index(meta, prefix)
+	if start < 0 {
+		return "", false
+	}
+	meta = meta[start+len(prefix):]
+	end := strings.Index(meta, "';")
+	if end < 0 {
+		end = strings.LastIndexByte(strings.TrimRight(meta, "\x00"), '\'')
+	}
+	if end < 0 {
+		return "", false
+	}
+	return icyText(meta[:end]), true
+}
+
+// icyText 元数据没有规定编码，不是有效的utf-8时按latin1处理
+func icyText(text string) string {
+	text = strings.TrimSpace(strings.Trim(text, "\x00"))
+	if utf8.ValidString(text) {
+		return text
+	}
+	return latin1(text)
+}
+
+func latin1(text string) string {
+	runes := make([]rune, len(text))
+	for i := 0; i < len(text); i++ {
+		runes[i] = rune(text[i])
+	}
+	return string(runes)
+}
+
+// resolveRadioPlaylist 主播放列表时选择音频节目，返回媒体播放列表的地址
+func resolveRadioPlaylist(ctx context.Context, playlistUrl *url.URL) (*url.URL, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", playlistUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus(resp); err != nil {
+		return nil, err
+	}
+	playlist, listType, err := m3u8.DecodeFrom(resp.Body, false)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if listType == m3u8.MEDIA {
+		return playlistUrl, nil
+	}
+	master, ok := playlist.(*m3u8.MasterPlaylist)
+	if !ok {
+		return nil, ErrUnkownM3u8PlaylistType
+	}
+	uri := radioRendition(master)
+	if uri == "" {
+		return nil, ErrRadioNoAudio
+	}
+	return playlistUrl.Parse(uri)
+}
+
+// radioRendition 优先选择默认的音频节目，其次是只有音频的码率最高的版本，都没有时选择码率最高的版本
+func radioRendition(master *m3u8.MasterPlaylist) string {
+	var alternative, audioOnly, best *m3u8.Variant
+	for _, variant := range master.Variants {
+		if variant == nil {
+			continue
+		}
+		for _, alt := range variant.Alternatives {
+			if alt == nil || alt.Type != "AUDIO" || alt.URI == "" {
+				continue
+			}
+			if alt.Default {
+				return alt.URI
+			}
+			if alternative == nil {
+				alternative = &m3u8.Variant{URI: alt.URI}
+			}
+		}
+		if variant.Codecs != "" && !strings.Contains(variant.Codecs, "avc") &&
+			!strings.Contains(variant.Codecs, "hvc") && !strings.Contains(variant.Codecs, "hev") {
+			if audioOnly == nil || variant.Bandwidth > audioOnly.Bandwidth {
+				audioOnly = variant
+			}
+		}
+		if best == nil || variant.Bandwidth > best.Bandwidth {
+			best = variant
+		}
+	}
+	for _, variant := range []*m3u8.Variant{alternative, audioOnly, best} {
+		if variant != nil {
+			return variant.URI
+		}
+	}
+	return ""
+}
+
+// radioFrame 一帧音频，Codec只在编码信息变化时不为空
+type radioFrame struct {
+	Data     []byte
+	Codec    av.AudioCodecData
+	Duration time.Duration
+}
+
+// radioParser 从aac(adts)或mp3的基本流中切分出帧，跳过id3标签和无法识别的数据
+type radioParser struct {
+	r       *bufio.Reader
+	onTitle func(string)
+	// key 当前的编码信息，用于判断是否变化
+	key    any
+	synced bool
+}
+
+func (p *radioParser) next() (radioFrame, error) {
+	skipped := 0
+	for {
+		if skipped > radioSyncLimit {
+			return radioFrame{}, ErrRadioNoAudio
+		}
+		head, err := p.r.Peek(10)
+		if len(head) < mpegAudioHeaderLength {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return radioFrame{}, err
+		}
+
+		// hls的音频分片以id3标签开头
+		if len(head) == 10 && string(head[:3]) == "ID3" {
+			size := 10 + id3Size(head[6:10])
+			if head[5]&0x10 != 0 {
+				size += 10
+			}
+			tag := make([]byte, size)
+			if _, err = io.ReadFull(p.r, tag); err != nil {
+				return radioFrame{}, err
+			}
+			if title := parseID3Title(tag); title != "" && p.onTitle != nil {
+				p.onTitle(title)
+			}
+			continue
+		}
+
+		frame, ok, err := p.readFrame(head)
+		if err != nil {
+			return radioFrame{}, err
+		}
+		if ok {
+			return frame, nil
+		}
+		p.synced = false
+		p.r.Discard(1)
+		skipped++
+	}
+}
+
+// readFrame head为有效的帧头时读取整帧，否则ok为false
+func (p *radioParser) readFrame(head []byte) (frame radioFrame, ok bool, err error) {
+	var key any
+	var codec av.AudioCodecData
+	var frameLen, headerLen, samples, rate int
+	if head[0] == 0xFF && head[1]&0xF6 == 0xF0 {
+		if len(head) < aacparser.ADTSHeaderLength {
+			return frame, false, nil
+		}
+		config, hdrlen, framelen, n, err := aacparser.ParseADTSHeader(head)
+		if err != nil || config.SampleRate == 0 {
+			return frame, false, nil
+		}
+		key, frameLen, headerLen, samples, rate = config, framelen, hdrlen, n, config.SampleRate
+		if key != p.key {
+			if codec, err = aacparser.NewCodecDataFromMPEG4AudioConfig(config); err != nil {
+				return frame, false, nil
+			}
+		}
+	} else if mpeg, n, valid := parseMPEGAudioHeader(head); valid {
+		key, codec, frameLen, samples, rate = mpeg, mpeg, n, mpeg.Samples, mpeg.Rate
+	} else {
+		return frame, false, nil
+	}
+
+	// 未同步时检查下一帧的帧头，避免把数据误认为帧头
+	if !p.synced {
+		next, _ := p.r.Peek(frameLen + 2)
+		if len(next) == frameLen+2 && !(next[frameLen] == 0xFF && next[frameLen+1]&0xE0 == 0xE0) &&
+			string(next[frameLen:]) != "ID" {
+			return frame, false, nil
+		}
+	}
+
+	data := make([]byte, frameLen)
+	if _, err = io.ReadFull(p.r, data); err != nil {
+		return frame, false, err
+	}
+	p.synced = true
+	frame = radioFrame{
+		Data:     data[headerLen:],
+		Duration: time.Duration(samples) * time.Second / time.Duration(rate),
+	}
+	if key != p.key {
+		frame.Codec, p.key = codec, key
+	}
+	return frame, true, nil
+}
+
+// parseID3Title 读取id3v2.3/2.4标签中的艺术家和标题
+func parseID3Title(tag []byte) string {
+	version := tag[3]
+	if version < 3 {
+		return ""
+	}
+	body := tag[10:]
+	if tag[5]&0x40 != 0 && len(body) >= 4 {
+		size := int(binary.BigEndian.Uint32(body))
+		if version == 4 {
+			size = id3Size(body)
+		} else {
+			size += 4
+		}
+		if size > len(body) {
+			return ""
+		}
+		body = body[size:]
+	}
+
+	var artist, title string
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		size := int(binary.BigEndian.Uint32(body[4:]))
+		if version == 4 {
+			size = id3Size(body[4:])
+		}
+		if size < 0 || 10+size > len(body) {
+			break
+		}
+		switch id {
+		case "TIT2":
+			title = id3Text(body[10 : 10+size])
+		case "TPE1":
+			artist = id3Text(body[10 : 10+size])
+		}
+		body = body[10+size:]
+	}
+	if artist != "" && title != "" {
+		return artist + " - " + title
+	}
+	return title
+}
+
+// id3Size 每个字节只使用低7位的长度
+func id3Size(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+// id3Text 解码文本帧，第一个字节为编码方式
+func id3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	encoding, b := b[0], b[1:]
+	var text string
+	switch encoding {
+	case 0:
+		text = latin1(string(b))
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(b) >= 2 && (b[0] == 0xFE && b[1] == 0xFF || b[0] == 0xFF && b[1] == 0xFE) {
+			bigEndian, b = b[0] == 0xFE, b[2:]
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(b[i*2:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(b[i*2:])
+			}
+		}
+		text = string(utf16.Decode(units))
+	default:
+		text = string(b)
+	}
+	return strings.TrimSpace(strings.Trim(text, "\x00"))
+}
+
+// radioGuide 以正在播放的标题作为节目，持续到节目单结束
+func radioGuide(env *Env, source Source, from time.Time, to time.Time) ([]Programme, error) {
+	info, err := radioNowPlaying(source)
+	if err != nil {
+		return nil, err
+	}
+	programme := Programme{Start: info.Since, Stop: to, Title: info.Title, Description: info.Description}
+	if programme.Title == "" {
+		programme.Title = info.Station
+	} else if info.Station != "" {
+		programme.Description = info.Station
+	}
+	if programme.Title == "" {
+		programme.Title = source.Name
+	}
+	if programme.Start.IsZero() || programme.Start.Before(from) {
+		programme.Start = from
+	}
+	return []Programme{programme}, nil
+}
+
+// radioNowPlaying 返回电台的正在播放信息，未在播放时短暂连接电台读取第一个元数据块，结果会缓存一段时间
+func radioNowPlaying(source Source) (RadioInfo, error) {
+	radioInfoLock.Lock()
+	entry, ok := radioInfos[source.Id]
+	if ok && (entry.playing || time.Since(entry.checked) < radioProbeCache) {
+		radioInfoLock.Unlock()
+		return entry.info, nil
+	}
+	radioInfoLock.Unlock()
+
+	info, err := probeRadio(source.URL)
+	radioInfoLock.Lock()
+	defer radioInfoLock.Unlock()
+	// 探测期间开始播放时以播放中的信息为准
+	if entry, ok := radioInfos[source.Id]; ok && entry.playing {
+		return entry.info, nil
+	}
+	radioInfos[source.Id] = &radioInfoEntry{info: info, checked: time.Now()}
+	return info, err
+}
+
+// probeRadio 连接电台读取名称和第一个元数据块中的标题，hls地址不会探测
+func probeRadio(rawUrl string) (RadioInfo, error) {
+	radioUrl, err := url.Parse(rawUrl)
+	if err != nil || strings.HasSuffix(radioUrl.Path, ".m3u8") {
+		return RadioInfo{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), radioProbeTimeout)
+	defer cancel()
+	resp, err := requestRadio(ctx, radioUrl)
+	if err != nil {
+		return RadioInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	info := RadioInfo{}
+	info.Station, info.Description = radioStation(resp.Header)
+	body := icyBody(resp, func(title string) {
+		info.Title, info.Since = title, time.Now()
+	})
+	if icy, ok := body.(*icyReader); ok {
+		// 读完第一段音频后紧接着就是元数据块
+		io.CopyN(io.Discard, icy, int64(icy.metaint)+1)
+	}
+	return info, nil
+}
@@ -0,0 +1,102 @@
+package tv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseStreamTitle(t *testing.T) {
+	tests := []struct {
+		meta  string
+		title string
+		ok    bool
+	}{
+		{"StreamTitle='Artist - Song';StreamUrl='http://radio';\x00\x00", "Artist - Song", true},
+		{"StreamTitle='Rock 'n' Roll';\x00", "Rock 'n' Roll", true},
+		{"StreamTitle='';\x00\x00", "", true},
+		{"StreamUrl='http://radio';StreamTitle=' News ';", "News", true},
+		// 没有结尾的分号时取最后一个引号
+		{"StreamTitle='Song'\x00\x00\x00", "Song", true},
+		{"StreamTitle='Song\x00\x00\x00", "", false},
+		{"StreamUrl='http://radio';", "", false},
+		// 不是有效的utf-8时按latin1处理
+		{"StreamTitle='Caf\xe9 del Mar';", "Café del Mar", true},
+		{"StreamTitle='Café del Mar';", "Café del Mar", true},
+	}
+	for _, test := range tests {
+		title, ok := parseStreamTitle(test.meta)
+		if title != test.title || ok != test.ok {
+			t.Errorf("parseStreamTitle(%q) = %q, %v, want %q, %v", test.meta, title, ok, test.title, test.ok)
+		}
+	}
+}
+
+// icyMeta 按icy格式编码元数据块，长度为16字节的倍数
+func icyMeta(meta string) []byte {
+	blocks := (len(meta) + 15) / 16
+	b := make([]byte, 1+blocks*16)
+	b[0] = byte(blocks)
+	copy(b[1:], meta)
+	return b
+}
+
+func TestICYReader(t *testing.T) {
+	var stream []byte
+	stream = append(stream, "abcd"...)
+	stream = append(stream, icyMeta("StreamTitle='One';")...)
+	stream = append(stream, "efgh"...)
+	// 长度为0的元数据块
+	stream = append(stream, 0)
+	stream = append(stream, "ijkl"...)
+	stream = append(stream, icyMeta("StreamTitle='Caf\xe9';")...)
+	stream = append(stream, "mn"...)
+
+	// 元数据块和音频在不同位置被分开读取
+	readers := map[string]func(io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+	}
+	for name, wrap := range readers {
+		var titles []string
+		resp := &http.Response{
+			Header: http.Header{"Icy-Metaint": {"4"}},
+			Body:   io.NopCloser(wrap(bytes.NewReader(stream))),
+		}
+		audio, err := io.ReadAll(icyBody(resp, func(title string) {
+			titles = append(titles, title)
+		}))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(audio) != "abcdefghijklmn" {
+			t.Errorf("%s: audio = %q", name, audio)
+		}
+		if strings.Join(titles, "|") != "One|Café" {
+			t.Errorf("%s: titles = %q", name, titles)
+		}
+	}
+}
+
+func TestICYReaderTruncated(t *testing.T) {
+	stream := append([]byte("abcd"), icyMeta("StreamTitle='One';")[:10]...)
+	resp := &http.Response{
+		Header: http.Header{"Icy-Metaint": {"4"}},
+		Body:   io.NopCloser(bytes.NewReader(stream)),
+	}
+	audio, err := io.ReadAll(icyBody(resp, nil))
+	if !errors.Is(err, io.ErrUnexpectedEOF) || string(audio) != "abcd" {
+		t.Errorf("ReadAll() = %q, %v", audio, err)
+	}
+
+	// 没有icy-metaint时原样返回
+	resp = &http.Response{Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(stream))}
+	if audio, _ = io.ReadAll(icyBody(resp, nil)); !bytes.Equal(audio, stream) {
+		t.Errorf("ReadAll() without metaint = %q", audio)
+	}
+}
@@ -0,0 +1,70 @@
+package tv
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// 连续重连失败的最大次数
+	reconnectMaxRetry = 5
+	// 重连的最大等待间隔
+	reconnectMaxBackoff = 10 * time.Second
+	// 重连后时间轴在上一帧基础上推进的间隔
+	reconnectGap = 40 * time.Millisecond
+)
+
+// reconnectBackoff 断开后自动重连的流(rtsp、flv、radio)连续重连失败的计数
+type reconnectBackoff struct {
+	retry int
+}
+
+// reset 成功输出过数据后重新计数
+func (b *reconnectBackoff) reset() {
+	b.retry = 0
+}
+
+// wait 等待下一次重连，间隔随失败次数增加，上游要求等待时不提前重连。
+// 连续失败超过次数时返回err，流被关闭时返回ErrReadClosedStream
+func (b *reconnectBackoff) wait(ctx context.Context, err error) error {
+	b.retry++
+	if b.retry > reconnectMaxRetry {
+		return err
+	}
+	backoff := time.Duration(b.retry) * time.Second
+	if backoff > reconnectMaxBackoff {
+		backoff = reconnectMaxBackoff
+	}
+	if after := RetryAfter(err); after > backoff {
+		backoff = after
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ErrReadClosedStream
+	}
+}
+
+// timeline 每次连接(或dash的每个period)的时间戳从0开始，接在已输出的数据之后使时间戳保持连续
+type timeline struct {
+	// offset 当前连接叠加的偏移，last 已输出的最大时间戳
+	offset time.Duration
+	last   time.Duration
+}
+
+// advance 之后的数据从上一帧之后gap处开始
+func (t *timeline) advance(gap time.Duration) {
+	t.offset = t.last + gap
+}
+
+// stamp 返回连接内的时间d对应的输出时间戳
+func (t *timeline) stamp(d time.Duration) time.Duration {
+	d += t.offset
+	if d > t.last {
+		t.last = d
+	}
+	return d
+}
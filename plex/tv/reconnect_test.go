@@ -0,0 +1,47 @@
+package tv
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimeline(t *testing.T) {
+	var line timeline
+	for _, d := range []time.Duration{0, 40 * time.Millisecond, 2 * time.Second} {
+		line.stamp(d)
+	}
+	// 重连后从0开始的时间戳接在上一帧之后
+	line.advance(reconnectGap)
+	if got, want := line.stamp(0), 2*time.Second+reconnectGap; got != want {
+		t.Errorf("stamp after reconnect = %v, want %v", got, want)
+	}
+	// 时间戳倒退时不影响已输出的最大时间戳
+	line.stamp(-time.Second)
+	line.advance(reconnectGap)
+	if got, want := line.stamp(0), 2*time.Second+2*reconnectGap; got != want {
+		t.Errorf("stamp after second reconnect = %v, want %v", got, want)
+	}
+}
+
+func TestReconnectBackoffClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var backoff reconnectBackoff
+	if err := backoff.wait(ctx, errors.New("eof")); err != ErrReadClosedStream {
+		t.Errorf("err = %v, want %v", err, ErrReadClosedStream)
+	}
+}
+
+func TestReconnectBackoffExhausted(t *testing.T) {
+	backoff := reconnectBackoff{retry: reconnectMaxRetry}
+	failed := errors.New("connection refused")
+	if err := backoff.wait(context.Background(), failed); err != failed {
+		t.Errorf("err = %v, want %v", err, failed)
+	}
+	backoff.reset()
+	if backoff.retry != 0 {
+		t.Errorf("retry = %d after reset", backoff.retry)
+	}
+}
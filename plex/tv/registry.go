@@ -0,0 +1,248 @@
+package tv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnsupportedStreamType    = errors.New("unsupported stream type")
+	ErrFFMpegNotConfigured      = errors.New("ffmpeg not configured")
+	ErrTranscodeProfileNotFound = errors.New("transcode profile not found")
+	ErrCommandNotFound          = errors.New("command not found")
+)
+
+// Source 创建流所需的频道信息
+type Source struct {
+	Id      string
+	Name    string
+	URL     string
+	Type    string
+	Options json.RawMessage
+}
+
+// DecodeOptions 将options解析到v中，未配置options时保持v的默认值
+func (s Source) DecodeOptions(v any) error {
+	if len(s.Options) == 0 {
+		return nil
+	}
+	return json.Unmarshal(s.Options, v)
+}
+
+// Env 创建流时可以使用的全局配置
+type Env struct {
+	FFMpeg            string
+	Logger            *log.Logger
+	TranscodeProfiles map[string]TranscodeProfile
+	Commands          map[string]Command
+	// Slate 默认的待机画面
+	Slate SlateConfig
+	// Push rtmp推流服务，未配置时为nil
+	Push *PushServer
+}
+
+// TranscodeProfile 查找转码配置，name为空时只转封装为ts
+func (e *Env) TranscodeProfile(name string) (TranscodeProfile, error) {
+	if e.FFMpeg == "" {
+		return TranscodeProfile{}, ErrFFMpegNotConfigured
+	}
+	if name == "" {
+		return TranscodeProfile{}, nil
+	}
+	profile, ok := e.TranscodeProfiles[name]
+	if !ok {
+		return TranscodeProfile{}, fmt.Errorf("%w: %s", ErrTranscodeProfileNotFound, name)
+	}
+	return profile, nil
+}
+
+// Command 查找命令，并将其中的占位符替换为频道的信息
+func (e *Env) Command(name string, source Source) (Command, error) {
+	command, ok := e.Commands[name]
+	if !ok {
+		return Command{}, fmt.Errorf("%w: %s", ErrCommandNotFound, name)
+	}
+	return command.Expand(map[string]string{
+		"id":   source.Id,
+		"name": source.Name,
+		"url":  source.URL,
+	}), nil
+}
+
+// StreamType 一种源类型
+type StreamType struct {
+	// Name 频道配置中type的值
+	Name string
+	// Shareable 多个观看者共享同一个源
+	Shareable bool
+	// ContentType 输出数据的媒体类型，为空时由流通过ContentTyper返回
+	ContentType string
+	// NeedsFFMpeg 必须配置ffmpeg才能使用
+	NeedsFFMpeg bool
+	// HandlesTranscode 流自身处理transcode选项，不需要再经过ffmpeg转码
+	HandlesTranscode bool
+	// Redirect 频道没有流也没有节目单，播放时重定向到频道的url
+	Redirect bool
+	// New 创建流，Redirect时为空
+	New func(env *Env, source Source) (TVStream, error)
+	// Validate 检查频道配置，可以为空
+	Validate func(env *Env, source Source) error
+	// ResolveURL 加载频道时将url规范化，如将短号或网页地址解析为直播间id，可以为空
+	ResolveURL func(ctx context.Context, env *Env, source Source) (string, error)
+	// Guide 返回from到to之间的节目单，可以为空
+	Guide func(env *Env, source Source, from time.Time, to time.Time) ([]Programme, error)
+}
+
+// Programme 节目单中的一个节目
+type Programme struct {
+	Start       time.Time
+	Stop        time.Time
+	Title       string
+	Description string
+}
+
+var (
+	streamTypesLock = new(sync.RWMutex)
+	streamTypes     = make(map[string]StreamType)
+)
+
+// RegisterStreamType 注册源类型，名称重复或者不是Redirect却没有New时panic
+func RegisterStreamType(t StreamType) {
+	streamTypesLock.Lock()
+	defer streamTypesLock.Unlock()
+	if t.Name == "" || (t.New == nil) != t.Redirect {
+		panic("tv: register invalid stream type")
+	}
+	if _, exists := streamTypes[t.Name]; exists {
+		panic("tv: register stream type twice: " + t.Name)
+	}
+	streamTypes[t.Name] = t
+}
+
+// LookupStreamType 查找已注册的源类型
+func LookupStreamType(name string) (StreamType, bool) {
+	streamTypesLock.RLock()
+	defer streamTypesLock.RUnlock()
+	t, ok := streamTypes[name]
+	return t, ok
+}
+
+// StreamTypes 已注册的源类型名称
+func StreamTypes() []string {
+	streamTypesLock.RLock()
+	defer streamTypesLock.RUnlock()
+	names := make([]string, 0, len(streamTypes))
+	for name := range streamTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateSource 检查频道的类型及配置是否有效
+func ValidateSource(env *Env, source Source) error {
+	t, ok := LookupStreamType(source.Type)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnsupportedStreamType, source.Type)
+	}
+	if t.NeedsFFMpeg && env.FFMpeg == "" {
+		return ErrFFMpegNotConfigured
+	}
+	if !t.HandlesTranscode {
+		opt := TranscodeOptions{}
+		if err := source.DecodeOptions(&opt); err != nil {
+			return err
+		}
+		if opt.Transcode != "" {
+			if _, err := env.TranscodeProfile(opt.Transcode); err != nil {
+				return err
+			}
+		}
+	}
+	if t.Validate != nil {
+		return t.Validate(env, source)
+	}
+	return nil
+}
+
+// ResolveSource 按频道的类型规范化url，类型不存在或不需要规范化时原样返回
+func ResolveSource(ctx context.Context, env *Env, source Source) (Source, error) {
+	t, ok := LookupStreamType(source.Type)
+	if !ok || t.ResolveURL == nil {
+		return source, nil
+	}
+	resolved, err := t.ResolveURL(ctx, env, source)
+	if err != nil {
+		return source, err
+	}
+	source.URL = resolved
+	return source, nil
+}
+
+// Guide 返回频道在from到to之间的节目单，类型不提供节目单时返回nil
+func Guide(env *Env, source Source, from time.Time, to time.Time) ([]Programme, error) {
+	t, ok := LookupStreamType(source.Type)
+	if !ok || t.Guide == nil {
+		return nil, nil
+	}
+	return t.Guide(env, source, from, to)
+}
+
+// NewStream 按频道的类型创建流，配置了transcode时通过ffmpeg转码输出
+func NewStream(env *Env, source Source) (TVStream, error) {
+	if err := ValidateSource(env, source); err != nil {
+		return nil, err
+	}
+	t, _ := LookupStreamType(source.Type)
+	if t.Redirect {
+		return nil, fmt.Errorf("%w: %s has no stream", ErrUnsupportedStreamType, source.Type)
+	}
+	stream, err := t.New(env, source)
+	if err != nil || t.HandlesTranscode {
+		return stream, err
+	}
+
+	opt := TranscodeOptions{}
+	if err = source.DecodeOptions(&opt); err != nil || opt.Transcode == "" {
+		return stream, err
+	}
+	profile, err := env.TranscodeProfile(opt.Transcode)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return NewFFMpegPipeStream(env.FFMpeg, stream, profile, opt.ffmpegOptions(env, source)), nil
+}
+
+// TranscodeOptions 所有源类型通用的转码选项
+type TranscodeOptions struct {
+	// Transcode 使用的转码配置名称，为空时不转码
+	Transcode string `json:"transcode"`
+	// Restart ffmpeg异常退出后自动重启的次数
+	Restart int `json:"restart"`
+}
+
+func (o TranscodeOptions) ffmpegOptions(env *Env, source Source) FFMpegOptions {
+	return FFMpegOptions{
+		Restart: o.Restart,
+		Logger:  env.Logger,
+		Tag:     source.Id,
+	}
+}
+
+// StreamContentType 返回流输出数据的媒体类型，流和类型都未声明时沿用mp4
+func StreamContentType(t StreamType, stream TVStream) string {
+	if typer, ok := stream.(ContentTyper); ok {
+		return typer.ContentType()
+	}
+	if t.ContentType != "" {
+		return t.ContentType
+	}
+	return ContentTypeMP4
+}
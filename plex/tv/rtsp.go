@@ -2,104 +2,322 @@ package tv
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"time"
 
 	"github.com/deepch/vdk/av"
-	"github.com/deepch/vdk/format/mp4f"
-	"github.com/deepch/vdk/format/rtspv2"
 )
 
+const (
+	RTSPFormatTS  = "ts"
+	RTSPFormatMP4 = "mp4"
+)
+
+var (
+	ErrRTSPKeyFrameTimeout = errors.New("rtsp: wait key frame timeout")
+	ErrRTSPInvalidOptions  = errors.New("rtsp: invalid options")
+)
+
+type RTSPOptions struct {
+	// Format 输出的封装格式，ts或mp4，默认为ts
+	Format string `json:"format"`
+	// Transport rtp的传输方式，tcp或udp，默认为tcp
+	Transport string `json:"transport"`
+	// DialTimeout 连接超时，单位秒，默认3秒
+	DialTimeout int `json:"dial_timeout"`
+	// ReadTimeout 读取超时，单位秒，默认3秒
+	ReadTimeout int `json:"read_timeout"`
+	// KeyFrameTimeout 等待关键帧的超时，单位秒，默认20秒
+	KeyFrameTimeout int `json:"keyframe_timeout"`
+	// DisableAudio 不拉取音频
+	DisableAudio bool `json:"disable_audio"`
+	// Tracks 使用的sdp媒体序号，从0开始，默认使用第一路视频和第一路音频
+	Tracks []int `json:"tracks"`
+}
+
+// Validate 检查配置是否有效
+func (o RTSPOptions) Validate() error {
+	switch o.Format {
+	case "", RTSPFormatTS, RTSPFormatMP4:
+	default:
+		return fmt.Errorf("%w: format %s", ErrRTSPInvalidOptions, o.Format)
+	}
+	switch o.Transport {
+	case "", RTSPTransportTCP, RTSPTransportUDP:
+	default:
+		return fmt.Errorf("%w: transport %s", ErrRTSPInvalidOptions, o.Transport)
+	}
+	for _, track := range o.Tracks {
+		if track < 0 {
+			return fmt.Errorf("%w: track %d", ErrRTSPInvalidOptions, track)
+		}
+	}
+	return nil
+}
+
+func (o RTSPOptions) dialTimeout() time.Duration {
+	return secondsOrDefault(o.DialTimeout, 3*time.Second)
+}
+
+func (o RTSPOptions) readTimeout() time.Duration {
+	return secondsOrDefault(o.ReadTimeout, 3*time.Second)
+}
+
+func (o RTSPOptions) keyFrameTimeout() time.Duration {
+	return secondsOrDefault(o.KeyFrameTimeout, 20*time.Second)
+}
+
+func secondsOrDefault(seconds int, def time.Duration) time.Duration {
+	if seconds <= 0 {
+		return def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 type RTSPStream struct {
-	url      string
-	r        *io.PipeReader
-	w        *io.PipeWriter
-	client   *rtspv2.RTSPClient
-	timeline time.Duration
+	url        string
+	opt        RTSPOptions
+	ffmpeg     string
+	transcoder *audioTranscoder
+	frames     chan Frame
+	pending    []byte
+	loopErr    error
+	muxer      packetMuxer
+
+	backoff  reconnectBackoff
+	timeline timeline
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-func NewRTSPStream(url string) *RTSPStream {
-	s := &RTSPStream{url: url}
-	s.r, s.w = io.Pipe()
+// NewRTSPStream 创建rtsp流，ffmpeg不为空时，ts和mp4不支持的音频会通过ffmpeg转码为aac
+func NewRTSPStream(url string, opt RTSPOptions, ffmpeg string) *RTSPStream {
+	s := &RTSPStream{
+		url:    url,
+		opt:    opt,
+		ffmpeg: ffmpeg,
+	}
+	if opt.Format == RTSPFormatMP4 {
+		s.muxer = newMP4Muxer()
+	} else {
+		s.muxer = newTSMuxer()
+	}
+	s.frames = make(chan Frame)
 	s.ctx, s.cancel = context.WithCancel(context.Background())
 	return s
 }
 
 func (s *RTSPStream) Start() error {
-	opt := rtspv2.RTSPClientOptions{
-		URL:                s.url,
-		DialTimeout:        3 * time.Second,
-		ReadWriteTimeout:   3 * time.Second,
-		InsecureSkipVerify: true,
-	}
-	client, err := rtspv2.Dial(opt)
+	client, err := dialRTSP(s.url, s.opt)
 	if err != nil {
 		return err
 	}
-	s.client = client
+	go s.loop(client)
+	return nil
+}
 
-	go func() {
-		defer s.client.Close()
-		muxer := mp4f.NewMuxer(nil)
-		err = muxer.WriteHeader(s.client.CodecData)
+func (s *RTSPStream) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		frame, err := s.ReadFrame()
 		if err != nil {
-			return
+			return 0, err
 		}
-		_, init := muxer.GetInit(s.client.CodecData)
-		_, err = s.w.Write(init)
-		if err != nil {
+		s.pending = frame.Data
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *RTSPStream) ReadFrame() (Frame, error) {
+	select {
+	case frame, ok := <-s.frames:
+		if !ok {
+			if s.loopErr != nil {
+				return Frame{}, s.loopErr
+			}
+			return Frame{}, ErrReadClosedStream
+		}
+		return frame, nil
+	case <-s.ctx.Done():
+		return Frame{}, ErrReadClosedStream
+	}
+}
+
+func (s *RTSPStream) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *RTSPStream) ContentType() string {
+	return s.muxer.ContentType()
+}
+
+// loop 持续输出数据，连接断开后自动重连，直到流被关闭或者连续重连失败
+func (s *RTSPStream) loop(client *rtspClient) {
+	defer close(s.frames)
+	for {
+		played, err := s.play(client)
+		client.Close()
+		if s.ctx.Err() != nil {
 			return
 		}
+		if played {
+			s.backoff.reset()
+		}
+		s.timeline.advance(reconnectGap)
 
-		keyFrameTimeout := time.NewTimer(20 * time.Second)
 		for {
-			var packet *av.Packet
-			select {
-			case <-s.ctx.Done():
-				return
-			case <-keyFrameTimeout.C:
+			if err = s.backoff.wait(s.ctx, err); err != nil {
+				s.loopErr = err
 				return
-			case sig := <-s.client.Signals:
-				if sig == rtspv2.SignalStreamRTPStop {
-					return
-				}
-			case packet = <-s.client.OutgoingPacketQueue:
 			}
-
-			if packet.IsKeyFrame {
-				keyFrameTimeout.Reset(20 * time.Second)
+			client, err = dialRTSP(s.url, s.opt)
+			if err == nil {
+				break
 			}
+		}
+	}
+}
 
-			s.timeline += packet.Duration
-			packet.Time = s.timeline
-
-			ready, buf, err := muxer.WritePacket(*packet, false)
-			if err != nil {
-				return
+// play 输出一次rtsp连接的数据，played表示是否成功输出过数据
+func (s *RTSPStream) play(client *rtspClient) (played bool, err error) {
+	// 头部在第一个关键帧到来时再输出，此时sps/pps已经就绪
+	headerWritten := false
+	keyFrameTimeout := time.NewTimer(s.opt.keyFrameTimeout())
+	defer keyFrameTimeout.Stop()
+	defer s.closeTranscoder()
+	for {
+		var packet av.Packet
+		var transcoded <-chan av.Packet
+		if s.transcoder != nil {
+			transcoded = s.transcoder.Packets()
+		}
+		select {
+		case <-s.ctx.Done():
+			return played, s.ctx.Err()
+		case <-keyFrameTimeout.C:
+			return played, ErrRTSPKeyFrameTimeout
+		case <-client.Done():
+			if client.Err() != nil {
+				return played, client.Err()
+			}
+			return played, io.EOF
+		case aacPacket, ok := <-transcoded:
+			if !ok {
+				// ffmpeg异常退出，之后的音频直接丢弃
+				s.closeTranscoder()
+				continue
 			}
+			if headerWritten {
+				if err := s.writePacket(aacPacket); err != nil {
+					return played, err
+				}
+			}
+			continue
+		case event := <-client.Events():
+			if event.codecs != nil {
+				headerWritten = false
+				continue
+			}
+			packet = event.packet
+		}
 
-			if ready {
-				_, err = s.w.Write(buf)
+		if packet.IsKeyFrame && !headerWritten {
+			// 参数集还没有就绪时不能输出头部，一直无法就绪时按关键帧超时重连
+			codecs := client.Codecs()
+			if codecsReady(codecs) {
+				header, err := s.muxer.WriteHeader(s.prepareCodecs(codecs))
 				if err != nil {
-					return
+					return played, err
 				}
+				if err = s.emit(Frame{Data: header, Header: true}); err != nil {
+					return played, err
+				}
+				headerWritten = true
 			}
 		}
+		if !headerWritten {
+			continue
+		}
+		if packet.IsKeyFrame {
+			keyFrameTimeout.Reset(s.opt.keyFrameTimeout())
+		}
 
-	}()
+		packet.Time = s.timeline.stamp(packet.Time)
+		if s.transcoder != nil && packet.Idx == s.transcoder.idx {
+			if err := s.transcoder.WritePacket(packet); err != nil {
+				s.closeTranscoder()
+			}
+			continue
+		}
+		if err := s.writePacket(packet); err != nil {
+			return played, err
+		}
+		played = true
+	}
+}
 
-	return nil
+func (s *RTSPStream) writePacket(packet av.Packet) error {
+	data, keyFrame, err := s.muxer.WritePacket(packet)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return s.emit(Frame{Data: data, KeyFrame: keyFrame})
 }
 
-func (s *RTSPStream) Read(b []byte) (int, error) {
-	return s.r.Read(b)
+// codecsReady 所有轨道的编码信息都已就绪
+func codecsReady(codecs []av.CodecData) bool {
+	for _, codec := range codecs {
+		if codec == nil {
+			return false
+		}
+	}
+	return true
 }
 
-func (s *RTSPStream) Close() error {
-	s.cancel()
-	s.r.Close()
-	return nil
+// prepareCodecs 返回输出的编码信息，需要转码的音频替换为转码后的aac
+func (s *RTSPStream) prepareCodecs(codecs []av.CodecData) []av.CodecData {
+	s.closeTranscoder()
+	output := make([]av.CodecData, len(codecs))
+	copy(output, codecs)
+	if s.ffmpeg == "" {
+		return output
+	}
+	for i, codec := range codecs {
+		audio, ok := codec.(av.AudioCodecData)
+		if !ok || !isTranscodableAudio(codec.Type()) {
+			continue
+		}
+		transcoder, err := newAudioTranscoder(s.ffmpeg, audio, int8(i))
+		if err != nil {
+			continue
+		}
+		s.transcoder = transcoder
+		output[i] = transcoder.Codec()
+		break
+	}
+	return output
+}
+
+func (s *RTSPStream) closeTranscoder() {
+	if s.transcoder != nil {
+		s.transcoder.Close()
+		s.transcoder = nil
+	}
+}
+
+func (s *RTSPStream) emit(frame Frame) error {
+	select {
+	case s.frames <- frame:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
 }
@@ -0,0 +1,964 @@
+package tv
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+)
+
+const (
+	RTSPTransportTCP = "tcp"
+	RTSPTransportUDP = "udp"
+)
+
+const (
+	rtspUserAgent = "plex-tuner"
+	// 会话保活的间隔
+	rtspKeepaliveInterval = 25 * time.Second
+	// 缓存的未完成帧的最大字节数
+	rtspMaxFrameSize = 8 * 1024 * 1024
+)
+
+var (
+	ErrRTSPNoTrack      = errors.New("rtsp: no supported track")
+	ErrRTSPBadResponse  = errors.New("rtsp: bad response")
+	ErrRTSPUnauthorized = errors.New("rtsp: unauthorized")
+)
+
+// rtspEvent rtsp客户端输出的事件，codecs不为nil时表示编码信息发生了变化
+type rtspEvent struct {
+	packet av.Packet
+	codecs []av.CodecData
+}
+
+// rtspClient rtsp拉流客户端，支持tcp和udp传输
+type rtspClient struct {
+	opt     RTSPOptions
+	url     *url.URL
+	baseUrl string
+	user    *url.Userinfo
+
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	cseq      int
+	session   string
+	authorize func(method string, uri string) string
+
+	// udp传输时每一路轨道在各自的go程中解析，解析和读取编码信息时需要加锁
+	tracks    []*rtspTrack
+	trackLock sync.Mutex
+	events    chan rtspEvent
+	err       error
+	done      chan struct{}
+	once      sync.Once
+}
+
+// rtspTrack 一路被setup的sdp媒体
+type rtspTrack struct {
+	media     sdp.Media
+	idx       int8
+	codecType av.CodecType
+	// codec 视频的参数集还没有就绪时为nil
+	codec     av.CodecData
+	clockRate int64
+	control   string
+
+	// tcp传输时的rtp通道号
+	channel byte
+	// udp传输时的rtp和rtcp连接
+	rtp  *net.UDPConn
+	rtcp *net.UDPConn
+
+	started  bool
+	lastTS   uint32
+	extTS    int64
+	frameTS  uint32
+	nalus    [][]byte
+	fuBuffer []byte
+	keyFrame bool
+	vps      []byte
+	sps      []byte
+	pps      []byte
+}
+
+func dialRTSP(rawUrl string, opt RTSPOptions) (*rtspClient, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	c := &rtspClient{
+		opt:    opt,
+		url:    u,
+		user:   u.User,
+		events: make(chan rtspEvent, 1000),
+		done:   make(chan struct{}),
+	}
+	noUser := *u
+	noUser.User = nil
+	c.baseUrl = noUser.String()
+
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "rtsps" {
+			host = net.JoinHostPort(u.Hostname(), "322")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "554")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", host, opt.dialTimeout())
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "rtsps" {
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: u.Hostname()})
+		conn.SetDeadline(time.Now().Add(opt.dialTimeout()))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	if err = c.setup(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go c.keepalive()
+	if opt.Transport == RTSPTransportUDP {
+		for _, track := range c.tracks {
+			go c.readUDP(track)
+		}
+	} else {
+		go c.readTCP()
+	}
+	return c, nil
+}
+
+// Codecs 返回所有轨道的编码信息，数据包的Idx为其中的下标。视频的参数集就绪之前对应的编码信息为nil
+func (c *rtspClient) Codecs() []av.CodecData {
+	c.trackLock.Lock()
+	defer c.trackLock.Unlock()
+	return c.codecs()
+}
+
+func (c *rtspClient) codecs() []av.CodecData {
+	codecs := make([]av.CodecData, len(c.tracks))
+	for i, track := range c.tracks {
+		codecs[i] = track.codec
+	}
+	return codecs
+}
+
+// Events 输出数据包和编码变化
+func (c *rtspClient) Events() <-chan rtspEvent {
+	return c.events
+}
+
+// Done 连接断开后关闭，之后可以通过Err获取原因
+func (c *rtspClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err 连接异常断开的原因，主动关闭时为nil
+func (c *rtspClient) Err() error {
+	return c.err
+}
+
+func (c *rtspClient) Close() {
+	c.once.Do(func() {
+		close(c.done)
+		if c.session != "" {
+			c.conn.SetDeadline(time.Now().Add(time.Second))
+			c.writeRequest("TEARDOWN", c.baseUrl, nil)
+		}
+		c.conn.Close()
+		for _, track := range c.tracks {
+			if track.rtp != nil {
+				track.rtp.Close()
+				track.rtcp.Close()
+			}
+		}
+	})
+}
+
+func (c *rtspClient) setup() error {
+	if _, err := c.request("OPTIONS", c.baseUrl, nil); err != nil {
+		return err
+	}
+	resp, err := c.request("DESCRIBE", c.baseUrl, map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return err
+	}
+	if base := resp.header.Get("Content-Base"); base != "" {
+		c.baseUrl = strings.TrimSpace(base)
+	}
+
+	_, medias := sdp.Parse(string(resp.body))
+	for _, i := range c.selectTracks(medias) {
+		track := newRTSPTrack(medias[i])
+		if track == nil {
+			continue
+		}
+		track.idx = int8(len(c.tracks))
+		track.control = c.controlUrl(track.media.Control)
+		if err = c.setupTrack(track); err != nil {
+			if track.rtp != nil {
+				track.rtp.Close()
+				track.rtcp.Close()
+			}
+			return err
+		}
+		c.tracks = append(c.tracks, track)
+	}
+	if len(c.tracks) == 0 {
+		return ErrRTSPNoTrack
+	}
+
+	_, err = c.request("PLAY", c.baseUrl, map[string]string{"Range": "npt=0.000-"})
+	return err
+}
+
+// selectTracks 返回需要setup的sdp媒体序号，未配置时选择第一路视频和第一路音频
+func (c *rtspClient) selectTracks(medias []sdp.Media) []int {
+	selected := make([]int, 0)
+	if len(c.opt.Tracks) > 0 {
+		for _, i := range c.opt.Tracks {
+			if i < 0 || i >= len(medias) {
+				continue
+			}
+			if c.opt.DisableAudio && medias[i].AVType == "audio" {
+				continue
+			}
+			selected = append(selected, i)
+		}
+		return selected
+	}
+
+	hasVideo, hasAudio := false, false
+	for i, media := range medias {
+		switch media.AVType {
+		case "video":
+			if !hasVideo {
+				selected = append(selected, i)
+				hasVideo = true
+			}
+		case "audio":
+			if !hasAudio && !c.opt.DisableAudio {
+				selected = append(selected, i)
+				hasAudio = true
+			}
+		}
+	}
+	return selected
+}
+
+func (c *rtspClient) controlUrl(control string) string {
+	if control == "" || control == "*" {
+		return c.baseUrl
+	}
+	if strings.HasPrefix(control, "rtsp://") || strings.HasPrefix(control, "rtsps://") {
+		return control
+	}
+	if strings.HasSuffix(c.baseUrl, "/") {
+		return c.baseUrl + control
+	}
+	return c.baseUrl + "/" + control
+}
+
+func (c *rtspClient) setupTrack(track *rtspTrack) error {
+	var transport string
+	if c.opt.Transport == RTSPTransportUDP {
+		rtp, rtcp, err := listenRTPPair()
+		if err != nil {
+			return err
+		}
+		track.rtp, track.rtcp = rtp, rtcp
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		transport = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", port, port+1)
+	} else {
+		track.channel = byte(track.idx) * 2
+		transport = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", track.channel, track.channel+1)
+	}
+	resp, err := c.request("SETUP", track.control, map[string]string{"Transport": transport})
+	if err != nil {
+		return err
+	}
+	if session := resp.header.Get("Session"); session != "" {
+		c.session = strings.TrimSpace(strings.Split(session, ";")[0])
+	}
+	// 服务端可能修改了通道号
+	for _, field := range strings.Split(resp.header.Get("Transport"), ";") {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "interleaved=") {
+			v := strings.TrimPrefix(field, "interleaved=")
+			if ch, err := strconv.Atoi(strings.Split(v, "-")[0]); err == nil {
+				track.channel = byte(ch)
+			}
+		}
+	}
+	return nil
+}
+
+// listenRTPPair 监听相邻的一对udp端口，偶数端口用于rtp，奇数端口用于rtcp
+func listenRTPPair() (*net.UDPConn, *net.UDPConn, error) {
+	for i := 0; i < 10; i++ {
+		rtp, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return nil, nil, err
+		}
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		if port%2 != 0 {
+			rtp.Close()
+			continue
+		}
+		rtcp, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+		if err != nil {
+			rtp.Close()
+			continue
+		}
+		rtp.SetReadBuffer(4 * 1024 * 1024)
+		return rtp, rtcp, nil
+	}
+	return nil, nil, errors.New("rtsp: no available udp port")
+}
+
+type rtspResponse struct {
+	status int
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// request 发送请求并读取响应，需要认证时自动重试一次
+func (c *rtspClient) request(method string, uri string, header map[string]string) (*rtspResponse, error) {
+	c.conn.SetDeadline(time.Now().Add(c.opt.readTimeout()))
+	if err := c.writeRequest(method, uri, header); err != nil {
+		return nil, err
+	}
+	resp, err := c.readResponse()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.status == 401 && c.authorize == nil && c.user != nil {
+		if err = c.prepareAuth(resp.header.Values("WWW-Authenticate")); err != nil {
+			return nil, err
+		}
+		return c.request(method, uri, header)
+	}
+	if resp.status == 401 {
+		return nil, ErrRTSPUnauthorized
+	}
+	if resp.status != 200 {
+		return nil, fmt.Errorf("rtsp: %s %s failed with status %d", method, uri, resp.status)
+	}
+	return resp, nil
+}
+
+func (c *rtspClient) writeRequest(method string, uri string, header map[string]string) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.cseq++
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "%s %s RTSP/1.0\r\n", method, uri)
+	fmt.Fprintf(b, "CSeq: %d\r\n", c.cseq)
+	fmt.Fprintf(b, "User-Agent: %s\r\n", rtspUserAgent)
+	if c.session != "" {
+		fmt.Fprintf(b, "Session: %s\r\n", c.session)
+	}
+	if c.authorize != nil {
+		fmt.Fprintf(b, "Authorization: %s\r\n", c.authorize(method, uri))
+	}
+	for k, v := range header {
+		fmt.Fprintf(b, "%s: %s\r\n", k, v)
+	}
+	b.WriteString("\r\n")
+	_, err := c.conn.Write([]byte(b.String()))
+	return err
+}
+
+func (c *rtspClient) readResponse() (*rtspResponse, error) {
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "RTSP/") {
+		return nil, ErrRTSPBadResponse
+	}
+	resp := &rtspResponse{}
+	if resp.status, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, ErrRTSPBadResponse
+	}
+	if resp.header, err = tp.ReadMIMEHeader(); err != nil {
+		return nil, err
+	}
+	if length, _ := strconv.Atoi(resp.header.Get("Content-Length")); length > 0 {
+		resp.body = make([]byte, length)
+		if _, err = io.ReadFull(c.reader, resp.body); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// prepareAuth 根据服务端的要求准备basic或digest认证
+func (c *rtspClient) prepareAuth(challenges []string) error {
+	username := c.user.Username()
+	password, _ := c.user.Password()
+	for _, challenge := range challenges {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		switch strings.ToLower(scheme) {
+		case "digest":
+			values := parseAuthParams(params)
+			realm, nonce, qop := values["realm"], values["nonce"], values["qop"]
+			ha1 := md5Hex(username + ":" + realm + ":" + password)
+			nc := 0
+			c.authorize = func(method string, uri string) string {
+				ha2 := md5Hex(method + ":" + uri)
+				auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, username, realm, nonce, uri)
+				if strings.Contains(qop, "auth") {
+					nc++
+					cnonce := make([]byte, 8)
+					rand.Read(cnonce)
+					cnonceHex := hex.EncodeToString(cnonce)
+					response := md5Hex(fmt.Sprintf("%s:%s:%08x:%s:auth:%s", ha1, nonce, nc, cnonceHex, ha2))
+					return auth + fmt.Sprintf(`, qop=auth, nc=%08x, cnonce="%s", response="%s"`, nc, cnonceHex, response)
+				}
+				return auth + fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+nonce+":"+ha2))
+			}
+			return nil
+		case "basic":
+			token := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+			c.authorize = func(method string, uri string) string {
+				return "Basic " + token
+			}
+		}
+	}
+	if c.authorize == nil {
+		return ErrRTSPUnauthorized
+	}
+	return nil
+}
+
+func parseAuthParams(s string) map[string]string {
+	values := make(map[string]string)
+	for _, field := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if ok {
+			values[strings.ToLower(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return values
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// keepalive 定时发送GET_PARAMETER保持会话
+func (c *rtspClient) keepalive() {
+	ticker := time.NewTicker(rtspKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if c.opt.Transport == RTSPTransportUDP {
+			// udp传输时控制连接上没有其他数据，直接读取响应
+			c.conn.SetDeadline(time.Now().Add(c.opt.readTimeout()))
+			if err := c.writeRequest("GET_PARAMETER", c.baseUrl, nil); err != nil {
+				c.fail(err)
+				return
+			}
+			if _, err := c.readResponse(); err != nil {
+				c.fail(err)
+				return
+			}
+		} else if err := c.writeRequest("GET_PARAMETER", c.baseUrl, nil); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// fail 记录错误并结束输出
+func (c *rtspClient) fail(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+		for _, track := range c.tracks {
+			if track.rtp != nil {
+				track.rtp.Close()
+				track.rtcp.Close()
+			}
+		}
+	})
+}
+
+func (c *rtspClient) readTCP() {
+	header := make([]byte, 4)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.opt.readTimeout()))
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		// 非rtp数据为保活请求的响应
+		if b[0] != '$' {
+			if _, err = c.readResponse(); err != nil {
+				c.fail(err)
+				return
+			}
+			continue
+		}
+
+		if _, err = io.ReadFull(c.reader, header); err != nil {
+			c.fail(err)
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			c.fail(err)
+			return
+		}
+		for _, track := range c.tracks {
+			if track.channel == header[1] {
+				if !c.handleRTP(track, data) {
+					return
+				}
+				break
+			}
+		}
+	}
+}
+
+func (c *rtspClient) readUDP(track *rtspTrack) {
+	buf := make([]byte, 65536)
+	for {
+		track.rtp.SetReadDeadline(time.Now().Add(c.opt.readTimeout()))
+		n, _, err := track.rtp.ReadFromUDP(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		if !c.handleRTP(track, data) {
+			return
+		}
+	}
+}
+
+// handleRTP 解析rtp包并输出，连接已经关闭时返回false
+func (c *rtspClient) handleRTP(track *rtspTrack, data []byte) bool {
+	payload, ts, marker, ok := parseRTP(data)
+	if !ok {
+		return true
+	}
+	c.trackLock.Lock()
+	packets, codecChanged := track.depacketize(payload, ts, marker)
+	var codecs []av.CodecData
+	if codecChanged {
+		codecs = c.codecs()
+	}
+	c.trackLock.Unlock()
+
+	if codecs != nil {
+		if !c.emit(rtspEvent{codecs: codecs}) {
+			return false
+		}
+	}
+	for _, packet := range packets {
+		if !c.emit(rtspEvent{packet: packet}) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *rtspClient) emit(event rtspEvent) bool {
+	select {
+	case c.events <- event:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// parseRTP 返回rtp包的负载、时间戳和marker标志
+func parseRTP(data []byte) (payload []byte, ts uint32, marker bool, ok bool) {
+	if len(data) < 12 || data[0]>>6 != 2 {
+		return
+	}
+	padding := data[0]&0x20 != 0
+	extension := data[0]&0x10 != 0
+	csrcCount := int(data[0] & 0x0f)
+	marker = data[1]&0x80 != 0
+	ts = binary.BigEndian.Uint32(data[4:8])
+
+	offset := 12 + 4*csrcCount
+	if extension {
+		if len(data) < offset+4 {
+			return
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(data[offset+2:]))
+	}
+	end := len(data)
+	if padding && end > offset {
+		end -= int(data[end-1])
+	}
+	if offset > end {
+		return
+	}
+	return data[offset:end], ts, marker, true
+}
+
+func newRTSPTrack(media sdp.Media) *rtspTrack {
+	track := &rtspTrack{media: media, codecType: media.Type, clockRate: int64(media.TimeScale)}
+	switch media.Type {
+	case av.H264:
+		// sdp中没有可用的参数集时等待带内的参数集
+		if len(media.SpropParameterSets) > 1 {
+			track.sps, track.pps = media.SpropParameterSets[0], media.SpropParameterSets[1]
+			track.updateCodec()
+		}
+	case av.H265:
+		track.vps, track.sps, track.pps = media.SpropVPS, media.SpropSPS, media.SpropPPS
+		track.updateCodec()
+	case av.AAC:
+		codecData, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes(media.Config)
+		if err != nil {
+			return nil
+		}
+		track.codec = codecData
+		if track.media.SizeLength == 0 {
+			track.media.SizeLength = 13
+			track.media.IndexLength = 3
+		}
+	case av.OPUS:
+		layout := av.CH_MONO
+		if media.ChannelCount == 2 {
+			layout = av.CH_STEREO
+		}
+		track.codec = codec.NewOpusCodecData(48000, layout)
+		track.clockRate = 48000
+	case av.PCM_ALAW:
+		track.codec = codec.NewPCMAlawCodecData()
+	case av.PCM_MULAW:
+		track.codec = codec.NewPCMMulawCodecData()
+	case av.PCM:
+		track.codec = codec.NewPCMCodecData()
+	default:
+		return nil
+	}
+	if track.clockRate == 0 {
+		if media.AVType == "video" {
+			track.clockRate = 90000
+		} else {
+			track.clockRate = 8000
+		}
+	}
+	return track
+}
+
+// timeOf 将rtp时间戳转换为从第一个包开始的时间，处理32位回绕
+func (t *rtspTrack) timeOf(ts uint32) time.Duration {
+	if !t.started {
+		t.started = true
+		t.lastTS = ts
+	}
+	t.extTS += int64(int32(ts - t.lastTS))
+	t.lastTS = ts
+	return time.Duration(t.extTS * int64(time.Second) / t.clockRate)
+}
+
+// depacketize 解析rtp负载，返回完整的数据包，codecChanged表示参数集发生了变化
+func (t *rtspTrack) depacketize(payload []byte, ts uint32, marker bool) (packets []av.Packet, codecChanged bool) {
+	if len(payload) == 0 {
+		return nil, false
+	}
+	switch t.codecType {
+	case av.H264, av.H265:
+		// 时间戳变化说明上一帧已经结束(丢失了marker包)
+		if len(t.nalus) > 0 && ts != t.frameTS {
+			packets = t.flushFrame(packets)
+		}
+		t.frameTS = ts
+		if t.codecType == av.H264 {
+			codecChanged = t.depacketizeH264(payload)
+		} else {
+			codecChanged = t.depacketizeH265(payload)
+		}
+		if marker {
+			packets = t.flushFrame(packets)
+		}
+	case av.AAC:
+		packets = t.depacketizeAAC(payload, ts)
+	default:
+		packets = append(packets, av.Packet{
+			Idx:  t.idx,
+			Data: payload,
+			Time: t.timeOf(ts),
+		})
+	}
+	return
+}
+
+func (t *rtspTrack) flushFrame(packets []av.Packet) []av.Packet {
+	size := 0
+	for _, nalu := range t.nalus {
+		size += 4 + len(nalu)
+	}
+	data := make([]byte, 0, size)
+	for _, nalu := range t.nalus {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+		data = append(data, nalu...)
+	}
+	packets = append(packets, av.Packet{
+		Idx:        t.idx,
+		Data:       data,
+		IsKeyFrame: t.keyFrame,
+		Time:       t.timeOf(t.frameTS),
+	})
+	t.nalus = nil
+	t.keyFrame = false
+	return packets
+}
+
+func (t *rtspTrack) depacketizeH264(payload []byte) (codecChanged bool) {
+	switch naluType := payload[0] & 0x1f; {
+	case naluType >= 1 && naluType <= 23:
+		codecChanged = t.addH264NALU(payload)
+	case naluType == 24: // STAP-A
+		data := payload[1:]
+		for len(data) > 2 {
+			size := int(binary.BigEndian.Uint16(data))
+			if size == 0 || size+2 > len(data) {
+				break
+			}
+			codecChanged = t.addH264NALU(data[2:size+2]) || codecChanged
+			data = data[size+2:]
+		}
+	case naluType == 28: // FU-A
+		if len(payload) < 2 {
+			return
+		}
+		start, end := payload[1]&0x80 != 0, payload[1]&0x40 != 0
+		if start {
+			t.fuBuffer = append(t.fuBuffer[:0], payload[0]&0xe0|payload[1]&0x1f)
+		} else if len(t.fuBuffer) == 0 {
+			return
+		}
+		t.fuBuffer = append(t.fuBuffer, payload[2:]...)
+		if len(t.fuBuffer) > rtspMaxFrameSize {
+			t.fuBuffer = t.fuBuffer[:0]
+			return
+		}
+		if end {
+			nalu := make([]byte, len(t.fuBuffer))
+			copy(nalu, t.fuBuffer)
+			t.fuBuffer = t.fuBuffer[:0]
+			codecChanged = t.addH264NALU(nalu)
+		}
+	}
+	return
+}
+
+func (t *rtspTrack) addH264NALU(nalu []byte) (codecChanged bool) {
+	switch nalu[0] & 0x1f {
+	case h264parser.NALU_SPS:
+		if string(nalu) != string(t.sps) {
+			t.sps = append([]byte(nil), nalu...)
+			return t.updateCodec()
+		}
+	case h264parser.NALU_PPS:
+		if string(nalu) != string(t.pps) {
+			t.pps = append([]byte(nil), nalu...)
+			return t.updateCodec()
+		}
+	case 9: // AUD由封装重新生成
+	default:
+		// 5为IDR帧
+		if nalu[0]&0x1f == 5 {
+			t.keyFrame = true
+		}
+		t.nalus = append(t.nalus, nalu)
+	}
+	return false
+}
+
+func (t *rtspTrack) depacketizeH265(payload []byte) (codecChanged bool) {
+	if len(payload) < 3 {
+		return
+	}
+	switch naluType := (payload[0] >> 1) & 0x3f; naluType {
+	case 48: // AP
+		data := payload[2:]
+		for len(data) > 2 {
+			size := int(binary.BigEndian.Uint16(data))
+			if size == 0 || size+2 > len(data) {
+				break
+			}
+			codecChanged = t.addH265NALU(data[2:size+2]) || codecChanged
+			data = data[size+2:]
+		}
+	case 49: // FU
+		fuHeader := payload[2]
+		start, end := fuHeader&0x80 != 0, fuHeader&0x40 != 0
+		if start {
+			t.fuBuffer = append(t.fuBuffer[:0], payload[0]&0x81|(fuHeader&0x3f)<<1, payload[1])
+		} else if len(t.fuBuffer) == 0 {
+			return
+		}
+		t.fuBuffer = append(t.fuBuffer, payload[3:]...)
+		if len(t.fuBuffer) > rtspMaxFrameSize {
+			t.fuBuffer = t.fuBuffer[:0]
+			return
+		}
+		if end {
+			nalu := make([]byte, len(t.fuBuffer))
+			copy(nalu, t.fuBuffer)
+			t.fuBuffer = t.fuBuffer[:0]
+			codecChanged = t.addH265NALU(nalu)
+		}
+	default:
+		codecChanged = t.addH265NALU(payload)
+	}
+	return
+}
+
+func (t *rtspTrack) addH265NALU(nalu []byte) (codecChanged bool) {
+	switch naluType := (nalu[0] >> 1) & 0x3f; {
+	case naluType == h265parser.NAL_UNIT_VPS:
+		if string(nalu) != string(t.vps) {
+			t.vps = append([]byte(nil), nalu...)
+			return t.updateCodec()
+		}
+	case naluType == h265parser.NAL_UNIT_SPS:
+		if string(nalu) != string(t.sps) {
+			t.sps = append([]byte(nil), nalu...)
+			return t.updateCodec()
+		}
+	case naluType == h265parser.NAL_UNIT_PPS:
+		if string(nalu) != string(t.pps) {
+			t.pps = append([]byte(nil), nalu...)
+			return t.updateCodec()
+		}
+	case naluType == h265parser.NAL_UNIT_ACCESS_UNIT_DELIMITER:
+	default:
+		// BLA、IDR、CRA都可以作为解码起点
+		if naluType >= h265parser.NAL_UNIT_CODED_SLICE_BLA_W_LP && naluType <= h265parser.NAL_UNIT_CODED_SLICE_CRA {
+			t.keyFrame = true
+		}
+		t.nalus = append(t.nalus, nalu)
+	}
+	return false
+}
+
+// updateCodec 参数集齐全后更新编码信息。解析时会直接读取sps开头的profile和level，
+// 参数集为空或者sps过短时会panic，需要先检查
+func (t *rtspTrack) updateCodec() bool {
+	switch t.codecType {
+	case av.H264:
+		if len(t.sps) < 4 || len(t.pps) == 0 {
+			return false
+		}
+		codecData, err := h264parser.NewCodecDataFromSPSAndPPS(t.sps, t.pps)
+		if err != nil {
+			return false
+		}
+		t.codec = codecData
+	case av.H265:
+		if len(t.vps) == 0 || len(t.sps) < 6 || len(t.pps) == 0 {
+			return false
+		}
+		codecData, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(t.vps, t.sps, t.pps)
+		if err != nil {
+			return false
+		}
+		t.codec = codecData
+	}
+	return true
+}
+
+// depacketizeAAC 解析RFC3640格式的aac负载
+func (t *rtspTrack) depacketizeAAC(payload []byte, ts uint32) (packets []av.Packet) {
+	if len(payload) < 2 {
+		return nil
+	}
+	headersBits := int(binary.BigEndian.Uint16(payload))
+	headersLen := (headersBits + 7) / 8
+	if len(payload) < 2+headersLen {
+		return nil
+	}
+	headerBits := t.media.SizeLength + t.media.IndexLength
+	if headerBits == 0 {
+		return nil
+	}
+	headers := payload[2 : 2+headersLen]
+	data := payload[2+headersLen:]
+	base := t.timeOf(ts)
+	frameDuration := time.Duration(1024 * int64(time.Second) / t.clockRate)
+	for i := 0; (i+1)*headerBits <= headersBits; i++ {
+		size := int(readBits(headers, i*headerBits, t.media.SizeLength))
+		if size > len(data) {
+			break
+		}
+		frame := data[:size]
+		data = data[size:]
+		if _, hdrlen, _, _, err := aacparser.ParseADTSHeader(frame); err == nil && len(frame) > hdrlen {
+			frame = frame[hdrlen:]
+		}
+		packets = append(packets, av.Packet{
+			Idx:      t.idx,
+			Data:     frame,
+			Time:     base + time.Duration(i)*frameDuration,
+			Duration: frameDuration,
+		})
+	}
+	return packets
+}
+
+// readBits 从offset位开始读取n位
+func readBits(data []byte, offset int, n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		pos := offset + i
+		if pos/8 >= len(data) {
+			break
+		}
+		v = v<<1 | uint32(data[pos/8]>>(7-pos%8)&1)
+	}
+	return v
+}
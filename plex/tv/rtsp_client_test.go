@@ -0,0 +1,603 @@
+package tv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+	"github.com/deepch/vdk/format/ts"
+)
+
+// 1920x1080的h265参数集
+var (
+	testH265VPS = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x78, 0x99, 0x98, 0x09}
+	testH265SPS = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x78, 0xa0, 0x03, 0xc0, 0x80, 0x10, 0xe5, 0x96, 0x66, 0x69, 0x24, 0xca, 0xe0, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x01, 0xe0, 0x80}
+	testH265PPS = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+)
+
+const testRTSPSDP = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=test\r\n" +
+	"t=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=control:trackID=0\r\n" +
+	"m=audio 0 RTP/AVP 8\r\n" +
+	"a=rtpmap:8 PCMA/8000\r\n" +
+	"a=control:trackID=1\r\n" +
+	"m=video 0 RTP/AVP 97\r\n" +
+	"a=rtpmap:97 H265/90000\r\n" +
+	"a=control:trackID=2\r\n"
+
+// rtspSender 向客户端发送一个rtp包，track为sdp中的媒体序号
+type rtspSender func(track int, ts uint32, marker bool, payload []byte)
+
+// fakeRTSPServer 模拟需要digest认证的rtsp服务器，PLAY之后调用play发送rtp包，
+// tcp传输时服务端把通道号改为10+2*track
+type fakeRTSPServer struct {
+	t        *testing.T
+	listener net.Listener
+	play     func(send rtspSender)
+
+	lock     sync.Mutex
+	requests []fakeRTSPRequest
+}
+
+type fakeRTSPRequest struct {
+	method string
+	uri    string
+	header textproto.MIMEHeader
+}
+
+func newFakeRTSPServer(t *testing.T, play func(send rtspSender)) *fakeRTSPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRTSPServer{t: t, listener: listener, play: play}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRTSPServer) url() string {
+	return "rtsp://admin:secret@" + s.listener.Addr().String() + "/live"
+}
+
+func (s *fakeRTSPServer) methods() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var methods []string
+	for _, r := range s.requests {
+		methods = append(methods, r.method)
+	}
+	return methods
+}
+
+func (s *fakeRTSPServer) setups() []fakeRTSPRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var setups []fakeRTSPRequest
+	for _, r := range s.requests {
+		if r.method == "SETUP" {
+			setups = append(setups, r)
+		}
+	}
+	return setups
+}
+
+// authorized 校验digest认证的response
+func (s *fakeRTSPServer) authorized(method string, uri string, auth string) bool {
+	if !strings.HasPrefix(auth, "Digest ") {
+		return false
+	}
+	params := parseAuthParams(strings.TrimPrefix(auth, "Digest "))
+	ha1 := md5Hex("admin:cam:secret")
+	ha2 := md5Hex(method + ":" + uri)
+	return params["uri"] == uri && params["response"] == md5Hex(ha1+":nonce1:"+ha2)
+}
+
+func (s *fakeRTSPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	var writeLock sync.Mutex
+	write := func(data []byte) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		_, err := conn.Write(data)
+		return err
+	}
+	reply := func(cseq string, status string, header string, body string) {
+		if body != "" {
+			header += fmt.Sprintf("Content-Length: %d\r\n", len(body))
+		}
+		write([]byte(fmt.Sprintf("RTSP/1.0 %s\r\nCSeq: %s\r\n%s\r\n%s", status, cseq, header, body)))
+	}
+
+	// 每一路轨道的tcp通道号或者客户端的udp地址
+	channels := make(map[int]byte)
+	udpAddrs := make(map[int]*net.UDPAddr)
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			s.t.Errorf("bad request line %q", line)
+			return
+		}
+		method, uri, cseq := fields[0], fields[1], header.Get("CSeq")
+		s.lock.Lock()
+		s.requests = append(s.requests, fakeRTSPRequest{method, uri, header})
+		s.lock.Unlock()
+
+		if method != "OPTIONS" && !s.authorized(method, uri, header.Get("Authorization")) {
+			reply(cseq, "401 Unauthorized", "WWW-Authenticate: Digest realm=\"cam\", nonce=\"nonce1\"\r\n", "")
+			continue
+		}
+		switch method {
+		case "DESCRIBE":
+			base := "rtsp://" + s.listener.Addr().String() + "/live/"
+			reply(cseq, "200 OK", "Content-Type: application/sdp\r\nContent-Base: "+base+"\r\n", testRTSPSDP)
+		case "SETUP":
+			track, _ := strconv.Atoi(uri[strings.LastIndex(uri, "=")+1:])
+			transport := header.Get("Transport")
+			if i := strings.Index(transport, "client_port="); i >= 0 {
+				port, _ := strconv.Atoi(strings.Split(transport[i+len("client_port="):], "-")[0])
+				udpAddrs[track] = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+			} else {
+				channels[track] = byte(10 + 2*track)
+				transport = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channels[track], channels[track]+1)
+			}
+			reply(cseq, "200 OK", "Session: sess1;timeout=60\r\nTransport: "+transport+"\r\n", "")
+		case "PLAY":
+			reply(cseq, "200 OK", "Session: sess1\r\n", "")
+			go s.sendRTP(write, channels, udpAddrs)
+		case "TEARDOWN":
+			reply(cseq, "200 OK", "", "")
+			return
+		default:
+			reply(cseq, "200 OK", "", "")
+		}
+	}
+}
+
+func (s *fakeRTSPServer) sendRTP(write func([]byte) error, channels map[int]byte, udpAddrs map[int]*net.UDPAddr) {
+	var udp *net.UDPConn
+	if len(udpAddrs) > 0 {
+		var err error
+		if udp, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+			s.t.Error(err)
+			return
+		}
+		defer udp.Close()
+	}
+	seqs := make(map[int]uint16)
+	s.play(func(track int, ts uint32, marker bool, payload []byte) {
+		packet := make([]byte, 12+len(payload))
+		packet[0] = 0x80
+		packet[1] = 96
+		if marker {
+			packet[1] |= 0x80
+		}
+		binary.BigEndian.PutUint16(packet[2:], seqs[track])
+		seqs[track]++
+		binary.BigEndian.PutUint32(packet[4:], ts)
+		copy(packet[12:], payload)
+		if addr, ok := udpAddrs[track]; ok {
+			udp.WriteToUDP(packet, addr)
+			// 避免udp包在本地缓冲区溢出
+			time.Sleep(time.Millisecond)
+			return
+		}
+		write(append([]byte{'$', channels[track], byte(len(packet) >> 8), byte(len(packet))}, packet...))
+	})
+}
+
+// sendH264 每10帧发送一次分为三个FU-A的idr帧，从第paramsFrom帧开始在idr帧前带有sps/pps，其余为单个nalu的p帧
+func sendH264(t *testing.T, send rtspSender, track int, frames int, paramsFrom int) {
+	video, _ := testCodecs(t)
+	codec := video.(h264parser.CodecData)
+	for i := 0; i < frames; i++ {
+		ts := uint32(i * 3600)
+		if i%10 != 0 {
+			send(track, ts, true, []byte{0x41, byte(i), 0xaa})
+			continue
+		}
+		if i >= paramsFrom {
+			send(track, ts, false, codec.SPS())
+			send(track, ts, false, codec.PPS())
+		}
+		send(track, ts, false, []byte{0x7c, 0x80 | 5, 0x88, 1, 2})
+		send(track, ts, false, []byte{0x7c, 5, 3, 4})
+		send(track, ts, true, []byte{0x7c, 0x40 | 5, 5, byte(i)})
+	}
+}
+
+// sendH265 第一帧前用AP发送参数集，每10帧一个分为两个FU的idr帧
+func sendH265(send rtspSender, track int, frames int) {
+	var ap []byte
+	for _, nalu := range [][]byte{testH265VPS, testH265SPS, testH265PPS} {
+		ap = append(append(ap, byte(len(nalu)>>8), byte(len(nalu))), nalu...)
+	}
+	for i := 0; i < frames; i++ {
+		ts := uint32(i * 3600)
+		if i%10 != 0 {
+			send(track, ts, true, []byte{0x02, 0x01, byte(i)})
+			continue
+		}
+		send(track, ts, false, append([]byte{48 << 1, 0x01}, ap...))
+		send(track, ts, false, []byte{49 << 1, 0x01, 0x80 | 19, 0xaf, 1})
+		send(track, ts, true, []byte{49 << 1, 0x01, 0x40 | 19, 2, byte(i)})
+	}
+}
+
+// collectRTSP 读取客户端的事件，直到每一路轨道都收到count个数据包
+func collectRTSP(t *testing.T, c *rtspClient, count int) (packets [][]av.Packet, codecs [][]av.CodecData) {
+	t.Helper()
+	packets = make([][]av.Packet, len(c.Codecs()))
+	timeout := time.After(5 * time.Second)
+	for {
+		done := true
+		for _, p := range packets {
+			done = done && len(p) >= count
+		}
+		if done {
+			return
+		}
+		select {
+		case event := <-c.Events():
+			if event.codecs != nil {
+				codecs = append(codecs, event.codecs)
+				continue
+			}
+			packets[event.packet.Idx] = append(packets[event.packet.Idx], event.packet)
+		case <-c.Done():
+			t.Fatalf("client closed: %v", c.Err())
+		case <-timeout:
+			t.Fatalf("timeout, got %d/%d packets", len(packets[0]), len(packets[len(packets)-1]))
+		}
+	}
+}
+
+func TestRTSPClientTCP(t *testing.T) {
+	server := newFakeRTSPServer(t, func(send rtspSender) {
+		for i := 0; i < 4; i++ {
+			send(1, uint32(i*160), false, bytes.Repeat([]byte{byte(i)}, 160))
+		}
+		sendH264(t, send, 0, 20, 0)
+	})
+	c, err := dialRTSP(server.url(), RTSPOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, codecs := collectRTSP(t, c, 4)
+	c.Close()
+
+	// 默认选择第一路视频和第一路音频，按sdp中的顺序setup
+	setups := server.setups()
+	if len(setups) != 2 {
+		t.Fatalf("got %d SETUP requests", len(setups))
+	}
+	base := "rtsp://" + server.listener.Addr().String() + "/live/"
+	for i, setup := range setups {
+		transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", 2*i, 2*i+1)
+		if setup.uri != base+"trackID="+strconv.Itoa(i) || setup.header.Get("Transport") != transport {
+			t.Errorf("SETUP %d = %s %s", i, setup.uri, setup.header.Get("Transport"))
+		}
+	}
+	// 带内的sps/pps到达后更新编码信息
+	if len(codecs) != 1 || codecs[0][0].(h264parser.CodecData).Width() != 640 || codecs[0][1].Type() != av.PCM_ALAW {
+		t.Fatalf("codec events = %v", codecs)
+	}
+
+	// FU-A拼接为完整的idr帧，参数集不包含在帧中
+	video := packets[0]
+	if !video[0].IsKeyFrame || !bytes.Equal(video[0].Data, []byte{0, 0, 0, 8, 0x65, 0x88, 1, 2, 3, 4, 5, 0}) {
+		t.Errorf("first frame = %+v", video[0])
+	}
+	for i, packet := range video[1:4] {
+		want := []byte{0, 0, 0, 3, 0x41, byte(i + 1), 0xaa}
+		if packet.IsKeyFrame || !bytes.Equal(packet.Data, want) || packet.Time != time.Duration(i+1)*40*time.Millisecond {
+			t.Errorf("frame %d = %+v", i+1, packet)
+		}
+	}
+	audio := packets[1]
+	if audio[3].Time != 60*time.Millisecond || len(audio[3].Data) != 160 || audio[3].Data[0] != 3 {
+		t.Errorf("audio packet = %v %d", audio[3].Time, len(audio[3].Data))
+	}
+
+	// 认证失败后重试，关闭时发送TEARDOWN
+	deadline := time.Now().Add(time.Second)
+	for !strings.HasSuffix(strings.Join(server.methods(), " "), "TEARDOWN") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := strings.Join(server.methods(), " "); got != "OPTIONS DESCRIBE DESCRIBE SETUP SETUP PLAY TEARDOWN" {
+		t.Errorf("requests = %s", got)
+	}
+}
+
+func TestRTSPClientUDP(t *testing.T) {
+	server := newFakeRTSPServer(t, func(send rtspSender) {
+		sendH265(send, 2, 12)
+		for i := 0; i < 3; i++ {
+			send(1, uint32(i*160), false, bytes.Repeat([]byte{byte(i)}, 160))
+		}
+	})
+	// 按配置的顺序选择h265和音频
+	c, err := dialRTSP(server.url(), RTSPOptions{Transport: RTSPTransportUDP, Tracks: []int{2, 1, 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	packets, codecs := collectRTSP(t, c, 3)
+
+	setups := server.setups()
+	if len(setups) != 2 || !strings.HasSuffix(setups[0].uri, "trackID=2") || !strings.HasSuffix(setups[1].uri, "trackID=1") {
+		t.Fatalf("SETUP requests = %+v", setups)
+	}
+	for i, setup := range setups {
+		transport := setup.header.Get("Transport")
+		port := c.tracks[i].rtp.LocalAddr().(*net.UDPAddr).Port
+		if port%2 != 0 || transport != fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", port, port+1) {
+			t.Errorf("SETUP %d transport = %s", i, transport)
+		}
+	}
+
+	if len(codecs) != 1 || codecs[0][0].Type() != av.H265 || codecs[0][0].(h265parser.CodecData).Width() != 1920 {
+		t.Fatalf("codec events = %v", codecs)
+	}
+	// FU拼接时还原nalu头
+	video := packets[0]
+	if !video[0].IsKeyFrame || !bytes.Equal(video[0].Data, []byte{0, 0, 0, 6, 19 << 1, 0x01, 0xaf, 1, 2, 0}) {
+		t.Errorf("first frame = %+v", video[0])
+	}
+	if video[1].IsKeyFrame || !bytes.Equal(video[1].Data, []byte{0, 0, 0, 3, 0x02, 0x01, 1}) || video[1].Time != 40*time.Millisecond {
+		t.Errorf("second frame = %+v", video[1])
+	}
+	if packets[1][2].Time != 40*time.Millisecond {
+		t.Errorf("audio time = %v", packets[1][2].Time)
+	}
+}
+
+func TestRTSPClientUnauthorized(t *testing.T) {
+	server := newFakeRTSPServer(t, func(send rtspSender) {})
+	_, err := dialRTSP(strings.Replace(server.url(), "secret", "wrong", 1), RTSPOptions{})
+	if !errors.Is(err, ErrRTSPUnauthorized) {
+		t.Errorf("dialRTSP() error = %v, want ErrRTSPUnauthorized", err)
+	}
+	// 只重试一次
+	if got := strings.Join(server.methods(), " "); got != "OPTIONS DESCRIBE DESCRIBE" {
+		t.Errorf("requests = %s", got)
+	}
+}
+
+func TestRTSPClientSelectTracks(t *testing.T) {
+	medias := []sdp.Media{{AVType: "audio"}, {AVType: "video"}, {AVType: "audio"}, {AVType: "video"}}
+	tests := []struct {
+		opt  RTSPOptions
+		want []int
+	}{
+		{RTSPOptions{}, []int{0, 1}},
+		{RTSPOptions{DisableAudio: true}, []int{1}},
+		{RTSPOptions{Tracks: []int{3, 2}}, []int{3, 2}},
+		// 超出范围的序号被忽略
+		{RTSPOptions{Tracks: []int{4, 3}}, []int{3}},
+		{RTSPOptions{Tracks: []int{2, 3}, DisableAudio: true}, []int{3}},
+		{RTSPOptions{Tracks: []int{0}, DisableAudio: true}, []int{}},
+	}
+	for _, test := range tests {
+		c := &rtspClient{opt: test.opt}
+		if got := c.selectTracks(medias); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("selectTracks(%+v) = %v, want %v", test.opt, got, test.want)
+		}
+	}
+}
+
+func TestRTSPTrackDepacketizeH264(t *testing.T) {
+	track := newRTSPTrack(sdp.Media{AVType: "video", Type: av.H264, TimeScale: 90000})
+	var packets []av.Packet
+	depacketize := func(payload []byte, ts uint32, marker bool) {
+		p, _ := track.depacketize(payload, ts, marker)
+		packets = append(packets, p...)
+	}
+	// STAP-A中的两个nalu属于同一帧
+	depacketize([]byte{24, 0, 2, 0x65, 1, 0, 3, 0x65, 2, 3}, 0, true)
+	// 丢失了marker包时，时间戳变化结束上一帧
+	depacketize([]byte{0x41, 4}, 3600, false)
+	// 没有开始分片的FU-A被丢弃
+	depacketize([]byte{0x7c, 0x40 | 1, 9}, 7200, false)
+	depacketize([]byte{0x41, 5}, 7200, true)
+
+	if len(packets) != 3 {
+		t.Fatalf("got %d packets", len(packets))
+	}
+	if !packets[0].IsKeyFrame || !bytes.Equal(packets[0].Data, []byte{0, 0, 0, 2, 0x65, 1, 0, 0, 0, 3, 0x65, 2, 3}) {
+		t.Errorf("stap-a frame = %+v", packets[0])
+	}
+	if packets[1].IsKeyFrame || !bytes.Equal(packets[1].Data, []byte{0, 0, 0, 2, 0x41, 4}) || packets[1].Time != 40*time.Millisecond {
+		t.Errorf("frame without marker = %+v", packets[1])
+	}
+	if !bytes.Equal(packets[2].Data, []byte{0, 0, 0, 2, 0x41, 5}) || packets[2].Time != 80*time.Millisecond {
+		t.Errorf("frame after lost fragment = %+v", packets[2])
+	}
+}
+
+func TestRTSPTrackTimestampWrap(t *testing.T) {
+	track := &rtspTrack{clockRate: 90000}
+	track.timeOf(0xffffffff - 3599)
+	if got := track.timeOf(0); got != 40*time.Millisecond {
+		t.Errorf("time after wrap = %v", got)
+	}
+	if got := track.timeOf(0xffffffff - 3599); got != 0 {
+		t.Errorf("time going back = %v", got)
+	}
+}
+
+func TestParseRTP(t *testing.T) {
+	header := []byte{0x80, 0xe0, 0, 1, 0, 0, 0x0e, 0x10, 0, 0, 0, 1}
+	payload, ts, marker, ok := parseRTP(append(header, 1, 2, 3))
+	if !ok || !marker || ts != 3600 || !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Errorf("parseRTP() = %v, %d, %v, %v", payload, ts, marker, ok)
+	}
+
+	// 带csrc、扩展头和填充
+	data := append([]byte{0xb1, 0x60, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1}, 0, 0, 0, 2)
+	data = append(data, 0xbe, 0xde, 0, 1, 9, 9, 9, 9)
+	data = append(data, 1, 2, 0, 2)
+	if payload, _, marker, ok = parseRTP(data); !ok || marker || !bytes.Equal(payload, []byte{1, 2}) {
+		t.Errorf("parseRTP() with extension = %v, %v, %v", payload, marker, ok)
+	}
+
+	for _, data := range [][]byte{header[:11], append([]byte{0x40}, header[1:]...), {0x90, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 9}} {
+		if _, _, _, ok := parseRTP(data); ok {
+			t.Errorf("parseRTP(%x) ok", data)
+		}
+	}
+}
+
+func TestRTSPStream(t *testing.T) {
+	server := newFakeRTSPServer(t, func(send rtspSender) {
+		for i := 0; i < 3; i++ {
+			send(1, uint32(i*160), false, make([]byte, 160))
+		}
+		sendH264(t, send, 0, 25, 0)
+	})
+	s := NewRTSPStream(server.url(), RTSPOptions{DisableAudio: true}, "")
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var output bytes.Buffer
+	for frames := 0; frames < 25; frames++ {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frames == 0 && !frame.Header {
+			t.Fatal("first frame is not the header")
+		}
+		output.Write(frame.Data)
+	}
+
+	demuxer := ts.NewDemuxer(&output)
+	codecs, err := demuxer.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codecs) != 1 || codecs[0].Type() != av.H264 {
+		t.Fatalf("codecs = %v", codecs)
+	}
+	var video int
+	for {
+		packet, err := demuxer.ReadPacket()
+		if err != nil {
+			break
+		}
+		if video == 0 && !packet.IsKeyFrame {
+			t.Fatal("first frame is not a key frame")
+		}
+		video++
+	}
+	if video < 20 {
+		t.Errorf("got %d video frames", video)
+	}
+	if setups := server.setups(); len(setups) != 1 {
+		t.Errorf("got %d SETUP requests with audio disabled", len(setups))
+	}
+}
+
+func TestRTSPStreamWaitsForParameterSets(t *testing.T) {
+	// sdp中没有sprop，前两个idr帧也没有带内的参数集。按帧间隔发送，使得输出从参数集到达后开始
+	server := newFakeRTSPServer(t, func(send rtspSender) {
+		sendH264(t, func(track int, ts uint32, marker bool, payload []byte) {
+			send(track, ts, marker, payload)
+			if marker {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}, 0, 40, 20)
+	})
+	s := NewRTSPStream(server.url(), RTSPOptions{DisableAudio: true}, "")
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var output bytes.Buffer
+	for frames := 0; frames < 20; frames++ {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frames == 0 && !frame.Header {
+			t.Fatal("first frame is not the header")
+		}
+		output.Write(frame.Data)
+	}
+
+	demuxer := ts.NewDemuxer(&output)
+	codecs, err := demuxer.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codecs) != 1 || codecs[0].(h264parser.CodecData).Width() != 640 {
+		t.Fatalf("codecs = %v", codecs)
+	}
+	// 输出从带有参数集的第20帧开始
+	packet, err := demuxer.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nalus, _ := h264parser.SplitNALUs(packet.Data)
+	if !packet.IsKeyFrame || nalus[len(nalus)-1][len(nalus[len(nalus)-1])-1] != 20 {
+		t.Errorf("first packet = %+v", packet)
+	}
+}
+
+func TestRTSPTrackWithoutParameterSets(t *testing.T) {
+	for _, media := range []sdp.Media{
+		{AVType: "video", Type: av.H264, TimeScale: 90000},
+		{AVType: "video", Type: av.H264, TimeScale: 90000, SpropParameterSets: [][]byte{{0x67}, {0x68}}},
+		{AVType: "video", Type: av.H265, TimeScale: 90000, SpropSPS: testH265SPS},
+	} {
+		track := newRTSPTrack(media)
+		if track == nil || track.codec != nil {
+			t.Fatalf("track for %v = %+v", media.Type, track)
+		}
+		// 参数集不完整的idr帧照常输出，但编码信息仍未就绪
+		packets, changed := track.depacketize([]byte{0x65, 1}, 0, true)
+		if media.Type == av.H265 {
+			packets, changed = track.depacketize([]byte{19 << 1, 1, 1}, 0, true)
+		}
+		if len(packets) != 1 || !packets[0].IsKeyFrame || changed || track.codec != nil {
+			t.Errorf("%v: packets = %+v, changed = %v, codec = %v", media.Type, packets, changed, track.codec)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package tv
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/ts"
+)
+
+// SlateConfig 待机画面的配置，配置了文件时循环播放文件，否则通过ffmpeg生成彩条文字卡片，没有ffmpeg时使用内置的测试画面
+type SlateConfig struct {
+	// File 循环播放的ts文件，视频需为h264，音频需为aac
+	File string `json:"file"`
+	// Text 生成的卡片上显示的文字
+	Text string `json:"text"`
+	// Font 生成卡片时使用的字体文件，显示中文时需要配置
+	Font string `json:"font"`
+}
+
+// Merge 返回以c为准、未配置的项使用def的配置
+func (c SlateConfig) Merge(def SlateConfig) SlateConfig {
+	if c.File == "" {
+		c.File = def.File
+	}
+	if c.Text == "" {
+		c.Text = def.Text
+	}
+	if c.Font == "" {
+		c.Font = def.Font
+	}
+	return c
+}
+
+// NewSlateStream 创建待机画面的流，配置中没有文字时显示text
+func NewSlateStream(env *Env, config SlateConfig, text string) (TVStream, error) {
+	if config.File != "" {
+		return newLoopFileStream(config.File), nil
+	}
+	if config.Text != "" {
+		text = config.Text
+	}
+	if env.FFMpeg == "" {
+		return newTestPatternStream(TestPatternOptions{Text: text}), nil
+	}
+	return NewPipeStream(slateCommand(env.FFMpeg, text, config.Font), env.Logger, "slate"), nil
+}
+
+// NewErrorSlateStream 创建显示错误信息的待机画面，总是显示text，配置中只使用字体
+func NewErrorSlateStream(env *Env, config SlateConfig, text string) (TVStream, error) {
+	return NewSlateStream(env, SlateConfig{Font: config.Font}, text)
+}
+
+// newLoopFileStream 按实时速度循环播放ts文件
+func newLoopFileStream(name string) *pacedStream {
+	return newPacedStream(func() (av.Demuxer, io.Closer, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ts.NewDemuxer(bufio.NewReader(f)), f, nil
+	})
+}
+
+// slateCommand 通过ffmpeg生成带文字的彩条画面及静音音轨
+func slateCommand(ffmpeg string, text string, font string) Command {
+	drawtext := "drawtext=expansion=none:text=" + filterValue(text) +
+		":fontcolor=white:fontsize=56:box=1:boxcolor=black@0.6:boxborderw=20" +
+		":x=(w-text_w)/2:y=(h-text_h)/2"
+	if font != "" {
+		drawtext += ":fontfile=" + filterValue(font)
+	}
+	return Command{
+		Args: []string{
+			ffmpeg, "-hide_banner", "-loglevel", "warning",
+			"-re", "-f", "lavfi", "-i", "smptehdbars=size=1280x720:rate=25",
+			"-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=48000",
+			"-vf", drawtext,
+			"-c:v", "libx264", "-preset", "ultrafast", "-tune", "stillimage", "-pix_fmt", "yuv420p", "-g", "50",
+			"-c:a", "aac", "-b:a", "64k",
+			"-f", "mpegts", "pipe:1",
+		},
+	}
+}
+
+// filterValue 转义ffmpeg滤镜的参数值，先按选项引用，再按滤镜图转义
+func filterValue(value string) string {
+	quoted := "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+	return strings.NewReplacer(
+		`\`, `\\`,
+		`'`, `\'`,
+		`[`, `\[`,
+		`]`, `\]`,
+		`,`, `\,`,
+		`;`, `\;`,
+	).Replace(quoted)
+}
@@ -0,0 +1,46 @@
+package tv
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestErrorSlateIgnoresFileAndText(t *testing.T) {
+	config := SlateConfig{
+		File: filepath.Join(t.TempDir(), "missing.ts"),
+		Text: "Offline",
+		Font: "/fonts/wqy.ttc",
+	}
+
+	// 有ffmpeg时，错误信息和字体都传给ffmpeg
+	stream, err := NewErrorSlateStream(&Env{FFMpeg: "ffmpeg"}, config, "CCTV1\nconnection refused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipe, ok := stream.(*PipeStream)
+	if !ok {
+		t.Fatalf("stream = %T, want *PipeStream", stream)
+	}
+	want := slateCommand("ffmpeg", "CCTV1\nconnection refused", config.Font)
+	if len(pipe.command.Args) != len(want.Args) {
+		t.Fatalf("args = %q, want %q", pipe.command.Args, want.Args)
+	}
+	for i := range want.Args {
+		if pipe.command.Args[i] != want.Args[i] {
+			t.Fatalf("args = %q, want %q", pipe.command.Args, want.Args)
+		}
+	}
+
+	// 没有ffmpeg时使用测试画面，不会去打开配置的文件
+	stream, err = NewErrorSlateStream(&Env{}, config, "CCTV1\nconnection refused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if err = stream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Read(make([]byte, 188)); err != nil {
+		t.Fatal(err)
+	}
+}
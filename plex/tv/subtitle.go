@@ -0,0 +1,223 @@
+package tv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/format/ts/tsio"
+)
+
+const (
+	tsPacketSize = 188
+
+	// 字幕轨道使用的pid，正常的流不会使用这么大的pid
+	tsSubtitlePID = 0x1FF0
+	// 私有数据流，通过注册描述符标记为WebVTT
+	tsStreamTypePrivate = 0x06
+	tsStreamIdPrivate1  = 0xBD
+	tsDescRegistration  = 0x05
+
+	// 等待输出的字幕数量上限，超过时丢弃最早的字幕
+	subtitleMaxPending = 32
+)
+
+var webVTTFormatIdentifier = []byte("WVTT")
+
+// SubtitleCue 一条字幕，从写入ts后的第一帧开始显示
+type SubtitleCue struct {
+	// Speaker 发言人，为空时只显示文字
+	Speaker  string
+	Text     string
+	Duration time.Duration
+}
+
+// SubtitleMuxer 在ts流中加入WebVTT字幕轨道。
+// 字幕以私有数据流(stream_type 0x06，注册描述符为WVTT)的pes写入，
+// 每个pes为一条WebVTT cue，时间相对于pes的pts
+type SubtitleMuxer struct {
+	r io.Reader
+
+	lock    *sync.Mutex
+	pending []SubtitleCue
+
+	packet  []byte
+	out     *bytes.Buffer
+	pmtPID  uint16
+	refPID  uint16
+	lastPTS time.Duration
+	tsw     *tsio.TSWriter
+	pes     []byte
+}
+
+// NewSubtitleMuxer 创建字幕封装，r需要输出完整的ts包
+func NewSubtitleMuxer(r io.Reader) *SubtitleMuxer {
+	return &SubtitleMuxer{
+		r:      r,
+		lock:   new(sync.Mutex),
+		packet: make([]byte, tsPacketSize),
+		out:    new(bytes.Buffer),
+		tsw:    tsio.NewTSWriter(tsSubtitlePID),
+		pes:    make([]byte, tsio.MaxPESHeaderLength),
+	}
+}
+
+// AddCue 添加一条字幕，会在下一个视频帧处写入
+func (m *SubtitleMuxer) AddCue(cue SubtitleCue) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.pending) >= subtitleMaxPending {
+		m.pending = m.pending[1:]
+	}
+	m.pending = append(m.pending, cue)
+}
+
+func (m *SubtitleMuxer) Read(b []byte) (int, error) {
+	for m.out.Len() == 0 {
+		if _, err := io.ReadFull(m.r, m.packet); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		if err := m.process(m.packet); err != nil {
+			return 0, err
+		}
+	}
+	return m.out.Read(b)
+}
+
+// process 处理一个ts包，改写PMT，并在参考流的pes开始处写入等待中的字幕
+func (m *SubtitleMuxer) process(packet []byte) error {
+	pid, start, _, hdrlen, err := tsio.ParseTSHeader(packet)
+	if err != nil || hdrlen >= tsPacketSize {
+		// 无法解析时原样输出
+		m.out.Write(packet)
+		return nil
+	}
+	payload := packet[hdrlen:]
+
+	switch {
+	case pid == tsio.PAT_PID && start:
+		m.parsePAT(payload)
+	case pid == m.pmtPID && start:
+		if rewritten := m.rewritePMT(packet, hdrlen); rewritten != nil {
+			packet = rewritten
+		}
+	case pid == m.refPID && start && len(payload) >= tsio.MaxPESHeaderLength:
+		if _, _, _, pts, _, err := tsio.ParsePESHeader(payload); err == nil && pts != 0 {
+			m.lastPTS = pts
+			// 字幕写在参考帧之前，pts相同
+			if err = m.writeCues(); err != nil {
+				return err
+			}
+		}
+	}
+	m.out.Write(packet)
+	return nil
+}
+
+func (m *SubtitleMuxer) parsePAT(payload []byte) {
+	tableId, _, hdrlen, datalen, err := tsio.ParsePSI(payload)
+	if err != nil || tableId != tsio.TableIdPAT || hdrlen+datalen > len(payload) {
+		return
+	}
+	pat := tsio.PAT{}
+	if _, err = pat.Unmarshal(payload[hdrlen : hdrlen+datalen]); err != nil {
+		return
+	}
+	for _, entry := range pat.Entries {
+		if entry.ProgramNumber != 0 {
+			m.pmtPID = entry.ProgramMapPID
+			return
+		}
+	}
+}
+
+// rewritePMT 在PMT中加入字幕轨道，PMT不在一个ts包内或加入后放不下时返回nil。
+// 直接在原始数据后追加，不经过tsio.PMT，避免丢失或无法解析原有的描述符
+func (m *SubtitleMuxer) rewritePMT(packet []byte, hdrlen int) []byte {
+	payload := packet[hdrlen:]
+	tableId, tableExt, psiHdrlen, datalen, err := tsio.ParsePSI(payload)
+	if err != nil || tableId != tsio.TableIdPMT || psiHdrlen+datalen+4 > len(payload) || datalen < 4 {
+		return nil
+	}
+	data := payload[psiHdrlen : psiHdrlen+datalen]
+	pcrPID := binary.BigEndian.Uint16(data[0:2]) & 0x1fff
+
+	m.refPID = 0
+	n := 4 + int(binary.BigEndian.Uint16(data[2:4])&0x3ff)
+	for n+5 <= len(data) {
+		streamType := data[n]
+		pid := binary.BigEndian.Uint16(data[n+1:n+3]) & 0x1fff
+		if pid == tsSubtitlePID {
+			return nil
+		}
+		switch streamType {
+		case tsStreamTypeH264, tsStreamTypeH265:
+			if m.refPID == 0 {
+				m.refPID = pid
+			}
+		}
+		n += 5 + int(binary.BigEndian.Uint16(data[n+3:n+5])&0x3ff)
+	}
+	// 没有视频时以PCR所在的流作为参考
+	if m.refPID == 0 {
+		m.refPID = pcrPID
+	}
+
+	info := []byte{tsStreamTypePrivate, 0xe0 | tsSubtitlePID>>8, tsSubtitlePID & 0xff, 0xf0, 2 + byte(len(webVTTFormatIdentifier)), tsDescRegistration, byte(len(webVTTFormatIdentifier))}
+	info = append(info, webVTTFormatIdentifier...)
+	if hdrlen+tsio.PSIHeaderLength+len(data)+len(info)+4 > tsPacketSize {
+		return nil
+	}
+
+	// 保留原包头中的连续计数，剩余部分用0xff填充
+	rewritten := make([]byte, tsPacketSize)
+	copy(rewritten, packet[:hdrlen])
+	psi := rewritten[hdrlen:]
+	copy(psi[tsio.PSIHeaderLength:], data)
+	copy(psi[tsio.PSIHeaderLength+len(data):], info)
+	n = tsio.FillPSI(psi, tsio.TableIdPMT, tableExt, len(data)+len(info))
+	for i := hdrlen + n; i < tsPacketSize; i++ {
+		rewritten[i] = 0xff
+	}
+	return rewritten
+}
+
+func (m *SubtitleMuxer) writeCues() error {
+	m.lock.Lock()
+	cues := m.pending
+	m.pending = nil
+	m.lock.Unlock()
+
+	for _, cue := range cues {
+		payload := []byte(cue.vtt())
+		n := tsio.FillPESHeader(m.pes, tsStreamIdPrivate1, len(payload), m.lastPTS, 0)
+		if err := m.tsw.WritePackets(m.out, [][]byte{m.pes[:n], payload}, 0, false, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vtt 返回WebVTT的cue，时间从0开始
+func (c SubtitleCue) vtt() string {
+	text := strings.ReplaceAll(c.Text, "-->", "->")
+	text = vttEscaper.Replace(text)
+	if c.Speaker != "" {
+		text = "<v " + vttEscaper.Replace(c.Speaker) + ">" + text
+	}
+	return "00:00:00.000 --> " + vttTimestamp(c.Duration) + "\n" + text + "\n"
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", " ", "\n", " ")
+
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
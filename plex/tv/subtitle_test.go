@@ -0,0 +1,339 @@
+package tv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/format/ts/tsio"
+)
+
+// patternTS 用测试画面生成约frames帧的ts，audioOnly为true时只有音频
+func patternTS(t *testing.T, frames int, audioOnly bool) []byte {
+	demuxer, err := newPatternDemuxer(TestPatternOptions{Text: "SUB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	codecs := demuxer.codecs
+	if audioOnly {
+		codecs = codecs[1:]
+	}
+	muxer := newTSMuxer()
+	header, err := muxer.WriteHeader(codecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.NewBuffer(header)
+	for video := 0; video < frames; {
+		packet, err := demuxer.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.Idx == 0 {
+			video++
+			if audioOnly {
+				continue
+			}
+		} else if audioOnly {
+			packet.Idx = 0
+		}
+		data, _, err := muxer.WritePacket(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Write(data)
+	}
+	return out.Bytes()
+}
+
+// mpegCRC32 校验包含crc在内的整个section，正确时结果为0
+func mpegCRC32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// testPMT PMT中的轨道，descriptors为原始数据
+type testPMT struct {
+	pcrPID  uint16
+	streams []testPMTStream
+}
+
+type testPMTStream struct {
+	streamType  uint8
+	pid         uint16
+	descriptors []byte
+}
+
+// parseTestPMT 解析PMT的数据部分。tsio.PMT在最后一个描述符正好到结尾时会解析失败，这里单独解析
+func parseTestPMT(t *testing.T, data []byte) testPMT {
+	t.Helper()
+	pmt := testPMT{pcrPID: binary.BigEndian.Uint16(data[0:2]) & 0x1fff}
+	n := 4 + int(binary.BigEndian.Uint16(data[2:4])&0x3ff)
+	for n < len(data) {
+		if n+5 > len(data) {
+			t.Fatalf("truncated pmt: %x", data)
+		}
+		length := int(binary.BigEndian.Uint16(data[n+3:n+5]) & 0x3ff)
+		if n+5+length > len(data) {
+			t.Fatalf("truncated pmt: %x", data)
+		}
+		pmt.streams = append(pmt.streams, testPMTStream{
+			streamType:  data[n],
+			pid:         binary.BigEndian.Uint16(data[n+1:n+3]) & 0x1fff,
+			descriptors: data[n+5 : n+5+length],
+		})
+		n += 5 + length
+	}
+	return pmt
+}
+
+type tsSample struct {
+	pmts [][]byte
+	pmt  testPMT
+	// 字幕以外的包，PMT包除外
+	media [][]byte
+	// 每个pes的pid、pts和内容
+	pes []tsPES
+}
+
+type tsPES struct {
+	pid  uint16
+	pts  time.Duration
+	data []byte
+}
+
+func parseTSSample(t *testing.T, data []byte) *tsSample {
+	t.Helper()
+	if len(data)%tsPacketSize != 0 {
+		t.Fatalf("output is %d bytes, not whole ts packets", len(data))
+	}
+	sample := &tsSample{}
+	var pmtPID uint16
+	for pos := 0; pos < len(data); pos += tsPacketSize {
+		packet := data[pos : pos+tsPacketSize]
+		pid, start, _, hdrlen, err := tsio.ParseTSHeader(packet)
+		if err != nil {
+			t.Fatalf("packet %d: %v", pos/tsPacketSize, err)
+		}
+		payload := packet[hdrlen:]
+		switch {
+		case pid == tsio.PAT_PID:
+			_, _, psiHdrlen, datalen, _ := tsio.ParsePSI(payload)
+			pat := tsio.PAT{}
+			pat.Unmarshal(payload[psiHdrlen : psiHdrlen+datalen])
+			pmtPID = pat.Entries[0].ProgramMapPID
+		case pid == pmtPID:
+			_, _, psiHdrlen, datalen, err := tsio.ParsePSI(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// section从table_id开始，到crc结束
+			section := payload[1 : psiHdrlen+datalen+4]
+			if mpegCRC32(section) != 0 {
+				t.Fatalf("pmt crc mismatch: %x", section)
+			}
+			sample.pmt = parseTestPMT(t, payload[psiHdrlen:psiHdrlen+datalen])
+			sample.pmts = append(sample.pmts, packet)
+			continue
+		}
+		if pid != tsSubtitlePID {
+			sample.media = append(sample.media, packet)
+		}
+		if pid == tsio.PAT_PID {
+			continue
+		}
+		if start {
+			_, _, _, pts, _, err := tsio.ParsePESHeader(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sample.pes = append(sample.pes, tsPES{pid: pid, pts: pts, data: append([]byte(nil), payload...)})
+			continue
+		}
+		// 续包追加到同一pid的最后一个pes
+		for i := len(sample.pes) - 1; i >= 0; i-- {
+			if sample.pes[i].pid == pid {
+				sample.pes[i].data = append(sample.pes[i].data, payload...)
+				break
+			}
+		}
+	}
+	return sample
+}
+
+func (s *tsSample) cues(t *testing.T) []tsPES {
+	var cues []tsPES
+	for _, pes := range s.pes {
+		if pes.pid != tsSubtitlePID {
+			continue
+		}
+		hdrlen, streamId, datalen, _, _, err := tsio.ParsePESHeader(pes.data)
+		if err != nil || streamId != tsStreamIdPrivate1 {
+			t.Fatalf("subtitle pes header: stream id %x, %v", streamId, err)
+		}
+		pes.data = pes.data[hdrlen : hdrlen+datalen]
+		cues = append(cues, pes)
+	}
+	return cues
+}
+
+func TestSubtitleMuxerRewritePMT(t *testing.T) {
+	input := patternTS(t, 10, false)
+	output, err := io.ReadAll(NewSubtitleMuxer(bytes.NewReader(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, out := parseTSSample(t, input), parseTSSample(t, output)
+
+	if len(out.pmts) != len(in.pmts) {
+		t.Fatalf("got %d pmt packets, want %d", len(out.pmts), len(in.pmts))
+	}
+	// 原有的轨道和描述符保持不变，字幕轨道追加在最后
+	streams := out.pmt.streams
+	if len(streams) != len(in.pmt.streams)+1 {
+		t.Fatalf("pmt streams = %+v", streams)
+	}
+	for i, stream := range in.pmt.streams {
+		if streams[i].streamType != stream.streamType || streams[i].pid != stream.pid || !bytes.Equal(streams[i].descriptors, stream.descriptors) {
+			t.Errorf("stream %d = %+v, want %+v", i, streams[i], stream)
+		}
+	}
+	subtitle := streams[len(streams)-1]
+	if subtitle.streamType != tsStreamTypePrivate || subtitle.pid != tsSubtitlePID ||
+		!bytes.Equal(subtitle.descriptors, append([]byte{tsDescRegistration, 4}, "WVTT"...)) {
+		t.Errorf("subtitle stream = %+v", subtitle)
+	}
+	if out.pmt.pcrPID != in.pmt.pcrPID {
+		t.Errorf("pcr pid = %d, want %d", out.pmt.pcrPID, in.pmt.pcrPID)
+	}
+	// 保留连续计数
+	for i := range out.pmts {
+		if !bytes.Equal(out.pmts[i][:4], in.pmts[i][:4]) {
+			t.Errorf("pmt header %x, want %x", out.pmts[i][:4], in.pmts[i][:4])
+		}
+	}
+	// 没有字幕时其余的包原样输出
+	if len(out.media) != len(in.media) {
+		t.Fatalf("got %d media packets, want %d", len(out.media), len(in.media))
+	}
+	for i := range in.media {
+		if !bytes.Equal(out.media[i], in.media[i]) {
+			t.Fatalf("media packet %d changed", i)
+		}
+	}
+
+	// 已经有字幕轨道的流不再重复添加
+	again, err := io.ReadAll(NewSubtitleMuxer(bytes.NewReader(output)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, output) {
+		t.Error("pmt rewritten twice")
+	}
+}
+
+func TestSubtitleMuxerWriteCues(t *testing.T) {
+	input := patternTS(t, 10, false)
+	muxer := NewSubtitleMuxer(bytes.NewReader(input))
+	muxer.AddCue(SubtitleCue{Speaker: "张三", Text: "hello <b>", Duration: 5 * time.Second})
+	muxer.AddCue(SubtitleCue{Text: "a --> b", Duration: 1500 * time.Millisecond})
+	output, err := io.ReadAll(muxer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, out := parseTSSample(t, input), parseTSSample(t, output)
+
+	cues := out.cues(t)
+	want := []string{
+		"00:00:00.000 --> 00:00:05.000\n<v 张三>hello &lt;b&gt;\n",
+		"00:00:00.000 --> 00:00:01.500\na -&gt; b\n",
+	}
+	if len(cues) != len(want) {
+		t.Fatalf("got %d cues, want %d", len(cues), len(want))
+	}
+	videoPID := in.pmt.streams[0].pid
+	var firstVideo tsPES
+	for _, pes := range out.pes {
+		if pes.pid == videoPID {
+			firstVideo = pes
+			break
+		}
+	}
+	for i, cue := range cues {
+		if string(cue.data) != want[i] {
+			t.Errorf("cue %d = %q, want %q", i, cue.data, want[i])
+		}
+		// 字幕的pts与之后的第一个视频帧相同
+		if cue.pts != firstVideo.pts {
+			t.Errorf("cue %d pts = %v, want %v", i, cue.pts, firstVideo.pts)
+		}
+	}
+	// 字幕写在参考帧之前
+	for i, pes := range out.pes {
+		if pes.pid == videoPID {
+			if i < len(cues) || out.pes[i-1].pid != tsSubtitlePID {
+				t.Errorf("cues are not before the first video frame")
+			}
+			break
+		}
+	}
+	if len(out.media) != len(in.media) {
+		t.Errorf("got %d media packets, want %d", len(out.media), len(in.media))
+	}
+}
+
+func TestSubtitleMuxerAudioOnly(t *testing.T) {
+	input := patternTS(t, 10, true)
+	muxer := NewSubtitleMuxer(bytes.NewReader(input))
+	muxer.AddCue(SubtitleCue{Text: "radio", Duration: time.Second})
+	output, err := io.ReadAll(muxer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := parseTSSample(t, output)
+	// 没有视频时以PCR所在的音频作为参考
+	cues := out.cues(t)
+	if len(cues) != 1 || cues[0].pts == 0 {
+		t.Fatalf("cues = %+v", cues)
+	}
+	for _, pes := range out.pes {
+		if pes.pid == out.pmt.pcrPID {
+			if pes.pts != cues[0].pts {
+				t.Errorf("cue pts = %v, want %v", cues[0].pts, pes.pts)
+			}
+			break
+		}
+	}
+}
+
+func TestSubtitleMuxerPendingLimit(t *testing.T) {
+	muxer := NewSubtitleMuxer(bytes.NewReader(patternTS(t, 2, false)))
+	for i := 0; i < subtitleMaxPending+8; i++ {
+		muxer.AddCue(SubtitleCue{Text: strings.Repeat("x", i+1), Duration: time.Second})
+	}
+	output, err := io.ReadAll(muxer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cues := parseTSSample(t, output).cues(t)
+	if len(cues) != subtitleMaxPending {
+		t.Fatalf("got %d cues, want %d", len(cues), subtitleMaxPending)
+	}
+	// 丢弃最早的字幕
+	if !strings.HasSuffix(string(cues[0].data), "\n"+strings.Repeat("x", 9)+"\n") {
+		t.Errorf("first cue = %q", cues[0].data)
+	}
+}
@@ -0,0 +1,290 @@
+package tv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+)
+
+var ErrUnsupportedAudioCodec = errors.New("unsupported audio codec")
+
+// audioTranscoder 通过ffmpeg将aac以外的音频转码为aac
+type audioTranscoder struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	ogg     *oggWriter
+	codec   aacparser.CodecData
+	idx     int8
+	start   time.Duration
+	started bool
+	packets chan av.Packet
+	done    chan struct{}
+}
+
+// isTranscodableAudio 是否是可以通过ffmpeg转码为aac的音频
+func isTranscodableAudio(t av.CodecType) bool {
+	switch t {
+	case av.PCM_ALAW, av.PCM_MULAW, av.PCM, av.OPUS:
+		return true
+	}
+	return false
+}
+
+func newAudioTranscoder(ffmpeg string, codec av.AudioCodecData, idx int8) (*audioTranscoder, error) {
+	sampleRate := codec.SampleRate()
+	channels := codec.ChannelLayout().Count()
+	if channels == 0 {
+		channels = 1
+	}
+
+	var input []string
+	switch codec.Type() {
+	case av.PCM_ALAW:
+		input = []string{"-f", "alaw"}
+	case av.PCM_MULAW:
+		input = []string{"-f", "mulaw"}
+	case av.PCM:
+		// rtp中的L16为大端序
+		input = []string{"-f", "s16be"}
+	case av.OPUS:
+		// opus没有裸流格式，需要先封装为ogg
+		input = []string{"-f", "ogg"}
+		sampleRate = 48000
+	default:
+		return nil, ErrUnsupportedAudioCodec
+	}
+	if codec.Type() != av.OPUS {
+		input = append(input, "-ar", strconv.Itoa(sampleRate), "-ac", strconv.Itoa(channels))
+	}
+
+	layout := av.CH_MONO
+	if channels > 1 {
+		channels = 2
+		layout = av.CH_STEREO
+	}
+	aacCodec, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:    aacparser.AOT_AAC_LC,
+		SampleRate:    sampleRate,
+		ChannelLayout: layout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	args = append(args, input...)
+	args = append(args,
+		"-i", "pipe:0",
+		"-vn",
+		"-c:a", "aac",
+		"-b:a", "96k",
+		"-ar", strconv.Itoa(sampleRate),
+		"-ac", strconv.Itoa(channels),
+		"-flush_packets", "1",
+		"-f", "adts",
+		"pipe:1")
+
+	t := &audioTranscoder{
+		cmd:     exec.Command(ffmpeg, args...),
+		codec:   aacCodec,
+		idx:     idx,
+		packets: make(chan av.Packet, 100),
+		done:    make(chan struct{}),
+	}
+	if t.stdin, err = t.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := t.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	t.stdout = bufio.NewReader(stdout)
+	if codec.Type() == av.OPUS {
+		t.ogg = newOggWriter(t.stdin, channels)
+	}
+	if err = t.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go t.readLoop()
+	return t, nil
+}
+
+// Codec 转码后的aac编码信息
+func (t *audioTranscoder) Codec() av.CodecData {
+	return t.codec
+}
+
+// Packets 转码后的数据包，ffmpeg退出后关闭
+func (t *audioTranscoder) Packets() <-chan av.Packet {
+	return t.packets
+}
+
+// WritePacket 写入待转码的数据包，第一个数据包的时间作为输出的起始时间
+func (t *audioTranscoder) WritePacket(packet av.Packet) error {
+	if !t.started {
+		t.start = packet.Time
+		t.started = true
+	}
+	if t.ogg != nil {
+		return t.ogg.WritePacket(packet.Data)
+	}
+	_, err := t.stdin.Write(packet.Data)
+	return err
+}
+
+func (t *audioTranscoder) Close() error {
+	close(t.done)
+	t.stdin.Close()
+	t.cmd.Process.Kill()
+	return t.cmd.Wait()
+}
+
+func (t *audioTranscoder) readLoop() {
+	defer close(t.packets)
+	var samples int64
+	for {
+		header, err := t.stdout.Peek(aacparser.ADTSHeaderLength)
+		if err != nil {
+			return
+		}
+		_, hdrlen, framelen, frameSamples, err := aacparser.ParseADTSHeader(header)
+		if err != nil {
+			return
+		}
+		frame := make([]byte, framelen)
+		if _, err = io.ReadFull(t.stdout, frame); err != nil {
+			return
+		}
+
+		rate := int64(t.codec.SampleRate())
+		packet := av.Packet{
+			Idx:      t.idx,
+			Data:     frame[hdrlen:],
+			Time:     t.start + time.Duration(samples*int64(time.Second)/rate),
+			Duration: time.Duration(int64(frameSamples) * int64(time.Second) / rate),
+		}
+		select {
+		case t.packets <- packet:
+		case <-t.done:
+			return
+		}
+		samples += int64(frameSamples)
+	}
+}
+
+var oggCRCTable = func() *crc32.Table {
+	// ogg使用不反转的crc32
+	var table crc32.Table
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return &table
+}()
+
+// oggWriter 将opus数据包封装为ogg，每个数据包单独一页
+type oggWriter struct {
+	w        io.Writer
+	channels int
+	seq      uint32
+	granule  uint64
+	started  bool
+}
+
+func newOggWriter(w io.Writer, channels int) *oggWriter {
+	return &oggWriter{w: w, channels: channels}
+}
+
+func (o *oggWriter) WritePacket(data []byte) error {
+	if !o.started {
+		head := make([]byte, 19)
+		copy(head, "OpusHead")
+		head[8] = 1
+		head[9] = byte(o.channels)
+		binary.LittleEndian.PutUint32(head[12:], 48000)
+		if err := o.writePage(head, 0x02); err != nil {
+			return err
+		}
+
+		vendor := "plex-tuner"
+		tags := make([]byte, 8+4+len(vendor)+4)
+		copy(tags, "OpusTags")
+		binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+		copy(tags[12:], vendor)
+		if err := o.writePage(tags, 0); err != nil {
+			return err
+		}
+		o.started = true
+	}
+	o.granule += uint64(opusPacketSamples(data))
+	return o.writePage(data, 0)
+}
+
+func (o *oggWriter) writePage(data []byte, headerType byte) error {
+	segments := len(data)/255 + 1
+	page := make([]byte, 27+segments+len(data))
+	copy(page, "OggS")
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], o.granule)
+	binary.LittleEndian.PutUint32(page[14:], 1)
+	binary.LittleEndian.PutUint32(page[18:], o.seq)
+	page[26] = byte(segments)
+	for i := 0; i < segments-1; i++ {
+		page[27+i] = 255
+	}
+	page[27+segments-1] = byte(len(data) % 255)
+	copy(page[27+segments:], data)
+
+	crc := uint32(0)
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+	o.seq++
+	_, err := o.w.Write(page)
+	return err
+}
+
+// opusPacketSamples 根据toc计算opus数据包在48k采样率下的采样数
+func opusPacketSamples(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	toc := data[0]
+	config := toc >> 3
+	var frameSamples int
+	switch {
+	case config < 12:
+		frameSamples = []int{480, 960, 1920, 2880}[config&3]
+	case config < 16:
+		frameSamples = []int{480, 960}[config&1]
+	default:
+		frameSamples = []int{120, 240, 480, 960}[config&3]
+	}
+	frames := 1
+	switch toc & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(data) > 1 {
+			frames = int(data[1] & 0x3f)
+		}
+	}
+	return frameSamples * frames
+}
@@ -0,0 +1,217 @@
+package tv
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/format/ts/tsio"
+)
+
+const (
+	tsStreamTypeH264 = 0x1B
+	tsStreamTypeH265 = 0x24
+	tsStreamTypeAAC  = 0x0F
+	// mpeg1和mpeg2(含2.5)音频
+	tsStreamTypeMPEG1Audio = 0x03
+	tsStreamTypeMPEG2Audio = 0x04
+
+	tsStreamIdVideo = 0xE0
+	tsStreamIdAudio = 0xC0
+
+	tsFirstPID = 0x100
+)
+
+// ts中pts为0时不会写入，所有时间戳整体后移
+const tsTimeOffset = time.Second
+
+var h265AUDBytes = []byte{0, 0, 0, 1, 0x46, 0x01, 0x50}
+
+// tsTrack ts中的一路基本流
+type tsTrack struct {
+	codec      av.CodecData
+	pid        uint16
+	streamType uint8
+	streamId   uint8
+	tsw        *tsio.TSWriter
+}
+
+// tsMuxer ts封装，支持h264、h265视频和aac、mpeg音频，其余轨道会被忽略
+type tsMuxer struct {
+	buf    *bytes.Buffer
+	tracks map[int8]*tsTrack
+	order  []*tsTrack
+	pcrPID uint16
+
+	psi   []byte
+	pes   []byte
+	adts  []byte
+	datav [][]byte
+	patw  *tsio.TSWriter
+	pmtw  *tsio.TSWriter
+}
+
+func newTSMuxer() *tsMuxer {
+	return &tsMuxer{
+		buf:  new(bytes.Buffer),
+		psi:  make([]byte, 188),
+		pes:  make([]byte, tsio.MaxPESHeaderLength),
+		adts: make([]byte, aacparser.ADTSHeaderLength),
+		patw: tsio.NewTSWriter(tsio.PAT_PID),
+		pmtw: tsio.NewTSWriter(tsio.PMT_PID),
+	}
+}
+
+func (m *tsMuxer) WriteHeader(codecs []av.CodecData) ([]byte, error) {
+	m.buf.Reset()
+	m.tracks = make(map[int8]*tsTrack)
+	m.order = nil
+	m.pcrPID = 0
+	for i, codec := range codecs {
+		track := &tsTrack{codec: codec}
+		switch codec.Type() {
+		case av.H264:
+			track.streamType, track.streamId = tsStreamTypeH264, tsStreamIdVideo
+		case av.H265:
+			track.streamType, track.streamId = tsStreamTypeH265, tsStreamIdVideo
+		case av.AAC:
+			track.streamType, track.streamId = tsStreamTypeAAC, tsStreamIdAudio
+		case codecTypeMPEGAudio:
+			track.streamType, track.streamId = tsStreamTypeMPEG2Audio, tsStreamIdAudio
+			if codec, ok := codec.(mpegAudioCodecData); ok && codec.MPEG1 {
+				track.streamType = tsStreamTypeMPEG1Audio
+			}
+		default:
+			continue
+		}
+		track.pid = uint16(tsFirstPID + len(m.order))
+		track.tsw = tsio.NewTSWriter(track.pid)
+		m.tracks[int8(i)] = track
+		m.order = append(m.order, track)
+
+		// 有视频时以视频作为pcr，否则以第一路流作为pcr
+		if m.pcrPID == 0 || (codec.Type().IsVideo() && !m.pcrIsVideo()) {
+			m.pcrPID = track.pid
+		}
+	}
+	if err := m.writePATPMT(); err != nil {
+		return nil, err
+	}
+	return m.take(), nil
+}
+
+func (m *tsMuxer) WritePacket(packet av.Packet) ([]byte, bool, error) {
+	track, ok := m.tracks[packet.Idx]
+	if !ok {
+		return nil, false, nil
+	}
+
+	keyFrame := packet.IsKeyFrame && track.codec.Type().IsVideo()
+	// 每个关键帧前重复PAT/PMT，使得从任意关键帧开始都能解码
+	if keyFrame {
+		if err := m.writePATPMT(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	dts := packet.Time + tsTimeOffset
+	pts := dts + packet.CompositionTime
+	var pcr time.Duration
+	if track.pid == m.pcrPID {
+		pcr = dts
+	}
+
+	var datav [][]byte
+	switch codec := track.codec.(type) {
+	case h264parser.CodecData:
+		datav = m.videoData(packet, h264parser.AUDBytes, codec.SPS(), codec.PPS())
+		n := tsio.FillPESHeader(m.pes, track.streamId, -1, pts, dts)
+		datav[0] = m.pes[:n]
+	case h265parser.CodecData:
+		datav = m.videoData(packet, h265AUDBytes, codec.VPS(), codec.SPS(), codec.PPS())
+		n := tsio.FillPESHeader(m.pes, track.streamId, -1, pts, dts)
+		datav[0] = m.pes[:n]
+	case aacparser.CodecData:
+		aacparser.FillADTSHeader(m.adts, codec.Config, 1024, len(packet.Data))
+		n := tsio.FillPESHeader(m.pes, track.streamId, len(m.adts)+len(packet.Data), pts, 0)
+		datav = append(m.datav[:0], m.pes[:n], m.adts, packet.Data)
+	case mpegAudioCodecData:
+		n := tsio.FillPESHeader(m.pes, track.streamId, len(packet.Data), pts, 0)
+		datav = append(m.datav[:0], m.pes[:n], packet.Data)
+	default:
+		return nil, false, nil
+	}
+
+	if err := track.tsw.WritePackets(m.buf, datav, pcr, keyFrame || track.codec.Type().IsAudio(), false); err != nil {
+		return nil, false, err
+	}
+	return m.take(), keyFrame, nil
+}
+
+func (m *tsMuxer) ContentType() string {
+	return ContentTypeTS
+}
+
+// videoData 将视频帧转换为带起始码的数据，关键帧前加上参数集，datav[0]留给pes头
+func (m *tsMuxer) videoData(packet av.Packet, aud []byte, paramSets ...[]byte) [][]byte {
+	datav := append(m.datav[:0], nil, aud)
+	if packet.IsKeyFrame {
+		for _, nalu := range paramSets {
+			if len(nalu) > 0 {
+				datav = append(datav, h264parser.StartCodeBytes, nalu)
+			}
+		}
+	}
+	nalus, _ := h264parser.SplitNALUs(packet.Data)
+	for _, nalu := range nalus {
+		datav = append(datav, h264parser.StartCodeBytes, nalu)
+	}
+	m.datav = datav
+	return datav
+}
+
+func (m *tsMuxer) pcrIsVideo() bool {
+	for _, track := range m.order {
+		if track.pid == m.pcrPID {
+			return track.codec.Type().IsVideo()
+		}
+	}
+	return false
+}
+
+func (m *tsMuxer) writePATPMT() error {
+	pat := tsio.PAT{
+		Entries: []tsio.PATEntry{
+			{ProgramNumber: 1, ProgramMapPID: tsio.PMT_PID},
+		},
+	}
+	n := pat.Marshal(m.psi[tsio.PSIHeaderLength:])
+	n = tsio.FillPSI(m.psi, tsio.TableIdPAT, tsio.TableExtPAT, n)
+	if err := m.patw.WritePackets(m.buf, [][]byte{m.psi[:n]}, 0, false, true); err != nil {
+		return err
+	}
+
+	pmt := tsio.PMT{PCRPID: m.pcrPID}
+	if pmt.PCRPID == 0 {
+		pmt.PCRPID = 0x1fff
+	}
+	for _, track := range m.order {
+		pmt.ElementaryStreamInfos = append(pmt.ElementaryStreamInfos, tsio.ElementaryStreamInfo{
+			StreamType:    track.streamType,
+			ElementaryPID: track.pid,
+		})
+	}
+	n = pmt.Marshal(m.psi[tsio.PSIHeaderLength:])
+	n = tsio.FillPSI(m.psi, tsio.TableIdPMT, tsio.TableExtPMT, n)
+	return m.pmtw.WritePackets(m.buf, [][]byte{m.psi[:n]}, 0, false, true)
+}
+
+func (m *tsMuxer) take() []byte {
+	data := make([]byte, m.buf.Len())
+	copy(data, m.buf.Bytes())
+	m.buf.Reset()
+	return data
+}
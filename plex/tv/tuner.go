@@ -0,0 +1,229 @@
+package tv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 读取远程设备信息和频道列表的超时
+const tunerRequestTimeout = 10 * time.Second
+
+var (
+	ErrTunerBusy          = errors.New("tuner: all remote tuners in use")
+	ErrTunerInvalidDevice = errors.New("tuner: invalid device url")
+)
+
+// TunerDevice 远程HDHomeRun兼容设备的discover.json
+type TunerDevice struct {
+	FriendlyName string `json:"FriendlyName"`
+	DeviceID     string `json:"DeviceID"`
+	TunerCount   int    `json:"TunerCount"`
+}
+
+// TunerChannel 远程设备lineup.json中的一个频道
+type TunerChannel struct {
+	GuideNumber string `json:"GuideNumber"`
+	GuideName   string `json:"GuideName"`
+	URL         string `json:"URL"`
+	HD          int    `json:"HD"`
+	DRM         int    `json:"DRM"`
+}
+
+// FetchTunerLineup 通过client读取远程设备的信息和频道列表，device为设备的地址，如http://192.168.1.10
+func FetchTunerLineup(ctx context.Context, client *http.Client, device string) (TunerDevice, []TunerChannel, error) {
+	base, err := url.Parse(strings.TrimRight(device, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return TunerDevice{}, nil, fmt.Errorf("%w: %s", ErrTunerInvalidDevice, device)
+	}
+
+	info := TunerDevice{}
+	if err = getJSON(ctx, client, base.String()+"/discover.json", &info); err != nil {
+		return TunerDevice{}, nil, err
+	}
+	var lineup []TunerChannel
+	if err = getJSON(ctx, client, base.String()+"/lineup.json", &lineup); err != nil {
+		return TunerDevice{}, nil, err
+	}
+	for i := range lineup {
+		if u, err := base.Parse(lineup[i].URL); err == nil {
+			lineup[i].URL = u.String()
+		}
+	}
+	return info, lineup, nil
+}
+
+// getJSON 读取json，每个请求最长tunerRequestTimeout，设备无响应时不会一直阻塞频道的导入
+func getJSON(ctx context.Context, client *http.Client, rawUrl string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, tunerRequestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", rawUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	if err = checkStatus(resp); err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// TunerOptions tuner-stream类型的选项，导入远程设备的频道时自动生成
+type TunerOptions struct {
+	// Device 远程设备的地址，同一设备的频道共享调谐器数量的限制
+	Device string `json:"device"`
+	// TunerCount 远程设备的调谐器数量，为0时不限制
+	TunerCount int `json:"tuner_count"`
+}
+
+var (
+	tunersLock = new(sync.Mutex)
+	// tunersInUse 每个远程设备正在使用的调谐器数量
+	tunersInUse = make(map[string]int)
+)
+
+// acquireTuner 占用远程设备的一个调谐器，已全部占用时返回ErrTunerBusy
+func acquireTuner(device string, count int) error {
+	tunersLock.Lock()
+	defer tunersLock.Unlock()
+	if count > 0 && tunersInUse[device] >= count {
+		return fmt.Errorf("%w: %s", ErrTunerBusy, device)
+	}
+	tunersInUse[device]++
+	return nil
+}
+
+func releaseTuner(device string) {
+	tunersLock.Lock()
+	defer tunersLock.Unlock()
+	if tunersInUse[device]--; tunersInUse[device] <= 0 {
+		delete(tunersInUse, device)
+	}
+}
+
+// TunerStream 转发远程设备的频道，占用远程设备的一个调谐器直到关闭
+type TunerStream struct {
+	url  string
+	opt  TunerOptions
+	resp *http.Response
+
+	acquired bool
+	once     *sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func NewTunerStream(streamUrl string, opt TunerOptions) *TunerStream {
+	s := &TunerStream{url: streamUrl, opt: opt, once: new(sync.Once)}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *TunerStream) Start() error {
+	if err := acquireTuner(s.opt.Device, s.opt.TunerCount); err != nil {
+		return err
+	}
+	s.acquired = true
+
+	request, err := http.NewRequestWithContext(s.ctx, "GET", s.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	if err = checkStatus(resp); err != nil {
+		return err
+	}
+	s.resp = resp
+	return nil
+}
+
+func (s *TunerStream) Read(b []byte) (int, error) {
+	return s.resp.Body.Read(b)
+}
+
+func (s *TunerStream) Close() error {
+	s.cancel()
+	s.once.Do(func() {
+		if s.resp != nil {
+			s.resp.Body.Close()
+		}
+		if s.acquired {
+			releaseTuner(s.opt.Device)
+		}
+	})
+	return nil
+}
+
+// ContentType 远程plex-tuner可能输出mp4，其余按ts处理
+func (s *TunerStream) ContentType() string {
+	if s.resp != nil {
+		if mediaType, _, _ := mime.ParseMediaType(s.resp.Header.Get("Content-Type")); mediaType == ContentTypeMP4 {
+			return ContentTypeMP4
+		}
+	}
+	return ContentTypeTS
+}
+
+// Status 远程设备调谐器的占用情况
+func (s *TunerStream) Status() any {
+	return tunerStatus(s.opt)
+}
+
+func tunerStatus(opt TunerOptions) any {
+	tunersLock.Lock()
+	defer tunersLock.Unlock()
+	return map[string]any{
+		"device":      opt.Device,
+		"tuner_count": opt.TunerCount,
+		"in_use":      tunersInUse[opt.Device],
+	}
+}
+
+// tunerLimitedStream 播放期间占用一个调谐器，使其他类型的流也受设备调谐器数量的限制
+type tunerLimitedStream struct {
+	TVStream
+	opt TunerOptions
+
+	acquired bool
+	once     sync.Once
+}
+
+func newTunerLimitedStream(stream TVStream, opt TunerOptions) *tunerLimitedStream {
+	return &tunerLimitedStream{TVStream: stream, opt: opt}
+}
+
+func (s *tunerLimitedStream) Start() error {
+	if err := acquireTuner(s.opt.Device, s.opt.TunerCount); err != nil {
+		return err
+	}
+	s.acquired = true
+	return s.TVStream.Start()
+}
+
+func (s *tunerLimitedStream) Close() error {
+	err := s.TVStream.Close()
+	s.once.Do(func() {
+		if s.acquired {
+			releaseTuner(s.opt.Device)
+		}
+	})
+	return err
+}
+
+func (s *tunerLimitedStream) Status() any {
+	return tunerStatus(s.opt)
+}
@@ -2,7 +2,37 @@ package tv
 
 import "io"
 
+const (
+	ContentTypeMP4 = "video/mp4"
+	ContentTypeTS  = "video/mp2t"
+)
+
 type TVStream interface {
 	io.ReadCloser
 	Start() error
 }
+
+// ContentTyper 可选接口，返回流输出数据的媒体类型
+type ContentTyper interface {
+	ContentType() string
+}
+
+// Frame 一块完整的输出数据
+type Frame struct {
+	Data []byte
+	// Header 为解码所需的初始化数据(ts的PAT/PMT或mp4的init)
+	Header bool
+	// KeyFrame 数据从关键帧开始，可以作为新读者解码的起点
+	KeyFrame bool
+}
+
+// FrameReader 可选接口，按完整的数据块输出的流。
+// 广播时会缓存头部和最近的关键帧，使中途加入的读者也能立即解码
+type FrameReader interface {
+	ReadFrame() (Frame, error)
+}
+
+// StatusReporter 可选接口，返回流的运行状态，会在状态接口中展示
+type StatusReporter interface {
+	Status() any
+}
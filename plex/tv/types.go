@@ -0,0 +1,341 @@
+package tv
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrUnsupportedResolveType = errors.New("unsupported resolve type")
+
+func init() {
+	RegisterStreamType(StreamType{
+		Name:     "redirect",
+		Redirect: true,
+		Validate: validateURL,
+	})
+	RegisterStreamType(StreamType{
+		Name:      "proxy",
+		Shareable: true,
+		New: func(env *Env, source Source) (TVStream, error) {
+			return NewHttpSteam(source.URL), nil
+		},
+		Validate: validateURL,
+	})
+	RegisterStreamType(StreamType{
+		Name:      "hls",
+		Shareable: true,
+		New: func(env *Env, source Source) (TVStream, error) {
+			playlistUrl, err := url.Parse(source.URL)
+			if err != nil {
+				return nil, err
+			}
+			opt := HLSOptions{}
+			if err = source.DecodeOptions(&opt); err != nil {
+				return nil, err
+			}
+			if opt.Tuner != nil {
+				return newTunerLimitedStream(NewHLSStream(playlistUrl), *opt.Tuner), nil
+			}
+			return NewHLSStream(playlistUrl), nil
+		},
+		Validate: validateURL,
+	})
+	RegisterStreamType(StreamType{
+		Name:             "auto",
+		Shareable:        true,
+		HandlesTranscode: true,
+		New:              NewAutoStream,
+		Validate:         validateURL,
+	})
+	RegisterStreamType(StreamType{
+		Name:      "tuner-stream",
+		Shareable: true,
+		New: func(env *Env, source Source) (TVStream, error) {
+			opt := TunerOptions{}
+			if err := source.DecodeOptions(&opt); err != nil {
+				return nil, err
+			}
+			if opt.Device == "" {
+				opt.Device = source.URL
+			}
+			return NewTunerStream(source.URL, opt), nil
+		},
+		Validate: validateURL,
+	})
+	RegisterStreamType(StreamType{
+		Name:        "flv",
+		Shareable:   true,
+		ContentType: ContentTypeTS,
+		New: func(env *Env, source Source) (TVStream, error) {
+			flvUrl, err := url.Parse(source.URL)
+			if err != nil {
+				return nil, err
+			}
+			return NewFLVStream(flvUrl), nil
+		},
+		Validate: validateURL,
+	})
+	RegisterStreamType(StreamType{
+		Name:        "dash",
+		Shareable:   true,
+		ContentType: ContentTypeTS,
+		New: func(env *Env, source Source) (TVStream, error) {
+			mpdUrl, err := url.Parse(source.URL)
+			if err != nil {
+				return nil, err
+			}
+			opt := DASHOptions{}
+			if err = source.DecodeOptions(&opt); err != nil {
+				return nil, err
+			}
+			return NewDASHStream(mpdUrl, opt), nil
+		},
+		Validate: func(env *Env, source Source) error {
+			if err := validateURL(env, source); err != nil {
+				return err
+			}
+			opt := DASHOptions{}
+			if err := source.DecodeOptions(&opt); err != nil {
+				return err
+			}
+			return opt.Validate()
+		},
+	})
+	RegisterStreamType(StreamType{
+		Name:        "file",
+		Shareable:   true,
+		ContentType: ContentTypeTS,
+		New:         NewFileStream,
+		Validate: func(env *Env, source Source) error {
+			opt := FileOptions{}
+			if err := source.DecodeOptions(&opt); err != nil {
+				return err
+			}
+			return opt.Validate(filePath(source.URL))
+		},
+		Guide: func(env *Env, source Source, from time.Time, to time.Time) ([]Programme, error) {
+			schedule, err := loadFileSchedule(env, source)
+			if err != nil {
+				return nil, err
+			}
+			return schedule.Guide(from, to), nil
+		},
+	})
+	RegisterStreamType(StreamType{
+		Name:             "radio",
+		Shareable:        true,
+		ContentType:      ContentTypeTS,
+		HandlesTranscode: true,
+		New:              NewRadio,
+		Validate: func(env *Env, source Source) error {
+			if err := validateURL(env, source); err != nil {
+				return err
+			}
+			opt := RadioOptions{}
+			if err := source.DecodeOptions(&opt); err != nil {
+				return err
+			}
+			return opt.Validate(env)
+		},
+		Guide: radioGuide,
+	})
+	RegisterStreamType(StreamType{
+		Name:        "testpattern",
+		Shareable:   true,
+		ContentType: ContentTypeTS,
+		New: func(env *Env, source Source) (TVStream, error) {
+			return NewTestPatternStream(source)
+		},
+		Validate: func(env *Env, source Source) error {
+			opt := TestPatternOptions{}
+			if err := source.DecodeOptions(&opt); err != nil {
+				return err
+			}
+			return opt.Validate()
+		},
+	})
+	for _, name := range []string{"udp", "rtp"} {
+		rtp := name == "rtp"
+		RegisterStreamType(StreamType{
+			Name:        name,
+			Shareable:   true,
+			ContentType: ContentTypeTS,
+			New: func(env *Env, source Source) (TVStream, error) {
+				opt := UDPOptions{}
+				if err := source.DecodeOptions(&opt); err != nil {
+					return nil, err
+				}
+				return NewUDPStream(source.URL, rtp, opt), nil
+			},
+			Validate: func(env *Env, source Source) error {
+				if _, err := ParseUDPAddr(source.URL); err != nil {
+					return err
+				}
+				opt := UDPOptions{}
+				if err := source.DecodeOptions(&opt); err != nil {
+					return err
+				}
+				return opt.Validate()
+			},
+		})
+	}
+	RegisterStreamType(StreamType{
+		Name:        "push",
+		Shareable:   true,
+		ContentType: ContentTypeTS,
+		New: func(env *Env, source Source) (TVStream, error) {
+			return NewPushStream(env.Push, source.URL), nil
+		},
+		Validate: func(env *Env, source Source) error {
+			if env.Push == nil {
+				return ErrPushNotConfigured
+			}
+			if source.URL == "" || strings.ContainsAny(source.URL, "/?") {
+				return fmt.Errorf("%w: %s", ErrPushInvalidKey, source.URL)
+			}
+			opt := PushOptions{}
+			return source.DecodeOptions(&opt)
+		},
+	})
+	RegisterStreamType(StreamType{
+		Name:      "rtsp",
+		Shareable: true,
+		New: func(env *Env, source Source) (TVStream, error) {
+			opt := RTSPOptions{}
+			if err := source.DecodeOptions(&opt); err != nil {
+				return nil, err
+			}
+			return NewRTSPStream(source.URL, opt, env.FFMpeg), nil
+		},
+		Validate: func(env *Env, source Source) error {
+			opt := RTSPOptions{}
+			if err := source.DecodeOptions(&opt); err != nil {
+				return err
+			}
+			return opt.Validate()
+		},
+	})
+	RegisterStreamType(StreamType{
+		Name:             "ffmpeg",
+		Shareable:        true,
+		NeedsFFMpeg:      true,
+		HandlesTranscode: true,
+		New: func(env *Env, source Source) (TVStream, error) {
+			opt := TranscodeOptions{}
+			if err := source.DecodeOptions(&opt); err != nil {
+				return nil, err
+			}
+			profile, err := env.TranscodeProfile(opt.Transcode)
+			if err != nil {
+				return nil, err
+			}
+			return NewFFMpegStream(env.FFMpeg, source.URL, profile, opt.ffmpegOptions(env, source)), nil
+		},
+		Validate: func(env *Env, source Source) error {
+			opt := TranscodeOptions{}
+			if err := source.DecodeOptions(&opt); err != nil {
+				return err
+			}
+			_, err := env.TranscodeProfile(opt.Transcode)
+			return err
+		},
+	})
+	RegisterStreamType(StreamType{
+		Name:      "pipe",
+		Shareable: true,
+		New: func(env *Env, source Source) (TVStream, error) {
+			command, err := commandOf(env, source)
+			if err != nil {
+				return nil, err
+			}
+			return NewPipeStream(command, env.Logger, source.Id), nil
+		},
+		Validate: func(env *Env, source Source) error {
+			_, err := commandOf(env, source)
+			return err
+		},
+	})
+	RegisterStreamType(StreamType{
+		Name:      "exec-resolve",
+		Shareable: true,
+		New: func(env *Env, source Source) (TVStream, error) {
+			resolved, err := resolveSource(env, source)
+			if err != nil {
+				return nil, err
+			}
+			t, _ := LookupStreamType(resolved.Type)
+			return t.New(env, resolved)
+		},
+		Validate: func(env *Env, source Source) error {
+			opt := CommandOptions{}
+			if err := source.DecodeOptions(&opt); err != nil {
+				return err
+			}
+			switch opt.ResolveType {
+			case "", "hls", "flv", "dash", "proxy":
+			default:
+				return fmt.Errorf("%w: %s", ErrUnsupportedResolveType, opt.ResolveType)
+			}
+			_, err := env.Command(opt.Command, source)
+			return err
+		},
+	})
+}
+
+func validateURL(env *Env, source Source) error {
+	_, err := url.Parse(source.URL)
+	return err
+}
+
+// CommandOptions pipe和exec-resolve类型的选项
+type CommandOptions struct {
+	// Command 使用的命令名称
+	Command string `json:"command"`
+	// ResolveType exec-resolve类型解析出的url交给的源类型，hls、flv、dash或proxy，默认根据url判断
+	ResolveType string `json:"resolve_type"`
+}
+
+func commandOf(env *Env, source Source) (Command, error) {
+	opt := CommandOptions{}
+	if err := source.DecodeOptions(&opt); err != nil {
+		return Command{}, err
+	}
+	return env.Command(opt.Command, source)
+}
+
+// resolveSource 运行exec-resolve的命令，返回以解析出的url作为地址的源
+func resolveSource(env *Env, source Source) (Source, error) {
+	opt := CommandOptions{}
+	if err := source.DecodeOptions(&opt); err != nil {
+		return Source{}, err
+	}
+	command, err := env.Command(opt.Command, source)
+	if err != nil {
+		return Source{}, err
+	}
+	resolvedUrl, err := ResolveCommand(command, env.Logger, source.Id)
+	if err != nil {
+		return Source{}, err
+	}
+
+	resolved := source
+	resolved.URL = resolvedUrl
+	resolved.Type = opt.ResolveType
+	if resolved.Type == "" {
+		resolved.Type = "proxy"
+		if u, err := url.Parse(resolvedUrl); err == nil {
+			switch {
+			case strings.HasSuffix(u.Path, ".m3u8"):
+				resolved.Type = "hls"
+			case strings.HasSuffix(u.Path, ".flv"):
+				resolved.Type = "flv"
+			case strings.HasSuffix(u.Path, ".mpd"):
+				resolved.Type = "dash"
+			}
+		}
+	}
+	return resolved, nil
+}
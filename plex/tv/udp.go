@@ -0,0 +1,312 @@
+package tv
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrUDPInvalidURL  = errors.New("udp: invalid url")
+	ErrUDPIdleTimeout = errors.New("udp: no data received")
+)
+
+const (
+	// 单个udp包的最大长度
+	udpMaxDatagram = 65536
+	// 接收缓冲区大小，避免码率较高时丢包
+	udpReadBuffer = 4 * 1024 * 1024
+)
+
+// UDPOptions udp和rtp类型的选项
+type UDPOptions struct {
+	// Interface 加入组播使用的网卡名称，为空时由系统选择
+	Interface string `json:"interface"`
+	// Timeout 收不到数据的超时，单位秒，默认5秒
+	Timeout int `json:"timeout"`
+	// ReorderBuffer rtp重排序时最多缓存的包数，默认32，为负数时不重排序
+	ReorderBuffer int `json:"reorder_buffer"`
+}
+
+// Validate 检查配置是否有效
+func (o UDPOptions) Validate() error {
+	if o.Interface == "" {
+		return nil
+	}
+	_, err := net.InterfaceByName(o.Interface)
+	return err
+}
+
+func (o UDPOptions) timeout() time.Duration {
+	return secondsOrDefault(o.Timeout, 5*time.Second)
+}
+
+func (o UDPOptions) reorderBuffer() int {
+	if o.ReorderBuffer == 0 {
+		return 32
+	}
+	if o.ReorderBuffer < 0 {
+		return 0
+	}
+	return o.ReorderBuffer
+}
+
+// ParseUDPAddr 解析udp://@239.0.0.1:1234或rtp://239.0.0.1:1234形式的地址
+func ParseUDPAddr(rawUrl string) (*net.UDPAddr, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" && u.Scheme != "rtp" {
+		return nil, fmt.Errorf("%w: %s", ErrUDPInvalidURL, rawUrl)
+	}
+	host, portStr, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUDPInvalidURL, rawUrl)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("%w: %s", ErrUDPInvalidURL, rawUrl)
+	}
+	addr := &net.UDPAddr{Port: port}
+	if host != "" {
+		if addr.IP = net.ParseIP(host); addr.IP == nil {
+			return nil, fmt.Errorf("%w: %s", ErrUDPInvalidURL, rawUrl)
+		}
+	}
+	return addr, nil
+}
+
+// UDPStream 接收udp组播或单播的ts流，组播时通过IGMP加入组播组。
+// rtp为true时去掉rtp头并按序号重排序，否则根据每个包的内容自动判断是否为rtp
+type UDPStream struct {
+	url string
+	rtp bool
+	opt UDPOptions
+
+	conn    *net.UDPConn
+	chunks  chan []byte
+	pending []byte
+	loopErr error
+	reorder *rtpReorder
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewUDPStream(url string, rtp bool, opt UDPOptions) *UDPStream {
+	s := &UDPStream{
+		url:     url,
+		rtp:     rtp,
+		opt:     opt,
+		chunks:  make(chan []byte, 64),
+		reorder: newRTPReorder(opt.reorderBuffer()),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// Start 加入组播组，并等待收到第一个包，超时未收到数据时返回ErrUDPIdleTimeout
+func (s *UDPStream) Start() error {
+	addr, err := ParseUDPAddr(s.url)
+	if err != nil {
+		return err
+	}
+	var ifi *net.Interface
+	if s.opt.Interface != "" {
+		if ifi, err = net.InterfaceByName(s.opt.Interface); err != nil {
+			return err
+		}
+	}
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		s.conn, err = net.ListenMulticastUDP("udp", ifi, addr)
+	} else {
+		s.conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn.SetReadBuffer(udpReadBuffer)
+
+	buf := make([]byte, udpMaxDatagram)
+	n, err := s.readDatagram(buf)
+	if err != nil {
+		s.conn.Close()
+		return err
+	}
+	go s.loop(buf, append([]byte(nil), buf[:n]...))
+	return nil
+}
+
+func (s *UDPStream) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		select {
+		case chunk, ok := <-s.chunks:
+			if !ok {
+				if s.loopErr != nil {
+					return 0, s.loopErr
+				}
+				return 0, ErrReadClosedStream
+			}
+			s.pending = chunk
+		case <-s.ctx.Done():
+			return 0, ErrReadClosedStream
+		}
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *UDPStream) Close() error {
+	s.cancel()
+	if s.conn != nil {
+		// 关闭连接时离开组播组
+		s.conn.Close()
+	}
+	return nil
+}
+
+func (s *UDPStream) ContentType() string {
+	return ContentTypeTS
+}
+
+// loop 持续接收数据，first为Start时收到的第一个包
+func (s *UDPStream) loop(buf []byte, first []byte) {
+	defer close(s.chunks)
+	if err := s.handle(first); err != nil {
+		return
+	}
+	for {
+		n, err := s.readDatagram(buf)
+		if err != nil {
+			if s.ctx.Err() == nil {
+				s.loopErr = err
+			}
+			return
+		}
+		if err = s.handle(append([]byte(nil), buf[:n]...)); err != nil {
+			return
+		}
+	}
+}
+
+// readDatagram 读取一个包，超时未收到数据时返回ErrUDPIdleTimeout
+func (s *UDPStream) readDatagram(buf []byte) (int, error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.opt.timeout()))
+	n, _, err := s.conn.ReadFromUDP(buf)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return 0, fmt.Errorf("%w in %s: %s", ErrUDPIdleTimeout, s.opt.timeout(), s.url)
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// handle 处理一个包，rtp包去掉头部并重排序后输出
+func (s *UDPStream) handle(datagram []byte) error {
+	if !s.rtp && (len(datagram) == 0 || datagram[0] == 0x47) {
+		return s.emit(datagram)
+	}
+	payload, _, _, ok := parseRTP(datagram)
+	if !ok {
+		return nil
+	}
+	seq := binary.BigEndian.Uint16(datagram[2:4])
+	for _, p := range s.reorder.push(seq, payload) {
+		if err := s.emit(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *UDPStream) emit(chunk []byte) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+	select {
+	case s.chunks <- chunk:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// rtpReorder 按序号重排序rtp包，缓存满时跳过丢失的包
+type rtpReorder struct {
+	size     int
+	started  bool
+	expected uint16
+	buffered map[uint16][]byte
+}
+
+func newRTPReorder(size int) *rtpReorder {
+	return &rtpReorder{size: size, buffered: make(map[uint16][]byte)}
+}
+
+// push 加入一个包，返回已经可以按顺序输出的负载
+func (r *rtpReorder) push(seq uint16, payload []byte) [][]byte {
+	if r.size == 0 {
+		return [][]byte{payload}
+	}
+	if !r.started {
+		r.started = true
+		r.expected = seq
+	}
+	diff := int16(seq - r.expected)
+	if diff < 0 {
+		// 迟到或重复的包，已经跳过了
+		if -int(diff) > r.size {
+			// 序号跳变太大，视为发送端重新开始计数
+			r.reset(seq)
+		} else {
+			return nil
+		}
+	} else if int(diff) > 2*r.size {
+		r.reset(seq)
+	}
+	r.buffered[seq] = payload
+
+	var ready [][]byte
+	for {
+		payload, ok := r.buffered[r.expected]
+		if !ok {
+			if len(r.buffered) <= r.size {
+				return ready
+			}
+			// 缓存已满，跳过丢失的包
+			r.expected = r.lowest()
+			continue
+		}
+		delete(r.buffered, r.expected)
+		ready = append(ready, payload)
+		r.expected++
+	}
+}
+
+func (r *rtpReorder) reset(seq uint16) {
+	for k := range r.buffered {
+		delete(r.buffered, k)
+	}
+	r.expected = seq
+}
+
+// lowest 返回缓存中离期望序号最近的序号
+func (r *rtpReorder) lowest() uint16 {
+	best, bestDiff := r.expected, -1
+	for seq := range r.buffered {
+		diff := int(seq - r.expected)
+		if bestDiff < 0 || diff < bestDiff {
+			best, bestDiff = seq, diff
+		}
+	}
+	return best
+}
@@ -0,0 +1,49 @@
+package tv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func TestRTPReorder(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		seqs []uint16
+		want []uint16
+	}{
+		{"in order", 4, []uint16{1, 2, 3}, []uint16{1, 2, 3}},
+		{"reordered", 4, []uint16{1, 3, 4, 2, 5}, []uint16{1, 2, 3, 4, 5}},
+		{"disabled", 0, []uint16{1, 3, 2, 2}, []uint16{1, 3, 2, 2}},
+		// 序号从65535回到0
+		{"wraparound", 4, []uint16{65534, 65535, 0, 1}, []uint16{65534, 65535, 0, 1}},
+		{"wraparound reordered", 4, []uint16{65534, 0, 65535, 1}, []uint16{65534, 65535, 0, 1}},
+		// 重复的包只输出一次，无论是已经输出的还是还在缓存中的
+		{"duplicate sent", 4, []uint16{1, 2, 2, 1, 3}, []uint16{1, 2, 3}},
+		{"duplicate buffered", 4, []uint16{1, 3, 3, 2, 4}, []uint16{1, 2, 3, 4}},
+		// 缓存超过size个包时跳过丢失的包，从缓存中最近的序号继续
+		{"buffer full", 2, []uint16{1, 4, 3, 5, 6}, []uint16{1, 3, 4, 5, 6}},
+		{"buffer full wraparound", 2, []uint16{65533, 0, 65535, 1, 2}, []uint16{65533, 65535, 0, 1, 2}},
+		{"buffer not full", 2, []uint16{1, 3, 4}, []uint16{1}},
+		// 向前跳变超过2*size、向后跳变超过size时视为重新计数
+		{"jump forward", 4, []uint16{1, 2, 3, 100, 101}, []uint16{1, 2, 3, 100, 101}},
+		{"jump forward drops buffered", 4, []uint16{1, 3, 100, 101}, []uint16{1, 100, 101}},
+		{"jump backward", 4, []uint16{100, 101, 10, 11}, []uint16{100, 101, 10, 11}},
+		{"late within window", 4, []uint16{10, 11, 12, 13, 14, 12, 15}, []uint16{10, 11, 12, 13, 14, 15}},
+	}
+	for _, test := range tests {
+		reorder := newRTPReorder(test.size)
+		var got []uint16
+		for _, seq := range test.seqs {
+			payload := make([]byte, 2)
+			binary.BigEndian.PutUint16(payload, seq)
+			for _, p := range reorder.push(seq, payload) {
+				got = append(got, binary.BigEndian.Uint16(p))
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: push(%v) = %v, want %v", test.name, test.seqs, got, test.want)
+		}
+	}
+}
@@ -2,9 +2,14 @@ package plex
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"plex-tuner/plex/tv"
+	"strconv"
 	"strings"
 )
 
@@ -23,6 +28,30 @@ func internalServerError(w ResponseWriter, err string) {
 	w.Write([]byte(err))
 }
 
+// streamError 播放失败时按err返回状态码，message为返回的错误信息：上游禁止访问、不存在及请求过于频繁时原样返回，
+// 调谐器都在使用中、推流频道没有在推流时为503，上游的其余错误为502
+func streamError(w ResponseWriter, err error, message string) {
+	status := http.StatusInternalServerError
+	var statusErr *tv.StatusError
+	switch {
+	case errors.Is(err, tv.ErrUpstreamForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, tv.ErrUpstreamNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, tv.ErrUpstreamRateLimited):
+		status = http.StatusTooManyRequests
+		if after := tv.RetryAfter(err); after > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(after.Seconds()))))
+		}
+	case errors.Is(err, tv.ErrTunerBusy) || errors.Is(err, tv.ErrPushOffline) || errors.Is(err, tv.ErrPushNotConfigured):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, tv.ErrUpstreamNotMedia) || errors.As(err, &statusErr):
+		status = http.StatusBadGateway
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(message))
+}
+
 func writeJson(w ResponseWriter, obj any) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(obj)
@@ -50,6 +79,12 @@ func isWebsocketUpgrade(r Request) bool {
 	return connection == "upgrade"
 }
 
+// getContentType 返回频道的流的媒体类型
+func getContentType(channel *Channel, stream tv.TVStream) string {
+	t, _ := tv.LookupStreamType(channel.Type)
+	return tv.StreamContentType(t, stream)
+}
+
 func getContent(p string) ([]byte, error) {
 	p = strings.TrimSpace(p)
 	if strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://") {
@@ -63,3 +98,15 @@ func getContent(p string) ([]byte, error) {
 	}
 	return os.ReadFile(p)
 }
+
+// stripErrorQuery 请求失败的错误中带有完整的url，去掉其中可能含有账号密码的参数
+func stripErrorQuery(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil && u.RawQuery != "" {
+			u.RawQuery = ""
+			urlErr.URL = u.String()
+		}
+	}
+	return err
+}
@@ -0,0 +1,220 @@
+package plex
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"plex-tuner/plex/tv"
+	"strings"
+)
+
+const (
+	XtreamFormatTS  = "ts"
+	XtreamFormatHLS = "hls"
+)
+
+var (
+	ErrXtreamAuth          = errors.New("xtream: authentication failed")
+	ErrXtreamInvalidOption = errors.New("xtream: invalid option")
+)
+
+// XtreamOptions xtream来源的选项
+type XtreamOptions struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Format 播放地址的格式，ts或hls，默认为ts
+	Format string `json:"format"`
+}
+
+// xtreamID 面板返回的id有时是数字有时是字符串，统一按字符串处理
+type xtreamID string
+
+func (id *xtreamID) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	if string(data) == "null" {
+		data = nil
+	}
+	*id = xtreamID(data)
+	return nil
+}
+
+type xtreamAccount struct {
+	UserInfo struct {
+		Auth           int      `json:"auth"`
+		Status         string   `json:"status"`
+		MaxConnections xtreamID `json:"max_connections"`
+	} `json:"user_info"`
+}
+
+type xtreamCategory struct {
+	CategoryId   xtreamID `json:"category_id"`
+	CategoryName string   `json:"category_name"`
+}
+
+type xtreamStream struct {
+	Num          xtreamID `json:"num"`
+	Name         string   `json:"name"`
+	StreamId     xtreamID `json:"stream_id"`
+	StreamIcon   string   `json:"stream_icon"`
+	EpgChannelId string   `json:"epg_channel_id"`
+	CategoryId   xtreamID `json:"category_id"`
+}
+
+// xtreamClient 调用面板的player_api.php
+type xtreamClient struct {
+	client   *http.Client
+	server   string
+	username string
+	password string
+}
+
+func newXtreamClient(client *http.Client, server string, opt XtreamOptions) *xtreamClient {
+	return &xtreamClient{
+		client:   client,
+		server:   strings.TrimRight(server, "/"),
+		username: opt.Username,
+		password: opt.Password,
+	}
+}
+
+func (c *xtreamClient) get(ctx context.Context, action string, v any) error {
+	query := url.Values{"username": {c.username}, "password": {c.password}}
+	if action != "" {
+		query.Set("action", action)
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", c.server+"/player_api.php?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(request)
+	if err != nil {
+		return stripErrorQuery(err)
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: %s", ErrXtreamAuth, c.server)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("xtream: unexpected status %d: %s", resp.StatusCode, c.server)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// account 检查账号是否可用，返回最大连接数，0为不限制
+func (c *xtreamClient) account(ctx context.Context) (int, error) {
+	account := new(xtreamAccount)
+	if err := c.get(ctx, "", account); err != nil {
+		return 0, err
+	}
+	info := account.UserInfo
+	if info.Auth != 1 || (info.Status != "" && info.Status != "Active") {
+		return 0, fmt.Errorf("%w: %s %s", ErrXtreamAuth, c.server, info.Status)
+	}
+	var connections int
+	fmt.Sscan(string(info.MaxConnections), &connections)
+	return connections, nil
+}
+
+// device 同一账号的频道共享连接数限制，状态接口中会显示，不直接使用用户名
+func (c *xtreamClient) device() string {
+	sum := sha1.Sum([]byte(c.username))
+	return c.server + "#" + hex.EncodeToString(sum[:4])
+}
+
+// epgURL 面板提供的XMLTV节目单
+func (c *xtreamClient) epgURL() string {
+	query := url.Values{"username": {c.username}, "password": {c.password}}
+	return c.server + "/xmltv.php?" + query.Encode()
+}
+
+// streamURL 频道的播放地址，ts为/live/用户名/密码/id.ts，hls为.m3u8
+func (c *xtreamClient) streamURL(id xtreamID, format string) string {
+	ext := ".ts"
+	if format == XtreamFormatHLS {
+		ext = ".m3u8"
+	}
+	return c.server + "/live/" + url.PathEscape(c.username) + "/" + url.PathEscape(c.password) + "/" + url.PathEscape(string(id)) + ext
+}
+
+// loadXtreamChannels 导入xtream codes面板的直播频道，url为面板地址
+func loadXtreamChannels(ctx context.Context, entry *Channel, opt ProviderOptions) ([]*Channel, error) {
+	xopt := XtreamOptions{}
+	if len(entry.Options) > 0 {
+		if err := json.Unmarshal(entry.Options, &xopt); err != nil {
+			return nil, err
+		}
+	}
+	switch xopt.Format {
+	case "", XtreamFormatTS, XtreamFormatHLS:
+	default:
+		return nil, fmt.Errorf("%w: format %s", ErrXtreamInvalidOption, xopt.Format)
+	}
+	if xopt.Username == "" || xopt.Password == "" {
+		return nil, fmt.Errorf("%w: username and password required", ErrXtreamInvalidOption)
+	}
+
+	client := newXtreamClient(httpClient, entry.URL, xopt)
+	connections, err := client.account(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var categories []xtreamCategory
+	if err = client.get(ctx, "get_live_categories", &categories); err != nil {
+		return nil, err
+	}
+	var streams []xtreamStream
+	if err = client.get(ctx, "get_live_streams", &streams); err != nil {
+		return nil, err
+	}
+
+	groups := make(map[xtreamID]string, len(categories))
+	for _, category := range categories {
+		groups[category.CategoryId] = category.CategoryName
+	}
+	// ts地址直接转发，hls地址作为hls类型播放，同时播放的频道数都受账号的最大连接数限制
+	tuner := tv.TunerOptions{Device: client.device(), TunerCount: connections}
+	streamType := "tuner-stream"
+	var options json.RawMessage
+	if xopt.Format == XtreamFormatHLS {
+		streamType = "hls"
+		options, err = json.Marshal(tv.HLSOptions{Tuner: &tuner})
+	} else {
+		options, err = json.Marshal(tuner)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	epgURL := client.epgURL()
+	channels := make([]*Channel, 0, len(streams))
+	for _, stream := range streams {
+		if stream.StreamId == "" {
+			continue
+		}
+		channels = append(channels, &Channel{
+			Id:      string(stream.StreamId),
+			Name:    stream.Name,
+			URL:     client.streamURL(stream.StreamId, xopt.Format),
+			Type:    streamType,
+			Icon:    stream.StreamIcon,
+			Group:   groups[stream.CategoryId],
+			EpgId:   stream.EpgChannelId,
+			EpgURL:  epgURL,
+			Options: options,
+			// 播放地址的路径中带有账号密码
+			secrets: []string{xopt.Username, xopt.Password},
+		})
+	}
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrProviderNoChannels, client.server)
+	}
+	return channels, nil
+}
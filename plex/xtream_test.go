@@ -0,0 +1,159 @@
+package plex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"plex-tuner/plex/tv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakePanel 模拟xtream面板的player_api.php，id混用数字和字符串
+func newFakePanel(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/player_api.php" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("username") != "user" || query.Get("password") != "p@ss" {
+			w.Write([]byte(`{"user_info":{"auth":0}}`))
+			return
+		}
+		switch query.Get("action") {
+		case "":
+			w.Write([]byte(`{"user_info":{"auth":1,"status":"Active","max_connections":"2"}}`))
+		case "get_live_categories":
+			w.Write([]byte(`[{"category_id":"1","category_name":"News"},{"category_id":2,"category_name":"Sports"}]`))
+		case "get_live_streams":
+			w.Write([]byte(`[
+				{"num":1,"name":"News One","stream_id":1001,"stream_icon":"http://icons/1.png","epg_channel_id":"news.us","category_id":"1"},
+				{"num":2,"name":"Sports Two","stream_id":"1002","stream_icon":"","epg_channel_id":null,"category_id":2},
+				{"num":3,"name":"Broken","stream_id":null,"category_id":2}
+			]`))
+		default:
+			t.Errorf("unexpected action %s", query.Get("action"))
+		}
+	}))
+}
+
+func xtreamEntry(server string, options string) *Channel {
+	return &Channel{Type: "xtream", URL: server + "/", Options: json.RawMessage(options)}
+}
+
+func TestXtreamChannels(t *testing.T) {
+	panel := newFakePanel(t)
+	defer panel.Close()
+
+	channels, err := loadXtreamChannels(context.Background(), xtreamEntry(panel.URL, `{"username":"user","password":"p@ss"}`), ProviderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 2 {
+		t.Fatalf("got %d channels, want 2", len(channels))
+	}
+	news, sports := channels[0], channels[1]
+	if news.Id != "1001" || news.Name != "News One" || news.Group != "News" || news.EpgId != "news.us" || news.Icon != "http://icons/1.png" {
+		t.Errorf("news = %+v", news)
+	}
+	if sports.Id != "1002" || sports.Group != "Sports" || sports.EpgId != "" {
+		t.Errorf("sports = %+v", sports)
+	}
+	if want := panel.URL + "/live/user/p@ss/1001.ts"; news.URL != want {
+		t.Errorf("url = %s, want %s", news.URL, want)
+	}
+	if want := panel.URL + "/xmltv.php?password=p%40ss&username=user"; news.EpgURL != want {
+		t.Errorf("epg url = %s, want %s", news.EpgURL, want)
+	}
+	if news.Type != "tuner-stream" {
+		t.Errorf("type = %s", news.Type)
+	}
+	opt := tv.TunerOptions{}
+	if err = json.Unmarshal(news.Options, &opt); err != nil {
+		t.Fatal(err)
+	}
+	if opt.TunerCount != 2 || !strings.HasPrefix(opt.Device, panel.URL+"#") || strings.Contains(opt.Device, "user") {
+		t.Errorf("tuner options = %+v", opt)
+	}
+	if status := news.status(); strings.Contains(status.URL, "p@ss") || strings.Contains(status.URL, "/user/") {
+		t.Errorf("status url exposes credentials: %s", status.URL)
+	}
+}
+
+func TestXtreamHLS(t *testing.T) {
+	panel := newFakePanel(t)
+	defer panel.Close()
+
+	channels, err := loadXtreamChannels(context.Background(), xtreamEntry(panel.URL, `{"username":"user","password":"p@ss","format":"hls"}`), ProviderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channels[1].Type != "hls" || channels[1].URL != panel.URL+"/live/user/p@ss/1002.m3u8" {
+		t.Errorf("channel = %+v", channels[1])
+	}
+	// hls频道同样受账号的最大连接数限制
+	opt := tv.HLSOptions{}
+	if err = json.Unmarshal(channels[1].Options, &opt); err != nil {
+		t.Fatal(err)
+	}
+	if opt.Tuner == nil || opt.Tuner.TunerCount != 2 || !strings.HasPrefix(opt.Tuner.Device, panel.URL+"#") {
+		t.Errorf("hls options = %s", channels[1].Options)
+	}
+}
+
+func TestXtreamAuthFailed(t *testing.T) {
+	panel := newFakePanel(t)
+	defer panel.Close()
+
+	_, err := loadXtreamChannels(context.Background(), xtreamEntry(panel.URL, `{"username":"user","password":"wrong"}`), ProviderOptions{})
+	if !errors.Is(err, ErrXtreamAuth) {
+		t.Errorf("err = %v, want %v", err, ErrXtreamAuth)
+	}
+	_, err = loadXtreamChannels(context.Background(), xtreamEntry(panel.URL, `{"username":"user"}`), ProviderOptions{})
+	if !errors.Is(err, ErrXtreamInvalidOption) {
+		t.Errorf("err = %v, want %v", err, ErrXtreamInvalidOption)
+	}
+}
+
+func TestXtreamErrorHidesPassword(t *testing.T) {
+	panel := newFakePanel(t)
+	panel.Close()
+
+	_, err := loadXtreamChannels(context.Background(), xtreamEntry(panel.URL, `{"username":"user","password":"p@ss"}`), ProviderOptions{})
+	if err == nil || strings.Contains(err.Error(), "password") || strings.Contains(err.Error(), "p%40ss") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestProviderRefresh(t *testing.T) {
+	loads := 0
+	provider := func(ctx context.Context, entry *Channel, opt ProviderOptions) ([]*Channel, error) {
+		loads++
+		if loads > 1 {
+			return nil, errors.New("panel down")
+		}
+		return []*Channel{{Id: "1", Name: "One"}}, nil
+	}
+	entry := &Channel{Type: "fake", URL: "http://fake", Options: json.RawMessage(`{"prefix":"f","refresh":1}`)}
+
+	channels, err := loadProviderChannels(context.Background(), provider, entry)
+	if err != nil || len(channels) != 1 || channels[0].Id != "f1" {
+		t.Fatalf("channels = %v, err = %v", channels, err)
+	}
+	// 请求时直接使用缓存，重新导入由后台进行
+	if _, err = loadProviderChannels(context.Background(), provider, entry); err != nil || loads != 1 {
+		t.Fatalf("loads = %d, err = %v", loads, err)
+	}
+	providerCaches[providerKey(entry)].loadedAt = providerCaches[providerKey(entry)].loadedAt.Add(-2 * time.Second)
+	if !providerExpired(entry) {
+		t.Fatal("provider should expire after refresh interval")
+	}
+	channels, err = refreshProvider(context.Background(), provider, entry)
+	if err == nil || len(channels) != 1 {
+		t.Errorf("failed refresh should keep previous channels, got %v, %v", channels, err)
+	}
+}